@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/matutter/tripplite/pkg/tripplite"
@@ -13,30 +17,58 @@ import (
 const (
 	ACTION_FETCH_METRICS = "fetch-metrics"
 	ACTION_UPDATE_CONFIG = "update-config"
+	ACTION_HEARTBEAT     = "heartbeat"
+)
+
+var (
+	ErrStaleMetrics = errors.New("stale metrics")
 )
 
 type Client struct {
-	s        Settings
-	changeId string
-	stale    bool
-	secret   []byte
-	running  bool
-	actions  chan string
+	s          Settings
+	changeId   string
+	configFrom *Upstream
+	secret     []byte
+	running    bool
+	actions    chan string
+	watcher    *tripplite.Watcher
+	upstreams  []*Upstream
+	active     *Upstream
+	last       *tripplite.UPSMetrics
+	contact    time.Time
+	failsafe   bool
+	hostname   string
 }
 
 func NewClientFromSettings(s Settings) *Client {
-	return &Client{
-		s:        s,
-		changeId: "",
-		stale:    true,
-		secret:   []byte(s.Secret),
-		running:  false,
-		actions:  make(chan string),
+	c := &Client{
+		s:         s,
+		changeId:  "",
+		secret:    []byte(s.Secret),
+		running:   false,
+		actions:   make(chan string),
+		watcher:   tripplite.NewWatcher(),
+		upstreams: []*Upstream{},
+		contact:   time.Now(),
+	}
+	c.hostname, _ = os.Hostname()
+	if len(c.s.Id) == 0 {
+		c.s.Id = c.hostname
 	}
+	for _, url := range s.GetUrls() {
+		c.upstreams = append(c.upstreams, NewUpstream(url, s.UPS, c.secret))
+	}
+	c.active = c.upstreams[0]
+	if c.s.Autoconfigure && !c.HMACEnabled() {
+		log.Warn().Msg("auto_configure needs a secret, remote scripts are ignored")
+	}
+	return c
 }
 
+// Remote scripts run as shell commands, so they are only taken from signed
+// configs.
 func (c Client) AutoConfigEnabled() bool {
-	return c.s.Autoconfigure
+	return c.s.Autoconfigure && c.HMACEnabled()
 }
 
 func (c Client) HMACEnabled() bool {
@@ -47,30 +79,20 @@ func (c Client) GetSecret() []byte {
 	return c.secret
 }
 
-func (c *Client) SetChangeId(newConfigHash string) {
-	c.stale = !strings.EqualFold(newConfigHash, c.changeId)
-	c.changeId = newConfigHash
-	if c.stale {
-		log.Debug().Msg("config is stale")
-	}
-}
-
-func (c Client) IsStale() bool {
-	return c.stale
+// The config is stale until it was fetched from the active server with its
+// current change id.
+func (c *Client) IsStale() bool {
+	return c.configFrom != c.active || c.active.ChangeId() != c.changeId
 }
 
-func (c Client) Url(parts ...string) string {
-	sep := "/"
-	url := c.s.Url
-	for _, part := range parts {
-		url = strings.TrimRight(url, sep) + sep + part
-	}
-	return strings.TrimRight(url, sep)
+// Url of the active server.
+func (c *Client) Url(parts ...string) string {
+	return c.active.Endpoint(parts...)
 }
 
 func (c *Client) FetchRemoteConfig() (*tripplite.PublicConfig, error) {
 	conf := tripplite.PublicConfig{}
-	err := Get(c, c.Url("config"), &conf)
+	err := Get(c.active, c.active.UPSEndpoint("config"), &conf)
 	if err != nil {
 		return nil, err
 	}
@@ -78,41 +100,254 @@ func (c *Client) FetchRemoteConfig() (*tripplite.PublicConfig, error) {
 	return &conf, err
 }
 
+// Replaces the watcher with one running the local scripts plus the public
+// scripts of the server, a local script takes precedence over a public script
+// of the same name. Scripts which were active stay active so they do not run
+// again.
+func (c *Client) rebuildWatcher(remote []tripplite.PublicScript) {
+	w := tripplite.NewWatcher()
+	w.SetResultListener(c)
+	for _, script := range remote {
+		w.AddPublicScript(script)
+	}
+	for _, script := range c.s.Scripts {
+		w.AddPublicScript(script)
+	}
+
+	for name, script := range w.Scripts {
+		if old, ok := c.watcher.Scripts[name]; ok {
+			script.Active = old.IsActive()
+		}
+	}
+	c.watcher = w
+	log.Info().Int("scripts", w.GetSize()).Msg("watcher updated")
+}
+
 func (c *Client) UpdateConfigFromRemote() error {
+	if !c.HMACEnabled() {
+		return errors.New("remote config is only used with a secret")
+	}
 
 	conf, err := c.FetchRemoteConfig()
 	if err != nil {
 		return err
 	}
 
-	w := tripplite.Watcher{}
+	delay, err := time.ParseDuration(conf.Delay)
+	if err != nil {
+		return err
+	}
+	c.s.Delay = delay
+	c.rebuildWatcher(conf.Scripts)
+	c.changeId = c.active.ChangeId()
+	c.configFrom = c.active
 
-	if c.stale {
-		delay, err := time.ParseDuration(conf.Delay)
-		if err != nil {
-			return err
+	log.Info().Str("change_id", c.changeId).Msg("config up to date")
+
+	return nil
+}
+
+type fetchResult struct {
+	upstream *Upstream
+	metrics  *tripplite.UPSMetrics
+	err      error
+}
+
+// Fetches a sample from one server, a sample older than max_age counts as a
+// failure of that server.
+func (c *Client) fetchFrom(u *Upstream) (*tripplite.UPSMetrics, error) {
+	m := tripplite.UPSMetrics{}
+	if err := Get(u, u.UPSEndpoint("metrics.json"), &m); err != nil {
+		return nil, err
+	}
+	age := time.Since(time.Unix(m.UnixTimestamp, 0))
+	if c.s.MaxAge > 0 && age > c.s.MaxAge {
+		return nil, fmt.Errorf("%w: sample is %s old", ErrStaleMetrics, age.Truncate(time.Second))
+	}
+	return &m, nil
+}
+
+// Fetches the latest sample from every healthy server, or every server when
+// none are healthy, and returns the freshest one. It is rejected unless it is
+// newer than the last sample. The server which sent it becomes the active
+// server.
+func (c *Client) FetchMetrics() (*tripplite.UPSMetrics, error) {
+	now := time.Now()
+	candidates := []*Upstream{}
+	for _, u := range c.upstreams {
+		if u.Healthy(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = c.upstreams
+	}
+
+	results := make([]fetchResult, len(candidates))
+	wg := sync.WaitGroup{}
+	for i, u := range candidates {
+		wg.Add(1)
+		go func(i int, u *Upstream) {
+			defer wg.Done()
+			m, err := c.fetchFrom(u)
+			results[i] = fetchResult{upstream: u, metrics: m, err: err}
+		}(i, u)
+	}
+	wg.Wait()
+
+	var best *fetchResult
+	var err error
+	for i := range results {
+		r := &results[i]
+		if r.err != nil {
+			r.upstream.fail(r.err, now, c.s.Delay)
+			err = r.err
+			continue
 		}
-		c.s.Delay = delay
-		for _, script := range c.s.Scripts {
-			w.AddPublicScript(script)
+		r.upstream.succeed(r.metrics)
+		// ties go to the active server so it is not switched needlessly
+		if best == nil || r.metrics.UnixTimestamp > best.metrics.UnixTimestamp ||
+			(r.metrics.UnixTimestamp == best.metrics.UnixTimestamp && r.upstream == c.active) {
+			best = r
 		}
-		c.stale = false
+	}
+	if best == nil {
+		return nil, err
 	}
 
-	log.Info().Str("change_id", c.changeId).Msg("config up to date")
+	m := best.metrics
+	if c.last != nil && m.UnixTimestamp <= c.last.UnixTimestamp {
+		return nil, fmt.Errorf("%w: sample from %d is not newer than %d", ErrStaleMetrics, m.UnixTimestamp, c.last.UnixTimestamp)
+	}
 
-	return nil
+	if best.upstream != c.active {
+		log.Warn().Str("from", c.active.Url).Str("to", best.upstream.Url).Msg("switching server")
+		c.active = best.upstream
+	}
+	c.last = m
+	return m, nil
+}
+
+// Acts on the last known status once no sample was accepted for
+// failsafe_timeout. The server shares the UPS, so it may go down before it
+// reports the battery running out: when the UPS was on battery the watcher is
+// given the last sample with the battery exhausted, which runs the on battery
+// scripts. When it was on line the client only warns.
+func (c *Client) checkFailsafe(now time.Time) {
+	timeout := c.s.FailsafeTimeout
+	if timeout <= 0 || c.failsafe || now.Sub(c.contact) < timeout {
+		return
+	}
+	c.failsafe = true
+
+	if c.last == nil || !(strings.EqualFold(c.last.Status, "OB") || strings.EqualFold(c.last.Status, "LB")) {
+		status := ""
+		if c.last != nil {
+			status = c.last.Status
+		}
+		log.Warn().Str("server", c.Url()).Dur("timeout", timeout).Str("status", status).Msg("server unreachable")
+		return
+	}
+
+	log.Error().Str("server", c.Url()).Dur("timeout", timeout).Str("status", c.last.Status).Msg("server unreachable while on battery, running fail-safe")
+	m := *c.last
+	m.BatteryCharge = 0
+	m.RuntimeRemaining = 0
+	m.Communication = tripplite.COMM_LOST
+	c.watcher.OnMetrics(&m)
+}
+
+func (c *Client) updateMetrics() {
+	m, err := c.FetchMetrics()
+	if err != nil {
+		if errors.Is(err, ErrStaleMetrics) {
+			log.Debug().Err(err).Str("server", c.Url()).Msg("ignoring sample")
+		} else {
+			log.Error().Err(err).Str("server", c.Url()).Msg("failed to fetch metrics")
+		}
+		c.checkFailsafe(time.Now())
+		return
+	}
+
+	c.contact = time.Now()
+	if c.failsafe {
+		log.Info().Str("server", c.Url()).Msg("server reachable again")
+		c.failsafe = false
+	}
+
+	if c.IsStale() && c.AutoConfigEnabled() {
+		if err := c.UpdateConfigFromRemote(); err != nil {
+			log.Error().Err(err).Str("server", c.Url()).Msg("failed to update config")
+		}
+	}
+
+	log.Debug().Interface("metrics", m).Send()
+	c.watcher.OnMetrics(m)
+}
+
+// Sends a report to every server, a server which shares the UPS waits for
+// its registered clients before shutting down.
+func (c *Client) report(kind string, scripts []string, result *tripplite.ScriptResult) {
+	if !c.s.Register {
+		return
+	}
+	report := tripplite.ClientReport{
+		Type:      kind,
+		Id:        c.s.Id,
+		Hostname:  c.hostname,
+		UPS:       c.s.UPS,
+		Scripts:   scripts,
+		Result:    result,
+		Timestamp: time.Now().Unix(),
+		Nonce:     tripplite.NewNonce(),
+	}
+
+	wg := sync.WaitGroup{}
+	for _, u := range c.upstreams {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			info := map[string]interface{}{}
+			if err := Post(u, u.Endpoint("clients"), report, &info); err != nil {
+				log.Debug().Err(err).Str("server", u.Url).Str("report", kind).Msg("failed to report")
+			}
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Registers with the servers or tells them the client is still up.
+func (c *Client) heartbeat(kind string) {
+	scripts := []string{}
+	for name := range c.watcher.Scripts {
+		scripts = append(scripts, name)
+	}
+	sort.Strings(scripts)
+	c.report(kind, scripts, nil)
+}
+
+// Reports the outcome of a script run, a shutdown script acknowledges the
+// shutdown to servers waiting for their clients.
+func (c *Client) OnScriptResult(result tripplite.ScriptResult) {
+	c.report(tripplite.CLIENT_REPORT_RESULT, nil, &result)
+}
+
+func (c *Client) startHeartbeatTimer() {
+	for c.running {
+		time.Sleep(c.s.Heartbeat)
+		c.actions <- ACTION_HEARTBEAT
+	}
 }
 
 func (c *Client) startUpdateTimer() {
 
-	if len(c.changeId) == 0 && c.HMACEnabled() {
+	if c.AutoConfigEnabled() {
 		c.actions <- ACTION_UPDATE_CONFIG
 	}
 
 	for c.running {
-		time.Sleep(c.s.Delay)
 		c.actions <- ACTION_FETCH_METRICS
+		time.Sleep(c.s.Delay)
 	}
 
 }
@@ -128,10 +363,17 @@ func (c *Client) Start() {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 
-	go c.startUpdateTimer()
-
+	c.rebuildWatcher(nil)
 	c.running = true
 
+	go c.startUpdateTimer()
+	if c.s.Register {
+		c.heartbeat(tripplite.CLIENT_REPORT_REGISTER)
+		if c.s.Heartbeat > 0 {
+			go c.startHeartbeatTimer()
+		}
+	}
+
 	for c.running {
 		select {
 		case sig = <-signals:
@@ -141,8 +383,9 @@ func (c *Client) Start() {
 			log.Debug().Msgf("running %s action", action)
 			switch action {
 			case ACTION_FETCH_METRICS:
-				// TODO fetch metrics
-				// TODO update watcher
+				c.updateMetrics()
+			case ACTION_HEARTBEAT:
+				c.heartbeat(tripplite.CLIENT_REPORT_HEARTBEAT)
 			case ACTION_UPDATE_CONFIG:
 				err := c.UpdateConfigFromRemote()
 				if err != nil {
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+)
+
+type testServer struct {
+	lock     sync.Mutex
+	metrics  tripplite.UPSMetrics
+	config   tripplite.PublicConfig
+	changeId string
+	secret   []byte
+	reports  []tripplite.ClientReport
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var o interface{} = s.metrics
+	switch r.URL.Path {
+	case "/config":
+		o = s.config
+	case "/clients":
+		report := tripplite.ClientReport{}
+		json.NewDecoder(r.Body).Decode(&report)
+		s.reports = append(s.reports, report)
+		o = report
+	}
+	data, _ := json.Marshal(o)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(tripplite.HTTP_CHANGE_ID_HEADER, s.changeId)
+	if len(s.secret) > 0 {
+		w.Header().Set(tripplite.HTTP_CONTENT_HASH_HEADER, base64.RawStdEncoding.EncodeToString(tripplite.ComputeHMAC(s.secret, data)))
+	}
+	w.Write(data)
+}
+
+func TestClientFetchMetrics(t *testing.T) {
+	ts := &testServer{
+		metrics:  tripplite.UPSMetrics{Status: "OL", UnixTimestamp: time.Now().Unix()},
+		config:   tripplite.PublicConfig{Delay: "1s", Scripts: []tripplite.PublicScript{{Name: "remote", Status: "OB", Charge: 50, ShutdownScript: "true"}}},
+		changeId: "1",
+		secret:   []byte("secret"),
+	}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	c := NewClientFromSettings(Settings{
+		Url:           server.URL,
+		Secret:        "secret",
+		Delay:         time.Second,
+		MaxAge:        time.Minute,
+		Autoconfigure: true,
+		Scripts:       []tripplite.PublicScript{{Name: "local", Status: "OB", ShutdownScript: "true"}},
+	})
+	c.rebuildWatcher(nil)
+
+	c.updateMetrics()
+	if c.IsStale() || c.watcher.GetSize() != 2 || c.last == nil {
+		t.Fatalf("expected the watcher to be built from remote and local scripts, got %d", c.watcher.GetSize())
+	}
+
+	// the same sample again is stale
+	if _, err := c.FetchMetrics(); !errors.Is(err, ErrStaleMetrics) {
+		t.Errorf("expected a repeated sample to be stale, got %v", err)
+	}
+
+	ts.lock.Lock()
+	ts.metrics.UnixTimestamp = time.Now().Add(-time.Hour).Unix()
+	ts.lock.Unlock()
+	c.last = nil
+	if _, err := c.FetchMetrics(); !errors.Is(err, ErrStaleMetrics) {
+		t.Errorf("expected an old sample to be stale, got %v", err)
+	}
+
+	// a new change id rebuilds the watcher, keeping active scripts active
+	c.watcher.Scripts["remote"].Active = true
+	ts.lock.Lock()
+	ts.metrics.Status = "OB"
+	ts.metrics.UnixTimestamp = time.Now().Unix() + 1
+	ts.config.Scripts = append(ts.config.Scripts, tripplite.PublicScript{Name: "added", Status: "OB", ShutdownScript: "true"})
+	ts.changeId = "2"
+	ts.lock.Unlock()
+
+	c.updateMetrics()
+	if c.IsStale() || c.watcher.GetSize() != 3 {
+		t.Errorf("expected the watcher to be rebuilt, got %d scripts", c.watcher.GetSize())
+	}
+	if !c.watcher.Scripts["remote"].Active {
+		t.Errorf("expected the active script to stay active")
+	}
+}
+
+func TestClientUnsignedConfig(t *testing.T) {
+	ts := &testServer{
+		metrics:  tripplite.UPSMetrics{Status: "OB", UnixTimestamp: time.Now().Unix()},
+		config:   tripplite.PublicConfig{Delay: "1s", Scripts: []tripplite.PublicScript{{Name: "remote", Status: "OB", ShutdownScript: "touch pwned"}}},
+		changeId: "1",
+	}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	// without a secret nothing proves the config came from the server
+	c := NewClientFromSettings(Settings{Url: server.URL, Delay: time.Second, MaxAge: time.Minute, Autoconfigure: true})
+	c.rebuildWatcher(nil)
+	c.updateMetrics()
+	if c.last == nil || c.watcher.GetSize() != 0 {
+		t.Errorf("expected remote scripts from an unsigned config to be ignored, got %d", c.watcher.GetSize())
+	}
+	if err := c.UpdateConfigFromRemote(); err == nil {
+		t.Errorf("expected the remote config to be refused without a secret")
+	}
+}
+
+func TestClientFailsafe(t *testing.T) {
+	ts := &testServer{metrics: tripplite.UPSMetrics{Status: "OL", BatteryCharge: 100, UnixTimestamp: time.Now().Unix()}}
+	server := httptest.NewServer(ts)
+
+	ran := filepath.Join(t.TempDir(), "ran")
+	c := NewClientFromSettings(Settings{
+		Url:             server.URL,
+		FailsafeTimeout: time.Minute,
+		Scripts:         []tripplite.PublicScript{{Name: "shutdown", Status: "OB", Charge: 20, ShutdownScript: "touch " + ran}},
+	})
+	c.rebuildWatcher(nil)
+
+	c.updateMetrics()
+	server.Close()
+
+	// on line only warns
+	c.contact = time.Now().Add(-2 * time.Minute)
+	c.updateMetrics()
+	if !c.failsafe || c.watcher.Scripts["shutdown"].Active {
+		t.Errorf("expected only a warning while on line")
+	}
+
+	// on battery runs the shutdown script
+	c.failsafe = false
+	c.last.Status = "OB"
+	c.updateMetrics()
+	if !c.watcher.Scripts["shutdown"].Active {
+		t.Fatalf("expected the shutdown script to be activated")
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(ran); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("expected the shutdown script to run")
+}
+
+func TestClientFailover(t *testing.T) {
+	now := time.Now().Unix()
+	primary := &testServer{metrics: tripplite.UPSMetrics{Status: "OL", UnixTimestamp: now}, changeId: "a"}
+	secondary := &testServer{metrics: tripplite.UPSMetrics{Status: "OL", UnixTimestamp: now}, changeId: "b"}
+	ps := httptest.NewServer(primary)
+	ss := httptest.NewServer(secondary)
+	defer ss.Close()
+
+	c := NewClientFromSettings(Settings{Urls: []string{ps.URL, ss.URL}, Delay: time.Second, MaxAge: time.Minute})
+	c.rebuildWatcher(nil)
+
+	// equally fresh samples keep the first server
+	if _, err := c.FetchMetrics(); err != nil || c.active.Url != ps.URL {
+		t.Fatalf("expected the first server, got %s %v", c.active.Url, err)
+	}
+
+	// the fresher sample wins
+	secondary.lock.Lock()
+	secondary.metrics.UnixTimestamp = now + 2
+	secondary.lock.Unlock()
+	primary.lock.Lock()
+	primary.metrics.UnixTimestamp = now + 1
+	primary.lock.Unlock()
+	if m, err := c.FetchMetrics(); err != nil || c.active.Url != ss.URL || m.UnixTimestamp != now+2 {
+		t.Errorf("expected the fresher server, got %s %v", c.active.Url, err)
+	}
+
+	// a server with a stale clock is failing
+	primary.lock.Lock()
+	primary.metrics.UnixTimestamp = now - 3600
+	primary.lock.Unlock()
+	secondary.lock.Lock()
+	secondary.metrics.UnixTimestamp = now + 3
+	secondary.lock.Unlock()
+	c.FetchMetrics()
+	if c.upstreams[0].Healthy(time.Now()) {
+		t.Errorf("expected the stale server to be skipped")
+	}
+
+	// the secondary goes away and the primary recovers
+	ss.Close()
+	primary.lock.Lock()
+	primary.metrics.UnixTimestamp = now + 4
+	primary.lock.Unlock()
+	c.upstreams[0].retryAt = time.Time{}
+	if m, err := c.FetchMetrics(); err != nil || c.active.Url != ps.URL || m.UnixTimestamp != now+4 {
+		t.Errorf("expected to fail over to the first server, got %s %v", c.active.Url, err)
+	}
+	if !c.IsStale() {
+		t.Errorf("expected a new server to make the config stale")
+	}
+	ps.Close()
+}
+
+func TestClientReports(t *testing.T) {
+	ts := &testServer{}
+	server := httptest.NewServer(ts)
+	defer server.Close()
+
+	c := NewClientFromSettings(Settings{
+		Url:      server.URL,
+		Register: true,
+		Id:       "nas",
+		UPS:      "ups",
+		Scripts:  []tripplite.PublicScript{{Name: "shutdown", Status: "OB", ShutdownScript: "exit 3"}},
+	})
+	c.rebuildWatcher(nil)
+
+	c.heartbeat(tripplite.CLIENT_REPORT_REGISTER)
+	if err := c.watcher.Scripts["shutdown"].Run(false); err == nil {
+		t.Errorf("expected the script to fail")
+	}
+
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if len(ts.reports) != 2 {
+		t.Fatalf("expected 2 reports, got %d", len(ts.reports))
+	}
+	register, result := ts.reports[0], ts.reports[1]
+	if register.Type != tripplite.CLIENT_REPORT_REGISTER || register.Id != "nas" || register.UPS != "ups" || len(register.Scripts) != 1 {
+		t.Errorf("unexpected register report %+v", register)
+	}
+	if result.Type != tripplite.CLIENT_REPORT_RESULT || result.Result == nil || result.Result.Script != "shutdown" || result.Result.ExitCode != 3 {
+		t.Errorf("unexpected result report %+v", result)
+	}
+}
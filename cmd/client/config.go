@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
@@ -11,18 +12,39 @@ import (
 )
 
 type Settings struct {
-	Url           string                   `yaml:"host" env:"UPS_HOST" env-default:"http://127.0.0.1:8080"`
-	Debug         bool                     `yaml:"debug" env:"UPS_DEBUG"`
-	Secret        string                   `yaml:"secret" env:"UPS_HMAC_SECRET"`
-	Delay         time.Duration            `yaml:"delay" env:"UPS_DELAY" env-default:"5s"`
-	Autoconfigure bool                     `yaml:"auto_configure" env:"UPS_AUTOCONF"`
-	Scripts       []tripplite.PublicScript `yaml:"scripts"`
+	Url             string                   `yaml:"host" env:"UPS_HOST" env-default:"http://127.0.0.1:8080"`
+	Urls            []string                 `yaml:"hosts" env:"UPS_HOSTS" env-separator:","`
+	Debug           bool                     `yaml:"debug" env:"UPS_DEBUG"`
+	Secret          string                   `yaml:"secret" env:"UPS_HMAC_SECRET"`
+	Delay           time.Duration            `yaml:"delay" env:"UPS_DELAY" env-default:"5s"`
+	MaxAge          time.Duration            `yaml:"max_age" env:"UPS_MAX_AGE" env-default:"60s"`
+	FailsafeTimeout time.Duration            `yaml:"failsafe_timeout" env:"UPS_FAILSAFE_TIMEOUT"`
+	Autoconfigure   bool                     `yaml:"auto_configure" env:"UPS_AUTOCONF"`
+	Register        bool                     `yaml:"register" env:"UPS_REGISTER" env-default:"true"`
+	Heartbeat       time.Duration            `yaml:"heartbeat" env:"UPS_HEARTBEAT" env-default:"30s"`
+	Id              string                   `yaml:"client_id" env:"UPS_CLIENT_ID"`
+	UPS             string                   `yaml:"ups" env:"UPS_NAME"`
+	Scripts         []tripplite.PublicScript `yaml:"scripts"`
+}
+
+// Servers to fetch from, hosts when given or else host.
+func (s Settings) GetUrls() []string {
+	urls := []string{}
+	for _, url := range s.Urls {
+		if url = strings.TrimSpace(url); len(url) > 0 {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) == 0 {
+		urls = append(urls, s.Url)
+	}
+	return urls
 }
 
 func NewSettings(use_env bool) (*Settings, error) {
 	s := Settings{}
 
-	err := cleanenv.ReadEnv(s)
+	err := cleanenv.ReadEnv(&s)
 	if err != nil {
 		log.Error().Err(err).Msg("invalid environment configuration")
 		return nil, err
@@ -1,27 +1,60 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/matutter/tripplite/pkg/tripplite"
 	"github.com/rs/zerolog/log"
 )
 
+var (
+	// Longest a request to a server may take, a hung server must not stall
+	// the others.
+	HTTP_TIMEOUT = 10 * time.Second
+)
+
 func Get(app tripplite.App, url string, response interface{}) error {
-	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
 	}
+	return send(app, req, response)
+}
 
-	client := http.Client{Transport: transport}
+// Posts o as JSON, signed when HMAC is enabled, and reads the response like
+// Get.
+func Post(app tripplite.App, url string, o interface{}, response interface{}) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if app.HMACEnabled() {
+		req.Header.Set(tripplite.HTTP_CONTENT_HASH_HEADER, base64.RawStdEncoding.EncodeToString(tripplite.ComputeHMAC(app.GetSecret(), data)))
+	}
+	return send(app, req, response)
+}
+
+func send(app tripplite.App, req *http.Request, response interface{}) error {
+	url := req.URL.String()
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: false},
+	}
+
+	client := http.Client{Transport: transport, Timeout: HTTP_TIMEOUT}
+	req.Header.Set("Accept", "application/json")
 
 	res, err := client.Do(req)
 	if err != nil {
@@ -29,6 +62,13 @@ func Get(app tripplite.App, url string, response interface{}) error {
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusNoContent {
+		return fmt.Errorf("no content from: %s", url)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from: %s", res.StatusCode, url)
+	}
+
 	content_type := res.Header.Get("Content-Type")
 	if content_type != "application/json" {
 		return fmt.Errorf("expected Content-Type application/json, got %s instead", content_type)
@@ -48,9 +88,9 @@ func Get(app tripplite.App, url string, response interface{}) error {
 		if !okay {
 			return fmt.Errorf("invalid HMAC for response from: %s", url)
 		}
-		app.SetChangeId(res.Header.Get(tripplite.HTTP_CHANGE_ID_HEADER))
 		log.Debug().Str("url", url).Msg("hmac OK")
 	}
+	app.SetChangeId(res.Header.Get(tripplite.HTTP_CHANGE_ID_HEADER))
 
 	err = json.Unmarshal(body, response)
 	if err != nil {
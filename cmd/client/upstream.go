@@ -0,0 +1,112 @@
+package main
+
+import (
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Longest a failing server is skipped while another one answers.
+	UPSTREAM_MAX_BACKOFF = time.Minute
+)
+
+// A monitoring server, each one tracks its own health and change id so the
+// client can fail over between servers watching the same UPS.
+type Upstream struct {
+	Url       string
+	ups       string
+	secret    []byte
+	lock      sync.Mutex
+	changeId  string
+	failures  int
+	retryAt   time.Time
+	lastError error
+	last      *tripplite.UPSMetrics
+}
+
+func NewUpstream(url string, ups string, secret []byte) *Upstream {
+	return &Upstream{Url: url, ups: ups, secret: secret}
+}
+
+func (u *Upstream) HMACEnabled() bool {
+	return len(u.secret) > 0
+}
+
+func (u *Upstream) GetSecret() []byte {
+	return u.secret
+}
+
+func (u *Upstream) SetChangeId(id string) {
+	if len(id) == 0 {
+		return
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.changeId = id
+}
+
+func (u *Upstream) ChangeId() string {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.changeId
+}
+
+func (u *Upstream) IsStale() bool {
+	return false
+}
+
+func (u *Upstream) Endpoint(parts ...string) string {
+	sep := "/"
+	url := u.Url
+	for _, part := range parts {
+		url = strings.TrimRight(url, sep) + sep + part
+	}
+	return strings.TrimRight(url, sep)
+}
+
+// Like Endpoint but scoped to the configured UPS, the server picks its first
+// UPS when none is set.
+func (u *Upstream) UPSEndpoint(parts ...string) string {
+	url := u.Endpoint(parts...)
+	if len(u.ups) > 0 {
+		url += "?ups=" + neturl.QueryEscape(u.ups)
+	}
+	return url
+}
+
+// A server which failed recently is skipped until its backoff passes.
+func (u *Upstream) Healthy(now time.Time) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return !now.Before(u.retryAt)
+}
+
+func (u *Upstream) fail(err error, now time.Time, delay time.Duration) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.failures++
+	u.lastError = err
+	backoff := delay << (u.failures - 1)
+	if u.failures > 16 || backoff > UPSTREAM_MAX_BACKOFF {
+		backoff = UPSTREAM_MAX_BACKOFF
+	}
+	u.retryAt = now.Add(backoff)
+	log.Warn().Err(err).Str("server", u.Url).Int("failures", u.failures).Dur("retry", backoff).Msg("server failing")
+}
+
+func (u *Upstream) succeed(m *tripplite.UPSMetrics) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.failures > 0 {
+		log.Info().Str("server", u.Url).Msg("server recovered")
+	}
+	u.failures = 0
+	u.lastError = nil
+	u.retryAt = time.Time{}
+	u.last = m
+}
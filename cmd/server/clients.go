@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Defaults of client_timeout and client_wait.
+	CLIENT_TIMEOUT = 90 * time.Second
+	CLIENT_WAIT    = 5 * time.Minute
+	// Script results kept per client.
+	CLIENT_RESULTS = 10
+	// How often WaitForClients checks on the clients.
+	CLIENT_WAIT_POLL = time.Second
+)
+
+// A client known to the server. It is online while it reported within the
+// registry's timeout and acknowledged once a script ran successfully, until
+// a script is cancelled or the UPS is back on line.
+type ClientInfo struct {
+	Id           string                   `json:"id"`
+	Hostname     string                   `json:"hostname"`
+	UPS          string                   `json:"ups"`
+	Remote       string                   `json:"remote"`
+	Scripts      []string                 `json:"scripts"`
+	Registered   int64                    `json:"registered"`
+	LastSeen     int64                    `json:"last_seen"`
+	Online       bool                     `json:"online"`
+	Acknowledged bool                     `json:"acknowledged"`
+	Results      []tripplite.ScriptResult `json:"results"`
+}
+
+// Clients which reported to the server, keyed by client id.
+type ClientRegistry struct {
+	Timeout time.Duration
+	Wait    time.Duration
+	lock    sync.Mutex
+	clients map[string]*ClientInfo
+}
+
+func NewClientRegistry(timeout time.Duration, wait time.Duration) *ClientRegistry {
+	return &ClientRegistry{
+		Timeout: timeout,
+		Wait:    wait,
+		clients: map[string]*ClientInfo{},
+	}
+}
+
+// Records a report from a client following the named UPS.
+func (r *ClientRegistry) Report(report tripplite.ClientReport, ups string, remote string, now time.Time) ClientInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, ok := r.clients[report.Id]
+	if !ok || report.Type == tripplite.CLIENT_REPORT_REGISTER {
+		// a client registers again when it starts, its host is back up
+		c = &ClientInfo{Id: report.Id, Registered: now.Unix(), Results: []tripplite.ScriptResult{}}
+		r.clients[report.Id] = c
+		log.Info().Str("client", report.Id).Str("hostname", report.Hostname).Str("ups", ups).Msg("client registered")
+	}
+	c.Hostname = report.Hostname
+	c.UPS = ups
+	c.Remote = remote
+	if report.Scripts != nil {
+		c.Scripts = report.Scripts
+	}
+	c.LastSeen = now.Unix()
+
+	if res := report.Result; report.Type == tripplite.CLIENT_REPORT_RESULT && res != nil {
+		c.Results = append(c.Results, *res)
+		if len(c.Results) > CLIENT_RESULTS {
+			c.Results = c.Results[len(c.Results)-CLIENT_RESULTS:]
+		}
+		c.Acknowledged = !res.Cancel && res.ExitCode == 0 && len(res.Error) == 0
+		log.Info().Str("client", c.Id).Str("script", res.Script).Bool("cancel", res.Cancel).Int("exit", res.ExitCode).Msg("client ran script")
+	}
+
+	return r.info(c, now)
+}
+
+// Clears the acknowledgements of a UPS's clients once its outage ends, so the
+// next outage waits on them again.
+func (r *ClientRegistry) OnEvent(e tripplite.PowerEvent) {
+	if e.Type != tripplite.EVENT_ON_BATTERY || e.Active {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, c := range r.clients {
+		if c.UPS == e.UPS {
+			c.Acknowledged = false
+		}
+	}
+}
+
+func (r *ClientRegistry) info(c *ClientInfo, now time.Time) ClientInfo {
+	info := *c
+	info.Online = now.Sub(time.Unix(c.LastSeen, 0)) <= r.Timeout
+	info.Scripts = append([]string{}, c.Scripts...)
+	info.Results = append([]tripplite.ScriptResult{}, c.Results...)
+	return info
+}
+
+// Clients following the named UPS, every client when ups is empty, by id.
+func (r *ClientRegistry) List(ups string, now time.Time) []ClientInfo {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	clients := []ClientInfo{}
+	for _, c := range r.clients {
+		if len(ups) == 0 || c.UPS == ups {
+			clients = append(clients, r.info(c, now))
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id < clients[j].Id })
+	return clients
+}
+
+// Online clients of the UPS which have not acknowledged yet.
+func (r *ClientRegistry) Pending(ups string, now time.Time) []string {
+	pending := []string{}
+	for _, c := range r.List(ups, now) {
+		if c.Online && !c.Acknowledged {
+			pending = append(pending, c.Id)
+		}
+	}
+	return pending
+}
+
+// Blocks until every client of the UPS acknowledged or went offline, at most
+// for Wait, or until stop returns true. This is how a server sharing the UPS
+// lets its clients shut down first.
+func (r *ClientRegistry) WaitForClients(ups string, stop func() bool) {
+	deadline := time.Now().Add(r.Wait)
+	for {
+		if stop != nil && stop() {
+			log.Info().Str("ups", ups).Msg("stopped waiting for clients")
+			return
+		}
+		pending := r.Pending(ups, time.Now())
+		if len(pending) == 0 {
+			log.Info().Str("ups", ups).Msg("all clients shut down")
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.Warn().Str("ups", ups).Strs("clients", pending).Msg("gave up waiting for clients")
+			return
+		}
+		time.Sleep(CLIENT_WAIT_POLL)
+	}
+}
+
+// The ClientWaiter of a UPS's watcher.
+type upsClientWaiter struct {
+	registry *ClientRegistry
+	ups      string
+}
+
+func (w upsClientWaiter) WaitForClients(stop func() bool) {
+	w.registry.WaitForClients(w.ups, stop)
+}
+
+func (r *ClientRegistry) Waiter(ups string) tripplite.ClientWaiter {
+	return upsClientWaiter{registry: r, ups: ups}
+}
+
+// Reads a client report, signed when a secret is configured.
+func (h *HttpApp) readClientReport(r *http.Request) (*tripplite.ClientReport, int, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, COMMAND_MAX_SIZE))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	report := tripplite.ClientReport{}
+	status, err := h.verifySigned(body, r.Header.Get(tripplite.HTTP_CONTENT_HASH_HEADER), &report, func() (int64, string) {
+		return report.Timestamp, report.Nonce
+	})
+	if err != nil {
+		return nil, status, err
+	}
+
+	if len(strings.TrimSpace(report.Id)) == 0 {
+		return nil, http.StatusBadRequest, errors.New("missing client id")
+	}
+	switch report.Type {
+	case tripplite.CLIENT_REPORT_REGISTER, tripplite.CLIENT_REPORT_HEARTBEAT, tripplite.CLIENT_REPORT_RESULT:
+	default:
+		return nil, http.StatusBadRequest, errors.New("unknown report type")
+	}
+	return &report, http.StatusOK, nil
+}
+
+func (h *HttpApp) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		name := r.URL.Query().Get("ups")
+		if len(name) > 0 && h.GetUPS(name) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h.sendJSON(h.Clients.List(name, time.Now()), w)
+		return
+	}
+
+	report, status, err := h.readClientReport(r)
+	if err != nil {
+		log.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("rejected client report")
+		w.WriteHeader(status)
+		return
+	}
+
+	u := h.GetUPS(report.UPS)
+	if u == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	info := h.Clients.Report(*report, u.Name, r.RemoteAddr, time.Now())
+	h.sendJSON(info, w)
+}
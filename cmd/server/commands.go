@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Largest accepted difference between a command timestamp and now.
+	COMMAND_MAX_AGE = 60 * time.Second
+	// Largest accepted command body.
+	COMMAND_MAX_SIZE = 4096
+)
+
+// Nonces of the signed messages accepted within 2*COMMAND_MAX_AGE, which
+// covers every timestamp still accepted, so each message is accepted once.
+type ReplayCache struct {
+	seen map[string]time.Time
+	lock sync.Mutex
+}
+
+// False when the nonce was seen before, otherwise it is remembered.
+func (c *ReplayCache) Add(nonce string, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	for n, at := range c.seen {
+		if now.Sub(at) > 2*COMMAND_MAX_AGE {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = now
+	return true
+}
+
+// Checks the signature of a JSON body and decodes it into v. The timestamp
+// and nonce it carries, returned by signed, must be within COMMAND_MAX_AGE of
+// now and not seen before. Without a secret there is nothing to replay.
+func (h *HttpApp) verifySigned(body []byte, mac string, v interface{}, signed func() (int64, string)) (int, error) {
+	ok, err := tripplite.ValidateHMAC(h, body, mac)
+	if err != nil || !ok {
+		return http.StatusUnauthorized, errors.New("invalid signature")
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if !h.HMACEnabled() {
+		return http.StatusOK, nil
+	}
+
+	timestamp, nonce := signed()
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > COMMAND_MAX_AGE || age < -COMMAND_MAX_AGE {
+		return http.StatusUnauthorized, errors.New("stale timestamp")
+	}
+	if len(nonce) == 0 {
+		return http.StatusBadRequest, errors.New("missing nonce")
+	}
+	if !h.Replays.Add(nonce, time.Now()) {
+		return http.StatusConflict, errors.New("replayed message")
+	}
+	return http.StatusOK, nil
+}
+
+// Authenticates a signed CommandRequest for the UPS. Commands are refused
+// outright when no secret is configured.
+func (h *HttpApp) verifyCommandRequest(body []byte, mac string, u *UPS) (*tripplite.CommandRequest, int, error) {
+	if !h.HMACEnabled() {
+		return nil, http.StatusForbidden, errors.New("commands require a secret")
+	}
+
+	req := tripplite.CommandRequest{}
+	status, err := h.verifySigned(body, mac, &req, func() (int64, string) { return req.Timestamp, req.Nonce })
+	if err != nil {
+		return nil, status, err
+	}
+	if req.UPS != u.Name {
+		return nil, http.StatusForbidden, errors.New("command is signed for another ups")
+	}
+	return &req, status, nil
+}
+
+func (h *HttpApp) readCommandRequest(r *http.Request, u *UPS) (*tripplite.CommandRequest, int, error) {
+	if !h.HMACEnabled() {
+		return nil, http.StatusForbidden, errors.New("commands require a secret")
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, COMMAND_MAX_SIZE))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return h.verifyCommandRequest(body, r.Header.Get(tripplite.HTTP_CONTENT_HASH_HEADER), u)
+}
+
+// Runs an authenticated command on the UPS, the status is the HTTP status
+// the outcome maps to.
+func (h *HttpApp) runCommand(u *UPS, req *tripplite.CommandRequest) (tripplite.CommandResponse, int) {
+	var err error
+	var status int
+	res := tripplite.CommandResponse{UPS: u.Name, Command: req.Command}
+
+	var delay time.Duration
+	if len(req.Delay) > 0 {
+		delay, err = time.ParseDuration(req.Delay)
+		if err != nil {
+			res.Error = err.Error()
+			return res, http.StatusBadRequest
+		}
+	}
+
+	h.lock.RLock()
+	mon := u.Monitor
+	h.lock.RUnlock()
+	if mon == nil {
+		res.Error = "device is not open"
+		return res, http.StatusServiceUnavailable
+	}
+
+	err = mon.InstantCommand(req.Command, delay)
+	switch {
+	case err == nil:
+		res.Ok = true
+		status = http.StatusOK
+	case errors.Is(err, tripplite.ErrUnknownCommand), errors.Is(err, tripplite.ErrNoSuchLoadBank):
+		status = http.StatusBadRequest
+	case errors.Is(err, tripplite.ErrUnsupportedCommand):
+		status = http.StatusNotImplemented
+	default:
+		status = http.StatusBadGateway
+	}
+	if err != nil {
+		log.Error().Err(err).Str("ups", u.Name).Str("command", req.Command).Msg("command failed")
+		res.Error = err.Error()
+	}
+	return res, status
+}
+
+func (h *HttpApp) handleCommand(w http.ResponseWriter, r *http.Request, u *UPS) {
+	req, status, err := h.readCommandRequest(r, u)
+	if err != nil {
+		log.Warn().Err(err).Str("ups", u.Name).Str("remote", r.RemoteAddr).Msg("rejected command")
+		h.sendJSONStatus(tripplite.CommandResponse{UPS: u.Name, Error: err.Error()}, status, w)
+		return
+	}
+
+	res, status := h.runCommand(u, req)
+	h.sendJSONStatus(res, status, w)
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
@@ -11,39 +14,164 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
+const DEFAULT_UPS_NAME = "ups"
+
+// A UPS matched by VID/PID plus serial number or bus/port path. Zero values
+// for delay, history_size, runtime, charge_model and events take the top
+// level setting.
+type DeviceSettings struct {
+	Name        string                    `yaml:"name"`
+	VendorId    string                    `yaml:"vendor_id"`
+	ProductId   string                    `yaml:"product_id"`
+	Serial      string                    `yaml:"serial"`
+	Path        string                    `yaml:"path"`
+	Delay       time.Duration             `yaml:"delay"`
+	HistorySize int                       `yaml:"history_size"`
+	Scripts     []tripplite.Script        `yaml:"scripts"`
+	Simulator   string                    `yaml:"simulator"`
+	Runtime     tripplite.RuntimeModel    `yaml:"runtime"`
+	ChargeModel tripplite.ChargeModel     `yaml:"charge_model"`
+	Events      tripplite.EventThresholds `yaml:"events"`
+}
+
 type Settings struct {
-	Listen      string             `yaml:"listen" env:"UPS_LISTEN" env-default:"0.0.0.0:8080"`
-	Debug       bool               `yaml:"debug" env:"UPS_DEBUG"`
-	VendorId    string             `yaml:"vendor_id" env:"UPS_VENDOR_ID"`
-	ProductId   string             `yaml:"product_id" env:"UPS_PRODUCT_ID"`
-	Delay       time.Duration      `yaml:"delay" env:"UPS_DELAY" env-default:"5s"`
-	HistorySize int                `yaml:"history_size" env:"UPS_HISTORY_SIZE" env-default:"1000"`
-	Scripts     []tripplite.Script `yaml:"scripts"`
-	Secret      string             `yaml:"secret" env:"UPS_HMAC_SECRET"`
+	Listen        string                    `yaml:"listen" env:"UPS_LISTEN" env-default:"0.0.0.0:8080"`
+	Debug         bool                      `yaml:"debug" env:"UPS_DEBUG"`
+	VendorId      string                    `yaml:"vendor_id" env:"UPS_VENDOR_ID"`
+	ProductId     string                    `yaml:"product_id" env:"UPS_PRODUCT_ID"`
+	Serial        string                    `yaml:"serial" env:"UPS_SERIAL"`
+	Path          string                    `yaml:"path" env:"UPS_PATH"`
+	Delay         time.Duration             `yaml:"delay" env:"UPS_DELAY" env-default:"5s"`
+	HistorySize   int                       `yaml:"history_size" env:"UPS_HISTORY_SIZE" env-default:"1000"`
+	HistoryDir    string                    `yaml:"history_dir" env:"UPS_HISTORY_DIR"`
+	HistoryAge    time.Duration             `yaml:"history_retention" env:"UPS_HISTORY_RETENTION" env-default:"720h"`
+	HistoryMax    int64                     `yaml:"history_max_bytes" env:"UPS_HISTORY_MAX_BYTES" env-default:"104857600"`
+	Scripts       []tripplite.Script        `yaml:"scripts"`
+	Secret        string                    `yaml:"secret" env:"UPS_HMAC_SECRET"`
+	Simulator     string                    `yaml:"simulator" env:"UPS_SIMULATOR"`
+	Devices       []DeviceSettings          `yaml:"devices"`
+	Runtime       tripplite.RuntimeModel    `yaml:"runtime"`
+	ChargeModel   tripplite.ChargeModel     `yaml:"charge_model"`
+	Events        tripplite.EventThresholds `yaml:"events"`
+	EventsSize    int                       `yaml:"events_size" env:"UPS_EVENTS_SIZE" env-default:"100"`
+	ClientTimeout time.Duration             `yaml:"client_timeout" env:"UPS_CLIENT_TIMEOUT" env-default:"90s"`
+	ClientWait    time.Duration             `yaml:"client_wait" env:"UPS_CLIENT_WAIT" env-default:"5m"`
+	NUTListen     string                    `yaml:"nut_listen" env:"UPS_NUT_LISTEN"`
+	NUTUsers      []NUTUser                 `yaml:"nut_users"`
+	SNMPListen    string                    `yaml:"snmp_listen" env:"UPS_SNMP_LISTEN"`
+	SNMPCommunity string                    `yaml:"snmp_community" env:"UPS_SNMP_COMMUNITY" env-default:"public"`
+	SNMPEngineId  string                    `yaml:"snmp_engine_id" env:"UPS_SNMP_ENGINE_ID"`
+	SNMPUsers     []SNMPUser                `yaml:"snmp_users"`
+	SNMPTraps     []SNMPTrapTarget          `yaml:"snmp_traps"`
+	MQTTBroker    string                    `yaml:"mqtt_broker" env:"UPS_MQTT_BROKER"`
+	MQTTClientId  string                    `yaml:"mqtt_client_id" env:"UPS_MQTT_CLIENT_ID"`
+	MQTTUsername  string                    `yaml:"mqtt_username" env:"UPS_MQTT_USERNAME"`
+	MQTTPassword  string                    `yaml:"mqtt_password" env:"UPS_MQTT_PASSWORD"`
+	MQTTTopic     string                    `yaml:"mqtt_topic" env:"UPS_MQTT_TOPIC" env-default:"tripplite"`
+	MQTTDiscovery bool                      `yaml:"mqtt_discovery" env:"UPS_MQTT_DISCOVERY" env-default:"true"`
+	MQTTPrefix    string                    `yaml:"mqtt_discovery_prefix" env:"UPS_MQTT_DISCOVERY_PREFIX" env-default:"homeassistant"`
+	MQTTRetain    bool                      `yaml:"mqtt_retain" env:"UPS_MQTT_RETAIN"`
+	Push          []PushSettings            `yaml:"push"`
+	SMTP          tripplite.SMTPSettings    `yaml:"smtp"`
 }
 
-func (s Settings) getVidPid() (uint16, uint16) {
-	var vid uint16
-	var pid uint16
-	var tmp int64
-	var err error
-	tmp, err = strconv.ParseInt(s.VendorId, 16, 16)
-	if err != nil {
-		log.Fatal().Err(err).Str("vendor_id", s.VendorId).Msg("invalid vendor id")
+// Directory of a device's history segments, empty when history is only kept
+// in memory.
+func (s Settings) getHistoryDir(d DeviceSettings) string {
+	if len(s.HistoryDir) == 0 {
+		return ""
+	}
+	return filepath.Join(s.HistoryDir, d.Name)
+}
+
+// Directory of a device's event segments, kept apart from its metrics.
+func (s Settings) getEventsDir(d DeviceSettings) string {
+	if len(s.HistoryDir) == 0 {
+		return ""
 	}
-	vid = (uint16(tmp))
-	tmp, err = strconv.ParseInt(s.ProductId, 16, 16)
+	return filepath.Join(s.HistoryDir, d.Name, "events")
+}
+
+func (s Settings) getHistoryRetention() tripplite.StoreRetention {
+	return tripplite.StoreRetention{MaxAge: s.HistoryAge, MaxSize: s.HistoryMax}
+}
+
+func parseUSBId(name string, value string) uint16 {
+	tmp, err := strconv.ParseUint(value, 16, 16)
 	if err != nil {
-		log.Fatal().Err(err).Str("product_id", s.ProductId).Msg("invalid product id")
+		log.Fatal().Err(err).Str(name, value).Msg("invalid " + strings.ReplaceAll(name, "_", " "))
+	}
+	return uint16(tmp)
+}
+
+func (s Settings) getVidPid() (uint16, uint16) {
+	return parseUSBId("vendor_id", s.VendorId), parseUSBId("product_id", s.ProductId)
+}
+
+func (d DeviceSettings) getMatch() tripplite.USBMatch {
+	return tripplite.USBMatch{
+		VendorId:  parseUSBId("vendor_id", d.VendorId),
+		ProductId: parseUSBId("product_id", d.ProductId),
+		Serial:    d.Serial,
+		Path:      d.Path,
+	}
+}
+
+// The configured devices, without a devices list the top level settings
+// describe a single UPS named "ups".
+func (s Settings) GetDevices() []DeviceSettings {
+	if len(s.Devices) == 0 {
+		return []DeviceSettings{{
+			Name:        DEFAULT_UPS_NAME,
+			VendorId:    s.VendorId,
+			ProductId:   s.ProductId,
+			Serial:      s.Serial,
+			Path:        s.Path,
+			Delay:       s.Delay,
+			HistorySize: s.HistorySize,
+			Scripts:     s.Scripts,
+			Simulator:   s.Simulator,
+			Runtime:     s.Runtime,
+			ChargeModel: s.ChargeModel,
+			Events:      s.Events,
+		}}
+	}
+
+	devices := make([]DeviceSettings, len(s.Devices))
+	for i, d := range s.Devices {
+		if len(d.Name) == 0 {
+			d.Name = fmt.Sprintf("%s%d", DEFAULT_UPS_NAME, i+1)
+		}
+		if len(d.VendorId) == 0 {
+			d.VendorId = s.VendorId
+		}
+		if len(d.ProductId) == 0 {
+			d.ProductId = s.ProductId
+		}
+		if d.Delay == 0 {
+			d.Delay = s.Delay
+		}
+		if d.HistorySize == 0 {
+			d.HistorySize = s.HistorySize
+		}
+		if d.Runtime == (tripplite.RuntimeModel{}) {
+			d.Runtime = s.Runtime
+		}
+		if d.ChargeModel.Discharging.IsZero() && d.ChargeModel.Charging.IsZero() {
+			d.ChargeModel = s.ChargeModel
+		}
+		if d.Events == (tripplite.EventThresholds{}) {
+			d.Events = s.Events
+		}
+		devices[i] = d
 	}
-	pid = (uint16(tmp))
-	return vid, pid
+	return devices
 }
 
 func NewSettings(use_env bool) (*Settings, error) {
 	s := Settings{}
 
-	err := cleanenv.ReadEnv(s)
+	err := cleanenv.ReadEnv(&s)
 	if err != nil {
 		log.Error().Err(err).Msg("invalid environment configuration")
 		return nil, err
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+type PowerEventListener interface {
+	OnEvent(tripplite.PowerEvent)
+}
+
+// Adds or updates events in the in-memory log, an event which ends replaces
+// the record of its start.
+func (u *UPS) recordEvents(events []tripplite.PowerEvent) {
+	for _, e := range events {
+		updated := false
+		for i := len(u.Events) - 1; i >= 0; i-- {
+			if u.Events[i].Id == e.Id {
+				u.Events[i] = e
+				updated = true
+				break
+			}
+		}
+		if !updated {
+			u.Events = append(u.Events, e)
+		}
+	}
+	if u.EventSize > 0 && len(u.Events) > u.EventSize {
+		u.Events = u.Events[len(u.Events)-u.EventSize:]
+	}
+}
+
+// Restores the newest events from the event log and continues those which
+// were still active.
+func (u *UPS) RestoreEvents() error {
+	if u.EventLog == nil {
+		return nil
+	}
+	events, err := u.EventLog.Read(0, 0)
+	if err != nil {
+		return err
+	}
+	if u.EventSize > 0 && len(events) > u.EventSize {
+		events = events[len(events)-u.EventSize:]
+	}
+	u.Events = events
+	u.Detector.Resume(events)
+	log.Info().Str("ups", u.Name).Int("events", len(events)).Msg("restored events")
+	return nil
+}
+
+func (h *HttpApp) publishEvents(events []tripplite.PowerEvent, u *UPS) {
+	if len(events) == 0 {
+		return
+	}
+
+	for _, e := range events {
+		log.Info().
+			Str("ups", u.Name).
+			Str("event", e.Type).
+			Bool("active", e.Active).
+			Float64("duration", e.Duration).
+			Str("detail", e.Detail).
+			Msg("power event")
+		if u.EventLog != nil {
+			if err := u.EventLog.Append(e); err != nil {
+				log.Error().Err(err).Str("ups", u.Name).Msg("failed to store event")
+			}
+		}
+	}
+
+	h.listenerLock.Lock()
+	defer h.listenerLock.Unlock()
+	for _, e := range events {
+		for _, listener := range h.EventListeners {
+			listener.OnEvent(e)
+		}
+	}
+}
+
+// Filters events by time range, type and state, newest first.
+type EventQuery struct {
+	From   int64
+	To     int64
+	Types  map[string]bool
+	Active bool
+	Limit  int
+}
+
+func parseEventQuery(r *http.Request) (EventQuery, error) {
+	var err error
+	values := r.URL.Query()
+	q := EventQuery{}
+
+	if q.From, err = parseTimeQuery(values, "from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTimeQuery(values, "to"); err != nil {
+		return q, err
+	}
+
+	known := map[string]bool{}
+	for _, kind := range tripplite.EVENT_TYPES {
+		known[kind] = true
+	}
+	for _, kind := range strings.Split(values.Get("type"), ",") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		if len(kind) == 0 {
+			continue
+		}
+		if !known[kind] {
+			return q, fmt.Errorf("unknown event type: %q", kind)
+		}
+		if q.Types == nil {
+			q.Types = map[string]bool{}
+		}
+		q.Types[kind] = true
+	}
+
+	q.Active = strings.EqualFold(values.Get("active"), "true")
+	q.Limit = parseIntQuery(r, "limit", 0, 1<<31-1, 0)
+	return q, nil
+}
+
+// Runs the query over events sorted oldest first.
+func (q EventQuery) Run(events []tripplite.PowerEvent, now time.Time) []tripplite.PowerEvent {
+	selected := []tripplite.PowerEvent{}
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		if q.To > 0 && e.Start > q.To {
+			continue
+		}
+		if q.From > 0 && !e.Active && e.End < q.From {
+			continue
+		}
+		if q.Types != nil && !q.Types[e.Type] {
+			continue
+		}
+		if q.Active && !e.Active {
+			continue
+		}
+		selected = append(selected, e.At(now))
+		if q.Limit > 0 && len(selected) >= q.Limit {
+			break
+		}
+	}
+	return selected
+}
+
+func (h *HttpApp) eventsOf(u *UPS, q EventQuery) ([]tripplite.PowerEvent, error) {
+	if u.EventLog != nil && (q.From > 0 || q.To > 0) {
+		return u.EventLog.Read(q.From, q.To)
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return append([]tripplite.PowerEvent{}, u.Events...), nil
+}
+
+func (h *HttpApp) handleEvents(w http.ResponseWriter, r *http.Request, u *UPS) {
+	q, err := parseEventQuery(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	events, err := h.eventsOf(u, q)
+	if err != nil {
+		log.Error().Err(err).Str("ups", u.Name).Msg("failed to read events")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.sendJSON(q.Run(events, time.Now()), w)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+// Unix seconds or RFC3339.
+func parseTimeQuery(values url.Values, arg string) (int64, error) {
+	str := values.Get(arg)
+	if len(str) == 0 {
+		return 0, nil
+	}
+	if unix, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return unix, nil
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %q", arg, str)
+	}
+	return t.Unix(), nil
+}
+
+// A duration like 5m or a number of seconds.
+func parseStepQuery(values url.Values) (time.Duration, error) {
+	str := values.Get("step")
+	if len(str) == 0 {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(str); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	step, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("invalid step: %q", str)
+	}
+	return step, nil
+}
+
+// Builds a HistoryQuery from from, to, step, agg, fields, limit and order.
+func parseHistoryQuery(r *http.Request) (tripplite.HistoryQuery, error) {
+	var err error
+	values := r.URL.Query()
+	q := tripplite.HistoryQuery{}
+
+	if q.From, err = parseTimeQuery(values, "from"); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTimeQuery(values, "to"); err != nil {
+		return q, err
+	}
+	if q.Step, err = parseStepQuery(values); err != nil {
+		return q, err
+	}
+	if err = q.ParseAggregate(values.Get("agg")); err != nil {
+		return q, err
+	}
+
+	for _, field := range strings.Split(values.Get("fields"), ",") {
+		if field = strings.TrimSpace(field); len(field) > 0 {
+			q.Fields = append(q.Fields, field)
+		}
+	}
+
+	q.Limit = parseIntQuery(r, "limit", 0, 1<<31-1, 0)
+
+	switch strings.ToLower(values.Get("order")) {
+	case "", "desc":
+		q.Ascending = false
+	case "asc":
+		q.Ascending = true
+	default:
+		return q, fmt.Errorf("invalid order: %q", values.Get("order"))
+	}
+
+	return q, nil
+}
+
+// Samples the query runs over. Without a time range this is the newest
+// history_size samples, from disk when history is persisted.
+func (h *HttpApp) historySamples(u *UPS, q tripplite.HistoryQuery) ([]*tripplite.UPSMetrics, error) {
+	if u.Store != nil {
+		if q.From > 0 || q.To > 0 {
+			return u.Store.Read(q.From, q.To)
+		}
+		return u.Store.Tail(u.Limit)
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return append([]*tripplite.UPSMetrics{}, u.History...), nil
+}
+
+func (h *HttpApp) handleHistory(w http.ResponseWriter, r *http.Request, u *UPS) {
+	q, err := parseHistoryQuery(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	samples, err := h.historySamples(u, q)
+	if err != nil {
+		log.Error().Err(err).Str("ups", u.Name).Msg("failed to read history")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	h.sendJSON(q.Run(samples), w)
+}
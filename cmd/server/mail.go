@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+// Mails the power events of the smtp settings when they start and end.
+type EventMailer struct {
+	Mailer *tripplite.Mailer
+	Events []string
+	app    *HttpApp
+}
+
+func NewEventMailer(h *HttpApp, mailer *tripplite.Mailer) *EventMailer {
+	return &EventMailer{Mailer: mailer, Events: mailer.Settings.Events, app: h}
+}
+
+func (m *EventMailer) wants(kind string) bool {
+	for _, e := range m.Events {
+		if e == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Renders and sends an event in the background, events are published with
+// the listener lock held.
+func (m *EventMailer) OnEvent(e tripplite.PowerEvent) {
+	if !m.wants(e.Type) {
+		return
+	}
+
+	title := strings.ReplaceAll(e.Type, "_", " ") + " started"
+	when := time.Unix(e.Start, 0)
+	if !e.Active {
+		title = strings.ReplaceAll(e.Type, "_", " ") + " ended"
+		when = time.Unix(e.End, 0)
+	}
+	data := tripplite.MailData{UPS: e.UPS, Title: title, Event: &e, Active: e.Active, Time: when}
+	if u := m.app.GetUPS(e.UPS); u != nil {
+		m.app.lock.RLock()
+		data.Metrics = u.LatestMetrics()
+		m.app.lock.RUnlock()
+	}
+
+	msg, err := m.Mailer.Render(data, "", "")
+	if err != nil {
+		log.Error().Err(err).Str("ups", e.UPS).Str("event", e.Type).Msg("cannot render mail")
+		return
+	}
+	go func() {
+		if err := m.Mailer.Notify(msg); err != nil {
+			log.Error().Err(err).Str("ups", e.UPS).Str("event", e.Type).Msg("failed to mail event")
+		}
+	}()
+}
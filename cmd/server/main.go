@@ -2,13 +2,14 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/matutter/tripplite/pkg/tripplite"
 	"github.com/rs/zerolog/log"
 )
 
 var settings *Settings
-var watcher *tripplite.Watcher
 
 func init() {
 	s, err := NewSettings(true)
@@ -16,16 +17,33 @@ func init() {
 		log.Fatal().Err(err).Msg("cannot load configuration")
 	}
 
-	w := tripplite.NewWatcher()
-	for _, script := range s.Scripts {
-		w.AddScript(script, false)
-	}
+	settings = s
+}
 
-	if w.GetSize() > 0 {
-		watcher = w
+func newMonitorOpener(d DeviceSettings) MonitorOpener {
+	if len(d.Simulator) > 0 {
+		return func() (*tripplite.SmartProUPSMonitor, error) {
+			tl, err := tripplite.LoadSimulatorTimeline(d.Simulator)
+			if err != nil {
+				return nil, err
+			}
+			log.Warn().Str("ups", d.Name).Str("timeline", d.Simulator).Str("name", tl.Name).Msg("using simulated device")
+			mon, _, err := tripplite.NewSimulatedMonitor(*tl)
+			if mon != nil {
+				mon.ChargeModel = d.ChargeModel
+			}
+			return mon, err
+		}
 	}
 
-	settings = s
+	match := d.getMatch()
+	return func() (*tripplite.SmartProUPSMonitor, error) {
+		mon, err := tripplite.NewSmartProUPSMonitorMatching(match)
+		if mon != nil {
+			mon.ChargeModel = d.ChargeModel
+		}
+		return mon, err
+	}
 }
 
 func main() {
@@ -34,27 +52,129 @@ func main() {
 		os.Exit(1)
 	}
 
-	vid, pid := settings.getVidPid()
-	h := NewHttpApp(settings.HistorySize, settings.Delay, settings.Secret)
+	h := NewHttpApp(settings.Secret)
+	h.Clients.Timeout = settings.ClientTimeout
+	h.Clients.Wait = settings.ClientWait
 
-	if watcher != nil {
-		h.Listeners = append(h.Listeners, watcher)
+	if len(settings.SMTP.Host) > 0 {
+		mailer, err := tripplite.NewMailer(settings.SMTP)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid smtp settings")
+		}
+		h.Mailer = mailer
+		h.EventListeners = append(h.EventListeners, NewEventMailer(h, mailer))
 	}
 
-	mon, err := tripplite.NewSmartProUPSMonitor(vid, pid)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to open monitor")
-	} else {
+	for _, d := range settings.GetDevices() {
+		if h.GetUPS(d.Name) != nil {
+			log.Fatal().Str("ups", d.Name).Msg("duplicate device name")
+		}
+		if err := d.ChargeModel.Validate(); err != nil {
+			log.Fatal().Err(err).Str("ups", d.Name).Msg("invalid charge model")
+		}
+
+		u := h.AddUPS(d.Name, d.HistorySize, d.Delay)
+		u.Open = newMonitorOpener(d)
+		u.Runtime = tripplite.NewRuntimeEstimator(d.Runtime)
+		u.Detector = tripplite.NewEventDetector(d.Events)
+		u.EventSize = settings.EventsSize
 
-		log.Info().
-			Str("manufacturer", mon.Manufacturer).
-			Str("product", mon.Product).
-			Str("protocol", mon.ProtocolName).
-			Dur("delay", h.Delay).
-			Msg("serving")
+		if dir := settings.getHistoryDir(d); len(dir) > 0 {
+			store, err := tripplite.OpenMetricsStore(dir, settings.getHistoryRetention())
+			if err != nil {
+				log.Fatal().Err(err).Str("ups", d.Name).Str("path", dir).Msg("cannot open history")
+			}
+			u.Store = store
+			if err := u.Restore(); err != nil {
+				log.Error().Err(err).Str("ups", d.Name).Msg("failed to restore history")
+			}
 
-		go h.StartServer(settings.Listen)
-		h.PollMetrics(mon) // blocks until SIGTERM
-		mon.Close()
+			events, err := tripplite.OpenEventStore(settings.getEventsDir(d), settings.getHistoryRetention())
+			if err != nil {
+				log.Fatal().Err(err).Str("ups", d.Name).Msg("cannot open event log")
+			}
+			u.EventLog = events
+			if err := u.RestoreEvents(); err != nil {
+				log.Error().Err(err).Str("ups", d.Name).Msg("failed to restore events")
+			}
+		}
+
+		w := tripplite.NewWatcher()
+		w.SetClientWaiter(h.Clients.Waiter(u.Name))
+		w.SetSecret(h.Secret)
+		w.SetMailer(h.Mailer)
+		for _, script := range d.Scripts {
+			if err := script.Validate(); err != nil {
+				log.Fatal().Err(err).Str("ups", d.Name).Str("script", script.Name).Msg("invalid script")
+			}
+			if strings.EqualFold(script.Action, tripplite.ACTION_EMAIL) && h.Mailer == nil {
+				log.Fatal().Str("ups", d.Name).Str("script", script.Name).Msg("email action needs smtp settings")
+			}
+			w.AddScript(script, false)
+		}
+		if w.GetSize() > 0 {
+			u.Listeners = append(u.Listeners, w)
+		}
 	}
+
+	if len(settings.NUTListen) > 0 {
+		h.NUT = NewNUTServer(h, settings.NUTUsers)
+		if err := h.NUT.Listen(settings.NUTListen); err != nil {
+			log.Fatal().Err(err).Str("address", settings.NUTListen).Msg("cannot listen for NUT clients")
+		}
+		go h.NUT.Serve()
+	}
+
+	if len(settings.SNMPListen) > 0 {
+		agent, err := NewSNMPAgent(h, settings.SNMPCommunity, settings.SNMPUsers, settings.SNMPTraps)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid SNMP settings")
+		}
+		if len(settings.SNMPEngineId) > 0 {
+			if err := agent.SetEngineId(settings.SNMPEngineId); err != nil {
+				log.Fatal().Err(err).Msg("invalid SNMP engine id")
+			}
+		}
+		if len(settings.HistoryDir) > 0 {
+			if err := agent.LoadBoots(filepath.Join(settings.HistoryDir, "snmp_engine_boots")); err != nil {
+				log.Error().Err(err).Msg("failed to count SNMP engine boots")
+			}
+		}
+		if err := agent.Listen(settings.SNMPListen); err != nil {
+			log.Fatal().Err(err).Str("address", settings.SNMPListen).Msg("cannot listen for SNMP requests")
+		}
+		h.SNMP = agent
+		h.EventListeners = append(h.EventListeners, agent)
+		go agent.Serve()
+	}
+
+	if len(settings.MQTTBroker) > 0 {
+		discovery := ""
+		if settings.MQTTDiscovery {
+			discovery = settings.MQTTPrefix
+		}
+		p := NewMQTTPublisher(settings.MQTTBroker, settings.MQTTTopic, discovery)
+		p.ClientId = settings.MQTTClientId
+		p.Username = settings.MQTTUsername
+		p.Password = settings.MQTTPassword
+		p.Retain = settings.MQTTRetain
+		if err := p.Connect(); err != nil {
+			log.Fatal().Err(err).Str("broker", settings.MQTTBroker).Msg("cannot connect to MQTT broker")
+		}
+		h.MQTT = p
+		h.Listeners = append(h.Listeners, p)
+	}
+
+	for _, s := range settings.Push {
+		sink, err := NewPushSink(s)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid push sink")
+		}
+		sink.Start()
+		h.Sinks = append(h.Sinks, sink)
+		h.Listeners = append(h.Listeners, sink)
+	}
+
+	go h.StartServer(settings.Listen)
+	h.PollMetrics() // blocks until SIGINT
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
@@ -23,3 +24,30 @@ func TestLoadConfig2(t *testing.T) {
 	}
 	t.Logf("%v", s)
 }
+
+func TestGetDevices(t *testing.T) {
+	s := Settings{VendorId: "09ae", ProductId: "0001", Delay: time.Second, HistorySize: 100}
+	devices := s.GetDevices()
+	if len(devices) != 1 || devices[0].Name != DEFAULT_UPS_NAME || devices[0].Delay != time.Second {
+		t.Errorf("unexpected default device %+v", devices)
+	}
+
+	s.Devices = []DeviceSettings{
+		{Name: "rack-a", Serial: "2211AV0000"},
+		{Path: "1-4", ProductId: "ffff", HistorySize: 10},
+	}
+	devices = s.GetDevices()
+	if len(devices) != 2 {
+		t.Fatalf("expected 2 devices, got %d", len(devices))
+	}
+
+	a := devices[0].getMatch()
+	if a.VendorId != 0x09ae || a.ProductId != 1 || a.Serial != "2211AV0000" || devices[0].HistorySize != 100 {
+		t.Errorf("unexpected device %+v", devices[0])
+	}
+
+	b := devices[1].getMatch()
+	if devices[1].Name != "ups2" || b.ProductId != 0xffff || b.Path != "1-4" || devices[1].HistorySize != 10 {
+		t.Errorf("unexpected device %+v", devices[1])
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// How long startup waits for the first connection to the broker, the
+	// publisher keeps retrying in the background afterwards.
+	MQTT_CONNECT_TIMEOUT = 10 * time.Second
+	// How long Close waits for the offline status to be delivered.
+	MQTT_CLOSE_TIMEOUT = 2 * time.Second
+	MQTT_QOS           = byte(1)
+)
+
+// Publishes every sample to an MQTT broker below Topic/<ups>: one topic per
+// field, the whole sample as JSON on state and a retained availability topic.
+// Topic/status is online while connected and the broker's last will sets it
+// offline. Home Assistant discovery is published for each UPS unless
+// Discovery is empty, and again whenever Home Assistant comes online.
+type MQTTPublisher struct {
+	Broker    string
+	Topic     string
+	Discovery string
+	ClientId  string
+	Username  string
+	Password  string
+	Retain    bool
+	client    mqtt.Client
+	lock      sync.Mutex
+	announced map[string]bool
+	available map[string]string
+}
+
+func NewMQTTPublisher(broker string, topic string, discovery string) *MQTTPublisher {
+	return &MQTTPublisher{
+		Broker:    broker,
+		Topic:     topic,
+		Discovery: discovery,
+		announced: map[string]bool{},
+		available: map[string]string{},
+	}
+}
+
+func (p *MQTTPublisher) statusTopic() string {
+	return p.Topic + "/status"
+}
+
+// Connects to the broker, reconnecting on its own when the connection drops.
+// An unreachable broker is retried in the background after
+// MQTT_CONNECT_TIMEOUT.
+func (p *MQTTPublisher) Connect() error {
+	if len(p.ClientId) == 0 {
+		hostname, _ := os.Hostname()
+		p.ClientId = "tripplite-" + tripplite.MQTTId(hostname)
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(p.Broker).
+		SetClientID(p.ClientId).
+		SetUsername(p.Username).
+		SetPassword(p.Password).
+		SetWill(p.statusTopic(), tripplite.MQTT_OFFLINE, MQTT_QOS, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			log.Warn().Err(err).Str("broker", p.Broker).Msg("lost connection to MQTT broker")
+		})
+	p.client = mqtt.NewClient(opts)
+
+	token := p.client.Connect()
+	if !token.WaitTimeout(MQTT_CONNECT_TIMEOUT) {
+		log.Warn().Str("broker", p.Broker).Msg("MQTT broker not reachable yet, retrying in the background")
+		return nil
+	}
+	return token.Error()
+}
+
+// Marks the publisher online and announces every UPS again on its next sample,
+// a restarted broker may have lost the retained messages.
+func (p *MQTTPublisher) onConnect(c mqtt.Client) {
+	log.Info().Str("broker", p.Broker).Msg("connected to MQTT broker")
+	p.lock.Lock()
+	p.announced = map[string]bool{}
+	p.available = map[string]string{}
+	p.lock.Unlock()
+
+	c.Publish(p.statusTopic(), MQTT_QOS, true, tripplite.MQTT_ONLINE)
+	if len(p.Discovery) > 0 {
+		c.Subscribe(p.Discovery+"/status", MQTT_QOS, func(c mqtt.Client, msg mqtt.Message) {
+			if string(msg.Payload()) == tripplite.MQTT_ONLINE {
+				p.lock.Lock()
+				p.announced = map[string]bool{}
+				p.lock.Unlock()
+			}
+		})
+	}
+}
+
+func (p *MQTTPublisher) publish(msg tripplite.MQTTMessage) {
+	p.client.Publish(msg.Topic, MQTT_QOS, msg.Retain, msg.Payload)
+}
+
+// Publishes a sample without waiting for the broker. A UPS which lost
+// communication is only marked offline.
+func (p *MQTTPublisher) OnMetrics(m *tripplite.UPSMetrics) bool {
+	if p.client == nil {
+		return false
+	}
+	base := p.Topic + "/" + tripplite.MQTTId(m.Name)
+
+	availability := tripplite.MQTT_ONLINE
+	if m.Communication == tripplite.COMM_LOST {
+		availability = tripplite.MQTT_OFFLINE
+	}
+
+	p.lock.Lock()
+	changed := p.available[m.Name] != availability
+	p.available[m.Name] = availability
+	announce := len(p.Discovery) > 0 && !p.announced[m.Name] && availability == tripplite.MQTT_ONLINE
+	if announce {
+		p.announced[m.Name] = true
+	}
+	p.lock.Unlock()
+
+	if announce {
+		for _, msg := range tripplite.MQTTDiscovery(p.Discovery, base, p.statusTopic(), m) {
+			p.publish(msg)
+		}
+	}
+	if changed {
+		p.publish(tripplite.MQTTMessage{Topic: base + "/availability", Payload: []byte(availability), Retain: true})
+	}
+	if availability == tripplite.MQTT_OFFLINE {
+		return true
+	}
+
+	state, err := json.Marshal(m)
+	if err != nil {
+		log.Error().Err(err).Str("ups", m.Name).Msg("cannot encode metrics")
+		return false
+	}
+	p.publish(tripplite.MQTTMessage{Topic: base + "/state", Payload: state, Retain: p.Retain})
+	for _, msg := range tripplite.MQTTFieldMessages(base, m, p.Retain) {
+		p.publish(msg)
+	}
+	return true
+}
+
+// Sets the status offline and disconnects, the last will is only sent when
+// the connection is lost.
+func (p *MQTTPublisher) Close() error {
+	if p.client == nil {
+		return errors.New("not connected")
+	}
+	if p.client.IsConnected() {
+		p.client.Publish(p.statusTopic(), MQTT_QOS, true, tripplite.MQTT_OFFLINE).WaitTimeout(MQTT_CLOSE_TIMEOUT)
+	}
+	p.client.Disconnect(uint(MQTT_CLOSE_TIMEOUT / time.Millisecond))
+	return nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// A NUT connection idle for this long is closed, upsmon polls every few
+	// seconds on one connection.
+	NUT_IDLE_TIMEOUT = 5 * time.Minute
+	// Longest accepted line from a NUT client.
+	NUT_MAX_LINE = 1024
+)
+
+// A user of the NUT listener, like an entry of upsd.users. Only a primary
+// upsmon may LOGIN as primary and set FSD.
+type NUTUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Upsmon   string `yaml:"upsmon"`
+}
+
+func (u NUTUser) primary() bool {
+	switch strings.ToLower(u.Upsmon) {
+	case "primary", "master":
+		return true
+	}
+	return false
+}
+
+// State of one NUT connection.
+type nutSession struct {
+	remote   string
+	username string
+	password string
+	user     *NUTUser
+	login    string
+}
+
+// Speaks the NUT network protocol (upsd) so NUT's upsmon and upsc can watch
+// the UPSes of the HttpApp.
+type NUTServer struct {
+	Users    []NUTUser
+	app      *HttpApp
+	listener net.Listener
+	lock     sync.Mutex
+	fsd      map[string]bool
+	logins   map[string]int
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+func NewNUTServer(h *HttpApp, users []NUTUser) *NUTServer {
+	return &NUTServer{
+		Users:  users,
+		app:    h,
+		fsd:    map[string]bool{},
+		logins: map[string]int{},
+		conns:  map[net.Conn]bool{},
+	}
+}
+
+func (s *NUTServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	log.Info().Str("address", listener.Addr().String()).Msg("listening for NUT clients")
+	return nil
+}
+
+func (s *NUTServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Accepts connections until Close.
+func (s *NUTServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("NUT listener failed")
+			}
+			return
+		}
+
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *NUTServer) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Whether upsmon forced a shutdown of the UPS. As with upsd the flag stays
+// until the server restarts.
+func (s *NUTServer) FSD(ups string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.fsd[ups]
+}
+
+func (s *NUTServer) handle(conn net.Conn) {
+	sess := &nutSession{remote: conn.RemoteAddr().String()}
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		if len(sess.login) > 0 {
+			s.logins[sess.login]--
+		}
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, NUT_MAX_LINE), NUT_MAX_LINE)
+	for {
+		conn.SetReadDeadline(time.Now().Add(NUT_IDLE_TIMEOUT))
+		if !scanner.Scan() {
+			return
+		}
+		words, ok := tripplite.NUTSplit(scanner.Text())
+		if !ok {
+			words = nil
+		}
+		reply, quit := s.command(sess, words, ok)
+		if _, err := conn.Write([]byte(reply)); err != nil || quit {
+			return
+		}
+	}
+}
+
+func nutError(code string) string {
+	return "ERR " + code + "\n"
+}
+
+// The UPS named by a request and its latest sample, or the NUT error.
+func (s *NUTServer) sample(name string) (*UPS, *tripplite.UPSMetrics, string) {
+	u := s.app.GetUPS(name)
+	if len(name) == 0 || u == nil {
+		return nil, nil, nutError("UNKNOWN-UPS")
+	}
+	m := s.app.LatestMetrics(u)
+	if m == nil || m.Communication == tripplite.COMM_LOST {
+		return u, nil, nutError("DATA-STALE")
+	}
+	return u, m, ""
+}
+
+func (s *NUTServer) description(u *UPS) string {
+	s.app.lock.RLock()
+	info := u.Info()
+	s.app.lock.RUnlock()
+	desc := strings.TrimSpace(info.Manufacturer + " " + info.Product)
+	if len(desc) == 0 {
+		desc = "Tripplite UPS"
+	}
+	return desc
+}
+
+func (s *NUTServer) variables(u *UPS, m *tripplite.UPSMetrics) []tripplite.NUTVariable {
+	vars := tripplite.NUTVariables(m, s.FSD(u.Name))
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
+
+// Runs one command, returning the reply and whether to hang up.
+func (s *NUTServer) command(sess *nutSession, words []string, ok bool) (string, bool) {
+	if !ok {
+		return nutError("INVALID-ARGUMENT"), false
+	}
+	if len(words) == 0 {
+		return nutError("UNKNOWN-COMMAND"), false
+	}
+
+	args := words[1:]
+	switch strings.ToUpper(words[0]) {
+	case "VER", "VERSION":
+		return "Tripplite UPS exporter upsd\n", false
+	case "NETVER", "PROTVER":
+		return tripplite.NUT_PROTOCOL_VERSION + "\n", false
+	case "HELP":
+		return "Commands: HELP VER GET LIST USERNAME PASSWORD LOGIN LOGOUT PRIMARY FSD\n", false
+	case "STARTTLS":
+		return nutError("FEATURE-NOT-CONFIGURED"), false
+	case "LOGOUT":
+		return "OK Goodbye\n", true
+	case "LIST":
+		return s.list(args), false
+	case "GET":
+		return s.get(args), false
+	case "USERNAME":
+		if len(args) != 1 {
+			return nutError("INVALID-ARGUMENT"), false
+		}
+		if len(sess.username) > 0 {
+			return nutError("ALREADY-SET-USERNAME"), false
+		}
+		sess.username = args[0]
+		return "OK\n", false
+	case "PASSWORD":
+		if len(args) != 1 {
+			return nutError("INVALID-ARGUMENT"), false
+		}
+		if len(sess.password) > 0 {
+			return nutError("ALREADY-SET-PASSWORD"), false
+		}
+		sess.password = args[0]
+		return "OK\n", false
+	case "LOGIN":
+		return s.login(sess, args), false
+	case "PRIMARY", "MASTER":
+		if reply := s.authorize(sess, args, true); len(reply) > 0 {
+			return reply, false
+		}
+		return "OK " + strings.ToUpper(words[0]) + "-GRANTED\n", false
+	case "FSD":
+		if reply := s.authorize(sess, args, true); len(reply) > 0 {
+			return reply, false
+		}
+		s.lock.Lock()
+		s.fsd[args[0]] = true
+		s.lock.Unlock()
+		log.Warn().Str("ups", args[0]).Str("user", sess.username).Str("remote", sess.remote).Msg("forced shutdown set by NUT client")
+		return "OK FSD-SET\n", false
+	}
+	return nutError("UNKNOWN-COMMAND"), false
+}
+
+// The NUT user matching the session's credentials.
+func (s *NUTServer) user(sess *nutSession) *NUTUser {
+	for i, u := range s.Users {
+		if u.Username == sess.username && u.Password == sess.password {
+			return &s.Users[i]
+		}
+	}
+	return nil
+}
+
+// Checks the session may act on the UPS named in args, returning the NUT
+// error if not.
+func (s *NUTServer) authorize(sess *nutSession, args []string, primary bool) string {
+	if len(args) != 1 {
+		return nutError("INVALID-ARGUMENT")
+	}
+	if len(sess.username) == 0 {
+		return nutError("USERNAME-REQUIRED")
+	}
+	if len(sess.password) == 0 {
+		return nutError("PASSWORD-REQUIRED")
+	}
+	user := s.user(sess)
+	if user == nil || (primary && !user.primary()) {
+		log.Warn().Str("user", sess.username).Str("remote", sess.remote).Msg("rejected NUT client")
+		return nutError("ACCESS-DENIED")
+	}
+	if len(args[0]) == 0 || s.app.GetUPS(args[0]) == nil {
+		return nutError("UNKNOWN-UPS")
+	}
+	return ""
+}
+
+func (s *NUTServer) login(sess *nutSession, args []string) string {
+	if len(sess.login) > 0 {
+		return nutError("ALREADY-LOGGED-IN")
+	}
+	if reply := s.authorize(sess, args, false); len(reply) > 0 {
+		return reply
+	}
+	sess.login = args[0]
+	s.lock.Lock()
+	s.logins[sess.login]++
+	s.lock.Unlock()
+	log.Info().Str("ups", sess.login).Str("user", sess.username).Str("remote", sess.remote).Msg("NUT client logged in")
+	return "OK\n"
+}
+
+func (s *NUTServer) list(args []string) string {
+	if len(args) == 0 {
+		return nutError("INVALID-ARGUMENT")
+	}
+	out := strings.Builder{}
+	switch strings.ToUpper(args[0]) {
+	case "UPS":
+		out.WriteString("BEGIN LIST UPS\n")
+		for _, u := range s.app.Devices {
+			fmt.Fprintf(&out, "UPS %s %s\n", u.Name, tripplite.NUTQuote(s.description(u)))
+		}
+		out.WriteString("END LIST UPS\n")
+	case "VAR":
+		if len(args) != 2 {
+			return nutError("INVALID-ARGUMENT")
+		}
+		u, m, reply := s.sample(args[1])
+		if m == nil {
+			return reply
+		}
+		fmt.Fprintf(&out, "BEGIN LIST VAR %s\n", u.Name)
+		for _, v := range s.variables(u, m) {
+			fmt.Fprintf(&out, "VAR %s %s %s\n", u.Name, v.Name, tripplite.NUTQuote(v.Value))
+		}
+		fmt.Fprintf(&out, "END LIST VAR %s\n", u.Name)
+	case "CLIENT":
+		if len(args) != 2 {
+			return nutError("INVALID-ARGUMENT")
+		}
+		if s.app.GetUPS(args[1]) == nil || len(args[1]) == 0 {
+			return nutError("UNKNOWN-UPS")
+		}
+		fmt.Fprintf(&out, "BEGIN LIST CLIENT %s\nEND LIST CLIENT %s\n", args[1], args[1])
+	case "RW", "CMD", "ENUM", "RANGE":
+		if len(args) < 2 {
+			return nutError("INVALID-ARGUMENT")
+		}
+		if s.app.GetUPS(args[1]) == nil || len(args[1]) == 0 {
+			return nutError("UNKNOWN-UPS")
+		}
+		// nothing is writable and commands go through /command
+		kind := strings.ToUpper(args[0])
+		rest := strings.Join(args[1:], " ")
+		fmt.Fprintf(&out, "BEGIN LIST %s %s\nEND LIST %s %s\n", kind, rest, kind, rest)
+	default:
+		return nutError("INVALID-ARGUMENT")
+	}
+	return out.String()
+}
+
+func (s *NUTServer) get(args []string) string {
+	if len(args) < 2 {
+		return nutError("INVALID-ARGUMENT")
+	}
+	switch strings.ToUpper(args[0]) {
+	case "NUMLOGINS":
+		u := s.app.GetUPS(args[1])
+		if u == nil || len(args[1]) == 0 {
+			return nutError("UNKNOWN-UPS")
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return fmt.Sprintf("NUMLOGINS %s %d\n", u.Name, s.logins[u.Name])
+	case "UPSDESC":
+		u := s.app.GetUPS(args[1])
+		if u == nil || len(args[1]) == 0 {
+			return nutError("UNKNOWN-UPS")
+		}
+		return fmt.Sprintf("UPSDESC %s %s\n", u.Name, tripplite.NUTQuote(s.description(u)))
+	case "VAR", "TYPE", "DESC":
+		if len(args) != 3 {
+			return nutError("INVALID-ARGUMENT")
+		}
+		u, m, reply := s.sample(args[1])
+		if m == nil {
+			return reply
+		}
+		for _, v := range s.variables(u, m) {
+			if v.Name != args[2] {
+				continue
+			}
+			switch strings.ToUpper(args[0]) {
+			case "TYPE":
+				kind := "STRING:64"
+				if tripplite.NUTNumeric(v.Name) {
+					kind = "NUMBER"
+				}
+				return fmt.Sprintf("TYPE %s %s %s\n", u.Name, v.Name, kind)
+			case "DESC":
+				return fmt.Sprintf("DESC %s %s %s\n", u.Name, v.Name, tripplite.NUTQuote("Description unavailable"))
+			}
+			return fmt.Sprintf("VAR %s %s %s\n", u.Name, v.Name, tripplite.NUTQuote(v.Value))
+		}
+		return nutError("VAR-NOT-SUPPORTED")
+	}
+	return nutError("INVALID-ARGUMENT")
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	PUSH_INFLUX       = "influx"
+	PUSH_INFLUX_UDP   = "influx_udp"
+	PUSH_REMOTE_WRITE = "remote_write"
+)
+
+var (
+	PUSH_BATCH_SIZE     = 100
+	PUSH_FLUSH_INTERVAL = 10 * time.Second
+	PUSH_BUFFER_SIZE    = 10000
+	PUSH_TIMEOUT        = 10 * time.Second
+	// Longest wait between retries while a sink is down.
+	PUSH_MAX_BACKOFF = 5 * time.Minute
+	// Largest UDP datagram sent to Influx, lines are never split.
+	PUSH_UDP_PAYLOAD = 1400
+)
+
+// A push destination for samples. Zero values for batch_size,
+// flush_interval, buffer_size and timeout take the defaults.
+type PushSettings struct {
+	Type          string                `yaml:"type"`
+	URL           string                `yaml:"url"`
+	Username      string                `yaml:"username"`
+	Password      string                `yaml:"password"`
+	Token         string                `yaml:"token"`
+	Headers       map[string]string     `yaml:"headers"`
+	BatchSize     int                   `yaml:"batch_size"`
+	FlushInterval time.Duration         `yaml:"flush_interval"`
+	BufferSize    int                   `yaml:"buffer_size"`
+	Timeout       time.Duration         `yaml:"timeout"`
+	Fields        tripplite.FieldFilter `yaml:"fields"`
+}
+
+// A batch the sink refused, sending it again would not help.
+type pushRejected struct {
+	status int
+	body   string
+}
+
+func (e pushRejected) Error() string {
+	return fmt.Sprintf("rejected with status %d: %s", e.status, e.body)
+}
+
+// Pushes samples to InfluxDB or a Prometheus remote-write endpoint. Samples
+// are buffered and sent in batches every flush interval or once a batch is
+// full. While the sink is down the buffer keeps up to buffer_size samples,
+// dropping the oldest, and sending is retried with a growing backoff.
+type PushSink struct {
+	PushSettings
+	client  *http.Client
+	encode  func([]*tripplite.UPSMetrics) []byte
+	send    func([]byte) error
+	lock    sync.Mutex
+	buffer  []*tripplite.UPSMetrics
+	dropped int
+	flush   chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func NewPushSink(s PushSettings) (*PushSink, error) {
+	if len(s.URL) == 0 {
+		return nil, errors.New("push sink without url")
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = PUSH_BATCH_SIZE
+	}
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = PUSH_FLUSH_INTERVAL
+	}
+	if s.BufferSize < s.BatchSize {
+		s.BufferSize = PUSH_BUFFER_SIZE
+	}
+	if s.Timeout <= 0 {
+		s.Timeout = PUSH_TIMEOUT
+	}
+
+	p := &PushSink{
+		PushSettings: s,
+		client:       &http.Client{Timeout: s.Timeout},
+		buffer:       []*tripplite.UPSMetrics{},
+		flush:        make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	switch strings.ToLower(s.Type) {
+	case PUSH_INFLUX:
+		p.encode = p.encodeInflux
+		p.send = func(body []byte) error {
+			return p.post(body, map[string]string{"Content-Type": tripplite.INFLUX_CONTENT_TYPE}, "Token")
+		}
+	case PUSH_INFLUX_UDP:
+		p.encode = p.encodeInflux
+		p.send = p.sendUDP
+	case PUSH_REMOTE_WRITE:
+		p.encode = p.encodeRemoteWrite
+		p.send = func(body []byte) error {
+			return p.post(body, map[string]string{
+				"Content-Type":                      tripplite.REMOTE_WRITE_CONTENT_TYPE,
+				"Content-Encoding":                  "snappy",
+				"X-Prometheus-Remote-Write-Version": tripplite.REMOTE_WRITE_VERSION,
+			}, "Bearer")
+		}
+	default:
+		return nil, fmt.Errorf("unknown push sink type %q", s.Type)
+	}
+	return p, nil
+}
+
+func (p *PushSink) encodeInflux(batch []*tripplite.UPSMetrics) []byte {
+	buf := bytes.Buffer{}
+	for _, m := range batch {
+		tripplite.WriteInfluxLine(&buf, m, p.Fields)
+	}
+	return buf.Bytes()
+}
+
+func (p *PushSink) encodeRemoteWrite(batch []*tripplite.UPSMetrics) []byte {
+	series := []tripplite.RemoteWriteSeries{}
+	for _, m := range batch {
+		series = append(series, tripplite.RemoteWriteSamples(m, p.Fields)...)
+	}
+	return snappy.Encode(nil, tripplite.EncodeRemoteWrite(series))
+}
+
+// POSTs a batch, server errors and 429 are retried, other errors reject it.
+func (p *PushSink) post(body []byte, headers map[string]string, scheme string) error {
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	for key, val := range p.Headers {
+		req.Header.Set(key, val)
+	}
+	if len(p.Token) > 0 {
+		req.Header.Set("Authorization", scheme+" "+p.Token)
+	} else if len(p.Username) > 0 {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("status %d: %s", res.StatusCode, msg)
+	}
+	return pushRejected{res.StatusCode, string(msg)}
+}
+
+// Sends lines in datagrams of up to PUSH_UDP_PAYLOAD bytes.
+func (p *PushSink) sendUDP(body []byte) error {
+	conn, err := net.DialTimeout("udp", strings.TrimPrefix(p.URL, "udp://"), p.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for len(body) > 0 {
+		n := len(body)
+		if n > PUSH_UDP_PAYLOAD {
+			if i := bytes.LastIndexByte(body[:PUSH_UDP_PAYLOAD], '\n'); i >= 0 {
+				n = i + 1
+			} else if i := bytes.IndexByte(body, '\n'); i >= 0 {
+				n = i + 1
+			}
+		}
+		if _, err := conn.Write(body[:n]); err != nil {
+			return err
+		}
+		body = body[n:]
+	}
+	return nil
+}
+
+// Buffers a sample, a full batch is sent right away.
+func (p *PushSink) OnMetrics(m *tripplite.UPSMetrics) bool {
+	p.lock.Lock()
+	p.buffer = append(p.buffer, m)
+	if over := len(p.buffer) - p.BufferSize; over > 0 {
+		if p.dropped == 0 {
+			log.Warn().Str("sink", p.URL).Msg("push buffer full, dropping the oldest samples")
+		}
+		p.buffer = p.buffer[over:]
+		p.dropped += over
+	}
+	full := len(p.buffer) >= p.BatchSize
+	p.lock.Unlock()
+
+	if full {
+		select {
+		case p.flush <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// Number of samples waiting to be sent.
+func (p *PushSink) Pending() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.buffer)
+}
+
+// Sends the buffer batch by batch. A failed batch is put back and the error
+// returned, rejected batches are dropped.
+func (p *PushSink) Flush() error {
+	for {
+		p.lock.Lock()
+		n := len(p.buffer)
+		if n > p.BatchSize {
+			n = p.BatchSize
+		}
+		batch := p.buffer[:n:n]
+		p.buffer = p.buffer[n:]
+		p.lock.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		err := p.send(p.encode(batch))
+		if rejected, ok := err.(pushRejected); ok {
+			log.Error().Err(rejected).Str("sink", p.URL).Int("samples", n).Msg("push sink rejected samples")
+			continue
+		}
+		if err != nil {
+			p.lock.Lock()
+			p.buffer = append(batch, p.buffer...)
+			if over := len(p.buffer) - p.BufferSize; over > 0 {
+				p.buffer = p.buffer[over:]
+				p.dropped += over
+			}
+			p.lock.Unlock()
+			return err
+		}
+
+		p.lock.Lock()
+		if p.dropped > 0 {
+			log.Warn().Str("sink", p.URL).Int("dropped", p.dropped).Msg("push sink recovered")
+			p.dropped = 0
+		}
+		p.lock.Unlock()
+	}
+}
+
+// Flushes every flush interval and on full batches until Close, retrying a
+// failing sink with a doubling backoff.
+func (p *PushSink) Start() {
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(p.FlushInterval)
+		defer ticker.Stop()
+		backoff := time.Duration(0)
+		retry := time.Time{}
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+			case <-p.flush:
+			}
+			if time.Now().Before(retry) {
+				continue
+			}
+			if err := p.Flush(); err != nil {
+				backoff *= 2
+				if backoff < p.FlushInterval {
+					backoff = p.FlushInterval
+				}
+				if backoff > PUSH_MAX_BACKOFF {
+					backoff = PUSH_MAX_BACKOFF
+				}
+				retry = time.Now().Add(backoff)
+				log.Warn().Err(err).Str("sink", p.URL).Int("pending", p.Pending()).Dur("retry", backoff).Msg("push failed")
+				continue
+			}
+			backoff = 0
+			retry = time.Time{}
+		}
+	}()
+}
+
+// Stops flushing and makes a last attempt to send what is buffered.
+func (p *PushSink) Close() error {
+	close(p.done)
+	<-p.stopped
+	return p.Flush()
+}
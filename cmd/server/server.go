@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/matutter/tripplite/pkg/tripplite"
@@ -36,40 +39,71 @@ type UPSMetricsListener interface {
 }
 
 type HttpApp struct {
-	History        []*tripplite.UPSMetrics
-	Limit          int
+	Devices        []*UPS
 	LastError      error
 	Server         *http.Server
-	Delay          time.Duration
 	Secret         []byte
 	Listeners      []UPSMetricsListener
+	EventListeners []PowerEventListener
+	Stream         *Broadcaster
+	Clients        *ClientRegistry
+	NUT            *NUTServer
+	SNMP           *SNMPAgent
+	MQTT           *MQTTPublisher
+	Sinks          []*PushSink
+	Mailer         *tripplite.Mailer
+	Replays        ReplayCache
 	CachedResponse map[string]interface{}
 	ChangeId       string
+	lock           sync.RWMutex
+	listenerLock   sync.Mutex
 }
 
-func NewHttpApp(limit int, delay time.Duration, secret string) *HttpApp {
-	if limit < 1 {
-		limit = 1
-	}
+func NewHttpApp(secret string) *HttpApp {
 	m := HttpApp{
-		History:        make([]*tripplite.UPSMetrics, 0, limit),
-		Limit:          limit,
+		Devices:        []*UPS{},
 		LastError:      nil,
 		Server:         nil,
-		Delay:          delay,
 		Secret:         []byte(secret),
 		Listeners:      []UPSMetricsListener{},
+		EventListeners: []PowerEventListener{},
+		Stream:         NewBroadcaster([]byte(secret)),
+		Clients:        NewClientRegistry(CLIENT_TIMEOUT, CLIENT_WAIT),
 		CachedResponse: map[string]interface{}{},
 		ChangeId:       strconv.FormatInt(time.Now().Unix(), 10),
 	}
+	m.Listeners = append(m.Listeners, m.Stream)
+	m.EventListeners = append(m.EventListeners, m.Stream, m.Clients)
 	return &m
 }
 
-func (h HttpApp) HMACEnabled() bool {
+func (h *HttpApp) AddUPS(name string, limit int, delay time.Duration) *UPS {
+	u := NewUPS(name, limit, delay)
+	h.Devices = append(h.Devices, u)
+	return u
+}
+
+// Finds a UPS by name, an empty name selects the first configured UPS.
+func (h *HttpApp) GetUPS(name string) *UPS {
+	if len(name) == 0 {
+		if len(h.Devices) == 0 {
+			return nil
+		}
+		return h.Devices[0]
+	}
+	for _, u := range h.Devices {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (h *HttpApp) HMACEnabled() bool {
 	return len(h.GetSecret()) > 0
 }
 
-func (h HttpApp) GetSecret() []byte {
+func (h *HttpApp) GetSecret() []byte {
 	return h.Secret
 }
 
@@ -77,11 +111,15 @@ func (h *HttpApp) SetChangeId(id string) {
 	h.ChangeId = id
 }
 
-func (h HttpApp) IsStale() bool {
+func (h *HttpApp) IsStale() bool {
 	return false
 }
 
 func (h *HttpApp) sendJSON(o interface{}, w http.ResponseWriter) {
+	h.sendJSONStatus(o, http.StatusOK, w)
+}
+
+func (h *HttpApp) sendJSONStatus(o interface{}, status int, w http.ResponseWriter) {
 	if o == nil {
 		w.WriteHeader(http.StatusNoContent)
 	} else {
@@ -92,12 +130,37 @@ func (h *HttpApp) sendJSON(o interface{}, w http.ResponseWriter) {
 			w.WriteHeader(http.StatusInternalServerError)
 		} else {
 			tripplite.SetHMACHeaders(h, data, w)
+			w.WriteHeader(status)
 			w.Write(data)
-			w.WriteHeader(http.StatusOK)
 		}
 	}
 }
 
+func (h *HttpApp) sendPrometheus(samples []*tripplite.UPSMetrics, w http.ResponseWriter) {
+	buf := bytes.Buffer{}
+	err := tripplite.WritePrometheusMetrics(&buf, samples)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", tripplite.PROMETHEUS_CONTENT_TYPE)
+	w.Write(buf.Bytes())
+}
+
+// JSON stays the default for existing consumers, the exposition format is
+// served to scrapers which ask for it (Prometheus sends text/plain or
+// openmetrics-text) or when forced with ?format=prometheus.
+func wantsPrometheus(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "json":
+		return false
+	case "prometheus", "text":
+		return true
+	}
+	accept := strings.ToLower(r.Header.Get("Accept"))
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
 func (h *HttpApp) Middleware(methods []string, handler http.HandlerFunc) http.HandlerFunc {
 	meth := map[string]bool{}
 	for _, m := range methods {
@@ -112,31 +175,76 @@ func (h *HttpApp) Middleware(methods []string, handler http.HandlerFunc) http.Ha
 	}
 }
 
-func (h *HttpApp) LatestMetrics() *tripplite.UPSMetrics {
-	l := len(h.History)
-	if l == 0 {
-		return nil
+// Resolves the UPS named by the ?ups= query parameter, replying 404 when there
+// is no such UPS.
+func (h *HttpApp) Scoped(handler func(http.ResponseWriter, *http.Request, *UPS)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := h.GetUPS(r.URL.Query().Get("ups"))
+		if u == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		handler(w, r, u)
 	}
-	return h.History[l-1]
 }
 
-func (h *HttpApp) appendMetrics(m *tripplite.UPSMetrics) {
-	if len(h.History) >= h.Limit {
-		h.History = append(h.History[1:], m)
+func (h *HttpApp) LatestMetrics(u *UPS) *tripplite.UPSMetrics {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return u.LatestMetrics()
+}
+
+// Latest sample of every UPS which has reported at least once.
+func (h *HttpApp) AllLatestMetrics() []*tripplite.UPSMetrics {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	samples := []*tripplite.UPSMetrics{}
+	for _, u := range h.Devices {
+		if m := u.LatestMetrics(); m != nil {
+			samples = append(samples, m)
+		}
 	}
-	h.History = append(h.History, m)
+	return samples
+}
+
+func (h *HttpApp) appendMetrics(u *UPS, m *tripplite.UPSMetrics) {
+	m.Name = u.Name
+
+	h.lock.Lock()
+	u.append(m)
+	events := u.Detector.Observe(m)
+	u.recordEvents(events)
+	h.lock.Unlock()
+
+	h.publishEvents(events, u)
+
+	if u.Store != nil {
+		if err := u.Store.Append(m); err != nil {
+			log.Error().Err(err).Str("ups", u.Name).Msg("failed to store metrics")
+		}
+	}
+
+	for _, listener := range u.Listeners {
+		listener.OnMetrics(m)
+	}
+
+	h.listenerLock.Lock()
+	defer h.listenerLock.Unlock()
 	for _, listener := range h.Listeners {
 		listener.OnMetrics(m)
 	}
 }
 
-func (h HttpApp) GetConfigResponse() interface{} {
+func (h *HttpApp) GetConfigResponse(u *UPS) interface{} {
 	scripts := []tripplite.PublicScript{}
-	for _, listener := range h.Listeners {
+	for _, listener := range u.Listeners {
 		switch t := listener.(type) {
 		case *tripplite.Watcher:
 			w := listener.(*tripplite.Watcher)
 			for _, script := range w.Scripts {
+				if len(script.Action) > 0 && !strings.EqualFold(script.Action, tripplite.ACTION_SCRIPT) {
+					continue
+				}
 				if script.Public || script.RemoteOnly {
 					scripts = append(scripts, script.ToPublicScript())
 				}
@@ -147,43 +255,83 @@ func (h HttpApp) GetConfigResponse() interface{} {
 	}
 	return tripplite.PublicConfig{
 		Scripts: scripts,
-		Delay:   h.Delay.String(),
+		Delay:   u.Delay.String(),
 	}
 }
 
-func (h *HttpApp) GetConfigCached() interface{} {
-	if cached, ok := h.CachedResponse["config"]; ok {
+func (h *HttpApp) GetConfigCached(u *UPS) interface{} {
+	key := "config:" + u.Name
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if cached, ok := h.CachedResponse[key]; ok {
 		return cached
 	}
-	data := h.GetConfigResponse()
-	h.CachedResponse["config"] = data
+	data := h.GetConfigResponse(u)
+	h.CachedResponse[key] = data
 	return data
 }
 
-func (h *HttpApp) StartServer(addr string) {
+func (h *HttpApp) Handler() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/metrics", http.StatusMovedPermanently)
 	})
 
+	// Without ?ups= scrapers get every UPS, JSON consumers get the first UPS.
 	mux.HandleFunc("/metrics", h.Middleware([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
-		m := h.LatestMetrics()
-		h.sendJSON(m, w)
+		name := r.URL.Query().Get("ups")
+		if wantsPrometheus(r) && len(name) == 0 {
+			h.sendPrometheus(h.AllLatestMetrics(), w)
+			return
+		}
+		h.Scoped(func(w http.ResponseWriter, r *http.Request, u *UPS) {
+			m := h.LatestMetrics(u)
+			if wantsPrometheus(r) {
+				h.sendPrometheus([]*tripplite.UPSMetrics{m}, w)
+			} else {
+				h.sendJSON(m, w)
+			}
+		})(w, r)
 	}))
 
-	mux.HandleFunc("/history", h.Middleware([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
-		l := len(h.History)
-		limit := parseIntQuery(r, "limit", h.Limit, l, 0)
-		h.sendJSON(h.History[:limit], w)
-	}))
+	mux.HandleFunc("/metrics.json", h.Middleware([]string{http.MethodGet}, h.Scoped(func(w http.ResponseWriter, r *http.Request, u *UPS) {
+		m := h.LatestMetrics(u)
+		h.sendJSON(m, w)
+	})))
+
+	mux.HandleFunc("/history", h.Middleware([]string{http.MethodGet}, h.Scoped(h.handleHistory)))
+
+	mux.HandleFunc("/events", h.Middleware([]string{http.MethodGet}, h.Scoped(h.handleEvents)))
+
+	mux.HandleFunc("/stream", h.Middleware([]string{http.MethodGet}, h.handleStream))
+
+	mux.HandleFunc("/ws", h.Middleware([]string{http.MethodGet}, h.handleSocket))
+
+	mux.HandleFunc("/clients", h.Middleware([]string{http.MethodGet, http.MethodPost}, h.handleClients))
 
-	mux.HandleFunc("/config", h.Middleware([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
-		conf := h.GetConfigCached()
+	mux.HandleFunc("/config", h.Middleware([]string{http.MethodGet}, h.Scoped(func(w http.ResponseWriter, r *http.Request, u *UPS) {
+		conf := h.GetConfigCached(u)
 		h.sendJSON(conf, w)
+	})))
+
+	mux.HandleFunc("/command", h.Middleware([]string{http.MethodPost}, h.Scoped(h.handleCommand)))
+
+	mux.HandleFunc("/ups", h.Middleware([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
+		h.lock.RLock()
+		devices := []UPSInfo{}
+		for _, u := range h.Devices {
+			devices = append(devices, u.Info())
+		}
+		h.lock.RUnlock()
+		h.sendJSON(devices, w)
 	}))
 
-	h.Server = &http.Server{Addr: addr, Handler: mux}
+	return mux
+}
+
+func (h *HttpApp) StartServer(addr string) {
+	h.Server = &http.Server{Addr: addr, Handler: h.Handler()}
 
 	log.Info().Str("address", addr).Msg("listening for requests")
 	if err := h.Server.ListenAndServe(); err != nil {
@@ -199,6 +347,26 @@ func (h *HttpApp) StartServer(addr string) {
 func (h *HttpApp) StopServer() {
 	server := h.Server
 	h.Server = nil
+	h.Stream.Close()
+	if h.NUT != nil {
+		h.NUT.Close()
+	}
+	if h.SNMP != nil {
+		h.SNMP.Close()
+	}
+	if h.MQTT != nil {
+		h.MQTT.Close()
+	}
+	if h.Mailer != nil {
+		if err := h.Mailer.Flush(); err != nil {
+			log.Error().Err(err).Msg("failed to send alert digest")
+		}
+	}
+	for _, sink := range h.Sinks {
+		if err := sink.Close(); err != nil {
+			log.Error().Err(err).Str("sink", sink.URL).Int("pending", sink.Pending()).Msg("failed to push remaining samples")
+		}
+	}
 	if server != nil {
 		go func() {
 			if err := server.Shutdown(context.Background()); err != nil {
@@ -208,27 +376,83 @@ func (h *HttpApp) StopServer() {
 	}
 }
 
-func (h *HttpApp) PollMetrics(mon *tripplite.SmartProUPSMonitor) {
+// Opens the UPS if needed and appends its samples until done is closed.
+func (h *HttpApp) pollUPS(u *UPS, done <-chan struct{}) {
 	var err error
-	var sig os.Signal
 	var m *tripplite.UPSMetrics
 
-	metrics, errors := mon.OpenStream(h.Delay)
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
+	// closed even when the device never opens
+	if u.Store != nil {
+		defer u.Store.Close()
+	}
+	if u.EventLog != nil {
+		defer u.EventLog.Close()
+	}
+
+	mon := u.Monitor
+	if mon == nil {
+		mon = u.openWithRetry(done)
+		if mon == nil {
+			return
+		}
+	}
+	mon.Name = u.Name
+
+	h.lock.Lock()
+	u.Monitor = mon
+	h.lock.Unlock()
+
+	for _, listener := range u.Listeners {
+		if w, ok := listener.(*tripplite.Watcher); ok {
+			w.SetSwitcher(mon)
+		}
+	}
+
+	log.Info().
+		Str("ups", u.Name).
+		Str("manufacturer", mon.Manufacturer).
+		Str("product", mon.Product).
+		Str("serial", mon.Serial).
+		Str("protocol", mon.ProtocolName).
+		Dur("delay", u.Delay).
+		Msg("polling")
+
+	metrics, errors := mon.OpenStream(u.Delay)
+	defer mon.Close()
 
 	for mon.IsStreaming() {
 		select {
-		case sig = <-signals:
-			log.Info().Str("signal", sig.String()).Msg("recieved keyboard interrupt")
+		case <-done:
 			mon.CloseStream()
-			h.StopServer()
 		case err = <-errors:
-			log.Error().Err(err).Msg("error gathering metrics")
+			log.Error().Err(err).Str("ups", u.Name).Msg("error gathering metrics")
 		case m = <-metrics:
 			log.Info().Interface("metrics", m).Send()
-			h.appendMetrics(m)
+			h.appendMetrics(u, m)
 		}
 	}
+}
+
+// Polls every UPS in its own goroutine, blocks until SIGINT.
+func (h *HttpApp) PollMetrics() {
+	var sig os.Signal
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for _, u := range h.Devices {
+		wg.Add(1)
+		go func(u *UPS) {
+			defer wg.Done()
+			h.pollUPS(u, done)
+		}(u)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	sig = <-signals
+	log.Info().Str("signal", sig.String()).Msg("recieved keyboard interrupt")
 
+	close(done)
+	h.StopServer()
+	wg.Wait()
 }
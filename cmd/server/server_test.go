@@ -0,0 +1,1127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	packets "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/golang/snappy"
+	"github.com/gorilla/websocket"
+	"github.com/gosnmp/gosnmp"
+	"github.com/matutter/tripplite/pkg/tripplite"
+)
+
+func TestMetricsContentNegotiation(t *testing.T) {
+	h := NewHttpApp("")
+	h.appendMetrics(h.AddUPS("ups", 10, time.Second), &tripplite.UPSMetrics{Status: "OL", BatteryCharge: 100, VendorID: "09ae"})
+	handler := h.Handler()
+
+	tests := []struct {
+		path        string
+		accept      string
+		contentType string
+	}{
+		{"/metrics", "", "application/json"},
+		{"/metrics", "*/*", "application/json"},
+		{"/metrics", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1", tripplite.PROMETHEUS_CONTENT_TYPE},
+		{"/metrics?format=prometheus", "", tripplite.PROMETHEUS_CONTENT_TYPE},
+		{"/metrics?format=json", "text/plain", "application/json"},
+		{"/metrics.json", "text/plain", "application/json"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if len(test.accept) > 0 {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if ct := rec.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s (Accept: %q): expected Content-Type %q, got %q", test.path, test.accept, test.contentType, ct)
+		}
+		if test.contentType == tripplite.PROMETHEUS_CONTENT_TYPE && !strings.Contains(rec.Body.String(), "tripplite_battery_charge_percent") {
+			t.Errorf("%s: missing metrics in body:\n%s", test.path, rec.Body.String())
+		}
+	}
+}
+
+func TestServerWithMemoryTransport(t *testing.T) {
+	replies := map[byte]string{
+		0:   "\x00\x30\x03",
+		'D': "D7880",
+		'L': "L1E",
+		'S': "S1001",
+		'V': "V1022",
+	}
+	transport := tripplite.NewMemoryTransport(func(cmd []byte) []byte {
+		if reply, ok := replies[cmd[0]]; ok {
+			return []byte(reply)
+		}
+		return nil
+	})
+
+	mon, err := tripplite.NewSmartProUPSMonitorWithTransport(transport, tripplite.DeviceInfo{VendorId: 0x09ae, ProductId: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	m, err := mon.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHttpApp("")
+	h.appendMetrics(h.AddUPS("ups", 10, time.Second), m)
+
+	rec := httptest.NewRecorder()
+	h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	res := tripplite.UPSMetrics{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "OB" || res.Load != 30 || res.BatteryVoltage != 12.8 {
+		t.Errorf("unexpected metrics %+v", res)
+	}
+}
+
+func TestMultipleUPS(t *testing.T) {
+	h := NewHttpApp("")
+	a := h.AddUPS("rack-a", 10, time.Second)
+	b := h.AddUPS("rack-b", 10, time.Second)
+	h.appendMetrics(a, &tripplite.UPSMetrics{Status: "OL", Load: 10})
+	h.appendMetrics(b, &tripplite.UPSMetrics{Status: "OB", Load: 20})
+	h.appendMetrics(b, &tripplite.UPSMetrics{Status: "OB", Load: 21})
+	handler := h.Handler()
+
+	get := func(path string, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if len(accept) > 0 {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		path string
+		name string
+		load uint
+	}{
+		{"/metrics", "rack-a", 10},
+		{"/metrics?ups=rack-a", "rack-a", 10},
+		{"/metrics?ups=rack-b", "rack-b", 21},
+		{"/metrics.json?ups=rack-b", "rack-b", 21},
+	}
+
+	for _, test := range tests {
+		res := tripplite.UPSMetrics{}
+		if err := json.Unmarshal(get(test.path, "").Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Name != test.name || res.Load != test.load {
+			t.Errorf("%s: expected %s with load %d, got %+v", test.path, test.name, test.load, res)
+		}
+	}
+
+	if rec := get("/metrics?ups=rack-c", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown ups, got %d", rec.Code)
+	}
+
+	history := []tripplite.UPSMetrics{}
+	if err := json.Unmarshal(get("/history?ups=rack-b&limit=10", "").Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Errorf("expected 2 samples for rack-b, got %d", len(history))
+	}
+
+	body := get("/metrics", "text/plain").Body.String()
+	for _, name := range []string{"rack-a", "rack-b"} {
+		if !strings.Contains(body, `tripplite_load_percent{ups="`+name+`"`) {
+			t.Errorf("missing %s in prometheus output:\n%s", name, body)
+		}
+	}
+	body = get("/metrics?ups=rack-b", "text/plain").Body.String()
+	if strings.Contains(body, "rack-a") {
+		t.Errorf("unexpected rack-a in scoped prometheus output:\n%s", body)
+	}
+
+	devices := []UPSInfo{}
+	if err := json.Unmarshal(get("/ups", "").Body.Bytes(), &devices); err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[1].Name != "rack-b" || devices[1].Status != "OB" {
+		t.Errorf("unexpected devices %+v", devices)
+	}
+}
+
+func TestCommandEndpoint(t *testing.T) {
+	replies := map[byte]string{
+		0:   "\x00\x30\x03",
+		'A': "A",
+	}
+	transport := tripplite.NewMemoryTransport(func(cmd []byte) []byte {
+		if reply, ok := replies[cmd[0]]; ok {
+			return []byte(reply)
+		}
+		return nil
+	})
+	mon, err := tripplite.NewSmartProUPSMonitorWithTransport(transport, tripplite.DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	secret := []byte("secret")
+	sign := func(body []byte) string {
+		return base64.RawStdEncoding.EncodeToString(tripplite.ComputeHMAC(secret, body))
+	}
+	body := func(command string, ts time.Time) []byte {
+		data, _ := json.Marshal(tripplite.CommandRequest{UPS: "ups", Command: command, Timestamp: ts.Unix(), Nonce: tripplite.NewNonce()})
+		return data
+	}
+
+	post := func(h *HttpApp, path string, data []byte, mac string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+		req.Header.Set(tripplite.HTTP_CONTENT_HASH_HEADER, mac)
+		rec := httptest.NewRecorder()
+		h.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	open := NewHttpApp("")
+	open.AddUPS("ups", 10, time.Second).Monitor = mon
+	test := body(tripplite.CMD_TEST_BATTERY_START, time.Now())
+	if rec := post(open, "/command", test, sign(test)); rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without secret, got %d", rec.Code)
+	}
+
+	h := NewHttpApp(string(secret))
+	h.AddUPS("ups", 10, time.Second).Monitor = mon
+
+	stale := body(tripplite.CMD_TEST_BATTERY_START, time.Now().Add(-time.Hour))
+	unknown := body("beeper.toggle", time.Now())
+	elsewhere, _ := json.Marshal(tripplite.CommandRequest{UPS: "spare", Command: tripplite.CMD_TEST_BATTERY_START, Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce()})
+	unique, _ := json.Marshal(tripplite.CommandRequest{UPS: "ups", Command: tripplite.CMD_TEST_BATTERY_START, Timestamp: time.Now().Unix()})
+	tests := []struct {
+		path   string
+		data   []byte
+		mac    string
+		status int
+	}{
+		{"/command", test, "", http.StatusUnauthorized},
+		{"/command", test, sign([]byte("other")), http.StatusUnauthorized},
+		{"/command", stale, sign(stale), http.StatusUnauthorized},
+		{"/command", unknown, sign(unknown), http.StatusBadRequest},
+		{"/command?ups=other", test, sign(test), http.StatusNotFound},
+		{"/command?ups=ups", elsewhere, sign(elsewhere), http.StatusForbidden},
+		{"/command?ups=ups", unique, sign(unique), http.StatusBadRequest},
+		{"/command?ups=ups", test, sign(test), http.StatusOK},
+		{"/command?ups=ups", test, sign(test), http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		if rec := post(h, test.path, test.data, test.mac); rec.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d %s", test.path, test.data, test.status, rec.Code, rec.Body.String())
+		}
+	}
+
+	last := transport.Sent[len(transport.Sent)-1]
+	if len(last) != 1 || last[0] != 'A' {
+		t.Errorf("expected self-test to be sent, got % x", last)
+	}
+}
+
+func TestHistoryStore(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() (*HttpApp, *UPS) {
+		store, err := tripplite.OpenMetricsStore(dir, tripplite.StoreRetention{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := NewHttpApp("")
+		u := h.AddUPS("ups", 3, time.Second)
+		u.Store = store
+		if err := u.Restore(); err != nil {
+			t.Fatal(err)
+		}
+		return h, u
+	}
+
+	h, u := open()
+	for i := 1; i <= 5; i++ {
+		h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OB", Load: uint(i), UnixTimestamp: int64(i)})
+	}
+	u.Store.Close()
+
+	// a restarted server keeps the newest samples
+	h, u = open()
+	defer u.Store.Close()
+	if len(u.History) != 3 || u.LatestMetrics().Load != 5 {
+		t.Errorf("unexpected restored history %+v", u.History)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history", nil))
+	history := []tripplite.UPSMetrics{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Load != 5 {
+		t.Errorf("expected newest first, got %+v", history)
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h := NewHttpApp("")
+	u := h.AddUPS("ups", 1000, time.Second)
+	for i := 0; i < 120; i++ {
+		h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OL", Load: uint(i % 10), BatteryCharge: 100, UnixTimestamp: int64(1000 + i)})
+	}
+
+	query := func(path string) ([]map[string]interface{}, int) {
+		rec := httptest.NewRecorder()
+		h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		records := []map[string]interface{}{}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return records, rec.Code
+	}
+
+	records, _ := query("/history?limit=2")
+	if len(records) != 2 || records[0]["UnixTimestamp"] != 1119.0 {
+		t.Errorf("expected the newest 2 samples, got %v", records)
+	}
+
+	records, _ = query("/history?from=1010&to=1019&order=asc&fields=load")
+	if len(records) != 10 || records[0]["UnixTimestamp"] != 1010.0 || len(records[0]) != 3 {
+		t.Errorf("unexpected range %v", records)
+	}
+
+	records, _ = query("/history?step=1m&agg=avg,Load:max&fields=Load,BatteryCharge")
+	if len(records) != 3 || records[0]["UnixTimestamp"] != 1080.0 || records[0]["Load"] != 9.0 || records[0]["BatteryCharge"] != 100.0 {
+		t.Errorf("unexpected downsampled history %v", records)
+	}
+
+	for _, path := range []string{"/history?from=yesterday", "/history?step=often", "/history?agg=median", "/history?order=random"} {
+		if _, code := query(path); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, code)
+		}
+	}
+}
+
+type testEventListener struct {
+	events []tripplite.PowerEvent
+}
+
+func (l *testEventListener) OnEvent(e tripplite.PowerEvent) {
+	l.events = append(l.events, e)
+}
+
+func TestEventsEndpoint(t *testing.T) {
+	h := NewHttpApp("")
+	u := h.AddUPS("ups", 10, time.Second)
+	store, err := tripplite.OpenEventStore(t.TempDir(), tripplite.StoreRetention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	u.EventLog = store
+	listener := &testEventListener{}
+	h.EventListeners = append(h.EventListeners, listener)
+
+	for i, status := range []string{"OL", "OB", "OB", "OL", "OB"} {
+		h.appendMetrics(u, &tripplite.UPSMetrics{Status: status, UnixTimestamp: int64(1000 + i*10)})
+	}
+	if len(listener.events) != 4 {
+		t.Errorf("expected 4 events published, got %+v", listener.events)
+	}
+
+	query := func(path string) ([]tripplite.PowerEvent, int) {
+		rec := httptest.NewRecorder()
+		h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		events := []tripplite.PowerEvent{}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return events, rec.Code
+	}
+
+	events, _ := query("/events")
+	if len(events) != 3 || events[0].Type != tripplite.EVENT_ON_BATTERY || !events[0].Active || events[0].Duration <= 0 {
+		t.Errorf("expected the active outage first, got %+v", events)
+	}
+
+	events, _ = query("/events?type=back_on_line")
+	if len(events) != 1 || events[0].Duration != 20 {
+		t.Errorf("unexpected back on line events %+v", events)
+	}
+
+	events, _ = query("/events?from=1035&to=1100")
+	if len(events) != 1 || events[0].Start != 1040 {
+		t.Errorf("unexpected events from the log %+v", events)
+	}
+
+	if _, code := query("/events?type=meteor"); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unknown type, got %d", code)
+	}
+}
+
+func TestStream(t *testing.T) {
+	h := NewHttpApp("secret")
+	a := h.AddUPS("a", 10, time.Second)
+	b := h.AddUPS("b", 10, time.Second)
+	h.appendMetrics(a, &tripplite.UPSMetrics{Status: "OL", Load: 1, UnixTimestamp: 100})
+
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	if resp, err := http.Get(server.URL + "/stream?ups=c"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown UPS")
+	}
+
+	resp, err := http.Get(server.URL + "/stream?ups=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != tripplite.STREAM_CONTENT_TYPE {
+		t.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	r := tripplite.NewStreamReader(resp.Body)
+
+	next := func() (tripplite.StreamMessage, map[string]interface{}) {
+		msg, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Valid(h) {
+			t.Errorf("invalid signature on %+v", msg)
+		}
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(msg.Data, &data); err != nil {
+			t.Fatal(err)
+		}
+		return msg, data
+	}
+
+	// the latest sample is sent on connect
+	msg, data := next()
+	if msg.Event != tripplite.STREAM_EVENT_METRICS || data["Load"] != 1.0 {
+		t.Errorf("unexpected first message %+v", msg)
+	}
+
+	for h.Stream.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	h.appendMetrics(b, &tripplite.UPSMetrics{Status: "OB", Load: 2, UnixTimestamp: 110})
+	h.appendMetrics(a, &tripplite.UPSMetrics{Status: "OB", Load: 3, UnixTimestamp: 110})
+
+	msg, data = next()
+	if msg.Event != tripplite.STREAM_EVENT_POWER || data["type"] != tripplite.EVENT_ON_BATTERY || data["ups"] != "a" {
+		t.Errorf("expected the on battery event of a, got %s %v", msg.Event, data)
+	}
+	msg, data = next()
+	if msg.Event != tripplite.STREAM_EVENT_METRICS || data["Load"] != 3.0 || msg.Id == 0 {
+		t.Errorf("expected the sample of a, got %s %v", msg.Event, data)
+	}
+
+	h.Stream.Close()
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected the stream to end on close, got %v", err)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	commands := make(chan byte, 10)
+	transport := tripplite.NewMemoryTransport(func(cmd []byte) []byte {
+		switch cmd[0] {
+		case 0:
+			return []byte("\x00\x30\x03")
+		case 'Z':
+			commands <- cmd[0]
+			return []byte("Z")
+		}
+		return nil
+	})
+	mon, err := tripplite.NewSmartProUPSMonitorWithTransport(transport, tripplite.DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	secret := []byte("secret")
+	h := NewHttpApp(string(secret))
+	a := h.AddUPS("a", 10, time.Second)
+	a.Monitor = mon
+	b := h.AddUPS("b", 10, time.Second)
+
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	request := func(req tripplite.SocketMessage) tripplite.SocketMessage {
+		if err := conn.WriteJSON(req); err != nil {
+			t.Fatal(err)
+		}
+		res := tripplite.SocketMessage{}
+		if err := conn.ReadJSON(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := request(tripplite.SocketMessage{Type: tripplite.SOCKET_SUBSCRIBE, Id: "1", UPS: "a", Topics: []string{"metrics"}})
+	if res.Type != tripplite.SOCKET_RESULT || res.Id != "1" {
+		t.Errorf("unexpected subscribe result %+v", res)
+	}
+	res = request(tripplite.SocketMessage{Type: tripplite.SOCKET_SUBSCRIBE, Id: "2", UPS: "c"})
+	if res.Type != tripplite.SOCKET_ERROR || res.Id != "2" {
+		t.Errorf("expected an error subscribing to an unknown UPS, got %+v", res)
+	}
+
+	h.appendMetrics(b, &tripplite.UPSMetrics{Status: "OL", Load: 1, UnixTimestamp: 100})
+	h.appendMetrics(a, &tripplite.UPSMetrics{Status: "OB", Load: 2, UnixTimestamp: 100})
+	res = tripplite.SocketMessage{}
+	if err := conn.ReadJSON(&res); err != nil {
+		t.Fatal(err)
+	}
+	m := tripplite.UPSMetrics{}
+	json.Unmarshal(res.Data, &m)
+	if res.Type != tripplite.SOCKET_METRICS || res.UPS != "a" || m.Load != 2 {
+		t.Errorf("expected only metrics of a, got %+v", res)
+	}
+	if ok, _ := tripplite.ValidateHMAC(h, res.Data, res.HMAC); !ok {
+		t.Errorf("invalid signature on pushed metrics")
+	}
+
+	cmd := tripplite.SocketMessage{Type: tripplite.SOCKET_COMMAND, Id: "3", UPS: "a"}
+	cmd.SetData(tripplite.CommandRequest{UPS: "a", Command: tripplite.CMD_RESET_INPUT_MINMAX, Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce()}, []byte("other"))
+	res = request(cmd)
+	if res.Type != tripplite.SOCKET_ERROR || res.Id != "3" {
+		t.Errorf("expected a badly signed command to be rejected, got %+v", res)
+	}
+	cmd.SetData(tripplite.CommandRequest{UPS: "b", Command: tripplite.CMD_RESET_INPUT_MINMAX, Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce()}, secret)
+	if res = request(cmd); res.Type != tripplite.SOCKET_ERROR {
+		t.Errorf("expected a command signed for another ups to be rejected, got %+v", res)
+	}
+
+	cmd.Id = "4"
+	cmd.SetData(tripplite.CommandRequest{UPS: "a", Command: tripplite.CMD_RESET_INPUT_MINMAX, Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce()}, secret)
+	res = request(cmd)
+	out := tripplite.CommandResponse{}
+	json.Unmarshal(res.Data, &out)
+	if res.Type != tripplite.SOCKET_RESULT || res.Id != "4" || !out.Ok {
+		t.Errorf("unexpected command result %+v", res)
+	}
+	select {
+	case code := <-commands:
+		if code != 'Z' {
+			t.Errorf("unexpected command %c", code)
+		}
+	default:
+		t.Errorf("expected reset to be sent")
+	}
+
+	cmd.Id = "5"
+	if res = request(cmd); res.Type != tripplite.SOCKET_ERROR || res.Id != "5" {
+		t.Errorf("expected a replayed command to be rejected, got %+v", res)
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	c := ReplayCache{}
+	now := time.Now()
+	if !c.Add("a", now) || !c.Add("b", now) {
+		t.Fatal("expected new nonces to be accepted")
+	}
+	if c.Add("a", now.Add(COMMAND_MAX_AGE)) {
+		t.Errorf("expected a seen nonce to be rejected")
+	}
+	if !c.Add("a", now.Add(3*COMMAND_MAX_AGE)) {
+		t.Errorf("expected an expired nonce to be forgotten")
+	}
+	if len(c.seen) != 1 {
+		t.Errorf("expected expired nonces to be dropped, got %v", c.seen)
+	}
+}
+
+func TestClients(t *testing.T) {
+	secret := []byte("secret")
+	h := NewHttpApp(string(secret))
+	h.AddUPS("ups", 10, time.Second)
+	h.Clients.Wait = 50 * time.Millisecond
+	CLIENT_WAIT_POLL = 10 * time.Millisecond
+
+	post := func(report tripplite.ClientReport, signed bool) *httptest.ResponseRecorder {
+		data, _ := json.Marshal(report)
+		req := httptest.NewRequest(http.MethodPost, "/clients", bytes.NewReader(data))
+		if signed {
+			req.Header.Set(tripplite.HTTP_CONTENT_HASH_HEADER, base64.RawStdEncoding.EncodeToString(tripplite.ComputeHMAC(secret, data)))
+		}
+		rec := httptest.NewRecorder()
+		h.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	register := tripplite.ClientReport{Type: tripplite.CLIENT_REPORT_REGISTER, Id: "nas", Hostname: "nas", Scripts: []string{"shutdown"}, Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce()}
+	if rec := post(register, false); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unsigned report to be rejected, got %d", rec.Code)
+	}
+	other := register
+	other.UPS = "other"
+	other.Nonce = tripplite.NewNonce()
+	if rec := post(other, true); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown ups, got %d", rec.Code)
+	}
+	if rec := post(register, true); rec.Code != http.StatusOK {
+		t.Fatalf("expected the client to register, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := post(register, true); rec.Code != http.StatusConflict {
+		t.Errorf("expected a replayed report to be rejected, got %d", rec.Code)
+	}
+
+	if pending := h.Clients.Pending("ups", time.Now()); len(pending) != 1 || pending[0] != "nas" {
+		t.Errorf("expected the client to be pending, got %v", pending)
+	}
+	start := time.Now()
+	h.Clients.WaitForClients("ups", nil)
+	if time.Since(start) < h.Clients.Wait {
+		t.Errorf("expected to wait for the client")
+	}
+
+	// a heartbeat keeps the scripts, a failed script does not acknowledge
+	post(tripplite.ClientReport{Type: tripplite.CLIENT_REPORT_HEARTBEAT, Id: "nas", Hostname: "nas", Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce()}, true)
+	post(tripplite.ClientReport{Type: tripplite.CLIENT_REPORT_RESULT, Id: "nas", Hostname: "nas", Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce(),
+		Result: &tripplite.ScriptResult{Script: "shutdown", ExitCode: 1}}, true)
+	if pending := h.Clients.Pending("ups", time.Now()); len(pending) != 1 {
+		t.Errorf("expected a failed script not to acknowledge, got %v", pending)
+	}
+	post(tripplite.ClientReport{Type: tripplite.CLIENT_REPORT_RESULT, Id: "nas", Hostname: "nas", Timestamp: time.Now().Unix(), Nonce: tripplite.NewNonce(),
+		Result: &tripplite.ScriptResult{Script: "shutdown", ExitCode: 0}}, true)
+	if pending := h.Clients.Pending("ups", time.Now()); len(pending) != 0 {
+		t.Errorf("expected no pending clients, got %v", pending)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/clients?ups=ups", nil))
+	clients := []ClientInfo{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &clients); err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || !clients[0].Online || !clients[0].Acknowledged || len(clients[0].Scripts) != 1 || len(clients[0].Results) != 2 {
+		t.Errorf("unexpected clients %+v", clients)
+	}
+
+	// the end of the outage clears the acknowledgement for the next one
+	u := h.GetUPS("ups")
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OB", BatteryCharge: 90})
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OL", BatteryCharge: 90})
+	if pending := h.Clients.Pending("ups", time.Now()); len(pending) != 1 {
+		t.Errorf("expected the client to be pending after the outage, got %v", pending)
+	}
+
+	// an offline client is not waited on
+	post(register, true)
+	if pending := h.Clients.Pending("ups", time.Now().Add(2*h.Clients.Timeout)); len(pending) != 0 {
+		t.Errorf("expected an offline client not to be pending, got %v", pending)
+	}
+}
+
+func TestNUTServer(t *testing.T) {
+	h := NewHttpApp("")
+	h.appendMetrics(h.AddUPS("rack", 10, time.Second), &tripplite.UPSMetrics{Status: "OB", BatteryCharge: 80, InputVoltage: 0.5, Model: "SMART1500"})
+	h.AddUPS("spare", 10, time.Second)
+
+	s := NewNUTServer(h, []NUTUser{{Username: "monuser", Password: "secret", Upsmon: "primary"}, {Username: "viewer", Password: "secret"}})
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, bufio.NewReader(conn)
+	}
+	conn, r := dial()
+	defer conn.Close()
+
+	send := func(line string, lines int) []string {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		out := []string{}
+		for i := 0; i < lines || (len(out) > 0 && strings.HasPrefix(out[0], "BEGIN") && !strings.HasPrefix(out[len(out)-1], "END")); i++ {
+			reply, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, strings.TrimRight(reply, "\n"))
+		}
+		return out
+	}
+
+	tests := []struct {
+		line  string
+		reply string
+	}{
+		{"GET VAR rack battery.charge", `VAR rack battery.charge "80"`},
+		{"GET VAR rack ups.status", `VAR rack ups.status "OB"`},
+		{"GET VAR rack input.voltage", `VAR rack input.voltage "0.5"`},
+		{"GET VAR rack ups.bogus", "ERR VAR-NOT-SUPPORTED"},
+		{"GET VAR other ups.status", "ERR UNKNOWN-UPS"},
+		{"GET VAR spare ups.status", "ERR DATA-STALE"},
+		{"GET TYPE rack battery.charge", "TYPE rack battery.charge NUMBER"},
+		{"GET UPSDESC rack", `UPSDESC rack "Tripplite UPS"`},
+		{"FSD rack", "ERR USERNAME-REQUIRED"},
+		{"LOGIN rack", "ERR USERNAME-REQUIRED"},
+		{"USERNAME viewer", "OK"},
+		{"PASSWORD wrong", "OK"},
+		{"LOGIN rack", "ERR ACCESS-DENIED"},
+		{"BOGUS", "ERR UNKNOWN-COMMAND"},
+	}
+	for _, test := range tests {
+		if reply := send(test.line, 1); reply[0] != test.reply {
+			t.Errorf("%s: expected %q, got %q", test.line, test.reply, reply[0])
+		}
+	}
+
+	list := send("LIST UPS", 1)
+	if len(list) != 4 || list[1] != `UPS rack "Tripplite UPS"` || list[2] != `UPS spare "Tripplite UPS"` {
+		t.Errorf("unexpected UPS list %q", list)
+	}
+	vars := send("LIST VAR rack", 1)
+	if vars[0] != "BEGIN LIST VAR rack" || vars[len(vars)-1] != "END LIST VAR rack" {
+		t.Errorf("unexpected var list %q", vars)
+	}
+	found := false
+	for _, line := range vars {
+		found = found || line == `VAR rack ups.model "SMART1500"`
+	}
+	if !found {
+		t.Errorf("expected ups.model in %q", vars)
+	}
+
+	// a primary upsmon logs in and forces a shutdown
+	primary, pr := dial()
+	defer primary.Close()
+	for _, line := range []string{"USERNAME monuser", "PASSWORD secret", "LOGIN rack", "PRIMARY rack", "FSD rack"} {
+		primary.Write([]byte(line + "\n"))
+		if reply, _ := pr.ReadString('\n'); !strings.HasPrefix(reply, "OK") {
+			t.Errorf("%s: expected OK, got %q", line, reply)
+		}
+	}
+	if reply := send("GET NUMLOGINS rack", 1); reply[0] != "NUMLOGINS rack 1" {
+		t.Errorf("expected one login, got %q", reply[0])
+	}
+	if reply := send("GET VAR rack ups.status", 1); reply[0] != `VAR rack ups.status "FSD OB"` {
+		t.Errorf("expected FSD, got %q", reply[0])
+	}
+	if reply := send("LOGOUT", 1); reply[0] != "OK Goodbye" {
+		t.Errorf("unexpected logout %q", reply[0])
+	}
+}
+
+func TestSNMPAgent(t *testing.T) {
+	h := NewHttpApp("")
+	u := h.AddUPS("rack", 10, time.Second)
+	h.AddUPS("spare", 10, time.Second)
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OL", BatteryCharge: 100, InputVoltage: 120, Load: 20, Manufacturer: "Tripp Lite"})
+
+	// a free port for the trap receiver
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trapAddr := pc.LocalAddr().String()
+	pc.Close()
+
+	users := []SNMPUser{{Username: "monitor", AuthProtocol: "SHA", AuthPassword: "authpass1", PrivProtocol: "AES", PrivPassword: "privpass1"}}
+	agent, err := NewSNMPAgent(h, "public", users, []SNMPTrapTarget{{Address: trapAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go agent.Serve()
+	defer agent.Close()
+	h.EventListeners = append(h.EventListeners, agent)
+	port := uint16(agent.Addr().(*net.UDPAddr).Port)
+
+	client := func(community string) *gosnmp.GoSNMP {
+		c := &gosnmp.GoSNMP{Target: "127.0.0.1", Port: port, Version: gosnmp.Version2c, Community: community, Timeout: 500 * time.Millisecond, Retries: 0}
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := client("public")
+	defer c.Conn.Close()
+	res, err := c.Get([]string{tripplite.UPS_ESTIMATED_CHARGE, tripplite.UPS_OUTPUT_SOURCE, tripplite.UPS_IDENT_MANUFACTURER, ".1.3.6.1.2.1.33.1.99.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := gosnmp.ToBigInt(res.Variables[0].Value).Int64(); v != 100 {
+		t.Errorf("expected charge 100, got %d", v)
+	}
+	if v := gosnmp.ToBigInt(res.Variables[1].Value).Int64(); v != tripplite.UPS_OUTPUT_SOURCE_NORMAL {
+		t.Errorf("expected output source normal, got %d", v)
+	}
+	if v := string(res.Variables[2].Value.([]byte)); v != "Tripp Lite" {
+		t.Errorf("expected manufacturer, got %q", v)
+	}
+	if res.Variables[3].Type != gosnmp.NoSuchObject {
+		t.Errorf("expected no such object, got %v", res.Variables[3].Type)
+	}
+
+	walked := []string{}
+	if err := c.BulkWalk(tripplite.UPS_MIB, func(pdu gosnmp.SnmpPDU) error {
+		walked = append(walked, pdu.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(walked) < 20 || walked[0] != tripplite.UPS_IDENT_MANUFACTURER {
+		t.Errorf("unexpected walk %v", walked)
+	}
+
+	// the spare UPS has no sample yet
+	spare := client("public@spare")
+	defer spare.Conn.Close()
+	if res, err := spare.Get([]string{tripplite.UPS_BATTERY_STATUS}); err != nil || gosnmp.ToBigInt(res.Variables[0].Value).Int64() != tripplite.UPS_BATTERY_STATUS_UNKNOWN {
+		t.Errorf("expected an unknown battery status, got %v %v", res, err)
+	}
+
+	wrong := client("private")
+	defer wrong.Conn.Close()
+	if _, err := wrong.Get([]string{tripplite.UPS_ESTIMATED_CHARGE}); err == nil {
+		t.Errorf("expected a wrong community to be ignored")
+	}
+
+	v3 := &gosnmp.GoSNMP{
+		Target: "127.0.0.1", Port: port, Version: gosnmp.Version3, Timeout: time.Second, Retries: 1,
+		SecurityModel: gosnmp.UserSecurityModel, MsgFlags: gosnmp.AuthPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName: "monitor", AuthenticationProtocol: gosnmp.SHA, AuthenticationPassphrase: "authpass1",
+			PrivacyProtocol: gosnmp.AES, PrivacyPassphrase: "privpass1",
+		},
+	}
+	if err := v3.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer v3.Conn.Close()
+	if res, err := v3.Get([]string{tripplite.UPS_INPUT_VOLTAGE}); err != nil || gosnmp.ToBigInt(res.Variables[0].Value).Int64() != 120 {
+		t.Errorf("expected input voltage over v3, got %v %v", res, err)
+	}
+
+	v3.SecurityParameters = &gosnmp.UsmSecurityParameters{
+		UserName: "monitor", AuthenticationProtocol: gosnmp.SHA, AuthenticationPassphrase: "wrongpass",
+		PrivacyProtocol: gosnmp.AES, PrivacyPassphrase: "privpass1",
+	}
+	if _, err := v3.Get([]string{tripplite.UPS_INPUT_VOLTAGE}); err == nil {
+		t.Errorf("expected a wrong password to be rejected")
+	}
+
+	// going on battery sends upsTrapOnBattery
+	traps := make(chan *gosnmp.SnmpPacket, 4)
+	listener := gosnmp.NewTrapListener()
+	listener.Params = &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}
+	listener.OnNewTrap = func(p *gosnmp.SnmpPacket, addr *net.UDPAddr) { traps <- p }
+	go listener.Listen(trapAddr)
+	defer listener.Close()
+	<-listener.Listening()
+
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OB", BatteryCharge: 90, InputVoltage: 0, UnixTimestamp: 10})
+	select {
+	case trap := <-traps:
+		if len(trap.Variables) < 2 || trap.Variables[1].Value != tripplite.UPS_TRAP_ON_BATTERY {
+			t.Errorf("expected an on battery trap, got %v", trap.Variables)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a trap")
+	}
+
+	if res, err := c.Get([]string{tripplite.UPS_ALARMS_PRESENT, tripplite.UPS_ALARM_DESCR + ".1"}); err != nil || gosnmp.ToBigInt(res.Variables[0].Value).Int64() != 1 || res.Variables[1].Value != tripplite.UPS_ALARM_ON_BATTERY {
+		t.Errorf("expected the on battery alarm, got %v %v", res, err)
+	}
+}
+
+// A single connection MQTT broker recording what is published to it.
+func startTestBroker(t *testing.T) (string, chan *packets.ConnectPacket, chan *packets.PublishPacket) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	connects := make(chan *packets.ConnectPacket, 4)
+	published := make(chan *packets.PublishPacket, 256)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					p, err := packets.ReadPacket(conn)
+					if err != nil {
+						return
+					}
+					switch p := p.(type) {
+					case *packets.ConnectPacket:
+						connects <- p
+						packets.NewControlPacket(packets.Connack).Write(conn)
+					case *packets.PublishPacket:
+						published <- p
+						if p.Qos == 1 {
+							ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+							ack.MessageID = p.MessageID
+							ack.Write(conn)
+						}
+					case *packets.SubscribePacket:
+						ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+						ack.MessageID = p.MessageID
+						ack.ReturnCodes = p.Qoss
+						ack.Write(conn)
+					case *packets.PingreqPacket:
+						packets.NewControlPacket(packets.Pingresp).Write(conn)
+					case *packets.DisconnectPacket:
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "tcp://" + ln.Addr().String(), connects, published
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker, connects, published := startTestBroker(t)
+
+	h := NewHttpApp("")
+	u := h.AddUPS("rack a", 10, time.Second)
+	p := NewMQTTPublisher(broker, "ups", tripplite.MQTT_DISCOVERY_PREFIX)
+	p.ClientId = "test"
+	if err := p.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	h.MQTT = p
+	h.Listeners = append(h.Listeners, p)
+
+	connect := <-connects
+	if !connect.WillFlag || connect.WillTopic != "ups/status" || string(connect.WillMessage) != tripplite.MQTT_OFFLINE || !connect.WillRetain {
+		t.Errorf("expected an offline last will, got %v", connect)
+	}
+
+	messages := map[string]*packets.PublishPacket{}
+	expect := func(topics ...string) {
+		t.Helper()
+		deadline := time.After(2 * time.Second)
+		for _, topic := range topics {
+			for messages[topic] == nil {
+				select {
+				case msg := <-published:
+					messages[msg.TopicName] = msg
+				case <-deadline:
+					t.Fatalf("expected a message on %s", topic)
+				}
+			}
+		}
+	}
+
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OL", BatteryCharge: 87, InputVoltage: 121.4, Serial: "2207AV0001", Model: "SMART1500"})
+	expect("ups/status", "ups/rack_a/availability", "ups/rack_a/state", "ups/rack_a/battery_charge", "ups/rack_a/line_power",
+		"homeassistant/sensor/tripplite_2207AV0001/battery_charge/config", "homeassistant/binary_sensor/tripplite_2207AV0001/line_power/config")
+
+	if msg := messages["ups/status"]; string(msg.Payload) != tripplite.MQTT_ONLINE || !msg.Retain {
+		t.Errorf("expected a retained online status, got %q", msg.Payload)
+	}
+	if msg := messages["ups/rack_a/availability"]; string(msg.Payload) != tripplite.MQTT_ONLINE || !msg.Retain {
+		t.Errorf("expected the UPS online, got %q", msg.Payload)
+	}
+	if v := string(messages["ups/rack_a/battery_charge"].Payload); v != "87" {
+		t.Errorf("expected charge 87, got %q", v)
+	}
+	if v := string(messages["ups/rack_a/input_voltage"].Payload); v != "121.4" {
+		t.Errorf("expected input voltage 121.4, got %q", v)
+	}
+	state := tripplite.UPSMetrics{}
+	if err := json.Unmarshal(messages["ups/rack_a/state"].Payload, &state); err != nil || state.BatteryCharge != 87 || state.Name != "rack a" {
+		t.Errorf("unexpected state %s %v", messages["ups/rack_a/state"].Payload, err)
+	}
+
+	config := map[string]interface{}{}
+	msg := messages["homeassistant/sensor/tripplite_2207AV0001/battery_charge/config"]
+	if err := json.Unmarshal(msg.Payload, &config); err != nil || !msg.Retain {
+		t.Fatalf("unexpected discovery %s %v", msg.Payload, err)
+	}
+	if config["device_class"] != "battery" || config["unit_of_measurement"] != "%" || config["state_topic"] != "ups/rack_a/battery_charge" || config["unique_id"] != "tripplite_2207AV0001_battery_charge" {
+		t.Errorf("unexpected discovery %s", msg.Payload)
+	}
+	if device := config["device"].(map[string]interface{}); device["model"] != "SMART1500" {
+		t.Errorf("unexpected device %v", device)
+	}
+
+	// discovery is only sent once, a lost UPS only goes offline
+	messages = map[string]*packets.PublishPacket{}
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OL", BatteryCharge: 88, Serial: "2207AV0001", Communication: tripplite.COMM_LOST})
+	expect("ups/rack_a/availability")
+	if v := string(messages["ups/rack_a/availability"].Payload); v != tripplite.MQTT_OFFLINE {
+		t.Errorf("expected the UPS offline, got %q", v)
+	}
+	for topic := range messages {
+		if strings.HasPrefix(topic, "homeassistant/") || topic == "ups/rack_a/battery_charge" {
+			t.Errorf("unexpected message on %s", topic)
+		}
+	}
+
+	h.StopServer()
+	expect("ups/status")
+	if v := string(messages["ups/status"].Payload); v != tripplite.MQTT_OFFLINE {
+		t.Errorf("expected an offline status on close, got %q", v)
+	}
+}
+
+func TestPushSinks(t *testing.T) {
+	var lock sync.Mutex
+	status := http.StatusNoContent
+	bodies := map[string][]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/remote" {
+			if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("unexpected remote-write headers %v", r.Header)
+			}
+			body, _ = snappy.Decode(nil, body)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if status < 300 {
+			bodies[r.URL.Path] = append(bodies[r.URL.Path], string(body))
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	received := func(path string) []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, bodies[path]...)
+	}
+	setStatus := func(s int) {
+		lock.Lock()
+		status = s
+		lock.Unlock()
+	}
+
+	h := NewHttpApp("")
+	u := h.AddUPS("rack", 10, time.Second)
+	influx, err := NewPushSink(PushSettings{Type: PUSH_INFLUX, URL: srv.URL + "/influx", BatchSize: 2, FlushInterval: time.Hour,
+		Fields: tripplite.FieldFilter{Include: []string{"battery_*", "status"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	influx.Start()
+	remote, _ := NewPushSink(PushSettings{Type: PUSH_REMOTE_WRITE, URL: srv.URL + "/remote", Token: "token", FlushInterval: time.Hour})
+	remote.Start()
+	h.Sinks = append(h.Sinks, influx, remote)
+	h.Listeners = append(h.Listeners, influx, remote)
+
+	// a full batch is sent right away
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OL", BatteryCharge: 87, InputVoltage: 120, UnixTimestamp: 100})
+	h.appendMetrics(u, &tripplite.UPSMetrics{Status: "OB", BatteryCharge: 86, InputVoltage: 0, UnixTimestamp: 101})
+	for i := 0; i < 100 && len(received("/influx")) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines := received("/influx")
+	if len(lines) != 1 || !strings.Contains(lines[0], "tripplite,ups=rack battery_charge_percent=87,") || !strings.Contains(lines[0], `status="OB" 101000000000`) {
+		t.Fatalf("unexpected influx batch %q", lines)
+	}
+	if strings.Contains(lines[0], "input_voltage") {
+		t.Errorf("expected input voltage to be filtered out")
+	}
+
+	// the remote-write sink waits for its interval or shutdown
+	if len(received("/remote")) != 0 || remote.Pending() != 2 {
+		t.Errorf("expected the remote-write samples to be buffered")
+	}
+	h.StopServer()
+	if body := received("/remote"); len(body) != 1 || !strings.Contains(body[0], "tripplite_battery_charge_percent") || !strings.Contains(body[0], "rack") {
+		t.Errorf("unexpected remote-write request %q", body)
+	}
+
+	// samples are kept while the sink is down, the oldest are dropped
+	retry, _ := NewPushSink(PushSettings{Type: PUSH_INFLUX, URL: srv.URL + "/retry", BatchSize: 2, BufferSize: 3,
+		Fields: tripplite.FieldFilter{Include: []string{"battery_charge_percent"}}})
+	setStatus(http.StatusServiceUnavailable)
+	for i := 1; i <= 3; i++ {
+		retry.OnMetrics(&tripplite.UPSMetrics{Name: "rack", BatteryCharge: float64(i), UnixTimestamp: int64(i)})
+	}
+	if err := retry.Flush(); err == nil || retry.Pending() != 3 {
+		t.Errorf("expected the failed batch to be kept, %d pending %v", retry.Pending(), err)
+	}
+	retry.OnMetrics(&tripplite.UPSMetrics{Name: "rack", BatteryCharge: 4, UnixTimestamp: 4})
+	setStatus(http.StatusNoContent)
+	if err := retry.Flush(); err != nil || retry.Pending() != 0 {
+		t.Errorf("expected the buffer to be sent, %d pending %v", retry.Pending(), err)
+	}
+	if body := strings.Join(received("/retry"), ""); strings.Contains(body, "=1 ") || !strings.Contains(body, "=2 ") || !strings.Contains(body, "=4 ") {
+		t.Errorf("expected the oldest sample to be dropped, got %q", body)
+	}
+
+	// rejected batches are not retried
+	setStatus(http.StatusBadRequest)
+	retry.OnMetrics(&tripplite.UPSMetrics{Name: "rack", BatteryCharge: 5})
+	if err := retry.Flush(); err != nil || retry.Pending() != 0 {
+		t.Errorf("expected a rejected batch to be dropped, %d pending %v", retry.Pending(), err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	udp, _ := NewPushSink(PushSettings{Type: PUSH_INFLUX_UDP, URL: "udp://" + pc.LocalAddr().String()})
+	udp.OnMetrics(&tripplite.UPSMetrics{Name: "rack", BatteryCharge: 42, UnixTimestamp: 1})
+	if err := udp.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := pc.ReadFrom(buf); err != nil || !strings.Contains(string(buf[:n]), "battery_charge_percent=42") {
+		t.Errorf("unexpected datagram %q %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,622 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Most varbinds in one GETBULK response.
+	SNMP_MAX_BULK = 64
+	// Largest accepted SNMP message.
+	SNMP_MAX_MESSAGE = 65507
+	// How far a v3 request's engine time may be off, see RFC 3414 3.2.7.
+	SNMP_TIME_WINDOW  = 150 * time.Second
+	SNMP_TRAP_TIMEOUT = 5 * time.Second
+)
+
+const (
+	snmpUnsupportedSecLevels = ".1.3.6.1.6.3.15.1.1.1.0"
+	snmpUnknownEngineIDs     = ".1.3.6.1.6.3.15.1.1.4.0"
+	snmpNotInTimeWindows     = ".1.3.6.1.6.3.15.1.1.2.0"
+	snmpUnknownUserNames     = ".1.3.6.1.6.3.15.1.1.3.0"
+)
+
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"":       gosnmp.NoAuth,
+	"MD5":    gosnmp.MD5,
+	"SHA":    gosnmp.SHA,
+	"SHA224": gosnmp.SHA224,
+	"SHA256": gosnmp.SHA256,
+	"SHA384": gosnmp.SHA384,
+	"SHA512": gosnmp.SHA512,
+}
+
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"":        gosnmp.NoPriv,
+	"DES":     gosnmp.DES,
+	"AES":     gosnmp.AES,
+	"AES192":  gosnmp.AES192,
+	"AES256":  gosnmp.AES256,
+	"AES192C": gosnmp.AES192C,
+	"AES256C": gosnmp.AES256C,
+}
+
+// An SNMPv3 USM user, no auth_protocol means noAuthNoPriv.
+type SNMPUser struct {
+	Username     string `yaml:"username"`
+	AuthProtocol string `yaml:"auth_protocol"`
+	AuthPassword string `yaml:"auth_password"`
+	PrivProtocol string `yaml:"priv_protocol"`
+	PrivPassword string `yaml:"priv_password"`
+}
+
+func (u SNMPUser) validate() error {
+	auth, ok := snmpAuthProtocols[strings.ToUpper(u.AuthProtocol)]
+	if !ok {
+		return fmt.Errorf("unknown auth_protocol %q of SNMP user %s", u.AuthProtocol, u.Username)
+	}
+	priv, ok := snmpPrivProtocols[strings.ToUpper(u.PrivProtocol)]
+	if !ok {
+		return fmt.Errorf("unknown priv_protocol %q of SNMP user %s", u.PrivProtocol, u.Username)
+	}
+	if priv != gosnmp.NoPriv && auth == gosnmp.NoAuth {
+		return fmt.Errorf("SNMP user %s has privacy without authentication", u.Username)
+	}
+	if len(u.Username) == 0 {
+		return errors.New("SNMP user without username")
+	}
+	return nil
+}
+
+func (u SNMPUser) flags() gosnmp.SnmpV3MsgFlags {
+	switch {
+	case snmpPrivProtocols[strings.ToUpper(u.PrivProtocol)] != gosnmp.NoPriv:
+		return gosnmp.AuthPriv
+	case snmpAuthProtocols[strings.ToUpper(u.AuthProtocol)] != gosnmp.NoAuth:
+		return gosnmp.AuthNoPriv
+	}
+	return gosnmp.NoAuthNoPriv
+}
+
+// USM parameters of the user for the engine, gosnmp localizes the keys.
+func (u SNMPUser) params(engineId string, boots uint32, engineTime uint32) *gosnmp.UsmSecurityParameters {
+	return &gosnmp.UsmSecurityParameters{
+		AuthoritativeEngineID:    engineId,
+		AuthoritativeEngineBoots: boots,
+		AuthoritativeEngineTime:  engineTime,
+		UserName:                 u.Username,
+		AuthenticationProtocol:   snmpAuthProtocols[strings.ToUpper(u.AuthProtocol)],
+		AuthenticationPassphrase: u.AuthPassword,
+		PrivacyProtocol:          snmpPrivProtocols[strings.ToUpper(u.PrivProtocol)],
+		PrivacyPassphrase:        u.PrivPassword,
+	}
+}
+
+// A receiver of traps, v2c with the community or v3 as one of the users.
+type SNMPTrapTarget struct {
+	Address   string `yaml:"address"`
+	Version   string `yaml:"version"`
+	Community string `yaml:"community"`
+	User      string `yaml:"user"`
+}
+
+// Serves the UPS-MIB over SNMP v2c and v3 and sends UPS-MIB traps for power
+// events. The first UPS is served unless a v3 context or a v2c community of
+// the form community@ups names another one.
+type SNMPAgent struct {
+	Community string
+	Users     []SNMPUser
+	Traps     []SNMPTrapTarget
+	EngineId  string
+	Boots     uint32
+	app       *HttpApp
+	conn      *net.UDPConn
+	start     time.Time
+}
+
+func NewSNMPAgent(h *HttpApp, community string, users []SNMPUser, traps []SNMPTrapTarget) (*SNMPAgent, error) {
+	for _, u := range users {
+		if err := u.validate(); err != nil {
+			return nil, err
+		}
+	}
+	a := &SNMPAgent{
+		Community: community,
+		Users:     users,
+		Traps:     traps,
+		EngineId:  defaultEngineId(),
+		Boots:     1,
+		app:       h,
+		start:     time.Now(),
+	}
+	for _, t := range traps {
+		if strings.TrimPrefix(t.Version, "v") == "3" && a.user(t.User) == nil {
+			return nil, fmt.Errorf("unknown SNMP user %q of trap target %s", t.User, t.Address)
+		}
+	}
+	return a, nil
+}
+
+// An RFC 3411 text engine id made from the hostname.
+func defaultEngineId() string {
+	host, _ := os.Hostname()
+	if len(host) == 0 {
+		host = "tripplite"
+	}
+	if len(host) > 27 {
+		host = host[:27]
+	}
+	// enterprise 8072 (net-snmp) with the high bit set, format 4 (text)
+	return "\x80\x00\x1f\x88\x04" + host
+}
+
+// Sets the engine id from hex, as shown by snmpget -v3 -e.
+func (a *SNMPAgent) SetEngineId(id string) error {
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(id), "0x"))
+	if err != nil {
+		return err
+	}
+	if len(raw) < 5 || len(raw) > 32 {
+		return errors.New("SNMP engine id must be 5 to 32 bytes")
+	}
+	a.EngineId = string(raw)
+	return nil
+}
+
+// Counts engine boots in a file so v3 replay protection holds across
+// restarts.
+func (a *SNMPAgent) LoadBoots(path string) error {
+	boots := uint32(0)
+	if data, err := os.ReadFile(path); err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 31); err == nil {
+			boots = uint32(n)
+		}
+	}
+	boots++
+	a.Boots = boots
+	return os.WriteFile(path, []byte(strconv.FormatUint(uint64(boots), 10)), 0600)
+}
+
+func (a *SNMPAgent) engineTime() uint32 {
+	return uint32(time.Since(a.start) / time.Second)
+}
+
+func (a *SNMPAgent) user(name string) *SNMPUser {
+	for i, u := range a.Users {
+		if u.Username == name {
+			return &a.Users[i]
+		}
+	}
+	return nil
+}
+
+func (a *SNMPAgent) Listen(addr string) error {
+	udp, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", udp)
+	if err != nil {
+		return err
+	}
+	a.conn = conn
+	log.Info().Str("address", conn.LocalAddr().String()).Msg("listening for SNMP requests")
+	return nil
+}
+
+func (a *SNMPAgent) Addr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+func (a *SNMPAgent) Close() {
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+// Answers requests until Close.
+func (a *SNMPAgent) Serve() {
+	buf := make([]byte, SNMP_MAX_MESSAGE)
+	for {
+		n, remote, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error().Err(err).Msg("SNMP listener failed")
+			}
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		res, err := a.handle(data)
+		if err != nil {
+			log.Debug().Err(err).Str("remote", remote.String()).Msg("dropped SNMP request")
+			continue
+		}
+		if res == nil {
+			continue
+		}
+		out, err := res.MarshalMsg()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to encode SNMP response")
+			continue
+		}
+		a.conn.WriteToUDP(out, remote)
+	}
+}
+
+// The version field of a message, the second field of its outer sequence.
+func snmpVersion(data []byte) (gosnmp.SnmpVersion, bool) {
+	if len(data) < 2 || data[0] != byte(gosnmp.Sequence) {
+		return 0, false
+	}
+	i := 2
+	if data[1]&0x80 != 0 {
+		i += int(data[1] & 0x7f)
+	}
+	if len(data) < i+3 || data[i] != byte(gosnmp.Integer) || data[i+1] != 1 {
+		return 0, false
+	}
+	return gosnmp.SnmpVersion(data[i+2]), true
+}
+
+func (a *SNMPAgent) handle(data []byte) (*gosnmp.SnmpPacket, error) {
+	version, ok := snmpVersion(data)
+	if !ok {
+		return nil, errors.New("not an SNMP message")
+	}
+	switch version {
+	case gosnmp.Version2c:
+		return a.handleV2c(data)
+	case gosnmp.Version3:
+		return a.handleV3(data)
+	}
+	return nil, fmt.Errorf("unsupported SNMP version %d", version)
+}
+
+func (a *SNMPAgent) handleV2c(data []byte) (*gosnmp.SnmpPacket, error) {
+	if len(a.Community) == 0 {
+		return nil, errors.New("v2c is disabled")
+	}
+	x := &gosnmp.GoSNMP{Version: gosnmp.Version2c}
+	req, err := x.UnmarshalTrap(data, false)
+	if err != nil {
+		return nil, err
+	}
+
+	community, ups := req.Community, ""
+	if i := strings.LastIndex(community, "@"); i >= 0 {
+		community, ups = community[:i], community[i+1:]
+	}
+	if subtle.ConstantTimeCompare([]byte(community), []byte(a.Community)) != 1 {
+		return nil, errors.New("wrong community")
+	}
+
+	res := &gosnmp.SnmpPacket{
+		Version:   gosnmp.Version2c,
+		Community: req.Community,
+		PDUType:   gosnmp.GetResponse,
+		RequestID: req.RequestID,
+	}
+	return res, a.respond(req, ups, res)
+}
+
+func (a *SNMPAgent) handleV3(data []byte) (*gosnmp.SnmpPacket, error) {
+	// unauthenticated messages decode without a user, engine discovery is one
+	probe := &gosnmp.GoSNMP{Version: gosnmp.Version3, SecurityModel: gosnmp.UserSecurityModel, SecurityParameters: &gosnmp.UsmSecurityParameters{}}
+	if req, err := probe.UnmarshalTrap(append([]byte{}, data...), true); err == nil {
+		usm := req.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if usm.AuthoritativeEngineID != a.EngineId {
+			return a.report(req, nil, snmpUnknownEngineIDs), nil
+		}
+		u := a.user(usm.UserName)
+		if u == nil || u.flags() != gosnmp.NoAuthNoPriv {
+			return a.report(req, nil, snmpUnknownUserNames), nil
+		}
+		return a.respondV3(req, u)
+	}
+
+	for i := range a.Users {
+		u := &a.Users[i]
+		if u.flags() == gosnmp.NoAuthNoPriv {
+			continue
+		}
+		x := &gosnmp.GoSNMP{
+			Version:            gosnmp.Version3,
+			SecurityModel:      gosnmp.UserSecurityModel,
+			MsgFlags:           u.flags(),
+			SecurityParameters: u.params(a.EngineId, a.Boots, a.engineTime()),
+		}
+		req, err := x.UnmarshalTrap(append([]byte{}, data...), true)
+		if err != nil {
+			continue
+		}
+		usm := req.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if usm.UserName != u.Username || usm.AuthoritativeEngineID != a.EngineId {
+			continue
+		}
+		if req.MsgFlags&gosnmp.AuthPriv != u.flags() {
+			return a.report(req, nil, snmpUnsupportedSecLevels), nil
+		}
+		if usm.AuthoritativeEngineBoots != a.Boots || absDuration(time.Duration(int64(usm.AuthoritativeEngineTime)-int64(a.engineTime()))*time.Second) > SNMP_TIME_WINDOW {
+			return a.report(req, u, snmpNotInTimeWindows), nil
+		}
+		return a.respondV3(req, u)
+	}
+	return nil, errors.New("no SNMP user matches")
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// A v3 message from the agent to the user, flags set the security level.
+func (a *SNMPAgent) v3Packet(req *gosnmp.SnmpPacket, u *SNMPUser, flags gosnmp.SnmpV3MsgFlags) *gosnmp.SnmpPacket {
+	usm := &gosnmp.UsmSecurityParameters{AuthoritativeEngineID: a.EngineId, AuthoritativeEngineBoots: a.Boots, AuthoritativeEngineTime: a.engineTime()}
+	if u != nil {
+		usm = u.params(a.EngineId, a.Boots, a.engineTime())
+		// the keys of the decoded request are already localized
+		if in, ok := req.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+			usm.SecretKey = in.SecretKey
+			usm.PrivacyKey = in.PrivacyKey
+		}
+		if flags&gosnmp.AuthPriv == gosnmp.AuthPriv {
+			usm.PrivacyParameters = make([]byte, 8)
+			rand.Read(usm.PrivacyParameters)
+		}
+	}
+	return &gosnmp.SnmpPacket{
+		Version:            gosnmp.Version3,
+		MsgFlags:           flags,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		SecurityParameters: usm,
+		MsgID:              req.MsgID,
+		MsgMaxSize:         uint32(SNMP_MAX_MESSAGE),
+		ContextEngineID:    a.EngineId,
+		ContextName:        req.ContextName,
+		RequestID:          req.RequestID,
+	}
+}
+
+// A Report PDU telling the client why its request was not answered, engine
+// discovery is answered with the unknown engine id report.
+func (a *SNMPAgent) report(req *gosnmp.SnmpPacket, u *SNMPUser, oid string) *gosnmp.SnmpPacket {
+	flags := gosnmp.NoAuthNoPriv
+	if u != nil {
+		flags = gosnmp.AuthNoPriv
+	}
+	res := a.v3Packet(req, u, flags)
+	res.PDUType = gosnmp.Report
+	res.Variables = []gosnmp.SnmpPDU{{Name: oid, Type: gosnmp.Counter32, Value: uint32(1)}}
+	return res
+}
+
+func (a *SNMPAgent) respondV3(req *gosnmp.SnmpPacket, u *SNMPUser) (*gosnmp.SnmpPacket, error) {
+	res := a.v3Packet(req, u, req.MsgFlags&gosnmp.AuthPriv)
+	res.PDUType = gosnmp.GetResponse
+	return res, a.respond(req, req.ContextName, res)
+}
+
+// The objects of the named UPS, the first UPS when ups is empty.
+func (a *SNMPAgent) view(ups string) ([]gosnmp.SnmpPDU, error) {
+	u := a.app.GetUPS(ups)
+	if u == nil {
+		return nil, fmt.Errorf("unknown ups %q", ups)
+	}
+	a.app.lock.RLock()
+	m := u.LatestMetrics()
+	events := append([]tripplite.PowerEvent{}, u.Events...)
+	a.app.lock.RUnlock()
+	if m == nil {
+		m = &tripplite.UPSMetrics{Communication: tripplite.COMM_LOST}
+	}
+	return tripplite.UPSMIBVariables(m, a.state(u, events)), nil
+}
+
+func (a *SNMPAgent) state(u *UPS, events []tripplite.PowerEvent) tripplite.UPSMIBState {
+	return tripplite.UPSMIBState{
+		Name:   u.Name,
+		Descr:  "Tripplite UPS " + u.Name,
+		Start:  a.start,
+		Now:    time.Now(),
+		Events: events,
+	}
+}
+
+func normalizeOID(oid string) string {
+	if strings.HasPrefix(oid, ".") {
+		return oid
+	}
+	return "." + oid
+}
+
+// The object following oid in the view, EndOfMibView after the last one.
+func snmpNext(view []gosnmp.SnmpPDU, oid string) gosnmp.SnmpPDU {
+	for _, pdu := range view {
+		if tripplite.CompareOID(pdu.Name, oid) > 0 {
+			return pdu
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+}
+
+func snmpGet(view []gosnmp.SnmpPDU, oid string) gosnmp.SnmpPDU {
+	for _, pdu := range view {
+		if tripplite.CompareOID(pdu.Name, oid) == 0 {
+			return pdu
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.NoSuchObject}
+}
+
+// Fills res with the answer to a GET, GETNEXT or GETBULK, everything is read
+// only.
+func (a *SNMPAgent) respond(req *gosnmp.SnmpPacket, ups string, res *gosnmp.SnmpPacket) error {
+	view, err := a.view(ups)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(req.Variables))
+	for i, v := range req.Variables {
+		names[i] = normalizeOID(v.Name)
+	}
+
+	vars := []gosnmp.SnmpPDU{}
+	switch req.PDUType {
+	case gosnmp.GetRequest:
+		for _, name := range names {
+			vars = append(vars, snmpGet(view, name))
+		}
+	case gosnmp.GetNextRequest:
+		for _, name := range names {
+			vars = append(vars, snmpNext(view, name))
+		}
+	case gosnmp.GetBulkRequest:
+		nonRepeaters := int(req.NonRepeaters)
+		if nonRepeaters > len(names) {
+			nonRepeaters = len(names)
+		}
+		for _, name := range names[:nonRepeaters] {
+			vars = append(vars, snmpNext(view, name))
+		}
+		// gosnmp decodes max-repetitions as zero, answer as many as fit
+		maxRepetitions := int(req.MaxRepetitions)
+		if maxRepetitions == 0 {
+			maxRepetitions = SNMP_MAX_BULK
+		}
+		repeaters := names[nonRepeaters:]
+		for r := 0; r < maxRepetitions && len(repeaters) > 0 && len(vars)+len(repeaters) <= SNMP_MAX_BULK; r++ {
+			done := true
+			for i, name := range repeaters {
+				next := snmpNext(view, name)
+				vars = append(vars, next)
+				repeaters[i] = next.Name
+				done = done && next.Type == gosnmp.EndOfMibView
+			}
+			if done {
+				break
+			}
+		}
+	case gosnmp.SetRequest:
+		res.Error = gosnmp.NotWritable
+		res.ErrorIndex = 1
+		vars = req.Variables
+	default:
+		return fmt.Errorf("unsupported PDU type %#x", byte(req.PDUType))
+	}
+	res.Variables = vars
+	return nil
+}
+
+// Sends UPS-MIB traps for power events: upsTrapOnBattery when the UPS goes on
+// battery, upsTrapTestCompleted after a self-test and alarm added/removed for
+// the others.
+func (a *SNMPAgent) OnEvent(e tripplite.PowerEvent) {
+	if len(a.Traps) == 0 {
+		return
+	}
+	u := a.app.GetUPS(e.UPS)
+	if u == nil {
+		return
+	}
+	view, err := a.view(u.Name)
+	if err != nil {
+		return
+	}
+
+	vars := []gosnmp.SnmpPDU{}
+	trap := ""
+	switch {
+	case e.Type == tripplite.EVENT_ON_BATTERY:
+		if !e.Active {
+			return
+		}
+		trap = tripplite.UPS_TRAP_ON_BATTERY
+		vars = append(vars, snmpGet(view, tripplite.UPS_ESTIMATED_MINUTES), snmpGet(view, tripplite.UPS_SECONDS_ON_BATTERY))
+	case e.Type == tripplite.EVENT_SELF_TEST:
+		if e.Active {
+			return
+		}
+		trap = tripplite.UPS_TRAP_TEST_COMPLETED
+		vars = append(vars, snmpGet(view, tripplite.UPS_TEST_RESULTS_SUMMARY), snmpGet(view, tripplite.UPS_TEST_RESULTS_DETAIL))
+	default:
+		descr, id, ok := tripplite.UPSAlarm(e.Type)
+		if !ok {
+			return
+		}
+		trap = tripplite.UPS_TRAP_ALARM_ENTRY_ADDED
+		if !e.Active {
+			trap = tripplite.UPS_TRAP_ALARM_ENTRY_REMOVED
+		}
+		index := "." + strconv.Itoa(id)
+		vars = append(vars,
+			gosnmp.SnmpPDU{Name: tripplite.UPS_ALARM_ID + index, Type: gosnmp.Integer, Value: id},
+			gosnmp.SnmpPDU{Name: tripplite.UPS_ALARM_DESCR + index, Type: gosnmp.ObjectIdentifier, Value: descr},
+		)
+	}
+
+	vars = append([]gosnmp.SnmpPDU{
+		snmpGet(view, tripplite.SNMP_SYS_UPTIME),
+		{Name: tripplite.SNMP_TRAP_OID, Type: gosnmp.ObjectIdentifier, Value: trap},
+	}, append(vars, snmpGet(view, tripplite.UPS_IDENT_NAME))...)
+
+	// called while events are published, sending must not hold them up
+	for _, target := range a.Traps {
+		go a.sendTrap(target, vars)
+	}
+}
+
+func (a *SNMPAgent) sendTrap(target SNMPTrapTarget, vars []gosnmp.SnmpPDU) {
+	host, port, err := net.SplitHostPort(target.Address)
+	if err != nil {
+		host, port = target.Address, "162"
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+
+	x := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      uint16(p),
+		Version:   gosnmp.Version2c,
+		Community: target.Community,
+		Timeout:   SNMP_TRAP_TIMEOUT,
+		Retries:   0,
+	}
+	if len(x.Community) == 0 {
+		x.Community = a.Community
+	}
+	if strings.TrimPrefix(target.Version, "v") == "3" {
+		u := a.user(target.User)
+		x.Version = gosnmp.Version3
+		x.SecurityModel = gosnmp.UserSecurityModel
+		x.MsgFlags = u.flags()
+		x.SecurityParameters = u.params(a.EngineId, a.Boots, a.engineTime())
+	}
+
+	if err := x.Connect(); err != nil {
+		log.Error().Err(err).Str("target", target.Address).Msg("failed to send SNMP trap")
+		return
+	}
+	defer x.Conn.Close()
+	if _, err := x.SendTrap(gosnmp.SnmpTrap{Variables: vars}); err != nil {
+		log.Error().Err(err).Str("target", target.Address).Msg("failed to send SNMP trap")
+		return
+	}
+	log.Debug().Str("target", target.Address).Interface("trap", vars[1].Value).Msg("sent SNMP trap")
+}
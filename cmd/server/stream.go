@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Comment lines sent on idle streams so proxies keep the connection open.
+	STREAM_KEEPALIVE = 15 * time.Second
+	// Messages queued per subscriber, a subscriber which falls further behind
+	// is disconnected rather than silently missing samples.
+	STREAM_BUFFER = 64
+	// Reconnect delay suggested to EventSource clients, in milliseconds.
+	STREAM_RETRY = 5000
+)
+
+// A published message and the name of the UPS it is about.
+type streamItem struct {
+	UPS     string
+	Message tripplite.StreamMessage
+}
+
+type subscriber struct {
+	ups      string
+	types    map[string]bool
+	messages chan streamItem
+}
+
+func (s *subscriber) wants(ups string, event string) bool {
+	return (len(s.ups) == 0 || s.ups == ups) && s.types[event]
+}
+
+// Fans samples and power events out to live streams. It is registered as a
+// metrics and event listener of the HttpApp.
+type Broadcaster struct {
+	Secret      []byte
+	lock        sync.Mutex
+	subscribers map[*subscriber]bool
+	nextId      uint64
+	closed      bool
+}
+
+func NewBroadcaster(secret []byte) *Broadcaster {
+	return &Broadcaster{
+		Secret:      secret,
+		subscribers: map[*subscriber]bool{},
+	}
+}
+
+// Subscribes to messages of the named UPS, or every UPS when ups is empty.
+func (b *Broadcaster) Subscribe(ups string, types []string) *subscriber {
+	s := &subscriber{
+		ups:      ups,
+		types:    map[string]bool{},
+		messages: make(chan streamItem, STREAM_BUFFER),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		close(s.messages)
+	} else {
+		b.subscribers[s] = true
+	}
+	return s
+}
+
+func (b *Broadcaster) Unsubscribe(s *subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.messages)
+	}
+}
+
+func (b *Broadcaster) Subscribers() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.subscribers)
+}
+
+// Ends every stream, used on shutdown since open streams would otherwise
+// keep the server from stopping.
+func (b *Broadcaster) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.messages)
+	}
+}
+
+func (b *Broadcaster) message(event string, o interface{}) (tripplite.StreamMessage, error) {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return tripplite.StreamMessage{}, err
+	}
+	b.nextId++
+	return tripplite.NewStreamMessage(b.nextId, event, data, b.Secret), nil
+}
+
+func (b *Broadcaster) publish(ups string, event string, o interface{}) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.subscribers) == 0 {
+		return
+	}
+
+	msg, err := b.message(event, o)
+	if err != nil {
+		log.Error().Err(err).Str("event", event).Msg("failed to encode stream message")
+		return
+	}
+	for s := range b.subscribers {
+		if !s.wants(ups, event) {
+			continue
+		}
+		select {
+		case s.messages <- streamItem{UPS: ups, Message: msg}:
+		default:
+			log.Warn().Str("ups", ups).Msg("stream subscriber fell behind, disconnecting")
+			delete(b.subscribers, s)
+			close(s.messages)
+		}
+	}
+}
+
+func (b *Broadcaster) OnMetrics(m *tripplite.UPSMetrics) bool {
+	b.publish(m.Name, tripplite.STREAM_EVENT_METRICS, m)
+	return true
+}
+
+func (b *Broadcaster) OnEvent(e tripplite.PowerEvent) {
+	b.publish(e.UPS, tripplite.STREAM_EVENT_POWER, e)
+}
+
+// The event names selected by ?types=, both when empty.
+func parseStreamTypes(r *http.Request) ([]string, bool) {
+	str := r.URL.Query().Get("types")
+	if len(str) == 0 {
+		return []string{tripplite.STREAM_EVENT_METRICS, tripplite.STREAM_EVENT_POWER}, true
+	}
+	types := []string{}
+	for _, t := range strings.Split(str, ",") {
+		switch t = strings.ToLower(strings.TrimSpace(t)); t {
+		case tripplite.STREAM_EVENT_METRICS, tripplite.STREAM_EVENT_POWER:
+			types = append(types, t)
+		case "":
+		default:
+			return nil, false
+		}
+	}
+	return types, len(types) > 0
+}
+
+// Streams samples and power events as server-sent events. Without ?ups= every
+// UPS is streamed, the latest sample of each is sent first.
+func (h *HttpApp) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("ups")
+	if len(name) > 0 && h.GetUPS(name) == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	types, ok := parseStreamTypes(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sub := h.Stream.Subscribe(name, types)
+	defer h.Stream.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", tripplite.STREAM_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("X-Change-Id", h.ChangeId)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("retry: " + strconv.Itoa(STREAM_RETRY) + "\n\n"))
+
+	if sub.types[tripplite.STREAM_EVENT_METRICS] {
+		for _, m := range h.AllLatestMetrics() {
+			if len(name) > 0 && m.Name != name {
+				continue
+			}
+			data, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			tripplite.NewStreamMessage(0, tripplite.STREAM_EVENT_METRICS, data, h.GetSecret()).WriteTo(w)
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		case item, ok := <-sub.messages:
+			if !ok {
+				return
+			}
+			if _, err := item.Message.WriteTo(w); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
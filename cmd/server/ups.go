@@ -0,0 +1,133 @@
+package main
+
+import (
+	"time"
+
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+type MonitorOpener func() (*tripplite.SmartProUPSMonitor, error)
+
+// A single UPS served by the HttpApp, each one has its own poll loop, history
+// and listeners (scripts).
+type UPS struct {
+	Name      string
+	History   []*tripplite.UPSMetrics
+	Limit     int
+	Delay     time.Duration
+	Listeners []UPSMetricsListener
+	Monitor   *tripplite.SmartProUPSMonitor
+	Open      MonitorOpener
+	Runtime   *tripplite.RuntimeEstimator
+	Store     *tripplite.MetricsStore
+	Detector  *tripplite.EventDetector
+	Events    []tripplite.PowerEvent
+	EventSize int
+	EventLog  *tripplite.EventStore
+}
+
+func NewUPS(name string, limit int, delay time.Duration) *UPS {
+	if limit < 1 {
+		limit = 1
+	}
+	return &UPS{
+		Name:      name,
+		History:   make([]*tripplite.UPSMetrics, 0, limit),
+		Limit:     limit,
+		Delay:     delay,
+		Listeners: []UPSMetricsListener{},
+		Runtime:   tripplite.NewRuntimeEstimator(tripplite.RuntimeModel{}),
+		Detector:  tripplite.NewEventDetector(tripplite.EventThresholds{}),
+		Events:    []tripplite.PowerEvent{},
+		EventSize: limit,
+	}
+}
+
+func (u *UPS) LatestMetrics() *tripplite.UPSMetrics {
+	l := len(u.History)
+	if l == 0 {
+		return nil
+	}
+	return u.History[l-1]
+}
+
+func (u *UPS) append(m *tripplite.UPSMetrics) {
+	if u.Runtime != nil {
+		m.RuntimeRemaining = u.Runtime.Estimate(m)
+	}
+	if len(u.History) >= u.Limit {
+		u.History = u.History[1:]
+	}
+	u.History = append(u.History, m)
+}
+
+// Restores the newest samples from the store and learns from them.
+func (u *UPS) Restore() error {
+	if u.Store == nil {
+		return nil
+	}
+	samples, err := u.Store.Tail(u.Limit)
+	if err != nil {
+		return err
+	}
+	if u.Runtime != nil {
+		u.Runtime.Learn(samples)
+	}
+	u.History = samples
+	log.Info().Str("ups", u.Name).Int("samples", len(samples)).Msg("restored history")
+	return nil
+}
+
+// Calls Open until it succeeds, backing off between attempts. Returns nil if
+// done is closed first.
+func (u *UPS) openWithRetry(done <-chan struct{}) *tripplite.SmartProUPSMonitor {
+	delay := tripplite.RECONNECT_MIN_DELAY
+	for {
+		mon, err := u.Open()
+		if err == nil {
+			return mon
+		}
+
+		log.Warn().Err(err).Str("ups", u.Name).Dur("retry", delay).Msg("failed to open device, retrying")
+		select {
+		case <-done:
+			return nil
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > tripplite.RECONNECT_MAX_DELAY {
+			delay = tripplite.RECONNECT_MAX_DELAY
+		}
+	}
+}
+
+// Summary of a UPS returned by /ups.
+type UPSInfo struct {
+	Name          string
+	Manufacturer  string
+	Product       string
+	Serial        string
+	Path          string
+	Protocol      string
+	Communication string
+	Status        string
+}
+
+// Callers hold the app's lock, which guards Monitor.
+func (u *UPS) Info() UPSInfo {
+	info := UPSInfo{Name: u.Name}
+	if mon := u.Monitor; mon != nil {
+		device := mon.DeviceInfo()
+		info.Manufacturer = device.Manufacturer
+		info.Product = device.Product
+		info.Serial = device.Serial
+		info.Path = device.Path
+		info.Protocol = mon.GetProtocolName()
+	}
+	if m := u.LatestMetrics(); m != nil {
+		info.Communication = m.Communication
+		info.Status = m.Status
+	}
+	return info
+}
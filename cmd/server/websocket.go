@@ -0,0 +1,220 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/matutter/tripplite/pkg/tripplite"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// Interval of WebSocket pings, a connection which misses two is closed.
+	SOCKET_PING_INTERVAL = 30 * time.Second
+	SOCKET_WRITE_TIMEOUT = 10 * time.Second
+	// Largest accepted message from a client.
+	SOCKET_MAX_MESSAGE int64 = COMMAND_MAX_SIZE * 2
+)
+
+// Browsers are held to the same origin by the default origin check, other
+// clients send no Origin header.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// The subscriptions of one connection, keyed by UPS name with "" for every
+// UPS.
+type socketSubscriptions struct {
+	lock   sync.Mutex
+	topics map[string]map[string]bool
+}
+
+func (s *socketSubscriptions) subscribe(ups string, topics []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.topics[ups] == nil {
+		s.topics[ups] = map[string]bool{}
+	}
+	for _, topic := range topics {
+		s.topics[ups][topic] = true
+	}
+}
+
+// Removes topics from a subscription, every topic when none are given. An
+// empty UPS drops every subscription.
+func (s *socketSubscriptions) unsubscribe(ups string, topics []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(ups) == 0 && len(topics) == 0 {
+		s.topics = map[string]map[string]bool{}
+		return
+	}
+	if len(topics) == 0 {
+		delete(s.topics, ups)
+		return
+	}
+	for _, topic := range topics {
+		delete(s.topics[ups], topic)
+	}
+}
+
+func (s *socketSubscriptions) wants(ups string, topic string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.topics[""][topic] || s.topics[ups][topic]
+}
+
+// Topics of a subscribe message, both when none are given.
+func socketTopics(topics []string) ([]string, bool) {
+	if len(topics) == 0 {
+		return []string{tripplite.SOCKET_METRICS, tripplite.SOCKET_EVENT}, true
+	}
+	selected := []string{}
+	for _, topic := range topics {
+		switch topic = strings.ToLower(topic); topic {
+		case tripplite.SOCKET_METRICS, tripplite.SOCKET_EVENT:
+			selected = append(selected, topic)
+		default:
+			return nil, false
+		}
+	}
+	return selected, true
+}
+
+// Handles one message from the client, returning the reply if there is one.
+func (h *HttpApp) handleSocketMessage(req tripplite.SocketMessage, subs *socketSubscriptions, remote string) *tripplite.SocketMessage {
+	res := &tripplite.SocketMessage{Id: req.Id, UPS: req.UPS}
+	fail := func(err string) *tripplite.SocketMessage {
+		res.Type = tripplite.SOCKET_ERROR
+		res.Error = err
+		return res
+	}
+
+	switch req.Type {
+	case tripplite.SOCKET_PING:
+		res.Type = tripplite.SOCKET_PONG
+		return res
+
+	case tripplite.SOCKET_SUBSCRIBE, tripplite.SOCKET_UNSUBSCRIBE:
+		if len(req.UPS) > 0 && h.GetUPS(req.UPS) == nil {
+			return fail("unknown ups")
+		}
+		if req.Type == tripplite.SOCKET_UNSUBSCRIBE {
+			subs.unsubscribe(req.UPS, req.Topics)
+			res.Type = tripplite.SOCKET_RESULT
+			return res
+		}
+		topics, ok := socketTopics(req.Topics)
+		if !ok {
+			return fail("unknown topic")
+		}
+		subs.subscribe(req.UPS, topics)
+		res.Type = tripplite.SOCKET_RESULT
+		res.Topics = topics
+		return res
+
+	case tripplite.SOCKET_COMMAND:
+		u := h.GetUPS(req.UPS)
+		if u == nil {
+			return fail("unknown ups")
+		}
+		cmd, _, err := h.verifyCommandRequest(req.Data, req.HMAC, u)
+		if err != nil {
+			log.Warn().Err(err).Str("ups", u.Name).Str("remote", remote).Msg("rejected command")
+			return fail(err.Error())
+		}
+		out, _ := h.runCommand(u, cmd)
+		res.Type = tripplite.SOCKET_RESULT
+		res.UPS = u.Name
+		res.Error = out.Error
+		res.SetData(out, h.GetSecret())
+		return res
+	}
+
+	return fail("unknown message type")
+}
+
+// Multiplexes metric and event subscriptions with signed commands over one
+// WebSocket. Nothing is pushed until the client subscribes.
+func (h *HttpApp) handleSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied
+		log.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	subs := &socketSubscriptions{topics: map[string]map[string]bool{}}
+	sub := h.Stream.Subscribe("", []string{tripplite.SOCKET_METRICS, tripplite.SOCKET_EVENT})
+	defer h.Stream.Unsubscribe(sub)
+
+	replies := make(chan *tripplite.SocketMessage, STREAM_BUFFER)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	// the only goroutine writing to conn
+	go func() {
+		ping := time.NewTicker(SOCKET_PING_INTERVAL)
+		defer ping.Stop()
+		defer conn.Close()
+		defer close(stopped)
+		for {
+			var out *tripplite.SocketMessage
+			select {
+			case <-done:
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(SOCKET_WRITE_TIMEOUT))
+				return
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(SOCKET_WRITE_TIMEOUT)); err != nil {
+					return
+				}
+				continue
+			case out = <-replies:
+			case item, ok := <-sub.messages:
+				if !ok {
+					conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(SOCKET_WRITE_TIMEOUT))
+					return
+				}
+				msg := item.Message
+				if !subs.wants(item.UPS, msg.Event) {
+					continue
+				}
+				out = &tripplite.SocketMessage{Type: msg.Event, UPS: item.UPS, Data: msg.Data, HMAC: msg.HMAC}
+			}
+			conn.SetWriteDeadline(time.Now().Add(SOCKET_WRITE_TIMEOUT))
+			if err := conn.WriteJSON(out); err != nil {
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	conn.SetReadLimit(SOCKET_MAX_MESSAGE)
+	conn.SetReadDeadline(time.Now().Add(2 * SOCKET_PING_INTERVAL))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * SOCKET_PING_INTERVAL))
+	})
+
+	for {
+		req := tripplite.SocketMessage{}
+		if err := conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Debug().Err(err).Str("remote", r.RemoteAddr).Msg("websocket closed")
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * SOCKET_PING_INTERVAL))
+		if res := h.handleSocketMessage(req, subs, r.RemoteAddr); res != nil {
+			select {
+			case replies <- res:
+			case <-stopped:
+				return
+			}
+		}
+	}
+}
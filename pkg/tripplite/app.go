@@ -2,8 +2,10 @@ package tripplite
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/http"
 )
@@ -15,6 +17,13 @@ type App interface {
 	IsStale() bool
 }
 
+// HMAC-SHA256 of msg, sent base64 encoded in the X-Content-Hash header.
+func ComputeHMAC(secret []byte, msg []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
 func ValidateHMAC(app App, msg []byte, expectedMACB64 string) (bool, error) {
 	if !app.HMACEnabled() {
 		return true, nil
@@ -29,7 +38,7 @@ func ValidateHMAC(app App, msg []byte, expectedMACB64 string) (bool, error) {
 		return false, fmt.Errorf("HMAC secret value is empty")
 	}
 
-	mac := hmac.New(sha256.New, secret).Sum(msg)
+	mac := ComputeHMAC(secret, msg)
 	expectedMAC, err := base64.RawStdEncoding.DecodeString(expectedMACB64)
 	if err != nil {
 		return false, err
@@ -40,7 +49,7 @@ func ValidateHMAC(app App, msg []byte, expectedMACB64 string) (bool, error) {
 func SetHMACHeaders(app App, msg []byte, w http.ResponseWriter) {
 	secret := app.GetSecret()
 	if len(secret) > 0 {
-		mac := hmac.New(sha256.New, secret).Sum(msg)
+		mac := ComputeHMAC(secret, msg)
 		w.Header().Add(HTTP_CONTENT_HASH_HEADER, base64.RawStdEncoding.EncodeToString(mac))
 	}
 }
@@ -49,3 +58,29 @@ type PublicConfig struct {
 	Delay   string         `json:"delay"`
 	Scripts []PublicScript `json:"scripts"`
 }
+
+// Body of POST /command, signed like every other message. Timestamp is unix
+// seconds and Nonce is unique per request, together they guard against
+// replaying a captured request. UPS names the target so a request cannot be
+// replayed against another UPS.
+type CommandRequest struct {
+	UPS       string `json:"ups"`
+	Command   string `json:"command"`
+	Delay     string `json:"delay,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+}
+
+// A random nonce for a signed message.
+func NewNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+type CommandResponse struct {
+	UPS     string `json:"ups"`
+	Command string `json:"command"`
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
@@ -0,0 +1,138 @@
+package tripplite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+const (
+	CHARGE_CURVE_LINEAR = "linear"
+	CHARGE_CURVE_SQRT   = "sqrt"
+	CHARGE_CURVE_TABLE  = "table"
+)
+
+var (
+	// The curve GetStats has always used, charge at or below MinVolt is
+	// reported as 10%.
+	DEFAULT_CHARGE_CURVE = ChargeCurve{
+		Type:      CHARGE_CURVE_SQRT,
+		MinVolt:   11.0,
+		MaxVolt:   13.4,
+		MinCharge: 10.0,
+	}
+)
+
+// One point of a table curve, the charge at a voltage per 12V block.
+type ChargePoint struct {
+	Volt   float64 `yaml:"volt" json:"volt"`
+	Charge float64 `yaml:"charge" json:"charge"`
+}
+
+// Maps the battery voltage of a 12V block to a charge in percent. Linear and
+// sqrt curves run from MinVolt (0%) to MaxVolt (100%) and report MinCharge at
+// or below MinVolt. A table is interpolated linearly between its points.
+type ChargeCurve struct {
+	Type      string        `yaml:"type" json:"type"`
+	MinVolt   float64       `yaml:"min_volt" json:"min_volt"`
+	MaxVolt   float64       `yaml:"max_volt" json:"max_volt"`
+	MinCharge float64       `yaml:"min_charge" json:"min_charge"`
+	Table     []ChargePoint `yaml:"table" json:"table"`
+}
+
+func (c ChargeCurve) IsZero() bool {
+	return len(c.Type) == 0 && c.MinVolt == 0 && c.MaxVolt == 0 && len(c.Table) == 0
+}
+
+func (c ChargeCurve) Validate() error {
+	switch strings.ToLower(c.Type) {
+	case CHARGE_CURVE_LINEAR, CHARGE_CURVE_SQRT:
+		if c.MaxVolt <= c.MinVolt {
+			return fmt.Errorf("%s curve needs max_volt above min_volt", c.Type)
+		}
+	case CHARGE_CURVE_TABLE:
+		if len(c.Table) < 2 {
+			return fmt.Errorf("table curve needs at least two points")
+		}
+	default:
+		return fmt.Errorf("unknown charge curve %q", c.Type)
+	}
+	return nil
+}
+
+func (c ChargeCurve) tableCharge(bv_12v float64) float64 {
+	points := append([]ChargePoint{}, c.Table...)
+	sort.Slice(points, func(i, j int) bool { return points[i].Volt < points[j].Volt })
+
+	if bv_12v <= points[0].Volt {
+		return points[0].Charge
+	}
+	for i := 1; i < len(points); i++ {
+		a, b := points[i-1], points[i]
+		if bv_12v <= b.Volt {
+			return a.Charge + (b.Charge-a.Charge)*(bv_12v-a.Volt)/(b.Volt-a.Volt)
+		}
+	}
+	return points[len(points)-1].Charge
+}
+
+func (c ChargeCurve) Charge(bv_12v float64) float64 {
+	var charge float64
+	switch strings.ToLower(c.Type) {
+	case CHARGE_CURVE_TABLE:
+		if len(c.Table) == 0 {
+			return 0
+		}
+		charge = c.tableCharge(bv_12v)
+	case CHARGE_CURVE_LINEAR, CHARGE_CURVE_SQRT:
+		if bv_12v >= c.MaxVolt {
+			return 100.0
+		} else if bv_12v <= c.MinVolt {
+			return c.MinCharge
+		}
+		charge = (bv_12v - c.MinVolt) / (c.MaxVolt - c.MinVolt)
+		if strings.EqualFold(c.Type, CHARGE_CURVE_SQRT) {
+			charge = math.Sqrt(charge)
+		}
+		charge *= 100.0
+	default:
+		return DEFAULT_CHARGE_CURVE.Charge(bv_12v)
+	}
+	return round2(math.Max(0, math.Min(100, charge)))
+}
+
+// Curves for a battery pack. The charger raises the battery voltage while on
+// line, so a separate Charging curve can be given, Discharging is used on
+// battery and whenever Charging is not set. An empty model uses
+// DEFAULT_CHARGE_CURVE.
+type ChargeModel struct {
+	Discharging ChargeCurve `yaml:"discharging" json:"discharging"`
+	Charging    ChargeCurve `yaml:"charging" json:"charging"`
+}
+
+func (c ChargeModel) Validate() error {
+	if !c.Discharging.IsZero() {
+		if err := c.Discharging.Validate(); err != nil {
+			return fmt.Errorf("discharging: %w", err)
+		}
+	}
+	if !c.Charging.IsZero() {
+		if err := c.Charging.Validate(); err != nil {
+			return fmt.Errorf("charging: %w", err)
+		}
+	}
+	return nil
+}
+
+// Charge in percent for the voltage of a 12V block and the UPS status.
+func (c ChargeModel) Charge(bv_12v float64, status string) float64 {
+	curve := c.Discharging
+	if strings.EqualFold(status, "OL") && !c.Charging.IsZero() {
+		curve = c.Charging
+	}
+	if curve.IsZero() {
+		curve = DEFAULT_CHARGE_CURVE
+	}
+	return curve.Charge(bv_12v)
+}
@@ -0,0 +1,81 @@
+package tripplite
+
+import (
+	"testing"
+)
+
+func TestChargeCurves(t *testing.T) {
+	linear := ChargeCurve{Type: CHARGE_CURVE_LINEAR, MinVolt: 11.0, MaxVolt: 13.0}
+	table := ChargeCurve{Type: CHARGE_CURVE_TABLE, Table: []ChargePoint{
+		{Volt: 12.7, Charge: 100},
+		{Volt: 11.6, Charge: 0},
+		{Volt: 12.2, Charge: 50},
+	}}
+
+	tests := []struct {
+		name     string
+		curve    ChargeCurve
+		voltage  float64
+		expected float64
+	}{
+		{"default full", ChargeCurve{}, 13.5, 100},
+		{"default empty", ChargeCurve{}, 10.5, 10},
+		{"default sqrt", ChargeCurve{}, 12.8, 86.6},
+		{"linear", linear, 12.5, 75},
+		{"linear below", linear, 10.0, 0},
+		{"table between", table, 11.9, 25},
+		{"table point", table, 12.2, 50},
+		{"table above", table, 13.0, 100},
+		{"table below", table, 11.0, 0},
+	}
+
+	for _, test := range tests {
+		model := ChargeModel{Discharging: test.curve}
+		if charge := model.Charge(test.voltage, "OB"); charge != test.expected {
+			t.Errorf("%s: expected %v at %vV, got %v", test.name, test.expected, test.voltage, charge)
+		}
+	}
+}
+
+func TestChargeModelCharging(t *testing.T) {
+	model := ChargeModel{
+		Discharging: ChargeCurve{Type: CHARGE_CURVE_LINEAR, MinVolt: 11.0, MaxVolt: 13.0},
+		Charging:    ChargeCurve{Type: CHARGE_CURVE_LINEAR, MinVolt: 12.0, MaxVolt: 14.0},
+	}
+	if charge := model.Charge(13.0, "OL"); charge != 50 {
+		t.Errorf("expected charging curve on line, got %v", charge)
+	}
+	if charge := model.Charge(13.0, "OB"); charge != 100 {
+		t.Errorf("expected discharging curve on battery, got %v", charge)
+	}
+
+	if err := model.Validate(); err != nil {
+		t.Error(err)
+	}
+	invalid := []ChargeModel{
+		{Discharging: ChargeCurve{Type: "cubic"}},
+		{Discharging: ChargeCurve{Type: CHARGE_CURVE_SQRT, MinVolt: 13, MaxVolt: 11}},
+		{Charging: ChargeCurve{Type: CHARGE_CURVE_TABLE, Table: []ChargePoint{{Volt: 12, Charge: 50}}}},
+	}
+	for _, model := range invalid {
+		if err := model.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", model)
+		}
+	}
+}
+
+func TestGetStatsChargeModel(t *testing.T) {
+	mon, err := NewSmartProUPSMonitorWithTransport(newSmartProTestTransport(smartProReplies), DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mon.ChargeModel = ChargeModel{Discharging: ChargeCurve{Type: CHARGE_CURVE_LINEAR, MinVolt: 12.0, MaxVolt: 14.0}}
+
+	m, err := mon.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.BatteryCharge != 70 {
+		t.Errorf("expected 70%% at 13.4V from the linear curve, got %v", m.BatteryCharge)
+	}
+}
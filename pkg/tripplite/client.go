@@ -12,8 +12,8 @@ import (
 )
 
 type Config struct {
-	DelayString string        `json:"delay"`
-	Scripts     []WatchScript `json:"scripts"`
+	DelayString string         `json:"delay"`
+	Scripts     []PublicScript `json:"scripts"`
 	Delay       time.Duration
 }
 
@@ -42,12 +42,12 @@ func (h *HttpApp) applyAutoConfig(base_url string) error {
 		return err
 	}
 
-	watcher := Watcher{}
+	watcher := NewWatcher()
 	for _, script := range config.Scripts {
-		watcher.AddScript(script)
+		watcher.AddPublicScript(script)
 	}
 
-	h.Listeners = []UPSMetricsListener{&watcher}
+	h.Listeners = []UPSMetricsListener{watcher}
 	h.Delay = config.Delay
 	return nil
 }
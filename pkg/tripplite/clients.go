@@ -0,0 +1,32 @@
+package tripplite
+
+// Kinds of ClientReport.
+const (
+	CLIENT_REPORT_REGISTER  = "register"
+	CLIENT_REPORT_HEARTBEAT = "heartbeat"
+	CLIENT_REPORT_RESULT    = "result"
+)
+
+// The outcome of a script run, ExitCode is -1 when the script did not start.
+type ScriptResult struct {
+	Script   string `json:"script"`
+	Cancel   bool   `json:"cancel"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	Start    int64  `json:"start"`
+	End      int64  `json:"end"`
+}
+
+// Body of POST /clients, signed like commands and with a nonce of its own. Every report carries the
+// hostname so a restarted server learns about the client from its next
+// heartbeat, Scripts is left out of result reports.
+type ClientReport struct {
+	Type      string        `json:"type"`
+	Id        string        `json:"id"`
+	Hostname  string        `json:"hostname"`
+	UPS       string        `json:"ups,omitempty"`
+	Scripts   []string      `json:"scripts,omitempty"`
+	Result    *ScriptResult `json:"result,omitempty"`
+	Timestamp int64         `json:"timestamp"`
+	Nonce     string        `json:"nonce"`
+}
@@ -0,0 +1,261 @@
+/**
+ * Instant commands from https://github.com/networkupstools/nut/blob/v2.7.4/drivers/tripplite_usb.c
+ */
+
+package tripplite
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Instant command names, the same as NUT's.
+const (
+	CMD_TEST_BATTERY_START = "test.battery.start"
+	CMD_LOAD_OFF           = "load.off"
+	CMD_LOAD_ON            = "load.on"
+	CMD_SHUTDOWN_RETURN    = "shutdown.return"
+	CMD_SHUTDOWN_STAYOFF   = "shutdown.stayoff"
+	CMD_SHUTDOWN_REBOOT    = "shutdown.reboot"
+	CMD_RESET_WATCHDOG     = "reset.watchdog"
+	CMD_RESET_INPUT_MINMAX = "reset.input.minmax"
+	// outlet.<bank>.load.off and outlet.<bank>.load.on switch a single bank.
+	CMD_OUTLET_FORMAT = "outlet.%d.load.%s"
+)
+
+const (
+	LOAD_BANK_ON      = "on"
+	LOAD_BANK_OFF     = "off"
+	LOAD_BANK_UNKNOWN = "unknown"
+)
+
+var (
+	INSTANT_COMMANDS = []string{
+		CMD_TEST_BATTERY_START,
+		CMD_LOAD_OFF,
+		CMD_LOAD_ON,
+		CMD_SHUTDOWN_RETURN,
+		CMD_SHUTDOWN_STAYOFF,
+		CMD_SHUTDOWN_REBOOT,
+		CMD_RESET_WATCHDOG,
+		CMD_RESET_INPUT_MINMAX,
+	}
+
+	ErrUnknownCommand     = errors.New("unknown command")
+	ErrUnsupportedCommand = errors.New("command not supported by protocol")
+	ErrCommandRejected    = errors.New("device did not acknowledge command")
+	ErrNoSuchLoadBank     = errors.New("no such load bank")
+
+	// Pause between setting the shutdown delay and the shutdown command.
+	SHUTDOWN_COMMAND_DELAY = 2 * time.Second
+)
+
+// Sends a control command and checks the device echoed its code.
+func (m *SmartProUPSMonitor) sendControl(cmd ...byte) error {
+	reply, err := m.SendCommand(cmd)
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 || reply[0] != cmd[0] {
+		return fmt.Errorf("%w: %c", ErrCommandRejected, cmd[0])
+	}
+	log.Debug().Str("ups", m.Name).Hex("cmd", cmd).Msg("command acknowledged")
+	return nil
+}
+
+func (m *SmartProUPSMonitor) isSmart() bool {
+	decoder, err := getProtocolDecoder(m.Protocol)
+	return err == nil && decoder.Smart
+}
+
+// Sets the delay in seconds before a following 'G' or 'K' cuts the load.
+func (m *SmartProUPSMonitor) setShutdownDelay(delay time.Duration) error {
+	seconds := uint16(delay.Seconds())
+	if delay.Seconds() > 0xffff {
+		seconds = 0xffff
+	}
+	return m.sendControl('N', byte(seconds>>8), byte(seconds))
+}
+
+// Starts a battery self-test ('A'), the result shows in the status flags.
+func (m *SmartProUPSMonitor) TestBattery() error {
+	if !m.isSmart() {
+		return ErrUnsupportedCommand
+	}
+	return m.sendControl('A')
+}
+
+// Switches an outlet bank, bank 0 is the whole load. SMART protocols need
+// the 'N' delay set before 'K' is accepted. NUT's control_outlet() sends this
+// delay as two hex ASCII digits ("N%02X"), unlike the binary delay its
+// soft_shutdown() and setShutdownDelay send, so both encodings are kept.
+func (m *SmartProUPSMonitor) switchOutlet(bank int, on bool) error {
+	if !m.isSmart() {
+		return ErrUnsupportedCommand
+	}
+	state := byte('0')
+	if on {
+		state = '1'
+	}
+	if err := m.sendControl([]byte(fmt.Sprintf("N%02X", 5))...); err != nil {
+		return err
+	}
+	if err := m.sendControl('K', byte('0'+bank), state); err != nil {
+		return err
+	}
+	m.setLoadBankState(bank, on)
+	return nil
+}
+
+// State of one switchable load bank. The protocol has no reply reporting
+// outlet state, so it is the state last switched through this monitor, banks
+// not switched since it started are left out.
+type LoadBank struct {
+	Bank  int    `json:"Bank"`
+	State string `json:"State"`
+}
+
+func loadBankState(on bool) string {
+	if on {
+		return LOAD_BANK_ON
+	}
+	return LOAD_BANK_OFF
+}
+
+// Records the bank count reported by 'V' and returns the banks switched
+// through this monitor.
+func (m *SmartProUPSMonitor) updateLoadBanks(count int) []LoadBank {
+	m.bankLock.Lock()
+	defer m.bankLock.Unlock()
+	m.loadBanks = count
+	var banks []LoadBank
+	for bank := 1; bank <= count; bank++ {
+		if state, ok := m.bankStates[bank]; ok {
+			banks = append(banks, LoadBank{Bank: bank, State: state})
+		}
+	}
+	return banks
+}
+
+func (m *SmartProUPSMonitor) setLoadBankState(bank int, on bool) {
+	m.bankLock.Lock()
+	defer m.bankLock.Unlock()
+	if m.bankStates == nil {
+		m.bankStates = map[int]string{}
+	}
+	if bank > 0 {
+		m.bankStates[bank] = loadBankState(on)
+		return
+	}
+	for i := 1; i <= m.loadBanks; i++ {
+		m.bankStates[i] = loadBankState(on)
+	}
+}
+
+// Returns the state a load bank, numbered from 1, was last switched to by
+// this monitor. It is not read from the UPS, which cannot report it, so it is
+// unknown until the bank is switched and misses changes made elsewhere.
+func (m *SmartProUPSMonitor) LastSwitchedState(bank int) (string, error) {
+	m.bankLock.Lock()
+	defer m.bankLock.Unlock()
+	if bank < 1 || bank > m.loadBanks {
+		return "", fmt.Errorf("%w: %d", ErrNoSuchLoadBank, bank)
+	}
+	if state, ok := m.bankStates[bank]; ok {
+		return state, nil
+	}
+	return LOAD_BANK_UNKNOWN, nil
+}
+
+// Switches one load bank, numbered from 1 up to the LoadBanks of the last
+// sample.
+func (m *SmartProUPSMonitor) SwitchLoadBank(bank int, on bool) error {
+	m.bankLock.Lock()
+	count := m.loadBanks
+	m.bankLock.Unlock()
+	if bank < 1 || bank > count {
+		return fmt.Errorf("%w: %d", ErrNoSuchLoadBank, bank)
+	}
+	return m.switchOutlet(bank, on)
+}
+
+func (m *SmartProUPSMonitor) LoadOff() error {
+	return m.switchOutlet(0, false)
+}
+
+func (m *SmartProUPSMonitor) LoadOn() error {
+	return m.switchOutlet(0, true)
+}
+
+// Cuts the load after delay and restores it when mains power returns. The UPS
+// must be on battery for this to work.
+func (m *SmartProUPSMonitor) ShutdownReturn(delay time.Duration) error {
+	if err := m.setShutdownDelay(delay); err != nil {
+		return err
+	}
+	time.Sleep(SHUTDOWN_COMMAND_DELAY)
+	return m.sendControl('G')
+}
+
+// Cuts the load after delay and keeps it off until switched on.
+func (m *SmartProUPSMonitor) ShutdownStayOff(delay time.Duration) error {
+	if err := m.setShutdownDelay(delay); err != nil {
+		return err
+	}
+	time.Sleep(SHUTDOWN_COMMAND_DELAY)
+	return m.sendControl('K', 0)
+}
+
+// Arms the watchdog ('W'), the load is power cycled unless the watchdog is
+// reset again within delay. The delay is one byte of seconds, 0 reboots now.
+func (m *SmartProUPSMonitor) ResetWatchdog(delay time.Duration) error {
+	seconds := byte(delay.Seconds())
+	if delay.Seconds() > 0xff {
+		seconds = 0xff
+	}
+	return m.sendControl('W', seconds)
+}
+
+// Power cycles the load immediately.
+func (m *SmartProUPSMonitor) Reboot() error {
+	return m.ResetWatchdog(0)
+}
+
+// Runs an instant command by its NUT name, delay is used by the shutdown and
+// watchdog commands.
+func (m *SmartProUPSMonitor) InstantCommand(name string, delay time.Duration) error {
+	log.Info().Str("ups", m.Name).Str("command", name).Dur("delay", delay).Msg("running instant command")
+	switch name {
+	case CMD_TEST_BATTERY_START:
+		return m.TestBattery()
+	case CMD_LOAD_OFF:
+		return m.LoadOff()
+	case CMD_LOAD_ON:
+		return m.LoadOn()
+	case CMD_SHUTDOWN_RETURN:
+		return m.ShutdownReturn(delay)
+	case CMD_SHUTDOWN_STAYOFF:
+		return m.ShutdownStayOff(delay)
+	case CMD_SHUTDOWN_REBOOT:
+		return m.Reboot()
+	case CMD_RESET_WATCHDOG:
+		return m.ResetWatchdog(delay)
+	case CMD_RESET_INPUT_MINMAX:
+		return m.ResetInputVoltage()
+	}
+
+	var bank int
+	var state string
+	if n, _ := fmt.Sscanf(name, CMD_OUTLET_FORMAT, &bank, &state); n == 2 {
+		switch state {
+		case "off":
+			return m.SwitchLoadBank(bank, false)
+		case "on":
+			return m.SwitchLoadBank(bank, true)
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+}
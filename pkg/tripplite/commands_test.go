@@ -0,0 +1,143 @@
+package tripplite
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestInstantCommands(t *testing.T) {
+	SHUTDOWN_COMMAND_DELAY = 0
+
+	replies := map[byte][]byte{}
+	for code, reply := range smartProReplies {
+		replies[code] = reply
+	}
+	for _, code := range []byte{'A', 'G', 'K', 'N', 'W'} {
+		replies[code] = []byte{code}
+	}
+
+	tests := []struct {
+		command string
+		delay   time.Duration
+		sent    [][]byte
+	}{
+		{CMD_TEST_BATTERY_START, 0, [][]byte{{'A'}}},
+		// outlets take the 'N' delay in hex ASCII, shutdowns in binary
+		{CMD_LOAD_OFF, 0, [][]byte{[]byte("N05"), []byte("K00")}},
+		{CMD_LOAD_ON, 0, [][]byte{[]byte("N05"), []byte("K01")}},
+		{CMD_SHUTDOWN_RETURN, 300 * time.Second, [][]byte{{'N', 0x01, 0x2c}, {'G'}}},
+		{CMD_SHUTDOWN_STAYOFF, 10 * time.Second, [][]byte{{'N', 0, 10}, {'K', 0}}},
+		{CMD_SHUTDOWN_REBOOT, 0, [][]byte{{'W', 0}}},
+		{CMD_RESET_WATCHDOG, 30 * time.Second, [][]byte{{'W', 30}}},
+		{CMD_RESET_INPUT_MINMAX, 0, [][]byte{{'Z'}}},
+	}
+
+	for _, test := range tests {
+		transport := newSmartProTestTransport(replies)
+		mon, err := NewSmartProUPSMonitorWithTransport(transport, DeviceInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		probes := len(transport.Sent)
+
+		if err := mon.InstantCommand(test.command, test.delay); err != nil {
+			t.Errorf("%s: %v", test.command, err)
+			continue
+		}
+
+		sent := transport.Sent[probes:]
+		if len(sent) != len(test.sent) {
+			t.Errorf("%s: expected %q, sent %q", test.command, test.sent, sent)
+			continue
+		}
+		for i := range sent {
+			if !bytes.Equal(sent[i], test.sent[i]) {
+				t.Errorf("%s: expected % x, sent % x", test.command, test.sent[i], sent[i])
+			}
+		}
+	}
+}
+
+func TestInstantCommandErrors(t *testing.T) {
+	mon, err := NewSmartProUPSMonitorWithTransport(newSmartProTestTransport(smartProReplies), DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mon.InstantCommand("beeper.toggle", 0); !errors.Is(err, ErrUnknownCommand) {
+		t.Errorf("expected ErrUnknownCommand, got %v", err)
+	}
+	if err := mon.TestBattery(); err == nil {
+		t.Error("expected error when the device does not acknowledge")
+	}
+
+	omnivs := map[byte][]byte{0: {0, 0x10, 0x01}, 'A': {'A'}}
+	mon, err = NewSmartProUPSMonitorWithTransport(newSmartProTestTransport(omnivs), DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mon.TestBattery(); !errors.Is(err, ErrUnsupportedCommand) {
+		t.Errorf("expected ErrUnsupportedCommand, got %v", err)
+	}
+}
+
+func TestSwitchLoadBank(t *testing.T) {
+	replies := map[byte][]byte{}
+	for code, reply := range smartProReplies {
+		replies[code] = reply
+	}
+	replies['K'] = []byte{'K'}
+	replies['N'] = []byte{'N'}
+
+	transport := newSmartProTestTransport(replies)
+	mon, err := NewSmartProUPSMonitorWithTransport(transport, DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mon.SwitchLoadBank(1, false); !errors.Is(err, ErrNoSuchLoadBank) {
+		t.Errorf("expected ErrNoSuchLoadBank before the bank count is known, got %v", err)
+	}
+
+	m, err := mon.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.LoadBanks != 2 || len(m.LoadBankStates) != 0 {
+		t.Fatalf("expected banks which were never switched to be left out, got %+v", m.LoadBankStates)
+	}
+	if state, _ := mon.LastSwitchedState(1); state != LOAD_BANK_UNKNOWN {
+		t.Errorf("expected bank 1 unknown, got %s", state)
+	}
+
+	if err := mon.InstantCommand("outlet.2.load.off", 0); err != nil {
+		t.Fatal(err)
+	}
+	if sent := transport.Sent[len(transport.Sent)-2:]; string(sent[0]) != "N05" || string(sent[1]) != "K20" {
+		t.Errorf("expected N05 K20, sent %q", sent)
+	}
+	if state, _ := mon.LastSwitchedState(2); state != LOAD_BANK_OFF {
+		t.Errorf("expected bank 2 off, got %s", state)
+	}
+	m, _ = mon.GetStats()
+	if len(m.LoadBankStates) != 1 || m.LoadBankStates[0] != (LoadBank{Bank: 2, State: LOAD_BANK_OFF}) {
+		t.Errorf("expected only bank 2, got %+v", m.LoadBankStates)
+	}
+	if err := mon.SwitchLoadBank(3, false); !errors.Is(err, ErrNoSuchLoadBank) {
+		t.Errorf("expected ErrNoSuchLoadBank, got %v", err)
+	}
+
+	if err := mon.LoadOn(); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = mon.GetStats()
+	if len(m.LoadBankStates) != 2 {
+		t.Errorf("expected both banks after load.on, got %+v", m.LoadBankStates)
+	}
+	for _, bank := range m.LoadBankStates {
+		if bank.State != LOAD_BANK_ON {
+			t.Errorf("expected every bank on after load.on, got %+v", m.LoadBankStates)
+		}
+	}
+}
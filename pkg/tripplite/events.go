@@ -0,0 +1,252 @@
+package tripplite
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Power event types. Most events span from when a condition starts until it
+// clears, EVENT_BACK_ON_LINE marks the end of an outage and spans the outage.
+const (
+	EVENT_ON_BATTERY       = "on_battery"
+	EVENT_BACK_ON_LINE     = "back_on_line"
+	EVENT_LOW_BATTERY      = "low_battery"
+	EVENT_OVERLOAD         = "overload"
+	EVENT_TEMPERATURE_HIGH = "temperature_high"
+	EVENT_COMM_LOST        = "comm_lost"
+	EVENT_SELF_TEST        = "self_test"
+)
+
+var (
+	EVENT_TYPES = []string{
+		EVENT_ON_BATTERY,
+		EVENT_BACK_ON_LINE,
+		EVENT_LOW_BATTERY,
+		EVENT_OVERLOAD,
+		EVENT_TEMPERATURE_HIGH,
+		EVENT_COMM_LOST,
+		EVENT_SELF_TEST,
+	}
+)
+
+// A power event, End is 0 while the event is active. Duration is in seconds.
+type PowerEvent struct {
+	Id       string  `json:"id"`
+	UPS      string  `json:"ups"`
+	Type     string  `json:"type"`
+	Start    int64   `json:"start"`
+	End      int64   `json:"end"`
+	Duration float64 `json:"duration"`
+	Active   bool    `json:"active"`
+	Detail   string  `json:"detail,omitempty"`
+}
+
+func newPowerEvent(ups string, kind string, start int64, detail string) *PowerEvent {
+	return &PowerEvent{
+		Id:     fmt.Sprintf("%s-%s-%d", ups, kind, start),
+		UPS:    ups,
+		Type:   kind,
+		Start:  start,
+		Active: true,
+		Detail: detail,
+	}
+}
+
+func (e *PowerEvent) finish(end int64) {
+	e.End = end
+	e.Duration = float64(end - e.Start)
+	e.Active = false
+}
+
+// The event with the duration of an active event counted up to now.
+func (e PowerEvent) At(now time.Time) PowerEvent {
+	if e.Active {
+		e.Duration = float64(now.Unix() - e.Start)
+	}
+	return e
+}
+
+// Thresholds for the overload and temperature events, zero values take the
+// defaults from WithDefaults.
+type EventThresholds struct {
+	Overload        uint    `yaml:"overload" json:"overload"`
+	TemperatureHigh float64 `yaml:"temperature_high" json:"temperature_high"`
+}
+
+func (t EventThresholds) WithDefaults() EventThresholds {
+	if t.Overload == 0 {
+		t.Overload = 100
+	}
+	if t.TemperatureHigh == 0 {
+		t.TemperatureHigh = 40.0
+	}
+	return t
+}
+
+// Turns the metrics stream of one UPS into power events.
+type EventDetector struct {
+	Thresholds EventThresholds
+	active     map[string]*PowerEvent
+	testResult string
+}
+
+func NewEventDetector(thresholds EventThresholds) *EventDetector {
+	return &EventDetector{
+		Thresholds: thresholds.WithDefaults(),
+		active:     map[string]*PowerEvent{},
+	}
+}
+
+// Continues events which were still active when the server stopped, they end
+// on the first sample without their condition.
+func (d *EventDetector) Resume(events []PowerEvent) {
+	for _, e := range events {
+		if e.Active {
+			event := e
+			d.active[e.Type] = &event
+		}
+	}
+}
+
+// Active events, oldest first.
+func (d *EventDetector) Active() []PowerEvent {
+	events := []PowerEvent{}
+	for _, e := range d.active {
+		events = append(events, *e)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start < events[j].Start })
+	return events
+}
+
+// Starts or ends the event of type kind, returning a copy of it when its
+// state changed. The detail is only recorded when the event starts.
+func (d *EventDetector) track(m *UPSMetrics, kind string, active bool, detail string) *PowerEvent {
+	current, ok := d.active[kind]
+	if active && !ok {
+		current = newPowerEvent(m.Name, kind, m.UnixTimestamp, detail)
+		d.active[kind] = current
+		event := *current
+		return &event
+	}
+	if !active && ok {
+		current.finish(m.UnixTimestamp)
+		delete(d.active, kind)
+		event := *current
+		return &event
+	}
+	return nil
+}
+
+// Returns the events which started or ended with this sample.
+func (d *EventDetector) Observe(m *UPSMetrics) []PowerEvent {
+	events := []PowerEvent{}
+	add := func(e *PowerEvent) {
+		if e != nil {
+			events = append(events, *e)
+		}
+	}
+
+	lost := m.Communication == COMM_LOST
+	add(d.track(m, EVENT_COMM_LOST, lost, ""))
+	if lost {
+		// the sample repeats the last values read, nothing else changed
+		return events
+	}
+
+	onBattery := statusMatches(m.Status, "OB")
+	if outage := d.track(m, EVENT_ON_BATTERY, onBattery, ""); outage != nil {
+		add(outage)
+		if !outage.Active && strings.EqualFold(m.Status, "OL") {
+			back := newPowerEvent(m.Name, EVENT_BACK_ON_LINE, outage.Start, fmt.Sprintf("on battery for %s", time.Duration(outage.Duration)*time.Second))
+			back.finish(m.UnixTimestamp)
+			add(back)
+		}
+	}
+
+	add(d.track(m, EVENT_LOW_BATTERY, strings.EqualFold(m.Status, "LB"), ""))
+	add(d.track(m, EVENT_OVERLOAD, m.Load >= d.Thresholds.Overload, fmt.Sprintf("load %d%%", m.Load)))
+	add(d.track(m, EVENT_TEMPERATURE_HIGH, m.TemperatureC >= d.Thresholds.TemperatureHigh, fmt.Sprintf("%.1fC", m.TemperatureC)))
+
+	if len(m.TestResult) > 0 {
+		testing := m.TestResult == TEST_RESULT_IN_PROGRESS
+		if e := d.track(m, EVENT_SELF_TEST, testing, m.TestResult); e != nil {
+			if !e.Active {
+				e.Detail = m.TestResult
+			}
+			add(e)
+		} else if !testing && len(d.testResult) > 0 && m.TestResult != d.testResult {
+			// a test which finished between two samples
+			e := newPowerEvent(m.Name, EVENT_SELF_TEST, m.UnixTimestamp, m.TestResult)
+			e.finish(m.UnixTimestamp)
+			add(e)
+		}
+		d.testResult = m.TestResult
+	}
+
+	return events
+}
+
+// Stores events as JSON lines, an event is written when it starts and again
+// when it ends.
+type EventStore struct {
+	*SegmentStore
+}
+
+func OpenEventStore(dir string, retention StoreRetention) (*EventStore, error) {
+	s, err := OpenSegmentStore(dir, retention)
+	if err != nil {
+		return nil, err
+	}
+	return &EventStore{s}, nil
+}
+
+func (s *EventStore) Append(e PowerEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ts := e.Start
+	if !e.Active {
+		ts = e.End
+	}
+	return s.SegmentStore.Append(ts, data)
+}
+
+// Events overlapping from and to (unix time, 0 for no bound) with their
+// latest state, oldest first. Every segment is read since an event may still
+// be active long after the segment holding its start.
+func (s *EventStore) Read(from int64, to int64) ([]PowerEvent, error) {
+	byId := map[string]PowerEvent{}
+	order := []string{}
+	err := s.Scan(0, 0, func(record []byte) bool {
+		e := PowerEvent{}
+		if err := json.Unmarshal(record, &e); err != nil {
+			return true
+		}
+		if _, ok := byId[e.Id]; !ok {
+			order = append(order, e.Id)
+		}
+		byId[e.Id] = e
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	events := []PowerEvent{}
+	for _, id := range order {
+		e := byId[id]
+		if to > 0 && e.Start > to {
+			continue
+		}
+		if from > 0 && !e.Active && e.End < from {
+			continue
+		}
+		events = append(events, e)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Start < events[j].Start })
+	return events, nil
+}
@@ -0,0 +1,116 @@
+package tripplite
+
+import (
+	"testing"
+)
+
+func eventTypes(events []PowerEvent) []string {
+	types := []string{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEventDetector(t *testing.T) {
+	d := NewEventDetector(EventThresholds{})
+	samples := []UPSMetrics{
+		{UnixTimestamp: 100, Status: "OL", Load: 20, TemperatureC: 25, TestResult: TEST_RESULT_PASSED},
+		{UnixTimestamp: 110, Status: "OB", Load: 20, TemperatureC: 25},
+		{UnixTimestamp: 120, Status: "LB", Load: 20, TemperatureC: 25},
+		{UnixTimestamp: 130, Status: "OL", Load: 20, TemperatureC: 25},
+		{UnixTimestamp: 140, Status: "OL", Load: 120, TemperatureC: 45},
+		{UnixTimestamp: 150, Status: "OL", Load: 20, TemperatureC: 25, Communication: COMM_LOST},
+		{UnixTimestamp: 160, Status: "OL", Load: 20, TemperatureC: 25, TestResult: TEST_RESULT_IN_PROGRESS},
+		{UnixTimestamp: 170, Status: "OL", Load: 20, TemperatureC: 25, TestResult: TEST_RESULT_BATTERY_FAILED},
+	}
+
+	events := []PowerEvent{}
+	for i := range samples {
+		samples[i].Name = "ups"
+		events = append(events, d.Observe(&samples[i])...)
+	}
+
+	expected := []struct {
+		kind     string
+		active   bool
+		duration float64
+		detail   string
+	}{
+		{EVENT_ON_BATTERY, true, 0, ""},
+		{EVENT_LOW_BATTERY, true, 0, ""},
+		{EVENT_ON_BATTERY, false, 20, ""},
+		{EVENT_BACK_ON_LINE, false, 20, "on battery for 20s"},
+		{EVENT_LOW_BATTERY, false, 10, ""},
+		{EVENT_OVERLOAD, true, 0, "load 120%"},
+		{EVENT_TEMPERATURE_HIGH, true, 0, "45.0C"},
+		{EVENT_COMM_LOST, true, 0, ""},
+		{EVENT_COMM_LOST, false, 10, ""},
+		{EVENT_OVERLOAD, false, 20, "load 120%"},
+		{EVENT_TEMPERATURE_HIGH, false, 20, "45.0C"},
+		{EVENT_SELF_TEST, true, 0, TEST_RESULT_IN_PROGRESS},
+		{EVENT_SELF_TEST, false, 10, TEST_RESULT_BATTERY_FAILED},
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %v", len(expected), eventTypes(events))
+	}
+	for i, e := range expected {
+		got := events[i]
+		if got.Type != e.kind || got.Active != e.active || got.Duration != e.duration || got.Detail != e.detail {
+			t.Errorf("event %d: expected %+v, got %+v", i, e, got)
+		}
+	}
+
+	if events[0].Id != events[2].Id {
+		t.Errorf("start and end of an event have different ids %q %q", events[0].Id, events[2].Id)
+	}
+	if len(d.Active()) != 0 {
+		t.Errorf("unexpected active events %+v", d.Active())
+	}
+}
+
+func TestEventStore(t *testing.T) {
+	store, err := OpenEventStore(t.TempDir(), StoreRetention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	d := NewEventDetector(EventThresholds{})
+	for _, m := range []UPSMetrics{
+		{Name: "ups", UnixTimestamp: 100, Status: "OB"},
+		{Name: "ups", UnixTimestamp: 200, Status: "OL"},
+		{Name: "ups", UnixTimestamp: 300, Status: "OL", Load: 150},
+	} {
+		for _, e := range d.Observe(&m) {
+			if err := store.Append(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	events, err := store.Read(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Type != EVENT_ON_BATTERY || events[0].Active || events[2].Type != EVENT_OVERLOAD || !events[2].Active {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	events, err = store.Read(250, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EVENT_OVERLOAD {
+		t.Errorf("unexpected events after 250 %+v", events)
+	}
+
+	// an active event continues after a restart
+	resumed := NewEventDetector(EventThresholds{})
+	all, _ := store.Read(0, 0)
+	resumed.Resume(all)
+	ended := resumed.Observe(&UPSMetrics{Name: "ups", UnixTimestamp: 400, Status: "OL", Load: 10})
+	if len(ended) != 1 || ended[0].Id != events[0].Id || ended[0].Duration != 100 {
+		t.Errorf("unexpected resumed events %+v", ended)
+	}
+}
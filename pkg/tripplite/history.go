@@ -0,0 +1,203 @@
+package tripplite
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	AGGREGATE_AVG = "avg"
+	AGGREGATE_MIN = "min"
+	AGGREGATE_MAX = "max"
+)
+
+// Fields every history record keeps, whatever fields were selected.
+var HISTORY_TIME_FIELDS = []string{"Time", "UnixTimestamp"}
+
+// Selects, downsamples and orders samples. From and To are inclusive unix
+// times, 0 for no bound. With a Step samples are grouped into buckets of that
+// length and numeric fields are combined with Aggregate, or the aggregate
+// named for the field in FieldAggregates; other fields keep the newest value
+// of the bucket. Fields selects JSON field names, empty keeps all of them.
+// Limit keeps the newest records after downsampling.
+type HistoryQuery struct {
+	From            int64
+	To              int64
+	Step            time.Duration
+	Aggregate       string
+	FieldAggregates map[string]string
+	Fields          []string
+	Limit           int
+	Ascending       bool
+}
+
+// A sample or aggregated bucket keyed by JSON field name.
+type HistoryRecord map[string]interface{}
+
+func validAggregate(agg string) bool {
+	switch agg {
+	case AGGREGATE_AVG, AGGREGATE_MIN, AGGREGATE_MAX:
+		return true
+	}
+	return false
+}
+
+// Parses "avg" or "max,Load:min,BatteryCharge:avg" into the default and per
+// field aggregates of the query.
+func (q *HistoryQuery) ParseAggregate(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		field, agg := "", part
+		if i := strings.IndexByte(part, ':'); i >= 0 {
+			field, agg = part[:i], part[i+1:]
+		}
+		agg = strings.ToLower(agg)
+		if !validAggregate(agg) {
+			return fmt.Errorf("unknown aggregate %q", agg)
+		}
+		if len(field) == 0 {
+			q.Aggregate = agg
+			continue
+		}
+		if q.FieldAggregates == nil {
+			q.FieldAggregates = map[string]string{}
+		}
+		q.FieldAggregates[strings.ToLower(field)] = agg
+	}
+	return nil
+}
+
+func (q HistoryQuery) aggregateFor(field string) string {
+	if agg, ok := q.FieldAggregates[strings.ToLower(field)]; ok {
+		return agg
+	}
+	if validAggregate(q.Aggregate) {
+		return q.Aggregate
+	}
+	return AGGREGATE_AVG
+}
+
+func (q HistoryQuery) inRange(m *UPSMetrics) bool {
+	return (q.From <= 0 || m.UnixTimestamp >= q.From) && (q.To <= 0 || m.UnixTimestamp <= q.To)
+}
+
+func toHistoryRecord(m *UPSMetrics) HistoryRecord {
+	record := HistoryRecord{}
+	data, err := json.Marshal(m)
+	if err == nil {
+		json.Unmarshal(data, &record)
+	}
+	return record
+}
+
+type fieldAggregate struct {
+	sum   float64
+	min   float64
+	max   float64
+	count int
+}
+
+// Combines the samples of one bucket, oldest first, into a single record.
+func (q HistoryQuery) aggregate(start int64, bucket []*UPSMetrics) HistoryRecord {
+	numeric := map[string]*fieldAggregate{}
+	record := HistoryRecord{}
+
+	for _, m := range bucket {
+		for field, val := range toHistoryRecord(m) {
+			num, ok := val.(float64)
+			if !ok {
+				record[field] = val
+				continue
+			}
+			agg, ok := numeric[field]
+			if !ok {
+				agg = &fieldAggregate{min: num, max: num}
+				numeric[field] = agg
+			}
+			agg.sum += num
+			agg.min = math.Min(agg.min, num)
+			agg.max = math.Max(agg.max, num)
+			agg.count++
+		}
+	}
+
+	for field, agg := range numeric {
+		switch q.aggregateFor(field) {
+		case AGGREGATE_MIN:
+			record[field] = agg.min
+		case AGGREGATE_MAX:
+			record[field] = agg.max
+		default:
+			record[field] = round2(agg.sum / float64(agg.count))
+		}
+	}
+
+	record["UnixTimestamp"] = start
+	record["Time"] = time.Unix(start, 0).Format(time.RFC3339)
+	return record
+}
+
+func (q HistoryQuery) selectFields(record HistoryRecord) HistoryRecord {
+	if len(q.Fields) == 0 {
+		return record
+	}
+	wanted := map[string]bool{}
+	for _, field := range append(q.Fields, HISTORY_TIME_FIELDS...) {
+		wanted[strings.ToLower(field)] = true
+	}
+	selected := HistoryRecord{}
+	for field, val := range record {
+		if wanted[strings.ToLower(field)] {
+			selected[field] = val
+		}
+	}
+	return selected
+}
+
+// Runs the query over samples, which may be in any order.
+func (q HistoryQuery) Run(samples []*UPSMetrics) []HistoryRecord {
+	selected := []*UPSMetrics{}
+	for _, m := range samples {
+		if m != nil && q.inRange(m) {
+			selected = append(selected, m)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].UnixTimestamp < selected[j].UnixTimestamp
+	})
+
+	records := []HistoryRecord{}
+	step := int64(q.Step.Seconds())
+	if step <= 0 {
+		for _, m := range selected {
+			records = append(records, q.selectFields(toHistoryRecord(m)))
+		}
+	} else {
+		for i := 0; i < len(selected); {
+			start := selected[i].UnixTimestamp - selected[i].UnixTimestamp%step
+			j := i
+			for j < len(selected) && selected[j].UnixTimestamp < start+step {
+				j++
+			}
+			records = append(records, q.selectFields(q.aggregate(start, selected[i:j])))
+			i = j
+		}
+	}
+
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[len(records)-q.Limit:]
+	}
+	if !q.Ascending {
+		for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+			records[i], records[j] = records[j], records[i]
+		}
+	}
+	return records
+}
@@ -0,0 +1,41 @@
+package tripplite
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryQueryDownsample(t *testing.T) {
+	samples := []*UPSMetrics{}
+	for i := 0; i < 30; i++ {
+		status := "OL"
+		if i >= 25 {
+			status = "OB"
+		}
+		samples = append(samples, &UPSMetrics{Status: status, Load: uint(i), InputVoltage: float64(100 + i), UnixTimestamp: int64(i)})
+	}
+
+	q := HistoryQuery{Step: 10 * time.Second, Ascending: true}
+	if err := q.ParseAggregate("min,Load:max"); err != nil {
+		t.Fatal(err)
+	}
+	records := q.Run(samples)
+
+	if len(records) != 3 {
+		t.Fatalf("expected 3 buckets, got %d", len(records))
+	}
+	last := records[2]
+	if last["UnixTimestamp"] != int64(20) || last["Load"] != 29.0 || last["InputVoltage"] != 120.0 || last["Status"] != "OB" {
+		t.Errorf("unexpected bucket %v", last)
+	}
+
+	q = HistoryQuery{Step: 10 * time.Second, Fields: []string{"inputvoltage"}, Limit: 1}
+	records = q.Run(samples)
+	if len(records) != 1 || records[0]["InputVoltage"] != 124.5 || len(records[0]) != 3 {
+		t.Errorf("unexpected average %v", records)
+	}
+
+	if err := q.ParseAggregate("Load:median"); err == nil {
+		t.Error("expected unknown aggregate error")
+	}
+}
@@ -0,0 +1,457 @@
+package tripplite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SMTP_TLS_STARTTLS = "starttls"
+	SMTP_TLS_IMPLICIT = "tls"
+	SMTP_TLS_NONE     = "none"
+
+	MAIL_SUBJECT = `[{{ .UPS }}] {{ .Title }}`
+	MAIL_BODY    = `{{ .Title }} at {{ .Time.Format "2006-01-02 15:04:05 MST" }}
+{{ with .Event }}{{ if .Detail }}
+{{ .Detail }}
+{{ end }}{{ end }}{{ with .Metrics }}
+Status:         {{ .Status }}
+Battery charge: {{ printf "%.0f" .BatteryCharge }}%
+Runtime:        {{ printf "%.0f" .RuntimeRemaining }}s
+Input voltage:  {{ printf "%.1f" .InputVoltage }}V
+Load:           {{ .Load }}%
+{{ end }}`
+)
+
+var (
+	SMTP_TIMEOUT = 30 * time.Second
+	// Most alerts collected into one digest, the oldest are dropped.
+	MAIL_MAX_DIGEST = 100
+)
+
+// Where and how alerts are mailed, zero values take the defaults from
+// WithDefaults. Subject and Body are templates of MailData, scripts may
+// override them. Once DigestAfter mails went out within Digest further alerts
+// are collected and sent as one digest per Digest, and no more than RateLimit
+// mails are sent per RateWindow.
+type SMTPSettings struct {
+	Host        string        `yaml:"host" env:"UPS_SMTP_HOST"`
+	Port        int           `yaml:"port" env:"UPS_SMTP_PORT"`
+	TLS         string        `yaml:"tls" env:"UPS_SMTP_TLS"`
+	SkipVerify  bool          `yaml:"insecure_skip_verify"`
+	Username    string        `yaml:"username" env:"UPS_SMTP_USERNAME"`
+	Password    string        `yaml:"password" env:"UPS_SMTP_PASSWORD"`
+	From        string        `yaml:"from" env:"UPS_SMTP_FROM"`
+	To          []string      `yaml:"to" env:"UPS_SMTP_TO"`
+	Subject     string        `yaml:"subject"`
+	Body        string        `yaml:"body"`
+	Events      []string      `yaml:"events"`
+	RateLimit   int           `yaml:"rate_limit"`
+	RateWindow  time.Duration `yaml:"rate_window"`
+	Digest      time.Duration `yaml:"digest"`
+	DigestAfter int           `yaml:"digest_after"`
+}
+
+func (s SMTPSettings) WithDefaults() SMTPSettings {
+	if len(s.TLS) == 0 {
+		s.TLS = SMTP_TLS_STARTTLS
+	}
+	s.TLS = strings.ToLower(s.TLS)
+	if s.Port == 0 {
+		switch s.TLS {
+		case SMTP_TLS_IMPLICIT:
+			s.Port = 465
+		case SMTP_TLS_NONE:
+			s.Port = 25
+		default:
+			s.Port = 587
+		}
+	}
+	if len(s.Subject) == 0 {
+		s.Subject = MAIL_SUBJECT
+	}
+	if len(s.Body) == 0 {
+		s.Body = MAIL_BODY
+	}
+	if s.RateLimit <= 0 {
+		s.RateLimit = 10
+	}
+	if s.RateWindow <= 0 {
+		s.RateWindow = time.Hour
+	}
+	if s.Digest <= 0 {
+		s.Digest = 5 * time.Minute
+	}
+	if s.DigestAfter <= 0 {
+		s.DigestAfter = 3
+	}
+	return s
+}
+
+func (s SMTPSettings) Validate() error {
+	switch {
+	case len(s.Host) == 0:
+		return errors.New("smtp host is required")
+	case len(s.From) == 0:
+		return errors.New("smtp from is required")
+	case len(s.To) == 0:
+		return errors.New("smtp to is required")
+	}
+	switch s.TLS {
+	case SMTP_TLS_STARTTLS, SMTP_TLS_IMPLICIT, SMTP_TLS_NONE:
+	default:
+		return fmt.Errorf("unknown smtp tls mode %q", s.TLS)
+	}
+	for _, addr := range append([]string{s.From}, s.To...) {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+	}
+	for _, kind := range s.Events {
+		if indexOf(EVENT_TYPES, kind) < 0 {
+			return fmt.Errorf("unknown event type %q", kind)
+		}
+	}
+	if _, err := template.New("subject").Parse(s.Subject); err != nil {
+		return err
+	}
+	_, err := template.New("body").Parse(s.Body)
+	return err
+}
+
+// The bare address of "Name <user@host>".
+func mailAddress(addr string) string {
+	if a, err := mail.ParseAddress(addr); err == nil {
+		return a.Address
+	}
+	return addr
+}
+
+func indexOf(values []string, val string) int {
+	for i, v := range values {
+		if v == val {
+			return i
+		}
+	}
+	return -1
+}
+
+// What subject and body templates are rendered with. Event is set for power
+// events and Script for script actions, Metrics is the latest sample if any.
+type MailData struct {
+	UPS     string
+	Title   string
+	Script  string
+	Event   *PowerEvent
+	Active  bool
+	Time    time.Time
+	Metrics *UPSMetrics
+}
+
+type MailMessage struct {
+	Subject string
+	Body    string
+}
+
+func renderMail(name string, tmpl string, data MailData) (string, error) {
+	t, err := template.New(name).Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+// Writes the message with the headers of a plain text mail.
+func formatMail(from string, to []string, msg MailMessage) []byte {
+	id := make([]byte, 12)
+	rand.Read(id)
+	domain := "localhost"
+	if i := strings.LastIndexByte(mailAddress(from), '@'); i >= 0 {
+		domain = mailAddress(from)[i+1:]
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(msg.Body, "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+// Sends one mail. STARTTLS is required unless tls is none, PLAIN auth is
+// only used over TLS or to localhost.
+func SendMail(s SMTPSettings, msg MailMessage) error {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	dialer := &net.Dialer{Timeout: SMTP_TIMEOUT}
+	config := &tls.Config{ServerName: s.Host, InsecureSkipVerify: s.SkipVerify}
+
+	var conn net.Conn
+	var err error
+	if s.TLS == SMTP_TLS_IMPLICIT {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, config)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SMTP_TIMEOUT))
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	hostname, _ := os.Hostname()
+	if len(hostname) == 0 {
+		hostname = "localhost"
+	}
+	if err := c.Hello(hostname); err != nil {
+		return err
+	}
+	if s.TLS == SMTP_TLS_STARTTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server does not support STARTTLS")
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if len(s.Username) > 0 {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, s.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(mailAddress(s.From)); err != nil {
+		return err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(mailAddress(to)); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatMail(s.From, s.To, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Sends alerts, rate limited and collected into digests while they flap.
+type Mailer struct {
+	Settings SMTPSettings
+	lock     sync.Mutex
+	sent     []time.Time
+	pending  []MailMessage
+	timer    *time.Timer
+}
+
+func NewMailer(s SMTPSettings) (*Mailer, error) {
+	s = s.WithDefaults()
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &Mailer{Settings: s}, nil
+}
+
+// Renders an alert with the given templates, empty ones take the settings'.
+func (m *Mailer) Render(data MailData, subject string, body string) (MailMessage, error) {
+	if len(subject) == 0 {
+		subject = m.Settings.Subject
+	}
+	if len(body) == 0 {
+		body = m.Settings.Body
+	}
+	if data.Time.IsZero() {
+		data.Time = time.Now()
+	}
+	msg := MailMessage{}
+	var err error
+	if msg.Subject, err = renderMail("subject", subject, data); err != nil {
+		return msg, err
+	}
+	// a subject is a single header line
+	msg.Subject = strings.Join(strings.Fields(msg.Subject), " ")
+	msg.Body, err = renderMail("body", body, data)
+	return msg, err
+}
+
+// Forgets mails sent before the rate window.
+func (m *Mailer) prune(now time.Time) {
+	i := 0
+	for i < len(m.sent) && now.Sub(m.sent[i]) >= m.Settings.RateWindow {
+		i++
+	}
+	m.sent = m.sent[i:]
+}
+
+func (m *Mailer) sentWithin(now time.Time, d time.Duration) int {
+	n := 0
+	for _, t := range m.sent {
+		if now.Sub(t) < d {
+			n++
+		}
+	}
+	return n
+}
+
+// When the rate limit allows the next mail.
+func (m *Mailer) nextAllowed(now time.Time) time.Time {
+	if len(m.sent) < m.Settings.RateLimit {
+		return now
+	}
+	return m.sent[len(m.sent)-m.Settings.RateLimit].Add(m.Settings.RateWindow)
+}
+
+// Gives back the rate slot taken for a mail which failed to send.
+func (m *Mailer) unsend(at time.Time) {
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].Equal(at) {
+			m.sent = append(m.sent[:i], m.sent[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *Mailer) schedule(now time.Time) {
+	if m.timer != nil {
+		return
+	}
+	at := now.Add(m.Settings.Digest)
+	if next := m.nextAllowed(now); next.After(at) {
+		at = next
+	}
+	m.timer = time.AfterFunc(at.Sub(now), func() {
+		if err := m.flush(false); err != nil {
+			log.Error().Err(err).Msg("failed to send alert digest")
+		}
+	})
+}
+
+// Sends an alert right away unless the rate limit is reached or alerts are
+// flapping, then it goes out with the next digest.
+func (m *Mailer) Notify(msg MailMessage) error {
+	now := time.Now()
+	m.lock.Lock()
+	m.prune(now)
+	if len(m.pending) > 0 || !m.nextAllowed(now).Equal(now) || m.sentWithin(now, m.Settings.Digest) >= m.Settings.DigestAfter {
+		if len(m.pending) >= MAIL_MAX_DIGEST {
+			m.pending = m.pending[1:]
+		}
+		m.pending = append(m.pending, msg)
+		m.schedule(now)
+		m.lock.Unlock()
+		log.Info().Str("subject", msg.Subject).Msg("alert added to digest")
+		return nil
+	}
+	m.sent = append(m.sent, now)
+	m.lock.Unlock()
+
+	err := SendMail(m.Settings, msg)
+	if err != nil {
+		m.lock.Lock()
+		m.unsend(now)
+		m.lock.Unlock()
+	}
+	return err
+}
+
+func digestMessage(msgs []MailMessage) MailMessage {
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	body := strings.Builder{}
+	for _, msg := range msgs {
+		body.WriteString(msg.Subject + "\n\n" + strings.TrimSpace(msg.Body) + "\n\n----\n\n")
+	}
+	return MailMessage{
+		Subject: fmt.Sprintf("%d UPS alerts, latest: %s", len(msgs), msgs[len(msgs)-1].Subject),
+		Body:    body.String(),
+	}
+}
+
+// Sends the pending alerts as one digest. They stay pending when sending
+// fails and are tried again with the next digest.
+func (m *Mailer) flush(force bool) error {
+	now := time.Now()
+	m.lock.Lock()
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	m.prune(now)
+	if len(m.pending) == 0 {
+		m.lock.Unlock()
+		return nil
+	}
+	if !force && !m.nextAllowed(now).Equal(now) {
+		m.schedule(now)
+		m.lock.Unlock()
+		return nil
+	}
+	msgs := m.pending
+	m.pending = nil
+	m.sent = append(m.sent, now)
+	m.lock.Unlock()
+
+	err := SendMail(m.Settings, digestMessage(msgs))
+	if err != nil {
+		// keep the alerts for the next attempt, newer ones came in meanwhile
+		m.lock.Lock()
+		m.unsend(now)
+		m.pending = append(msgs, m.pending...)
+		if over := len(m.pending) - MAIL_MAX_DIGEST; over > 0 {
+			m.pending = m.pending[over:]
+		}
+		m.schedule(time.Now())
+		m.lock.Unlock()
+	}
+	return err
+}
+
+// Number of alerts waiting for the next digest.
+func (m *Mailer) Pending() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.pending)
+}
+
+// Sends the pending digest now regardless of the rate limit, for shutdown.
+func (m *Mailer) Flush() error {
+	return m.flush(true)
+}
@@ -0,0 +1,292 @@
+package tripplite
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A received mail with the session it came in.
+type sinkMail struct {
+	TLS  bool
+	Auth string
+	From string
+	To   []string
+	Msg  *mail.Message
+	Body string
+}
+
+// A local SMTP server accepting every mail, with STARTTLS and AUTH PLAIN or
+// implicit TLS.
+func startSMTPSink(t *testing.T, implicit bool) (string, int, chan sinkMail) {
+	// borrow httptest's certificate for 127.0.0.1
+	certs := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: certs.TLS.Certificates}
+	certs.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	mails := make(chan sinkMail, 16)
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		m := sinkMail{TLS: implicit}
+		if implicit {
+			conn = tls.Server(conn, config)
+		}
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 sink ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			words := strings.Fields(line)
+			if len(words) == 0 {
+				continue
+			}
+			switch strings.ToUpper(words[0]) {
+			case "EHLO":
+				if m.TLS {
+					reply("250-sink\r\n250 AUTH PLAIN")
+				} else {
+					reply("250-sink\r\n250 STARTTLS")
+				}
+			case "STARTTLS":
+				reply("220 go ahead")
+				conn = tls.Server(conn, config)
+				r = bufio.NewReader(conn)
+				m.TLS = true
+			case "AUTH":
+				auth, _ := base64.StdEncoding.DecodeString(words[2])
+				m.Auth = string(auth)
+				reply("235 ok")
+			case "MAIL":
+				m.From = strings.Trim(strings.TrimPrefix(words[1], "FROM:"), "<>")
+				reply("250 ok")
+			case "RCPT":
+				m.To = append(m.To, strings.Trim(strings.TrimPrefix(words[1], "TO:"), "<>"))
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				data := strings.Builder{}
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				m.Msg, _ = mail.ReadMessage(strings.NewReader(data.String()))
+				body, _ := io.ReadAll(quotedprintable.NewReader(m.Msg.Body))
+				m.Body = string(body)
+				mails <- m
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, mails
+}
+
+func receive(t *testing.T, mails chan sinkMail) sinkMail {
+	t.Helper()
+	select {
+	case m := <-mails:
+		return m
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a mail")
+	}
+	return sinkMail{}
+}
+
+func TestSendMail(t *testing.T) {
+	host, port, mails := startSMTPSink(t, false)
+	s := SMTPSettings{
+		Host: host, Port: port, SkipVerify: true,
+		Username: "ups", Password: "secret",
+		From: "UPS Monitor <ups@example.com>", To: []string{"ops@example.com"},
+	}.WithDefaults()
+	if err := s.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SendMail(s, MailMessage{Subject: "[rack] on battery started", Body: "charge 42%\n"}); err != nil {
+		t.Fatal(err)
+	}
+	m := receive(t, mails)
+	if !m.TLS || m.Auth != "\x00ups\x00secret" || m.From != "ups@example.com" || m.To[0] != "ops@example.com" {
+		t.Errorf("unexpected session %+v", m)
+	}
+	if subject := m.Msg.Header.Get("Subject"); subject != "[rack] on battery started" || m.Body != "charge 42%\r\n" {
+		t.Errorf("unexpected mail %q %q", subject, m.Body)
+	}
+
+	host, port, mails = startSMTPSink(t, true)
+	s = SMTPSettings{Host: host, Port: port, TLS: SMTP_TLS_IMPLICIT, SkipVerify: true, From: "ups@example.com", To: []string{"ops@example.com"}}.WithDefaults()
+	if err := SendMail(s, MailMessage{Subject: "implicit", Body: "tls"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := receive(t, mails); !m.TLS || m.Msg.Header.Get("Subject") != "implicit" {
+		t.Errorf("unexpected implicit TLS mail %+v", m)
+	}
+
+	// the certificate is verified unless insecure_skip_verify is set
+	s.TLS = SMTP_TLS_STARTTLS
+	host, port, _ = startSMTPSink(t, false)
+	s.Host, s.Port, s.Username = host, port, ""
+	noTLS := s
+	noTLS.SkipVerify = false
+	if err := SendMail(noTLS, MailMessage{Subject: "x"}); err == nil {
+		t.Errorf("expected an unverified certificate to be refused")
+	}
+}
+
+func TestMailer(t *testing.T) {
+	host, port, mails := startSMTPSink(t, false)
+	mailer, err := NewMailer(SMTPSettings{
+		Host: host, Port: port, SkipVerify: true,
+		From: "ups@example.com", To: []string{"ops@example.com"},
+		Digest: 200 * time.Millisecond, DigestAfter: 2, RateLimit: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := MailData{UPS: "rack", Title: "on battery started", Metrics: &UPSMetrics{Status: "OB", BatteryCharge: 42}}
+	msg, err := mailer.Render(data, "", "")
+	if err != nil || msg.Subject != "[rack] on battery started" || !strings.Contains(msg.Body, "Battery charge: 42%") {
+		t.Errorf("unexpected default mail %q %q %v", msg.Subject, msg.Body, err)
+	}
+	if msg, _ := mailer.Render(data, "{{ .UPS }}\r\nBcc: x@example.com", "{{ .Metrics.Status }}"); msg.Subject != "rack Bcc: x@example.com" || msg.Body != "OB" {
+		t.Errorf("expected the subject on one line, got %q %q", msg.Subject, msg.Body)
+	}
+
+	// two alerts go out right away, the flapping rest is collected
+	for i := 1; i <= 5; i++ {
+		if err := mailer.Notify(MailMessage{Subject: "alert " + strconv.Itoa(i), Body: "body"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if subject := receive(t, mails).Msg.Header.Get("Subject"); subject != "alert 1" {
+		t.Errorf("unexpected first mail %s", subject)
+	}
+	receive(t, mails)
+	if mailer.Pending() != 3 {
+		t.Errorf("expected 3 alerts in the digest, got %d", mailer.Pending())
+	}
+	digest := receive(t, mails)
+	if subject := digest.Msg.Header.Get("Subject"); subject != "3 UPS alerts, latest: alert 5" || !strings.Contains(digest.Body, "alert 3") {
+		t.Errorf("unexpected digest %s %q", subject, digest.Body)
+	}
+
+	// the rate limit of 3 is reached, Flush sends anyway
+	mailer.Notify(MailMessage{Subject: "alert 6"})
+	time.Sleep(300 * time.Millisecond)
+	if mailer.Pending() != 1 {
+		t.Errorf("expected the rate limit to hold the alert back")
+	}
+	if err := mailer.Flush(); err != nil || receive(t, mails).Msg.Header.Get("Subject") != "alert 6" {
+		t.Errorf("expected Flush to send the alert %v", err)
+	}
+
+	if _, err := NewMailer(SMTPSettings{Host: host, From: "ups@example.com", To: []string{"ops"}}); err == nil {
+		t.Errorf("expected an invalid address to be refused")
+	}
+	if _, err := NewMailer(SMTPSettings{Host: host, From: "ups@example.com", To: []string{"ops@example.com"}, Events: []string{"on_fire"}}); err == nil {
+		t.Errorf("expected an unknown event to be refused")
+	}
+}
+
+func TestMailerFailure(t *testing.T) {
+	host, port, mails := startSMTPSink(t, false)
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	down := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	mailer, _ := NewMailer(SMTPSettings{
+		Host: host, Port: down, SkipVerify: true,
+		From: "ups@example.com", To: []string{"ops@example.com"},
+		Digest: 100 * time.Millisecond, DigestAfter: 1, RateLimit: 2,
+	})
+
+	// a failed alert does not use up the rate limit
+	for i := 0; i < 3; i++ {
+		if err := mailer.Notify(MailMessage{Subject: "lost"}); err == nil {
+			t.Fatal("expected the alert to fail")
+		}
+	}
+	mailer.Settings.Port = port
+	if err := mailer.Notify(MailMessage{Subject: "alert 1"}); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, mails)
+
+	// a failed digest stays pending and goes out with the next one
+	mailer.Notify(MailMessage{Subject: "alert 2"})
+	mailer.lock.Lock()
+	mailer.Settings.Port = down
+	mailer.lock.Unlock()
+	if err := mailer.Flush(); err == nil || mailer.Pending() != 1 {
+		t.Fatalf("expected the alert to stay pending, got %d %v", mailer.Pending(), err)
+	}
+	mailer.lock.Lock()
+	mailer.Settings.Port = port
+	mailer.lock.Unlock()
+	if subject := receive(t, mails).Msg.Header.Get("Subject"); subject != "alert 2" {
+		t.Errorf("expected the alert to be retried, got %s", subject)
+	}
+}
+
+func TestEmailAction(t *testing.T) {
+	host, port, mails := startSMTPSink(t, false)
+	mailer, _ := NewMailer(SMTPSettings{Host: host, Port: port, SkipVerify: true, From: "ups@example.com", To: []string{"ops@example.com"}})
+
+	results := make(resultRecorder, 4)
+	w := NewWatcher()
+	w.SetMailer(mailer)
+	w.SetResultListener(results)
+	w.AddScript(Script{Name: "mail ops", Status: "OB", Charge: 50, Action: ACTION_EMAIL,
+		Subject: "{{ .UPS }} at {{ .Metrics.BatteryCharge }}%", Body: "{{ if .Active }}shut down now{{ else }}all clear{{ end }}"}, false)
+
+	w.OnMetrics(&UPSMetrics{Name: "rack", Status: "OB", BatteryCharge: 40})
+	if m := receive(t, mails); m.Msg.Header.Get("Subject") != "rack at 40%" || strings.TrimSpace(m.Body) != "shut down now" {
+		t.Errorf("unexpected activation mail %q %q", m.Msg.Header.Get("Subject"), m.Body)
+	}
+	if res := <-results; res.ExitCode != 0 {
+		t.Errorf("unexpected result %v", res)
+	}
+	w.OnMetrics(&UPSMetrics{Name: "rack", Status: "OL", BatteryCharge: 41})
+	if m := receive(t, mails); strings.TrimSpace(m.Body) != "all clear" {
+		t.Errorf("unexpected cancel mail %q", m.Body)
+	}
+}
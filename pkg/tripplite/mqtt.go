@@ -0,0 +1,155 @@
+package tripplite
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Payloads of the retained availability topics.
+	MQTT_ONLINE  = "online"
+	MQTT_OFFLINE = "offline"
+	// Default Home Assistant discovery prefix.
+	MQTT_DISCOVERY_PREFIX = "homeassistant"
+)
+
+// A message to publish, Retain keeps it on the broker for late subscribers.
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// A UPSMetrics field published on its own topic and announced to Home
+// Assistant as an entity.
+type mqttField struct {
+	Key         string
+	Name        string
+	Component   string
+	DeviceClass string
+	Unit        string
+	StateClass  string
+	Category    string
+	Value       func(*UPSMetrics) string
+}
+
+func mqttNumber(key string, name string, class string, unit string, precision int, val func(*UPSMetrics) float64) mqttField {
+	return mqttField{key, name, "sensor", class, unit, "measurement", "", func(m *UPSMetrics) string {
+		return strconv.FormatFloat(val(m), 'f', precision, 64)
+	}}
+}
+
+func mqttText(key string, name string, category string, val func(*UPSMetrics) string) mqttField {
+	return mqttField{key, name, "sensor", "", "", "", category, val}
+}
+
+// Fields by topic, device classes and units are Home Assistant's.
+var mqttFields = []mqttField{
+	mqttNumber("battery_charge", "Battery Charge", "battery", "%", 0, func(m *UPSMetrics) float64 { return m.BatteryCharge }),
+	mqttNumber("battery_runtime", "Battery Runtime", "duration", "s", 0, func(m *UPSMetrics) float64 { return m.RuntimeRemaining }),
+	mqttNumber("battery_voltage", "Battery Voltage", "voltage", "V", 1, func(m *UPSMetrics) float64 { return m.BatteryVoltage }),
+	mqttNumber("input_voltage", "Input Voltage", "voltage", "V", 1, func(m *UPSMetrics) float64 { return m.InputVoltage }),
+	mqttNumber("input_frequency", "Input Frequency", "frequency", "Hz", 1, func(m *UPSMetrics) float64 { return m.InputFrequency }),
+	mqttNumber("load", "Load", "", "%", 0, func(m *UPSMetrics) float64 { return float64(m.Load) }),
+	mqttNumber("temperature", "Temperature", "temperature", "°C", 1, func(m *UPSMetrics) float64 { return m.TemperatureC }),
+	mqttText("status", "Status", "", func(m *UPSMetrics) string { return m.Status }),
+	mqttText("test_result", "Self-Test Result", "diagnostic", func(m *UPSMetrics) string { return m.TestResult }),
+	{"line_power", "Line Power", "binary_sensor", "power", "", "", "", func(m *UPSMetrics) string {
+		if strings.EqualFold(m.Status, "OL") {
+			return "ON"
+		}
+		return "OFF"
+	}},
+}
+
+// Replaces everything but letters, digits, - and _ so a name can be used in
+// topics and discovery ids.
+func MQTTId(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// The per-field messages of a sample below base, empty values are left out.
+func MQTTFieldMessages(base string, m *UPSMetrics, retain bool) []MQTTMessage {
+	msgs := []MQTTMessage{}
+	for _, f := range mqttFields {
+		if val := f.Value(m); len(val) > 0 {
+			msgs = append(msgs, MQTTMessage{Topic: base + "/" + f.Key, Payload: []byte(val), Retain: retain})
+		}
+	}
+	return msgs
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// A Home Assistant MQTT discovery payload.
+type haConfig struct {
+	Name             string           `json:"name"`
+	UniqueId         string           `json:"unique_id"`
+	ObjectId         string           `json:"object_id"`
+	StateTopic       string           `json:"state_topic"`
+	DeviceClass      string           `json:"device_class,omitempty"`
+	Unit             string           `json:"unit_of_measurement,omitempty"`
+	StateClass       string           `json:"state_class,omitempty"`
+	EntityCategory   string           `json:"entity_category,omitempty"`
+	Availability     []haAvailability `json:"availability"`
+	AvailabilityMode string           `json:"availability_mode"`
+	Device           haDevice         `json:"device"`
+}
+
+// Retained Home Assistant discovery messages for every field of the UPS
+// publishing below base. Entities are available while both the publisher's
+// status topic and the UPS's availability topic are online.
+func MQTTDiscovery(prefix string, base string, status string, m *UPSMetrics) []MQTTMessage {
+	id := "tripplite_" + MQTTId(m.Name)
+	if len(m.Serial) > 0 {
+		id = "tripplite_" + MQTTId(m.Serial)
+	}
+	device := haDevice{
+		Identifiers:  []string{id},
+		Name:         m.Name,
+		Manufacturer: m.Manufacturer,
+		Model:        m.Model,
+		SWVersion:    m.FirmwareVersion,
+	}
+
+	msgs := []MQTTMessage{}
+	for _, f := range mqttFields {
+		config := haConfig{
+			Name:             f.Name,
+			UniqueId:         id + "_" + f.Key,
+			ObjectId:         MQTTId(m.Name) + "_" + f.Key,
+			StateTopic:       base + "/" + f.Key,
+			DeviceClass:      f.DeviceClass,
+			Unit:             f.Unit,
+			StateClass:       f.StateClass,
+			EntityCategory:   f.Category,
+			Availability:     []haAvailability{{status}, {base + "/availability"}},
+			AvailabilityMode: "all",
+			Device:           device,
+		}
+		payload, _ := json.Marshal(config)
+		msgs = append(msgs, MQTTMessage{
+			Topic:   prefix + "/" + f.Component + "/" + id + "/" + f.Key + "/config",
+			Payload: payload,
+			Retain:  true,
+		})
+	}
+	return msgs
+}
@@ -0,0 +1,44 @@
+package tripplite
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMQTTMessages(t *testing.T) {
+	if id := MQTTId("rack a/#1+"); id != "rack_a__1_" {
+		t.Errorf("unexpected id %s", id)
+	}
+
+	m := &UPSMetrics{Name: "rack", Status: "OB", BatteryCharge: 64.4, TemperatureC: 25.25}
+	values := map[string]string{}
+	for _, msg := range MQTTFieldMessages("ups/rack", m, false) {
+		values[msg.Topic] = string(msg.Payload)
+	}
+	expect := map[string]string{
+		"ups/rack/battery_charge": "64",
+		"ups/rack/temperature":    "25.2",
+		"ups/rack/status":         "OB",
+		"ups/rack/line_power":     "OFF",
+	}
+	for topic, val := range expect {
+		if values[topic] != val {
+			t.Errorf("%s: expected %q, got %q", topic, val, values[topic])
+		}
+	}
+	if _, ok := values["ups/rack/test_result"]; ok {
+		t.Errorf("expected an empty test result to be left out")
+	}
+
+	msgs := MQTTDiscovery("homeassistant", "ups/rack", "ups/status", m)
+	if len(msgs) != len(mqttFields) {
+		t.Fatalf("expected %d discovery messages, got %d", len(mqttFields), len(msgs))
+	}
+	config := haConfig{}
+	if err := json.Unmarshal(msgs[0].Payload, &config); err != nil {
+		t.Fatal(err)
+	}
+	if msgs[0].Topic != "homeassistant/sensor/tripplite_rack/battery_charge/config" || config.Device.Identifiers[0] != "tripplite_rack" || len(config.Availability) != 2 || config.Availability[1].Topic != "ups/rack/availability" {
+		t.Errorf("unexpected discovery %s %s", msgs[0].Topic, msgs[0].Payload)
+	}
+}
@@ -0,0 +1,151 @@
+package tripplite
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// Default port of NUT's upsd.
+	NUT_PORT = 3493
+	// Version of the NUT network protocol spoken by the upsd listener.
+	NUT_PROTOCOL_VERSION = "1.3"
+)
+
+// One NUT variable of a UPS, e.g. battery.charge.
+type NUTVariable struct {
+	Name  string
+	Value string
+}
+
+type nutVariable struct {
+	Name    string
+	Numeric bool
+	Value   func(*UPSMetrics) string
+}
+
+func nutNumber(name string, precision int, val func(*UPSMetrics) float64) nutVariable {
+	return nutVariable{name, true, func(m *UPSMetrics) string {
+		return strconv.FormatFloat(val(m), 'f', precision, 64)
+	}}
+}
+
+func nutText(name string, val func(*UPSMetrics) string) nutVariable {
+	return nutVariable{name, false, val}
+}
+
+// UPSMetrics fields by their standard NUT name, see NUT's docs/nut-names.txt.
+var nutVariables = []nutVariable{
+	nutNumber("battery.charge", 0, func(m *UPSMetrics) float64 { return m.BatteryCharge }),
+	nutNumber("battery.runtime", 0, func(m *UPSMetrics) float64 { return m.RuntimeRemaining }),
+	nutNumber("battery.voltage", 1, func(m *UPSMetrics) float64 { return m.BatteryVoltage }),
+	nutNumber("battery.voltage.nominal", 1, func(m *UPSMetrics) float64 { return m.BatteryVoltageNominal }),
+	nutNumber("input.frequency", 1, func(m *UPSMetrics) float64 { return m.InputFrequency }),
+	nutNumber("input.frequency.nominal", 0, func(m *UPSMetrics) float64 { return m.InputFrequencyNominal }),
+	nutNumber("input.voltage", 1, func(m *UPSMetrics) float64 { return m.InputVoltage }),
+	nutNumber("input.voltage.maximum", 1, func(m *UPSMetrics) float64 { return m.InputVoltageMaximum }),
+	nutNumber("input.voltage.minimum", 1, func(m *UPSMetrics) float64 { return m.InputVoltageMinimum }),
+	nutNumber("input.voltage.nominal", 0, func(m *UPSMetrics) float64 { return m.InputVoltageNominal }),
+	nutNumber("ups.load", 0, func(m *UPSMetrics) float64 { return float64(m.Load) }),
+	nutNumber("ups.power.nominal", 0, func(m *UPSMetrics) float64 { return float64(m.Power) }),
+	nutNumber("ups.temperature", 1, func(m *UPSMetrics) float64 { return m.TemperatureC }),
+	nutText("device.mfr", func(m *UPSMetrics) string { return m.Manufacturer }),
+	nutText("device.model", func(m *UPSMetrics) string { return m.Model }),
+	nutText("device.serial", func(m *UPSMetrics) string { return m.Serial }),
+	nutText("device.type", func(m *UPSMetrics) string { return "ups" }),
+	nutText("driver.name", func(m *UPSMetrics) string { return "tripplite" }),
+	nutText("ups.firmware", func(m *UPSMetrics) string { return m.FirmwareVersion }),
+	nutText("ups.id", func(m *UPSMetrics) string { return m.UnitId }),
+	nutText("ups.mfr", func(m *UPSMetrics) string { return m.Manufacturer }),
+	nutText("ups.model", func(m *UPSMetrics) string { return m.Model }),
+	nutText("ups.productid", func(m *UPSMetrics) string { return m.ProductID }),
+	nutText("ups.serial", func(m *UPSMetrics) string { return m.Serial }),
+	nutText("ups.test.result", func(m *UPSMetrics) string { return m.TestResult }),
+	nutText("ups.vendorid", func(m *UPSMetrics) string { return m.VendorID }),
+}
+
+// The ups.status of a sample, a low battery is reported on battery as NUT
+// does and fsd prepends the forced shutdown flag set by upsmon.
+func NUTStatus(m *UPSMetrics, fsd bool) string {
+	flags := []string{}
+	if fsd {
+		flags = append(flags, "FSD")
+	}
+	switch strings.ToUpper(m.Status) {
+	case "OL":
+		flags = append(flags, "OL")
+	case "OB":
+		flags = append(flags, "OB")
+	case "LB":
+		flags = append(flags, "OB", "LB")
+	case "OFF":
+		flags = append(flags, "OFF")
+	}
+	return strings.Join(flags, " ")
+}
+
+// Every NUT variable of a sample, empty strings are left out.
+func NUTVariables(m *UPSMetrics, fsd bool) []NUTVariable {
+	vars := []NUTVariable{}
+	for _, v := range nutVariables {
+		if val := v.Value(m); len(val) > 0 {
+			vars = append(vars, NUTVariable{Name: v.Name, Value: val})
+		}
+	}
+	vars = append(vars, NUTVariable{Name: "ups.status", Value: NUTStatus(m, fsd)})
+	for _, bank := range m.LoadBankStates {
+		vars = append(vars, NUTVariable{Name: "outlet." + strconv.Itoa(bank.Bank) + ".status", Value: bank.State})
+	}
+	return vars
+}
+
+// Whether a NUT variable holds a number, for GET TYPE.
+func NUTNumeric(name string) bool {
+	for _, v := range nutVariables {
+		if v.Name == name {
+			return v.Numeric
+		}
+	}
+	return false
+}
+
+// Quotes a value for the NUT protocol.
+func NUTQuote(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	return `"` + strings.ReplaceAll(val, `"`, `\"`) + `"`
+}
+
+// Splits a NUT protocol line into words, double quotes group words and a
+// backslash escapes the next character.
+func NUTSplit(line string) ([]string, bool) {
+	words := []string{}
+	word := strings.Builder{}
+	quoted, escaped, inWord := false, false, false
+	for _, c := range strings.TrimRight(line, "\r\n") {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\':
+			escaped, inWord = true, true
+		case c == '"':
+			quoted, inWord = !quoted, true
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quoted || escaped {
+		return nil, false
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, true
+}
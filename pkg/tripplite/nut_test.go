@@ -0,0 +1,74 @@
+package tripplite
+
+import (
+	"testing"
+)
+
+func TestNUTSplit(t *testing.T) {
+	tests := []struct {
+		line  string
+		words []string
+		ok    bool
+	}{
+		{"LIST UPS\n", []string{"LIST", "UPS"}, true},
+		{"GET VAR  ups   battery.charge\r\n", []string{"GET", "VAR", "ups", "battery.charge"}, true},
+		{`PASSWORD "pass word"`, []string{"PASSWORD", "pass word"}, true},
+		{`PASSWORD "say \"hi\" \\"`, []string{"PASSWORD", `say "hi" \`}, true},
+		{`PASSWORD ""`, []string{"PASSWORD", ""}, true},
+		{`PASSWORD "open`, nil, false},
+	}
+	for _, test := range tests {
+		words, ok := NUTSplit(test.line)
+		if ok != test.ok || len(words) != len(test.words) {
+			t.Errorf("%q: expected %q, got %q", test.line, test.words, words)
+			continue
+		}
+		for i := range words {
+			if words[i] != test.words[i] {
+				t.Errorf("%q: expected %q, got %q", test.line, test.words, words)
+			}
+		}
+	}
+
+	if q := NUTQuote(`a "b" \c`); q != `"a \"b\" \\c"` {
+		t.Errorf("unexpected quoting %s", q)
+	}
+}
+
+func TestNUTVariables(t *testing.T) {
+	m := &UPSMetrics{
+		Status:         "LB",
+		BatteryCharge:  12.6,
+		InputVoltage:   0,
+		Load:           35,
+		Manufacturer:   "Tripp Lite",
+		LoadBankStates: []LoadBank{{Bank: 1, State: LOAD_BANK_ON}},
+	}
+	vars := map[string]string{}
+	for _, v := range NUTVariables(m, true) {
+		vars[v.Name] = v.Value
+	}
+
+	expected := map[string]string{
+		"battery.charge":  "13",
+		"input.voltage":   "0.0",
+		"ups.load":        "35",
+		"ups.mfr":         "Tripp Lite",
+		"ups.status":      "FSD OB LB",
+		"outlet.1.status": "on",
+	}
+	for name, val := range expected {
+		if vars[name] != val {
+			t.Errorf("%s: expected %q, got %q", name, val, vars[name])
+		}
+	}
+	if _, ok := vars["ups.serial"]; ok {
+		t.Errorf("expected empty strings to be left out")
+	}
+	if !NUTNumeric("battery.charge") || NUTNumeric("ups.mfr") || NUTNumeric("ups.status") {
+		t.Errorf("unexpected variable types")
+	}
+	if s := NUTStatus(&UPSMetrics{Status: "OL"}, false); s != "OL" {
+		t.Errorf("expected OL, got %s", s)
+	}
+}
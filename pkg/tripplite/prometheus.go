@@ -0,0 +1,178 @@
+package tripplite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+	PROMETHEUS_NAMESPACE    = "tripplite"
+)
+
+var (
+	// Every status GetStats can report, exported as an enum-style gauge so
+	// that exactly one series per device is 1 at any time.
+	PROMETHEUS_STATUS_VALUES = []string{"OL", "OB", "LB", "OFF"}
+)
+
+type promLabel struct {
+	Name  string
+	Value string
+}
+
+type promGauge struct {
+	Name  string
+	Help  string
+	Value func(*UPSMetrics) float64
+}
+
+var promGauges = []promGauge{
+	{"battery_charge_percent", "Estimated battery charge in percent.", func(m *UPSMetrics) float64 { return m.BatteryCharge }},
+	{"battery_voltage_volts", "Battery voltage.", func(m *UPSMetrics) float64 { return m.BatteryVoltage }},
+	{"battery_voltage_nominal_volts", "Nominal battery voltage.", func(m *UPSMetrics) float64 { return m.BatteryVoltageNominal }},
+	{"input_voltage_volts", "Input (line) voltage.", func(m *UPSMetrics) float64 { return m.InputVoltage }},
+	{"input_voltage_minimum_volts", "Minimum input voltage seen since the last reset.", func(m *UPSMetrics) float64 { return m.InputVoltageMinimum }},
+	{"input_voltage_maximum_volts", "Maximum input voltage seen since the last reset.", func(m *UPSMetrics) float64 { return m.InputVoltageMaximum }},
+	{"input_voltage_nominal_volts", "Nominal input voltage.", func(m *UPSMetrics) float64 { return m.InputVoltageNominal }},
+	{"input_frequency_hertz", "Input (line) frequency.", func(m *UPSMetrics) float64 { return m.InputFrequency }},
+	{"input_frequency_nominal_hertz", "Nominal input frequency.", func(m *UPSMetrics) float64 { return m.InputFrequencyNominal }},
+	{"load_percent", "Output load in percent of capacity.", func(m *UPSMetrics) float64 { return float64(m.Load) }},
+	{"battery_runtime_seconds", "Estimated runtime remaining on battery, 0 when unknown.", func(m *UPSMetrics) float64 { return m.RuntimeRemaining }},
+	{"power_nominal_voltamperes", "Nominal output power.", func(m *UPSMetrics) float64 { return float64(m.Power) }},
+	{"temperature_celsius", "UPS internal temperature.", func(m *UPSMetrics) float64 { return m.TemperatureC }},
+	{"last_update_timestamp_seconds", "Unix time of the last sample read from the device.", func(m *UPSMetrics) float64 { return float64(m.UnixTimestamp) }},
+}
+
+func promName(name string) string {
+	return PROMETHEUS_NAMESPACE + "_" + name
+}
+
+func promEscape(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	val = strings.ReplaceAll(val, "\n", `\n`)
+	return strings.ReplaceAll(val, `"`, `\"`)
+}
+
+func promFormatFloat(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+func promDeviceLabels(m *UPSMetrics) []promLabel {
+	return []promLabel{
+		{"ups", m.Name},
+		{"vendor_id", m.VendorID},
+		{"product_id", m.ProductID},
+		{"unit_id", m.UnitId},
+	}
+}
+
+func writePromHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func writePromSample(w io.Writer, name string, labels []promLabel, val float64) {
+	io.WriteString(w, name)
+	if len(labels) > 0 {
+		io.WriteString(w, "{")
+		for i, label := range labels {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			fmt.Fprintf(w, `%s="%s"`, label.Name, promEscape(label.Value))
+		}
+		io.WriteString(w, "}")
+	}
+	fmt.Fprintf(w, " %s\n", promFormatFloat(val))
+}
+
+// Writes the samples in the Prometheus text exposition format. Each metric
+// family is written once with one series per sample.
+func WritePrometheusMetrics(out io.Writer, samples []*UPSMetrics) error {
+	w := bufio.NewWriter(out)
+
+	metrics := []*UPSMetrics{}
+	for _, m := range samples {
+		if m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+
+	if len(metrics) == 0 {
+		return w.Flush()
+	}
+
+	name := promName("info")
+	writePromHeader(w, name, "Device information, the value is always 1.", "gauge")
+	for _, m := range metrics {
+		labels := append(promDeviceLabels(m),
+			promLabel{"serial", m.Serial},
+			promLabel{"manufacturer", m.Manufacturer},
+			promLabel{"model", m.Model},
+			promLabel{"firmware", m.FirmwareVersion},
+		)
+		writePromSample(w, name, labels, 1)
+	}
+
+	name = promName("status")
+	writePromHeader(w, name, "Current UPS status, 1 for the active status and 0 otherwise.", "gauge")
+	for _, m := range metrics {
+		for _, status := range PROMETHEUS_STATUS_VALUES {
+			val := 0.0
+			if strings.EqualFold(m.Status, status) {
+				val = 1.0
+			}
+			labels := append(promDeviceLabels(m), promLabel{"status", status})
+			writePromSample(w, name, labels, val)
+		}
+	}
+
+	name = promName("communication_ok")
+	writePromHeader(w, name, "1 while the device answers commands, 0 after communication is lost.", "gauge")
+	for _, m := range metrics {
+		val := 1.0
+		if m.Communication == COMM_LOST {
+			val = 0.0
+		}
+		writePromSample(w, name, promDeviceLabels(m), val)
+	}
+
+	name = promName("load_bank_on")
+	writePromHeader(w, name, "1 while a switchable load bank was last switched on by this server, banks it has not switched are omitted.", "gauge")
+	for _, m := range metrics {
+		for _, bank := range m.LoadBankStates {
+			if bank.State == LOAD_BANK_UNKNOWN {
+				continue
+			}
+			val := 0.0
+			if bank.State == LOAD_BANK_ON {
+				val = 1.0
+			}
+			labels := append(promDeviceLabels(m), promLabel{"bank", strconv.Itoa(bank.Bank)})
+			writePromSample(w, name, labels, val)
+		}
+	}
+
+	for _, gauge := range promGauges {
+		name = promName(gauge.Name)
+		writePromHeader(w, name, gauge.Help, "gauge")
+		for _, m := range metrics {
+			writePromSample(w, name, promDeviceLabels(m), gauge.Value(m))
+		}
+	}
+
+	return w.Flush()
+}
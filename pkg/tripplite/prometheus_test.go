@@ -0,0 +1,71 @@
+package tripplite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	m := UPSMetrics{
+		Name:            "rack-a",
+		VendorID:        "09ae",
+		ProductID:       "0001",
+		Manufacturer:    "Tripp Lite",
+		Model:           "SMART1500LCD \"rack\"",
+		FirmwareVersion: "FW-2.1",
+		UnitId:          "65535",
+		BatteryCharge:   87.5,
+		InputVoltage:    121.2,
+		Load:            23,
+		Status:          "OB",
+		UnixTimestamp:   1667000000,
+		LoadBanks:       2,
+		LoadBankStates:  []LoadBank{{Bank: 1, State: LOAD_BANK_OFF}, {Bank: 2, State: LOAD_BANK_UNKNOWN}},
+	}
+
+	buf := bytes.Buffer{}
+	err := WritePrometheusMetrics(&buf, []*UPSMetrics{&m, nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"# HELP tripplite_battery_charge_percent Estimated battery charge in percent.\n",
+		"# TYPE tripplite_battery_charge_percent gauge\n",
+		`tripplite_battery_charge_percent{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535"} 87.5` + "\n",
+		`tripplite_input_voltage_volts{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535"} 121.2` + "\n",
+		`tripplite_load_percent{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535"} 23` + "\n",
+		`tripplite_status{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535",status="OB"} 1` + "\n",
+		`tripplite_status{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535",status="OL"} 0` + "\n",
+		`tripplite_load_bank_on{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535",bank="1"} 0` + "\n",
+		`model="SMART1500LCD \"rack\"",firmware="FW-2.1"} 1` + "\n",
+		`tripplite_last_update_timestamp_seconds{ups="rack-a",vendor_id="09ae",product_id="0001",unit_id="65535"} 1.667e+09` + "\n",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(out, line) {
+			t.Errorf("missing %q in output:\n%s", line, out)
+		}
+	}
+
+	if strings.Contains(out, `bank="2"`) {
+		t.Errorf("unexpected series for a bank in unknown state:\n%s", out)
+	}
+
+	if n := strings.Count(out, "# TYPE tripplite_status gauge"); n != 1 {
+		t.Errorf("expected one TYPE line for tripplite_status, got %d", n)
+	}
+}
+
+func TestWritePrometheusMetricsEmpty(t *testing.T) {
+	buf := bytes.Buffer{}
+	err := WritePrometheusMetrics(&buf, []*UPSMetrics{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("expected no output, got %q", buf.String())
+	}
+}
@@ -0,0 +1,372 @@
+/**
+ * Protocol families from https://github.com/networkupstools/nut/blob/v2.7.4/drivers/tripplite_usb.c
+ */
+
+package tripplite
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	TEST_RESULT_PASSED         = "Test passed"
+	TEST_RESULT_BATTERY_FAILED = "Battery failed"
+	TEST_RESULT_IN_PROGRESS    = "In progress"
+	TEST_RESULT_BAD_INVERTER   = "Bad inverter"
+	TEST_RESULT_UNKNOWN        = "Unknown"
+)
+
+var (
+	ErrUnknownProtocol = fmt.Errorf("unsupported protocol")
+)
+
+// Decodes the replies of one protocol family into metrics. Commands lists the
+// command codes sent on every poll, replies are keyed by command code. Smart
+// protocols accept the self-test and outlet commands.
+type ProtocolDecoder struct {
+	Name     string
+	Commands []byte
+	Decode   func(m *SmartProUPSMonitor, messages map[byte][]byte, metrics *UPSMetrics)
+	Smart    bool
+}
+
+var PROTOCOL_DECODERS = map[uint]*ProtocolDecoder{
+	0x1001: {
+		Name:     "OMNIVS",
+		Commands: []byte{'B', 'F', 'S', 'U', 'V'},
+		Decode:   decodeOmniVS,
+	},
+	0x2001: {
+		Name:     "OMNIVS_2001",
+		Commands: []byte{'D', 'F', 'L', 'S', 'U', 'V'},
+		Decode:   decodeOmniVS2001,
+	},
+	0x3003: {
+		Name:     "SMARTPRO",
+		Smart:    true,
+		Commands: []byte{'D', 'F', 'L', 'M', 'P', 'S', 'T', 'U', 'V'},
+		Decode:   decodeSmartPro,
+	},
+	0x3005: {
+		Name:     "SMART_3005",
+		Smart:    true,
+		Commands: []byte{'D', 'F', 'L', 'M', 'P', 'S', 'T', 'U', 'V'},
+		Decode:   decodeSmart3005,
+	},
+}
+
+func getProtocolDecoder(protocol uint) (*ProtocolDecoder, error) {
+	if decoder, ok := PROTOCOL_DECODERS[protocol]; ok {
+		return decoder, nil
+	}
+	return nil, fmt.Errorf("%w: %04x", ErrUnknownProtocol, protocol)
+}
+
+// Parses size hex ASCII characters at start, like hex2d in the NUT driver.
+func hex2d(data []byte, start int, size int) int64 {
+	if start < 0 || start+size > len(data) {
+		return 0
+	}
+	tmp, _ := strconv.ParseInt(string(data[start:start+size]), 16, 32)
+	return tmp
+}
+
+// Reads a big-endian binary field of size bytes at start.
+func bin2d(data []byte, start int, size int) int64 {
+	var tmp int64 = 0
+	for i := start; i < start+size && i < len(data); i++ {
+		tmp = (tmp << 8) | int64(data[i])
+	}
+	return tmp
+}
+
+func round2(val float64) float64 {
+	return math.Round(val*100.0) / 100.0
+}
+
+// Nominal input voltage and the voltage replies are scaled by for the code
+// in the 'V' reply.
+func inputVoltageNominal(code byte) (float64, float64) {
+	switch code {
+	case '0', 0:
+		return 100.0, 100.0
+	case '2', 2:
+		return 230.0, 230.0
+	case '3', 3:
+		return 208.0, 230.0
+	}
+	return 120.0, 120.0
+}
+
+func temperatureFromRaw(raw int64, metrics *UPSMetrics) {
+	temp := float64(raw)*0.3636 - 21.0
+	metrics.TemperatureC = round2(temp)
+	metrics.TemperatureF = round2((temp * (9.0 / 5.0)) + 32.0)
+}
+
+func decodeFirmwareAndUnit(messages map[byte][]byte, metrics *UPSMetrics) {
+	// firmware
+	if data, ok := messages['F']; ok {
+		tmp := strconv_clean(data[1:7])
+		metrics.FirmwareVersion = tmp
+	}
+
+	// unit
+	if data, ok := messages['U']; ok {
+		tmp := (uint64(data[1]) << 8) | uint64(data[2])
+		metrics.UnitId = strconv.FormatUint(tmp, 10)
+	}
+}
+
+// The 'S' flags are bits on the same byte for the hex and binary protocols,
+// only the low battery marker differs.
+func decodeSmartStatus(messages map[byte][]byte, metrics *UPSMetrics, binary bool) {
+	if data, ok := messages['S']; ok {
+		code := data[4]
+		if code&4 == 4 {
+			metrics.Status = "OFF"
+		} else if code&1 == 1 {
+			metrics.Status = "OB"
+		} else {
+			metrics.Status = "OL"
+		}
+		code = data[1]
+		if code == '0' || (binary && code == 0) {
+			metrics.Status = "LB"
+		}
+		metrics.TestResult = selfTestResult(data[2])
+	}
+}
+
+// The third 'S' byte holds the result of the last self-test, as in NUT's
+// ups.test.result.
+func selfTestResult(code byte) string {
+	switch code {
+	case '0', 0:
+		return TEST_RESULT_PASSED
+	case '1', 1:
+		return TEST_RESULT_BATTERY_FAILED
+	case '2', 2:
+		return TEST_RESULT_IN_PROGRESS
+	case '3', 3:
+		return TEST_RESULT_BAD_INVERTER
+	}
+	return TEST_RESULT_UNKNOWN
+}
+
+func decodePower(messages map[byte][]byte, metrics *UPSMetrics) {
+	if data, ok := messages['P']; ok {
+		end := bytes.IndexByte(data, 'X')
+		if end < 1 {
+			return
+		}
+		va, _ := strconv.ParseUint(string(data[1:end]), 10, 32)
+		metrics.Power = uint(va)
+		metrics.PowerUnit = "VA"
+	}
+}
+
+// Protocol 3003, every numeric field is hex ASCII.
+func decodeSmartPro(m *SmartProUPSMonitor, messages map[byte][]byte, metrics *UPSMetrics) {
+
+	battery_voltage_nominal := 12.0
+	input_voltage_nominal := 120.0
+	input_voltage_scaled := 120.0
+	switchable_load_banks := 0
+
+	decodeFirmwareAndUnit(messages, metrics)
+
+	// load
+	if data, ok := messages['L']; ok {
+		metrics.Load = uint(hex2d(data, 1, 2))
+	}
+
+	// temp
+	if data, ok := messages['T']; ok {
+		metrics.InputFrequency = float64(hex2d(data, 3, 3)) / 10.0
+
+		switch data[6] {
+		case '0':
+			metrics.InputFrequencyNominal = 50
+		case '1':
+			metrics.InputFrequencyNominal = 60
+		}
+
+		temperatureFromRaw(hex2d(data, 1, 2), metrics)
+	}
+
+	decodeSmartStatus(messages, metrics, false)
+
+	// voltage
+	if data, ok := messages['V']; ok {
+		battery_voltage_nominal = float64(hex2d(data, 2, 2)) * 6.0
+		input_voltage_nominal, input_voltage_scaled = inputVoltageNominal(data[1])
+
+		lb := data[4]
+		if lb >= '0' && lb <= '9' {
+			switchable_load_banks = int(lb) - '0'
+		}
+	}
+	metrics.LoadBanks = switchable_load_banks
+	metrics.InputVoltageNominal = input_voltage_nominal
+	metrics.BatteryVoltageNominal = battery_voltage_nominal
+
+	// drain (probably)
+	if data, ok := messages['D']; ok {
+		iv := float64(hex2d(data, 1, 2)) * input_voltage_scaled / 120.0
+		bv_12v := float64(hex2d(data, 3, 2)) / 10.0
+		bv := bv_12v * battery_voltage_nominal / 12.0
+
+		metrics.InputVoltage = round2(iv)
+		metrics.BatteryVoltage = round2(bv)
+		metrics.BatteryCharge = m.ChargeModel.Charge(bv_12v, metrics.Status)
+	}
+
+	// min / max
+	if data, ok := messages['M']; ok {
+		ivmin := float64(hex2d(data, 1, 2)) * input_voltage_scaled / 120.0
+		metrics.InputVoltageMinimum = round2(ivmin)
+
+		// TODO - this value appears always 0, it should be 199
+		if ivmin <= 0 {
+			m.tryResetInputVoltageReading()
+		}
+
+		ivmax := float64(hex2d(data, 3, 2)) * input_voltage_scaled / 120.0
+		metrics.InputVoltageMaximum = round2(ivmax)
+	}
+
+	decodePower(messages, metrics)
+}
+
+// Protocol 3005 uses the 3003 command set with binary fields in place of hex
+// ASCII.
+func decodeSmart3005(m *SmartProUPSMonitor, messages map[byte][]byte, metrics *UPSMetrics) {
+
+	battery_voltage_nominal := 12.0
+	input_voltage_nominal := 120.0
+	input_voltage_scaled := 120.0
+
+	decodeFirmwareAndUnit(messages, metrics)
+
+	if data, ok := messages['L']; ok {
+		metrics.Load = uint(bin2d(data, 1, 1))
+	}
+
+	if data, ok := messages['T']; ok {
+		temperatureFromRaw(bin2d(data, 1, 1), metrics)
+		metrics.InputFrequency = float64(bin2d(data, 2, 2)) / 10.0
+		switch data[4] {
+		case '0', 0:
+			metrics.InputFrequencyNominal = 50
+		case '1', 1:
+			metrics.InputFrequencyNominal = 60
+		}
+	}
+
+	decodeSmartStatus(messages, metrics, true)
+
+	if data, ok := messages['V']; ok {
+		input_voltage_nominal, input_voltage_scaled = inputVoltageNominal(data[1])
+		battery_voltage_nominal = float64(bin2d(data, 2, 1)) * 6.0
+		if banks := data[3]; banks <= 9 {
+			metrics.LoadBanks = int(banks)
+		}
+	}
+	metrics.InputVoltageNominal = input_voltage_nominal
+	metrics.BatteryVoltageNominal = battery_voltage_nominal
+
+	if data, ok := messages['D']; ok {
+		iv := float64(bin2d(data, 1, 1)) * input_voltage_scaled / 120.0
+		bv_12v := float64(bin2d(data, 2, 1)) / 10.0
+		bv := bv_12v * battery_voltage_nominal / 12.0
+
+		metrics.InputVoltage = round2(iv)
+		metrics.BatteryVoltage = round2(bv)
+		metrics.BatteryCharge = m.ChargeModel.Charge(bv_12v, metrics.Status)
+	}
+
+	if data, ok := messages['M']; ok {
+		ivmin := float64(bin2d(data, 1, 1)) * input_voltage_scaled / 120.0
+		ivmax := float64(bin2d(data, 2, 1)) * input_voltage_scaled / 120.0
+		metrics.InputVoltageMinimum = round2(ivmin)
+		metrics.InputVoltageMaximum = round2(ivmax)
+		if ivmin <= 0 {
+			m.tryResetInputVoltageReading()
+		}
+	}
+
+	decodePower(messages, metrics)
+}
+
+// Status of the OMNIVS family is a single digit in the second 'S' byte.
+func decodeOmniVSStatus(messages map[byte][]byte, metrics *UPSMetrics) {
+	if data, ok := messages['S']; ok {
+		switch data[2] {
+		case '0':
+			metrics.Status = "OL"
+		case '1':
+			metrics.Status = "OB"
+		case '2':
+			// charge-only mode, no AC out
+			metrics.Status = "OFF"
+		}
+		if data[1] == '0' {
+			metrics.Status = "LB"
+		}
+	}
+}
+
+func decodeOmniVSNominal(messages map[byte][]byte, metrics *UPSMetrics) float64 {
+	input_voltage_scaled := 120.0
+	metrics.InputVoltageNominal = 120.0
+	metrics.BatteryVoltageNominal = 12.0
+	if data, ok := messages['V']; ok {
+		metrics.InputVoltageNominal, input_voltage_scaled = inputVoltageNominal(data[1])
+		if bvn := hex2d(data, 2, 2); bvn > 0 {
+			metrics.BatteryVoltageNominal = float64(bvn) * 6.0
+		}
+	}
+	return input_voltage_scaled
+}
+
+// Protocol 1001, input and battery voltage come from the 'B' reply and there
+// is no load, temperature or frequency reading.
+func decodeOmniVS(m *SmartProUPSMonitor, messages map[byte][]byte, metrics *UPSMetrics) {
+	decodeFirmwareAndUnit(messages, metrics)
+	decodeOmniVSStatus(messages, metrics)
+	input_voltage_scaled := decodeOmniVSNominal(messages, metrics)
+
+	if data, ok := messages['B']; ok {
+		iv := float64(hex2d(data, 1, 2)) * input_voltage_scaled / 120.0
+		bv_12v := float64(hex2d(data, 3, 2)) / 10.0
+
+		metrics.InputVoltage = round2(iv)
+		metrics.BatteryVoltage = round2(bv_12v * metrics.BatteryVoltageNominal / 12.0)
+		metrics.BatteryCharge = m.ChargeModel.Charge(bv_12v, metrics.Status)
+	}
+}
+
+// Protocol 2001, the OMNIVS status byte with SMARTPRO style 'D' and 'L'
+// replies.
+func decodeOmniVS2001(m *SmartProUPSMonitor, messages map[byte][]byte, metrics *UPSMetrics) {
+	decodeFirmwareAndUnit(messages, metrics)
+	decodeOmniVSStatus(messages, metrics)
+	input_voltage_scaled := decodeOmniVSNominal(messages, metrics)
+
+	if data, ok := messages['L']; ok {
+		metrics.Load = uint(hex2d(data, 1, 2))
+	}
+
+	if data, ok := messages['D']; ok {
+		iv := float64(hex2d(data, 1, 2)) * input_voltage_scaled / 120.0
+		bv_12v := float64(hex2d(data, 3, 2)) / 10.0
+
+		metrics.InputVoltage = round2(iv)
+		metrics.BatteryVoltage = round2(bv_12v * metrics.BatteryVoltageNominal / 12.0)
+		metrics.BatteryCharge = m.ChargeModel.Charge(bv_12v, metrics.Status)
+	}
+}
@@ -0,0 +1,95 @@
+package tripplite
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnknownProtocol(t *testing.T) {
+	// 4001 is not in NUT's driver, its reply layout is unknown
+	for _, reply := range [][]byte{{0, 0x99, 0x99}, {0, 0x40, 0x01}} {
+		transport := newSmartProTestTransport(map[byte][]byte{0: reply})
+		_, err := NewSmartProUPSMonitorWithTransport(transport, DeviceInfo{})
+		if !errors.Is(err, ErrUnknownProtocol) {
+			t.Errorf("expected ErrUnknownProtocol for %x, got %v", reply[1:], err)
+		}
+	}
+}
+
+func TestGetStatsSmart3005(t *testing.T) {
+	replies := map[byte][]byte{
+		0:   {0, 0x30, 0x05},
+		'D': {'D', 120, 128},
+		'L': {'L', 42},
+		'M': {'M', 110, 130},
+		'P': []byte("P750X"),
+		'S': {'S', 1, 0, 0, 1},
+		'T': {'T', 100, 0x01, 0xf4, 0},
+		'V': {'V', '2', 4, 1},
+	}
+
+	mon, err := NewSmartProUPSMonitorWithTransport(newSmartProTestTransport(replies), DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mon.ProtocolName != "SMART_3005" {
+		t.Errorf("expected SMART_3005, got %s", mon.ProtocolName)
+	}
+
+	m, err := mon.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+	}{
+		{"Status", "OB", m.Status},
+		{"Load", uint(42), m.Load},
+		{"InputVoltageNominal", 230.0, m.InputVoltageNominal},
+		{"InputVoltage", 230.0, m.InputVoltage},
+		{"BatteryVoltageNominal", 24.0, m.BatteryVoltageNominal},
+		{"BatteryVoltage", 25.6, m.BatteryVoltage},
+		{"InputFrequency", 50.0, m.InputFrequency},
+		{"InputFrequencyNominal", 50.0, m.InputFrequencyNominal},
+		{"LoadBanks", 1, m.LoadBanks},
+		{"Power", uint(750), m.Power},
+	}
+
+	for _, check := range checks {
+		if check.expected != check.actual {
+			t.Errorf("%s: expected %v, got %v", check.name, check.expected, check.actual)
+		}
+	}
+}
+
+func TestGetStatsOmniVS(t *testing.T) {
+	replies := map[byte][]byte{
+		0:   {0, 0x10, 0x01},
+		'B': []byte("B7880"),
+		'S': []byte("S11"),
+		'V': []byte("V102"),
+	}
+
+	mon, err := NewSmartProUPSMonitorWithTransport(newSmartProTestTransport(replies), DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := mon.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Status != "OB" || m.InputVoltage != 120 || m.BatteryVoltage != 12.8 {
+		t.Errorf("unexpected metrics %+v", m)
+	}
+
+	for _, sent := range mon.t.(*MemoryTransport).Sent {
+		if sent[0] == 'T' || sent[0] == 'M' {
+			t.Errorf("sent unsupported command %c to OMNIVS", sent[0])
+		}
+	}
+}
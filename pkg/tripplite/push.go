@@ -0,0 +1,177 @@
+package tripplite
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	INFLUX_CONTENT_TYPE       = "text/plain; charset=utf-8"
+	REMOTE_WRITE_CONTENT_TYPE = "application/x-protobuf"
+	REMOTE_WRITE_VERSION      = "0.1.0"
+)
+
+// Selects the fields a push sink sends by name, e.g. battery_* or
+// input_voltage_volts. Nothing included means every field, excludes win.
+type FieldFilter struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (f FieldFilter) Allows(name string) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, name) {
+		return false
+	}
+	return !matchAny(f.Exclude, name)
+}
+
+// A numeric field of a sample, named like the Prometheus gauges without the
+// namespace.
+type PushField struct {
+	Name  string
+	Value float64
+}
+
+// The numeric fields of a sample which pass the filter.
+func PushFields(m *UPSMetrics, filter FieldFilter) []PushField {
+	fields := []PushField{}
+	for _, gauge := range promGauges {
+		if filter.Allows(gauge.Name) {
+			fields = append(fields, PushField{gauge.Name, gauge.Value(m)})
+		}
+	}
+	if filter.Allows("communication_ok") {
+		val := 1.0
+		if m.Communication == COMM_LOST {
+			val = 0.0
+		}
+		fields = append(fields, PushField{"communication_ok", val})
+	}
+	return fields
+}
+
+// When a sample was taken, now for samples without a timestamp.
+func SampleTime(m *UPSMetrics) time.Time {
+	switch {
+	case !m.Timestamp.IsZero():
+		return m.Timestamp
+	case m.UnixTimestamp > 0:
+		return time.Unix(m.UnixTimestamp, 0)
+	}
+	return time.Now()
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+var influxStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// Writes a sample as one line of InfluxDB line protocol, measurement
+// tripplite tagged with the device labels. Samples without fields are
+// skipped as Influx rejects them.
+func WriteInfluxLine(w io.Writer, m *UPSMetrics, filter FieldFilter) error {
+	fields := []string{}
+	for _, f := range PushFields(m, filter) {
+		if math.IsNaN(f.Value) || math.IsInf(f.Value, 0) {
+			continue
+		}
+		fields = append(fields, f.Name+"="+strconv.FormatFloat(f.Value, 'f', -1, 64))
+	}
+	if filter.Allows("status") && len(m.Status) > 0 {
+		fields = append(fields, `status="`+influxStringEscaper.Replace(m.Status)+`"`)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	line := strings.Builder{}
+	line.WriteString(PROMETHEUS_NAMESPACE)
+	for _, label := range append(promDeviceLabels(m), promLabel{"serial", m.Serial}) {
+		if len(label.Value) > 0 {
+			line.WriteString("," + label.Name + "=" + influxTagEscaper.Replace(label.Value))
+		}
+	}
+	line.WriteString(" " + strings.Join(fields, ","))
+	line.WriteString(" " + strconv.FormatInt(SampleTime(m).UnixNano(), 10) + "\n")
+	_, err := io.WriteString(w, line.String())
+	return err
+}
+
+// One series of a remote-write request.
+type RemoteWriteSeries struct {
+	Labels    []promLabel
+	Value     float64
+	Timestamp int64
+}
+
+func newRemoteWriteSeries(name string, labels []promLabel, val float64, ts int64) RemoteWriteSeries {
+	all := []promLabel{{"__name__", promName(name)}}
+	for _, label := range labels {
+		if len(label.Value) > 0 {
+			all = append(all, label)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return RemoteWriteSeries{all, val, ts}
+}
+
+// The series of a sample with the names of the scrape endpoint. status is
+// sent as the same enum-style gauge.
+func RemoteWriteSamples(m *UPSMetrics, filter FieldFilter) []RemoteWriteSeries {
+	ts := SampleTime(m).UnixMilli()
+	labels := promDeviceLabels(m)
+	series := []RemoteWriteSeries{}
+	for _, f := range PushFields(m, filter) {
+		series = append(series, newRemoteWriteSeries(f.Name, labels, f.Value, ts))
+	}
+	if filter.Allows("status") {
+		for _, status := range PROMETHEUS_STATUS_VALUES {
+			val := 0.0
+			if strings.EqualFold(m.Status, status) {
+				val = 1.0
+			}
+			series = append(series, newRemoteWriteSeries("status", append(labels, promLabel{"status", status}), val, ts))
+		}
+	}
+	return series
+}
+
+func protoBytes(buf []byte, field uint64, val []byte) []byte {
+	buf = binary.AppendUvarint(buf, field<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(val)))
+	return append(buf, val...)
+}
+
+// Encodes a prometheus.WriteRequest protobuf, the body of a remote-write
+// request before snappy compression.
+func EncodeRemoteWrite(series []RemoteWriteSeries) []byte {
+	req := []byte{}
+	for _, s := range series {
+		ts := []byte{}
+		for _, label := range s.Labels {
+			l := protoBytes(nil, 1, []byte(label.Name))
+			l = protoBytes(l, 2, []byte(label.Value))
+			ts = protoBytes(ts, 1, l)
+		}
+		sample := binary.AppendUvarint(nil, 1<<3|1)
+		sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(s.Value))
+		sample = binary.AppendUvarint(sample, 2<<3|0)
+		sample = binary.AppendUvarint(sample, uint64(s.Timestamp))
+		ts = protoBytes(ts, 2, sample)
+		req = protoBytes(req, 1, ts)
+	}
+	return req
+}
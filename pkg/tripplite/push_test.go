@@ -0,0 +1,70 @@
+package tripplite
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFieldFilter(t *testing.T) {
+	filter := FieldFilter{Include: []string{"battery_*", "status"}, Exclude: []string{"battery_voltage_*"}}
+	tests := map[string]bool{
+		"battery_charge_percent":        true,
+		"battery_voltage_volts":         false,
+		"battery_voltage_nominal_volts": false,
+		"status":                        true,
+		"load_percent":                  false,
+	}
+	for name, ok := range tests {
+		if filter.Allows(name) != ok {
+			t.Errorf("%s: expected %v", name, ok)
+		}
+	}
+	if !(FieldFilter{}).Allows("load_percent") {
+		t.Errorf("expected an empty filter to allow everything")
+	}
+}
+
+func TestWriteInfluxLine(t *testing.T) {
+	m := &UPSMetrics{Name: "rack a", Serial: "2207,1", Status: "OB", BatteryCharge: 87, Load: 20, Timestamp: time.Unix(1700000000, 5)}
+	buf := bytes.Buffer{}
+	if err := WriteInfluxLine(&buf, m, FieldFilter{Include: []string{"battery_charge_percent", "load_percent", "status"}}); err != nil {
+		t.Fatal(err)
+	}
+	expect := `tripplite,ups=rack\ a,serial=2207\,1 battery_charge_percent=87,load_percent=20,status="OB" 1700000000000000005` + "\n"
+	if buf.String() != expect {
+		t.Errorf("expected %q, got %q", expect, buf.String())
+	}
+
+	buf.Reset()
+	WriteInfluxLine(&buf, m, FieldFilter{Include: []string{"nothing"}})
+	if buf.Len() != 0 {
+		t.Errorf("expected no line without fields, got %q", buf.String())
+	}
+}
+
+func TestEncodeRemoteWrite(t *testing.T) {
+	series := []RemoteWriteSeries{{Labels: []promLabel{{"n", "v"}}, Value: 1, Timestamp: 2}}
+	expect := []byte{
+		0x0a, 0x15, // timeseries
+		0x0a, 0x06, 0x0a, 0x01, 'n', 0x12, 0x01, 'v', // label
+		0x12, 0x0b, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, 0x10, 0x02, // sample
+	}
+	if got := EncodeRemoteWrite(series); !bytes.Equal(got, expect) {
+		t.Errorf("expected %x, got %x", expect, got)
+	}
+
+	m := &UPSMetrics{Name: "rack", Status: "OL", UnixTimestamp: 1700000000}
+	samples := RemoteWriteSamples(m, FieldFilter{Include: []string{"status"}})
+	if len(samples) != len(PROMETHEUS_STATUS_VALUES) {
+		t.Fatalf("expected one series per status, got %d", len(samples))
+	}
+	labels := []string{}
+	for _, label := range samples[0].Labels {
+		labels = append(labels, label.Name+"="+label.Value)
+	}
+	if strings.Join(labels, ",") != "__name__=tripplite_status,status=OL,ups=rack" || samples[0].Value != 1 || samples[0].Timestamp != 1700000000000 {
+		t.Errorf("unexpected series %v %v", labels, samples[0])
+	}
+}
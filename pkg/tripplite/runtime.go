@@ -0,0 +1,149 @@
+package tripplite
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+var (
+	// Upper bound of an estimate, a nearly idle UPS would otherwise report
+	// days of runtime.
+	RUNTIME_MAX = 24 * time.Hour
+	// A discharge is only learned from once it lasted this long and dropped
+	// the charge by RUNTIME_LEARN_MIN_DROP percent.
+	RUNTIME_LEARN_MIN_DURATION = 60 * time.Second
+	RUNTIME_LEARN_MIN_DROP     = 2.0
+)
+
+// Battery model used to estimate runtime, zero values take the defaults from
+// WithDefaults. CapacityAh is the rating of the battery string at its nominal
+// voltage over RatedHours, Peukert is the exponent of Peukert's law (about
+// 1.1-1.3 for lead acid). LearnRate weighs each observed discharge against
+// what was learned before, 0 keeps the default and a negative value disables
+// learning.
+type RuntimeModel struct {
+	CapacityAh  float64 `yaml:"capacity_ah" json:"capacity_ah"`
+	RatedHours  float64 `yaml:"rated_hours" json:"rated_hours"`
+	Peukert     float64 `yaml:"peukert" json:"peukert"`
+	PowerFactor float64 `yaml:"power_factor" json:"power_factor"`
+	Efficiency  float64 `yaml:"efficiency" json:"efficiency"`
+	LearnRate   float64 `yaml:"learn_rate" json:"learn_rate"`
+}
+
+func (r RuntimeModel) WithDefaults() RuntimeModel {
+	if r.CapacityAh <= 0 {
+		r.CapacityAh = 9.0
+	}
+	if r.RatedHours <= 0 {
+		r.RatedHours = 20.0
+	}
+	if r.Peukert <= 0 {
+		r.Peukert = 1.2
+	}
+	if r.PowerFactor <= 0 {
+		r.PowerFactor = 0.6
+	}
+	if r.Efficiency <= 0 {
+		r.Efficiency = 0.9
+	}
+	if r.LearnRate == 0 {
+		r.LearnRate = 0.25
+	}
+	return r
+}
+
+// Real power drawn by the load in watts, 0 when the device does not report
+// its nominal power.
+func (r RuntimeModel) LoadWatts(m *UPSMetrics) float64 {
+	return float64(m.Power) * float64(m.Load) / 100.0 * r.PowerFactor
+}
+
+// Runtime from a full battery at the given load, using Peukert's law
+// t = H * (C / (I * H))^k with the battery current I drawn by the inverter.
+func (r RuntimeModel) FullRuntime(watts float64, batteryVoltage float64) time.Duration {
+	max := RUNTIME_MAX.Seconds()
+	if batteryVoltage <= 0 {
+		return 0
+	}
+	if watts <= 0 {
+		return RUNTIME_MAX
+	}
+	current := watts / (batteryVoltage * r.Efficiency)
+	hours := r.RatedHours * math.Pow(r.CapacityAh/(current*r.RatedHours), r.Peukert)
+	return time.Duration(math.Min(hours*3600.0, max) * float64(time.Second))
+}
+
+// Estimates runtime remaining from the model, corrected by a factor learned
+// from how fast the charge actually fell while on battery.
+type RuntimeEstimator struct {
+	Model  RuntimeModel
+	Factor float64
+	start  *UPSMetrics
+	load   float64
+	count  int
+}
+
+func NewRuntimeEstimator(model RuntimeModel) *RuntimeEstimator {
+	return &RuntimeEstimator{Model: model.WithDefaults(), Factor: 1.0}
+}
+
+func onBattery(m *UPSMetrics) bool {
+	return m.Communication != COMM_LOST && statusMatches(m.Status, "OB")
+}
+
+// Learns from samples in the order they were taken, like a saved history.
+func (e *RuntimeEstimator) Learn(history []*UPSMetrics) {
+	for _, m := range history {
+		e.observe(m)
+	}
+}
+
+func (e *RuntimeEstimator) observe(m *UPSMetrics) {
+	if !onBattery(m) || e.Model.LearnRate < 0 {
+		e.start = nil
+		return
+	}
+
+	if e.start == nil || m.BatteryCharge > e.start.BatteryCharge {
+		e.start = m
+		e.load = 0
+		e.count = 0
+	}
+	e.load += e.Model.LoadWatts(m)
+	e.count++
+
+	elapsed := time.Duration(m.UnixTimestamp-e.start.UnixTimestamp) * time.Second
+	drop := e.start.BatteryCharge - m.BatteryCharge
+	if elapsed < RUNTIME_LEARN_MIN_DURATION || drop < RUNTIME_LEARN_MIN_DROP {
+		return
+	}
+
+	predicted := e.Model.FullRuntime(e.load/float64(e.count), m.BatteryVoltageNominal)
+	if predicted <= 0 || predicted >= RUNTIME_MAX {
+		return
+	}
+	observed := elapsed.Seconds() * 100.0 / drop
+	factor := math.Max(0.1, math.Min(10.0, observed/predicted.Seconds()))
+	e.Factor += e.Model.LearnRate * (factor - e.Factor)
+
+	e.start = m
+	e.load = 0
+	e.count = 0
+}
+
+// Runtime remaining at the load and charge of a sample, 0 when unknown.
+func (e *RuntimeEstimator) Remaining(m *UPSMetrics) time.Duration {
+	if m.Power == 0 || strings.EqualFold(m.Status, "OFF") {
+		return 0
+	}
+	full := e.Model.FullRuntime(e.Model.LoadWatts(m), m.BatteryVoltageNominal)
+	remaining := full.Seconds() * e.Factor * m.BatteryCharge / 100.0
+	return time.Duration(math.Min(remaining, RUNTIME_MAX.Seconds()) * float64(time.Second))
+}
+
+// Learns from the sample and returns its runtime remaining in seconds.
+func (e *RuntimeEstimator) Estimate(m *UPSMetrics) float64 {
+	e.observe(m)
+	return math.Round(e.Remaining(m).Seconds())
+}
@@ -0,0 +1,89 @@
+package tripplite
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRuntimeModel(t *testing.T) {
+	model := RuntimeModel{}.WithDefaults()
+	m := UPSMetrics{Power: 1500, Load: 50, BatteryVoltageNominal: 24, BatteryCharge: 100, Status: "OB"}
+
+	if watts := model.LoadWatts(&m); watts != 450 {
+		t.Errorf("expected 450W, got %v", watts)
+	}
+
+	full := model.FullRuntime(model.LoadWatts(&m), m.BatteryVoltageNominal)
+	if math.Abs(full.Seconds()-722) > 5 {
+		t.Errorf("expected about 722s at 450W, got %v", full)
+	}
+
+	half := model.FullRuntime(model.LoadWatts(&m)/2, m.BatteryVoltageNominal)
+	if half <= 2*full {
+		t.Errorf("expected Peukert runtime at half load above twice %v, got %v", full, half)
+	}
+
+	e := NewRuntimeEstimator(RuntimeModel{})
+	m.BatteryCharge = 50
+	if remaining := e.Estimate(&m); math.Abs(remaining-361) > 3 {
+		t.Errorf("expected about 361s at 50%%, got %v", remaining)
+	}
+
+	m.Power = 0
+	if remaining := e.Estimate(&m); remaining != 0 {
+		t.Errorf("expected unknown runtime without nominal power, got %v", remaining)
+	}
+}
+
+func TestRuntimeLearning(t *testing.T) {
+	history := []*UPSMetrics{}
+	for i := 0; i <= 60; i++ {
+		history = append(history, &UPSMetrics{
+			Power:                 1500,
+			Load:                  50,
+			BatteryVoltageNominal: 24,
+			BatteryCharge:         100 - float64(i),
+			Status:                "OB",
+			UnixTimestamp:         int64(i * 10),
+		})
+	}
+
+	// 1% every 10s is 1000s from full, longer than the 722s the model predicts
+	e := NewRuntimeEstimator(RuntimeModel{})
+	e.Learn(history)
+	if e.Factor < 1.2 || e.Factor > 1.39 {
+		t.Errorf("expected factor to approach 1.38, got %v", e.Factor)
+	}
+
+	fixed := NewRuntimeEstimator(RuntimeModel{LearnRate: -1})
+	fixed.Learn(history)
+	if fixed.Factor != 1 {
+		t.Errorf("expected learning to be disabled, got %v", fixed.Factor)
+	}
+
+	m := history[len(history)-1]
+	if e.Remaining(m) <= fixed.Remaining(m) {
+		t.Errorf("expected learned estimate %v above model %v", e.Remaining(m), fixed.Remaining(m))
+	}
+}
+
+func TestScriptRuntime(t *testing.T) {
+	script := Script{Name: "runtime", Status: "OB", Runtime: 5 * time.Minute}
+
+	tests := []struct {
+		m      UPSMetrics
+		expect bool
+	}{
+		{UPSMetrics{Status: "OB", BatteryCharge: 90, RuntimeRemaining: 600}, false},
+		{UPSMetrics{Status: "OB", BatteryCharge: 90, RuntimeRemaining: 200}, true},
+		{UPSMetrics{Status: "OB", BatteryCharge: 90, RuntimeRemaining: 0}, false},
+		{UPSMetrics{Status: "OL", BatteryCharge: 90, RuntimeRemaining: 200}, false},
+	}
+
+	for _, test := range tests {
+		if active := script.Check(test.m); active != test.expect {
+			t.Errorf("expected %v for %+v", test.expect, test.m)
+		}
+	}
+}
@@ -1,32 +1,192 @@
 package tripplite
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// Pseudo status for scripts which run when communication is lost.
+	STATUS_COMM_LOST = "COMMLOST"
+
+	// Runs script on activation and cancel when deactivated, the default.
+	ACTION_SCRIPT = "script"
+	// Switches Bank off on activation and back on when deactivated.
+	ACTION_SHED_BANK = "shed_bank"
+	// POSTs Body to URL on activation and when deactivated.
+	ACTION_WEBHOOK = "webhook"
+	// Mails Subject and Body on activation and when deactivated.
+	ACTION_EMAIL = "email"
+)
+
+// Switches load banks for shed_bank actions, see SmartProUPSMonitor.
+type LoadBankSwitcher interface {
+	SwitchLoadBank(bank int, on bool) error
+}
+
+// Blocks scripts with wait_for_clients until the clients of the UPS have shut
+// down, see the server's client registry. The wait ends early once stop
+// returns true.
+type ClientWaiter interface {
+	WaitForClients(stop func() bool)
+}
+
+// Told the outcome of every script run.
+type ScriptResultListener interface {
+	OnScriptResult(ScriptResult)
+}
+
 // From API endpoints
 type PublicScript struct {
-	Name           string  `json:"name"`
-	Charge         float64 `json:"charge"`
-	Status         string  `json:"status"`
-	ShutdownScript string  `json:"script"`
-	CancelScript   string  `json:"cancel"`
+	Name           string        `json:"name"`
+	Charge         float64       `json:"charge"`
+	Runtime        time.Duration `json:"runtime"`
+	Status         string        `json:"status"`
+	ShutdownScript string        `json:"script"`
+	CancelScript   string        `json:"cancel"`
 }
 
 // From Configs
 type Script struct {
-	Public         bool    `json:"public" yaml:"public"`
-	RemoteOnly     bool    `json:"remote_only" yaml:"remote_only"`
-	Name           string  `json:"name" yaml:"name"`
-	Charge         float64 `json:"charge" yaml:"charge"`
-	Status         string  `json:"status" yaml:"status"`
-	ShutdownScript string  `json:"script" yaml:"script"`
-	CancelScript   string  `json:"cancel" yaml:"cancel"`
+	Public         bool          `json:"public" yaml:"public"`
+	RemoteOnly     bool          `json:"remote_only" yaml:"remote_only"`
+	Name           string        `json:"name" yaml:"name"`
+	Charge         float64       `json:"charge" yaml:"charge"`
+	Runtime        time.Duration `json:"runtime" yaml:"runtime"`
+	Status         string        `json:"status" yaml:"status"`
+	ShutdownScript string        `json:"script" yaml:"script"`
+	CancelScript   string        `json:"cancel" yaml:"cancel"`
+	Action         string        `json:"action" yaml:"action"`
+	Bank           int           `json:"bank" yaml:"bank"`
+	WaitForClients bool          `json:"wait_for_clients" yaml:"wait_for_clients"`
+	// webhook actions, 0 retries takes WEBHOOK_RETRIES and -1 disables them
+	URL     string            `json:"url" yaml:"url"`
+	Body    string            `json:"body" yaml:"body"`
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	Retries int               `json:"retries" yaml:"retries"`
+	// email actions, Body is the mail's body template
+	Subject string `json:"subject" yaml:"subject"`
+}
+
+// A runtime threshold in JSON, a duration string like "5m0s" as in YAML.
+// Numbers are taken as seconds.
+type scriptRuntime time.Duration
+
+func (r scriptRuntime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(r).String())
+}
+
+func (r *scriptRuntime) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch val := v.(type) {
+	case nil:
+	case string:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return err
+		}
+		*r = scriptRuntime(d)
+	case float64:
+		*r = scriptRuntime(val * float64(time.Second))
+	default:
+		return fmt.Errorf("invalid runtime %s", data)
+	}
+	return nil
+}
+
+func (s PublicScript) MarshalJSON() ([]byte, error) {
+	type plain PublicScript
+	return json.Marshal(struct {
+		plain
+		Runtime scriptRuntime `json:"runtime"`
+	}{plain(s), scriptRuntime(s.Runtime)})
+}
+
+func (s *PublicScript) UnmarshalJSON(data []byte) error {
+	type plain PublicScript
+	v := struct {
+		*plain
+		Runtime scriptRuntime `json:"runtime"`
+	}{plain: (*plain)(s), Runtime: scriptRuntime(s.Runtime)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	s.Runtime = time.Duration(v.Runtime)
+	return nil
+}
+
+// Scripts are only marshalled for logs, so header values, which carry
+// credentials like Authorization, are redacted.
+func (s Script) MarshalJSON() ([]byte, error) {
+	type plain Script
+	if len(s.Headers) > 0 {
+		headers := map[string]string{}
+		for name := range s.Headers {
+			headers[name] = "<redacted>"
+		}
+		s.Headers = headers
+	}
+	return json.Marshal(struct {
+		plain
+		Runtime scriptRuntime `json:"runtime"`
+	}{plain(s), scriptRuntime(s.Runtime)})
+}
+
+func (s *Script) UnmarshalJSON(data []byte) error {
+	type plain Script
+	v := struct {
+		*plain
+		Runtime scriptRuntime `json:"runtime"`
+	}{plain: (*plain)(s), Runtime: scriptRuntime(s.Runtime)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	s.Runtime = time.Duration(v.Runtime)
+	return nil
+}
+
+// Checks the action and its settings, so a mistake fails at startup rather
+// than when the UPS goes on battery. Email actions also need a mailer, which
+// the script cannot check.
+func (w Script) Validate() error {
+	switch strings.ToLower(w.Action) {
+	case "", ACTION_SCRIPT:
+	case ACTION_SHED_BANK:
+		if w.Bank < 1 {
+			return fmt.Errorf("%s action needs a bank numbered from 1", w.Action)
+		}
+	case ACTION_WEBHOOK:
+		if u, err := url.Parse(w.URL); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return fmt.Errorf("%s action needs an absolute url, got %q", w.Action, w.URL)
+		}
+		if _, err := parseWebhookBody(w.Body); err != nil {
+			return fmt.Errorf("webhook body: %w", err)
+		}
+	case ACTION_EMAIL:
+		if _, err := template.New("subject").Parse(w.Subject); err != nil {
+			return fmt.Errorf("email subject: %w", err)
+		}
+		if _, err := template.New("body").Parse(w.Body); err != nil {
+			return fmt.Errorf("email body: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", w.Action)
+	}
+	return nil
 }
 
 func (w Script) getCharge() float64 {
@@ -40,44 +200,68 @@ func (w Script) getCharge() float64 {
 	return v
 }
 
+func statusMatches(status string, expected string) bool {
+	if strings.EqualFold(status, expected) {
+		return true
+	}
+	// "LB" (low battery) is only reported while on battery
+	return strings.EqualFold(status, "LB") && strings.EqualFold(expected, "OB")
+}
+
 func (w Script) Check(metrics UPSMetrics) bool {
+	// Scripts for "COMMLOST" run while the device cannot be reached
+	if strings.EqualFold(w.Status, STATUS_COMM_LOST) {
+		return metrics.Communication == COMM_LOST
+	}
+
 	// Generally the staus must be "OB" (on battery) and...
-	if strings.EqualFold(metrics.Status, w.Status) {
+	if statusMatches(metrics.Status, w.Status) {
 		// the charge needs to fall below the user-defined charge
 		if metrics.BatteryCharge < w.getCharge() {
 			return true
 		}
+		// or the estimated runtime below the user-defined runtime
+		if w.Runtime > 0 && metrics.RuntimeRemaining > 0 && metrics.RuntimeRemaining < w.Runtime.Seconds() {
+			return true
+		}
 	}
 	return false
 }
 
 type WatcherScript struct {
 	Script
-	Active  bool
-	Running bool
-	Enabled bool
+	Active   bool
+	Running  bool
+	Enabled  bool
+	switcher LoadBankSwitcher
+	waiter   ClientWaiter
+	results  ScriptResultListener
+	secret   []byte
+	mailer   *Mailer
+	sample   UPSMetrics
+	pending  *scriptTransition
+	// Active, Running, sample and pending are shared between OnMetrics and runs
+	lock sync.Mutex
 }
 
-func (s WatcherScript) ToPublicScript() PublicScript {
+// A transition which arrived while the script was running.
+type scriptTransition struct {
+	cancel bool
+	sample UPSMetrics
+}
+
+func (s *WatcherScript) ToPublicScript() PublicScript {
 	return PublicScript{
 		Name:           s.Name,
 		Charge:         s.Charge,
+		Runtime:        s.Runtime,
 		Status:         s.Status,
 		ShutdownScript: s.ShutdownScript,
 		CancelScript:   s.CancelScript,
 	}
 }
 
-func (w *WatcherScript) FromScript(s Script) *WatcherScript {
-	w.Name = s.Name
-	w.Charge = s.Charge
-	w.Status = s.Status
-	w.ShutdownScript = s.ShutdownScript
-	w.CancelScript = s.CancelScript
-	return w
-}
-
-func (w WatcherScript) GetShell() string {
+func (w *WatcherScript) GetShell() string {
 	shell := os.Getenv("SHELL")
 	if len(shell) == 0 {
 		shell = "/bin/sh"
@@ -85,18 +269,182 @@ func (w WatcherScript) GetShell() string {
 	return shell
 }
 
+// Tells the result listener the outcome of a run, exit code 0 without an
+// error.
+func (w *WatcherScript) report(result ScriptResult, err error) error {
+	result.End = time.Now().Unix()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.ExitCode = 0
+	}
+	if w.results != nil {
+		w.results.OnScriptResult(result)
+	}
+	return err
+}
+
+func (w *WatcherScript) shedBank(do_cancel bool) error {
+	result := ScriptResult{Script: w.Name, Cancel: do_cancel, Start: time.Now().Unix(), ExitCode: -1}
+	if w.switcher == nil {
+		log.Warn().Str("script", w.Name).Int("bank", w.Bank).Msg("no device to switch load bank")
+		return w.report(result, ErrUnsupportedCommand)
+	}
+
+	log.Info().Str("script", w.Name).Int("bank", w.Bank).Bool("on", do_cancel).Msg("switching load bank")
+	err := w.switcher.SwitchLoadBank(w.Bank, do_cancel)
+	if err != nil {
+		log.Error().Err(err).Str("script", w.Name).Int("bank", w.Bank).Msg("failed to switch load bank")
+	}
+	return w.report(result, err)
+}
+
+func (w *WatcherScript) webhook(do_cancel bool, m UPSMetrics) error {
+	result := ScriptResult{Script: w.Name, Cancel: do_cancel, Start: time.Now().Unix(), ExitCode: -1}
+
+	body, err := WebhookBody(w.Body, NewWebhookEvent(w.Name, &m, do_cancel))
+	if err == nil {
+		retries := w.Retries
+		if retries == 0 {
+			retries = WEBHOOK_RETRIES
+		} else if retries < 0 {
+			retries = 0
+		}
+		log.Info().Str("script", w.Name).Str("url", w.URL).Bool("cancel", do_cancel).Msg("sending webhook")
+		err = SendWebhook(w.URL, body, w.Headers, w.secret, retries)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("script", w.Name).Str("url", w.URL).Msg("webhook failed")
+	}
+	return w.report(result, err)
+}
+
+func (w *WatcherScript) email(do_cancel bool, m UPSMetrics) error {
+	result := ScriptResult{Script: w.Name, Cancel: do_cancel, Start: time.Now().Unix(), ExitCode: -1}
+
+	err := errors.New("no smtp settings")
+	if w.mailer != nil {
+		title := w.Name + " activated"
+		if do_cancel {
+			title = w.Name + " cancelled"
+		}
+		data := MailData{UPS: m.Name, Title: title, Script: w.Name, Active: !do_cancel, Metrics: &m}
+		var msg MailMessage
+		if msg, err = w.mailer.Render(data, w.Subject, w.Body); err == nil {
+			log.Info().Str("script", w.Name).Bool("cancel", do_cancel).Msg("sending mail")
+			err = w.mailer.Notify(msg)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Str("script", w.Name).Msg("mail failed")
+	}
+	return w.report(result, err)
+}
+
+func (w *WatcherScript) IsActive() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.Active
+}
+
+func (w *WatcherScript) IsRunning() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.Running
+}
+
 func (w *WatcherScript) Run(do_cancel bool) error {
-	if w.Running {
+	w.lock.Lock()
+	m := w.sample
+	w.lock.Unlock()
+	return w.run(do_cancel, m)
+}
+
+// Runs the action for a sample. A transition arriving meanwhile runs once
+// this one is done, only the latest is kept and it is dropped when it leaves
+// the script in the state it is already in.
+func (w *WatcherScript) run(do_cancel bool, m UPSMetrics) error {
+	if !w.begin(do_cancel, m) {
 		return nil
 	}
+	return w.runFrom(do_cancel, m)
+}
+
+// Marks the script running, false when it already runs and the transition
+// is kept for after the current run.
+func (w *WatcherScript) begin(do_cancel bool, m UPSMetrics) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.Running {
+		w.pending = &scriptTransition{do_cancel, m}
+		return false
+	}
 	w.Running = true
+	return true
+}
+
+// Runs the action of a begun transition, then the pending one.
+func (w *WatcherScript) runFrom(do_cancel bool, m UPSMetrics) error {
+	for {
+		err := w.runAction(do_cancel, m)
+
+		w.lock.Lock()
+		next := w.pending
+		w.pending = nil
+		if next == nil || next.cancel == do_cancel {
+			w.Running = false
+			w.lock.Unlock()
+			return err
+		}
+		w.lock.Unlock()
+		do_cancel, m = next.cancel, next.sample
+	}
+}
+
+// True when a cancel arrived while the script runs.
+func (w *WatcherScript) cancelPending() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.pending != nil && w.pending.cancel
+}
+
+// Runs the action once, webhooks tell the sample's status.
+func (w *WatcherScript) runAction(do_cancel bool, m UPSMetrics) error {
+	if strings.EqualFold(w.Action, ACTION_SHED_BANK) {
+		return w.shedBank(do_cancel)
+	}
+
+	if strings.EqualFold(w.Action, ACTION_WEBHOOK) {
+		return w.webhook(do_cancel, m)
+	}
+
+	if strings.EqualFold(w.Action, ACTION_EMAIL) {
+		return w.email(do_cancel, m)
+	}
 
 	script := w.ShutdownScript
 	if do_cancel {
 		script = w.CancelScript
 	}
 
+	if !do_cancel && w.WaitForClients && w.waiter != nil {
+		log.Info().Str("script", w.Name).Msg("waiting for clients to shut down")
+		w.waiter.WaitForClients(w.cancelPending)
+		// neither script runs, there is no shutdown to cancel
+		w.lock.Lock()
+		cancelled := w.pending != nil && w.pending.cancel
+		if cancelled {
+			w.pending = nil
+		}
+		w.lock.Unlock()
+		if cancelled {
+			log.Info().Str("script", w.Name).Msg("cancelled while waiting for clients")
+			return nil
+		}
+	}
+
 	log.Info().Str("script", w.Name).Str("exec", script).Msg("running")
+	result := ScriptResult{Script: w.Name, Cancel: do_cancel, Start: time.Now().Unix(), ExitCode: -1}
 
 	shell_exec := w.GetShell()
 	shell := exec.Command(shell_exec, "-")
@@ -107,17 +455,24 @@ func (w *WatcherScript) Run(do_cancel bool) error {
 		err = shell.Start()
 		if err == nil {
 			io.WriteString(stdin, script+"\n")
+			// the shell only exits once it reads EOF
+			stdin.Close()
 			err = shell.Wait()
-			log.Info().Str("script", w.Name).Int("exit", shell.ProcessState.ExitCode()).Msg("script complete")
+			result.ExitCode = shell.ProcessState.ExitCode()
+			log.Info().Str("script", w.Name).Int("exit", result.ExitCode).Msg("script complete")
 		}
 	}
 
-	w.Running = false
-	return err
+	return w.report(result, err)
 }
 
 type Watcher struct {
-	Scripts map[string]*WatcherScript
+	Scripts  map[string]*WatcherScript
+	switcher LoadBankSwitcher
+	waiter   ClientWaiter
+	results  ScriptResultListener
+	secret   []byte
+	mailer   *Mailer
 }
 
 func NewWatcher() *Watcher {
@@ -132,14 +487,24 @@ func (w *Watcher) AddScript(script Script, enableRemote bool) {
 		return
 	}
 
-	w.Scripts[strings.ToLower(script.Name)] = &WatcherScript{
-		Script:  script,
-		Active:  false,
-		Running: false,
-		Enabled: enableRemote || !script.RemoteOnly,
+	wst := &WatcherScript{
+		Script:   script,
+		Active:   false,
+		Running:  false,
+		Enabled:  enableRemote || !script.RemoteOnly,
+		switcher: w.switcher,
+		waiter:   w.waiter,
+		results:  w.results,
+		secret:   w.secret,
+		mailer:   w.mailer,
 	}
+	w.Scripts[strings.ToLower(script.Name)] = wst
 
-	log.Info().Interface("script", script).Msgf("loaded script %s", script.Name)
+	log.Info().
+		Interface("script", wst.ToPublicScript()).
+		Str("action", script.Action).
+		Str("url", script.URL).
+		Msgf("loaded script %s", script.Name)
 }
 
 func (w *Watcher) AddPublicScript(script PublicScript) {
@@ -154,6 +519,7 @@ func (w *Watcher) AddPublicScript(script PublicScript) {
 			RemoteOnly:     false,
 			Name:           script.Name,
 			Charge:         script.Charge,
+			Runtime:        script.Runtime,
 			Status:         script.Status,
 			ShutdownScript: script.ShutdownScript,
 			CancelScript:   script.CancelScript,
@@ -161,15 +527,47 @@ func (w *Watcher) AddPublicScript(script PublicScript) {
 		Active:  false,
 		Running: false,
 		Enabled: true,
+		results: w.results,
 	}
 }
 
-func (w *Watcher) DisableAll() {
+// Sets the device used by shed_bank actions.
+func (w *Watcher) SetSwitcher(switcher LoadBankSwitcher) {
+	w.switcher = switcher
 	for _, script := range w.Scripts {
-		script.Enabled = false
-		if script.Active {
-			script.Run(true)
-		}
+		script.switcher = switcher
+	}
+}
+
+// Sets what scripts with wait_for_clients wait on.
+func (w *Watcher) SetClientWaiter(waiter ClientWaiter) {
+	w.waiter = waiter
+	for _, script := range w.Scripts {
+		script.waiter = waiter
+	}
+}
+
+// Sets the listener told the outcome of every script run.
+func (w *Watcher) SetResultListener(results ScriptResultListener) {
+	w.results = results
+	for _, script := range w.Scripts {
+		script.results = results
+	}
+}
+
+// Sets the secret webhook bodies are signed with.
+func (w *Watcher) SetSecret(secret []byte) {
+	w.secret = secret
+	for _, script := range w.Scripts {
+		script.secret = secret
+	}
+}
+
+// Sets the mailer of email actions.
+func (w *Watcher) SetMailer(mailer *Mailer) {
+	w.mailer = mailer
+	for _, script := range w.Scripts {
+		script.mailer = mailer
 	}
 }
 
@@ -197,23 +595,32 @@ func (w *Watcher) OnMetrics(m *UPSMetrics) bool {
 			any_active = true
 		}
 
-		if !wst.Active && active {
+		wst.lock.Lock()
+		was_active := wst.Active
+		wst.Active = active
+		wst.sample = *m
+		wst.lock.Unlock()
+
+		if !was_active && active {
 			log.Info().
 				Str("script", wst.Script.Name).
 				Float64("charge", wst.Script.getCharge()).
 				Bool("active", active).
 				Msg("state changed to active")
 
-			go wst.Run(active)
-		} else if wst.Active && !active {
+			if wst.begin(!active, *m) {
+				go wst.runFrom(!active, *m)
+			}
+		} else if was_active && !active {
 			log.Info().
 				Str("script", wst.Script.Name).
 				Float64("charge", wst.Script.getCharge()).
 				Bool("active", active).
 				Msg("state changed from active to inactive")
-			go wst.Run(active)
+			if wst.begin(!active, *m) {
+				go wst.runFrom(!active, *m)
+			}
 		}
-		wst.Active = active
 	}
 
 	return any_active
@@ -1,7 +1,14 @@
 package tripplite
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/rs/zerolog/log"
@@ -47,6 +54,7 @@ func TestWatcher(t *testing.T) {
 		{m: UPSMetrics{Status: "OB", BatteryCharge: 20.0}, expect: false},
 		{m: UPSMetrics{Status: "OB", BatteryCharge: 19.999}, expect: true},
 		{m: UPSMetrics{Status: "OB", BatteryCharge: 10.0}, expect: true},
+		{m: UPSMetrics{Status: "LB", BatteryCharge: 10.0}, expect: true},
 		{m: UPSMetrics{Status: "OL", BatteryCharge: 15.0}, expect: false},
 	}
 
@@ -66,3 +74,200 @@ func TestScriptDefaults(t *testing.T) {
 	cleanenv.ReadEnv(&script)
 	t.Logf("%v", script)
 }
+
+func TestWatcherQueuesTransitions(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "script.log")
+	w := NewWatcher()
+	w.AddScript(Script{
+		Name:           "slow",
+		Charge:         50,
+		Status:         "OB",
+		ShutdownScript: fmt.Sprintf("sleep 0.3; echo shutdown >> %s", out),
+		CancelScript:   fmt.Sprintf("echo cancel >> %s", out),
+	}, false)
+
+	waitFor := func(expected string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			data, _ := os.ReadFile(out)
+			if strings.TrimSpace(string(data)) == expected && !w.Scripts["slow"].IsRunning() {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		data, _ := os.ReadFile(out)
+		t.Fatalf("expected script output %q, got %q", expected, string(data))
+	}
+
+	// the cancel arrives while the shutdown script still runs
+	w.OnMetrics(&UPSMetrics{Status: "OB", BatteryCharge: 40})
+	time.Sleep(50 * time.Millisecond)
+	w.OnMetrics(&UPSMetrics{Status: "OL", BatteryCharge: 40})
+	waitFor("shutdown\ncancel")
+
+	// a flap back to active during the run leaves nothing to do
+	os.Remove(out)
+	w.OnMetrics(&UPSMetrics{Status: "OB", BatteryCharge: 40})
+	time.Sleep(50 * time.Millisecond)
+	w.OnMetrics(&UPSMetrics{Status: "OL", BatteryCharge: 40})
+	w.OnMetrics(&UPSMetrics{Status: "OB", BatteryCharge: 40})
+	time.Sleep(400 * time.Millisecond)
+	waitFor("shutdown")
+}
+
+type testWaiter struct {
+	waiting chan bool
+}
+
+func (c testWaiter) WaitForClients(stop func() bool) {
+	c.waiting <- true
+	for !stop() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatcherCancelWhileWaiting(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "script.log")
+	waiter := testWaiter{waiting: make(chan bool, 1)}
+	w := NewWatcher()
+	w.AddScript(Script{
+		Name:           "wait",
+		Charge:         50,
+		Status:         "OB",
+		WaitForClients: true,
+		ShutdownScript: fmt.Sprintf("echo shutdown >> %s", out),
+		CancelScript:   fmt.Sprintf("echo cancel >> %s", out),
+	}, false)
+	w.SetClientWaiter(waiter)
+
+	w.OnMetrics(&UPSMetrics{Status: "OB", BatteryCharge: 40})
+	select {
+	case <-waiter.waiting:
+	case <-time.After(time.Second):
+		t.Fatal("expected the script to wait for clients")
+	}
+	w.OnMetrics(&UPSMetrics{Status: "OL", BatteryCharge: 40})
+
+	for i := 0; i < 100 && w.Scripts["wait"].IsRunning(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Scripts["wait"].IsRunning() {
+		t.Fatal("expected the wait to end on the cancel")
+	}
+	if data, err := os.ReadFile(out); err == nil {
+		t.Errorf("expected no script to run, got %q", string(data))
+	}
+}
+
+type testSwitcher struct {
+	lock     sync.Mutex
+	switched []bool
+	busy     bool
+	overlap  bool
+}
+
+func (s *testSwitcher) SwitchLoadBank(bank int, on bool) error {
+	s.lock.Lock()
+	s.overlap = s.overlap || s.busy
+	s.busy = true
+	s.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.busy = false
+	if bank == 2 {
+		s.switched = append(s.switched, on)
+	}
+	return nil
+}
+
+func (s *testSwitcher) get() []bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]bool{}, s.switched...)
+}
+
+func TestWatcherShedBank(t *testing.T) {
+	switcher := &testSwitcher{}
+	w := NewWatcher()
+	w.AddScript(Script{Name: "shed", Charge: 100, Status: "OB", Action: ACTION_SHED_BANK, Bank: 2}, false)
+	w.SetSwitcher(switcher)
+
+	for _, status := range []string{"OL", "OB", "OB", "OL"} {
+		w.OnMetrics(&UPSMetrics{Status: status, BatteryCharge: 90})
+		time.Sleep(20 * time.Millisecond)
+	}
+	for i := 0; i < 50 && w.Scripts["shed"].IsRunning(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	switched := switcher.get()
+	if len(switched) != 2 || switched[0] || !switched[1] {
+		t.Errorf("expected bank 2 to be switched off then on, got %v", switched)
+	}
+	if switcher.overlap {
+		t.Errorf("expected switch commands not to overlap")
+	}
+}
+
+func TestScriptRuntimeJSON(t *testing.T) {
+	data, _ := json.Marshal(PublicScript{Name: "shutdown", Runtime: 5 * time.Minute})
+	if !strings.Contains(string(data), `"runtime":"5m0s"`) {
+		t.Errorf("expected the runtime as a duration string, got %s", data)
+	}
+	script := PublicScript{}
+	if err := json.Unmarshal(data, &script); err != nil || script.Name != "shutdown" || script.Runtime != 5*time.Minute {
+		t.Errorf("unexpected script %+v %v", script, err)
+	}
+	if err := json.Unmarshal([]byte(`{"runtime":90}`), &script); err != nil || script.Runtime != 90*time.Second {
+		t.Errorf("expected a number as seconds, got %v %v", script.Runtime, err)
+	}
+	if err := json.Unmarshal([]byte(`{"runtime":"soon"}`), &script); err == nil {
+		t.Errorf("expected an invalid runtime to be refused")
+	}
+
+	full := Script{}
+	if err := json.Unmarshal([]byte(`{"name":"shed","runtime":"2m","action":"shed_bank"}`), &full); err != nil || full.Runtime != 2*time.Minute || full.Action != ACTION_SHED_BANK {
+		t.Errorf("unexpected script %+v %v", full, err)
+	}
+}
+
+func TestScriptRedactsHeaders(t *testing.T) {
+	script := Script{Name: "page", Action: ACTION_WEBHOOK, Headers: map[string]string{"Authorization": "Bearer hunter2"}}
+	data, _ := json.Marshal(script)
+	if strings.Contains(string(data), "hunter2") || !strings.Contains(string(data), "Authorization") {
+		t.Errorf("expected the header value to be redacted, got %s", data)
+	}
+	if script.Headers["Authorization"] != "Bearer hunter2" {
+		t.Errorf("expected the script's headers to be left alone")
+	}
+}
+
+func TestScriptValidate(t *testing.T) {
+	valid := []Script{
+		{Name: "shell", ShutdownScript: "true"},
+		{Name: "shed", Action: ACTION_SHED_BANK, Bank: 2},
+		{Name: "page", Action: "Webhook", URL: "https://example.com/hook", Body: `{"ups":{{ json .UPS }}}`},
+		{Name: "mail", Action: ACTION_EMAIL, Subject: "{{ .UPS }}"},
+	}
+	for _, script := range valid {
+		if err := script.Validate(); err != nil {
+			t.Errorf("%s: unexpected error %v", script.Name, err)
+		}
+	}
+
+	invalid := []Script{
+		{Name: "typo", Action: "webhok", URL: "https://example.com/hook"},
+		{Name: "shed", Action: ACTION_SHED_BANK},
+		{Name: "page", Action: ACTION_WEBHOOK},
+		{Name: "relative", Action: ACTION_WEBHOOK, URL: "/hook"},
+		{Name: "template", Action: ACTION_WEBHOOK, URL: "https://example.com/hook", Body: "{{ .UPS"},
+		{Name: "mail", Action: ACTION_EMAIL, Subject: "{{ end }}"},
+	}
+	for _, script := range invalid {
+		if err := script.Validate(); err == nil {
+			t.Errorf("%s: expected an error", script.Name)
+		}
+	}
+}
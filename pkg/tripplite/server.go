@@ -3,7 +3,6 @@ package tripplite
 import (
 	"context"
 	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -35,7 +34,7 @@ func parseIntQuery(r *http.Request, arg string, defaultVal int, max int, min int
 }
 
 type UPSMetricsListener interface {
-	OnMetrics(*UPSMetrics)
+	OnMetrics(*UPSMetrics) bool
 }
 
 type HttpApp struct {
@@ -70,7 +69,7 @@ func (h *HttpApp) ValidateHMAC(msg []byte, expectedMACB64 string) (bool, error)
 	if len(msg) == 0 || len(expectedMACB64) == 0 {
 		return false, fmt.Errorf("empty raw message or epxected HMAC")
 	}
-	mac := hmac.New(sha256.New, h.Secret).Sum(msg)
+	mac := ComputeHMAC(h.Secret, msg)
 	expectedMAC, err := base64.RawStdEncoding.DecodeString(expectedMACB64)
 	if err != nil {
 		return false, err
@@ -79,7 +78,7 @@ func (h *HttpApp) ValidateHMAC(msg []byte, expectedMACB64 string) (bool, error)
 }
 
 func (h *HttpApp) setHMACHeaders(msg []byte, w http.ResponseWriter) {
-	mac := hmac.New(sha256.New, h.Secret).Sum(msg)
+	mac := ComputeHMAC(h.Secret, msg)
 	w.Header().Add("X-Content-Hash", base64.RawStdEncoding.EncodeToString(mac))
 }
 
@@ -157,14 +156,14 @@ func (h *HttpApp) StartServer(addr string) {
 
 	mux.HandleFunc("/config", h.Middleware([]string{http.MethodGet}, func(w http.ResponseWriter, r *http.Request) {
 
-		scripts := []WatchScript{}
+		scripts := []PublicScript{}
 		for _, listener := range h.Listeners {
 			switch t := listener.(type) {
 			case *Watcher:
 				w := listener.(*Watcher)
-				for _, script := range w.scripts {
-					if script.Script.Shared || script.Script.RemoteOnly {
-						scripts = append(scripts, script.Script)
+				for _, script := range w.Scripts {
+					if script.Public || script.RemoteOnly {
+						scripts = append(scripts, script.ToPublicScript())
 					}
 				}
 			default:
@@ -215,11 +214,11 @@ func (h *HttpApp) PollMetrics(mon *SmartProUPSMonitor) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
 
-	for mon.streaming {
+	for mon.IsStreaming() {
 		select {
 		case sig = <-signals:
 			log.Info().Str("signal", sig.String()).Msg("recieved keyboard interrupt")
-			mon.closeStream()
+			mon.CloseStream()
 			h.StopServer()
 		case err = <-errors:
 			log.Error().Err(err).Msg("error gathering metrics")
@@ -0,0 +1,361 @@
+package tripplite
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/rs/zerolog/log"
+)
+
+// One keyframe of a simulator timeline. Battery voltage, load and temperature
+// are interpolated linearly towards the next keyframe which sets the same
+// field, everything else changes in steps like mains power does.
+type SimulatorStep struct {
+	At             time.Duration `yaml:"at" json:"at"`
+	Comment        string        `yaml:"comment" json:"comment"`
+	Status         string        `yaml:"status" json:"status"`
+	LowBattery     *bool         `yaml:"low_battery" json:"low_battery"`
+	InputVoltage   *float64      `yaml:"input_voltage" json:"input_voltage"`
+	InputFrequency *float64      `yaml:"input_frequency" json:"input_frequency"`
+	BatteryVoltage *float64      `yaml:"battery_voltage" json:"battery_voltage"`
+	Load           *float64      `yaml:"load" json:"load"`
+	TemperatureC   *float64      `yaml:"temperature" json:"temperature"`
+}
+
+// Static identity of the simulated device.
+type SimulatorDevice struct {
+	VendorId              uint16  `yaml:"vendor_id" json:"vendor_id"`
+	ProductId             uint16  `yaml:"product_id" json:"product_id"`
+	Manufacturer          string  `yaml:"manufacturer" json:"manufacturer"`
+	Product               string  `yaml:"product" json:"product"`
+	Serial                string  `yaml:"serial" json:"serial"`
+	Protocol              uint16  `yaml:"protocol" json:"protocol"`
+	Firmware              string  `yaml:"firmware" json:"firmware"`
+	UnitId                uint16  `yaml:"unit_id" json:"unit_id"`
+	Power                 uint    `yaml:"power" json:"power"`
+	BatteryVoltageNominal float64 `yaml:"battery_voltage_nominal" json:"battery_voltage_nominal"`
+	InputVoltageNominal   float64 `yaml:"input_voltage_nominal" json:"input_voltage_nominal"`
+	InputFrequencyNominal float64 `yaml:"input_frequency_nominal" json:"input_frequency_nominal"`
+	LoadBanks             int     `yaml:"load_banks" json:"load_banks"`
+}
+
+type SimulatorTimeline struct {
+	Name   string          `yaml:"name" json:"name"`
+	Loop   bool            `yaml:"loop" json:"loop"`
+	Speed  float64         `yaml:"speed" json:"speed"`
+	Device SimulatorDevice `yaml:"device" json:"device"`
+	Steps  []SimulatorStep `yaml:"steps" json:"steps"`
+}
+
+// The device state at a point on the timeline, battery voltage is the actual
+// pack voltage and not scaled to 12V.
+type SimulatorState struct {
+	Status         string
+	LowBattery     bool
+	InputVoltage   float64
+	InputFrequency float64
+	BatteryVoltage float64
+	Load           float64
+	TemperatureC   float64
+}
+
+func LoadSimulatorTimeline(path string) (*SimulatorTimeline, error) {
+	tl := SimulatorTimeline{}
+	err := cleanenv.ReadConfig(path, &tl)
+	if err != nil {
+		return nil, err
+	}
+	return &tl, nil
+}
+
+// A simulated SMARTPRO (3003) UPS which answers commands framed by
+// SendCommand with replies computed from a timeline.
+type Simulator struct {
+	Timeline SimulatorTimeline
+	Clock    func() time.Time
+	start    time.Time
+	lock     sync.Mutex
+	ivMin    float64
+	ivMax    float64
+}
+
+func NewSimulator(tl SimulatorTimeline) *Simulator {
+	d := &tl.Device
+	if d.VendorId == 0 {
+		d.VendorId = 0x09ae
+	}
+	if d.ProductId == 0 {
+		d.ProductId = 0x0001
+	}
+	if len(d.Manufacturer) == 0 {
+		d.Manufacturer = "Tripp Lite"
+	}
+	if len(d.Product) == 0 {
+		d.Product = "TRIPP LITE SMART1500LCD"
+	}
+	if d.Protocol == 0 {
+		d.Protocol = 0x3003
+	}
+	if len(d.Firmware) == 0 {
+		d.Firmware = "SIM001"
+	}
+	if d.Power == 0 {
+		d.Power = 1500
+	}
+	if d.BatteryVoltageNominal == 0 {
+		d.BatteryVoltageNominal = 12
+	}
+	if d.InputVoltageNominal == 0 {
+		d.InputVoltageNominal = 120
+	}
+	if d.InputFrequencyNominal == 0 {
+		d.InputFrequencyNominal = 60
+	}
+	if tl.Speed <= 0 {
+		tl.Speed = 1
+	}
+
+	sort.SliceStable(tl.Steps, func(i, j int) bool {
+		return tl.Steps[i].At < tl.Steps[j].At
+	})
+
+	return &Simulator{
+		Timeline: tl,
+		Clock:    time.Now,
+		start:    time.Now(),
+	}
+}
+
+func (s *Simulator) DeviceInfo() DeviceInfo {
+	d := s.Timeline.Device
+	return DeviceInfo{
+		VendorId:     d.VendorId,
+		ProductId:    d.ProductId,
+		Manufacturer: d.Manufacturer,
+		Product:      d.Product,
+		Serial:       d.Serial,
+	}
+}
+
+// Returns a transport answering with this simulator and restarts the timeline.
+func (s *Simulator) Transport() *MemoryTransport {
+	s.Reset()
+	return NewMemoryTransport(s.HandleCommand)
+}
+
+func (s *Simulator) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.start = s.Clock()
+	s.ivMin = 0
+	s.ivMax = 0
+}
+
+func (s *Simulator) duration() time.Duration {
+	steps := s.Timeline.Steps
+	if len(steps) == 0 {
+		return 0
+	}
+	return steps[len(steps)-1].At
+}
+
+// Simulated time since the timeline started.
+func (s *Simulator) Elapsed() time.Duration {
+	elapsed := time.Duration(float64(s.Clock().Sub(s.start)) * s.Timeline.Speed)
+	if total := s.duration(); s.Timeline.Loop && total > 0 {
+		elapsed = elapsed % total
+	}
+	return elapsed
+}
+
+func interpolateStep(steps []SimulatorStep, at time.Duration, field func(*SimulatorStep) *float64, defaultVal float64, linear bool) float64 {
+	var prev *SimulatorStep
+	var next *SimulatorStep
+
+	for i := range steps {
+		step := &steps[i]
+		if field(step) == nil {
+			continue
+		}
+		if step.At <= at {
+			prev = step
+		} else {
+			next = step
+			break
+		}
+	}
+
+	switch {
+	case prev == nil && next == nil:
+		return defaultVal
+	case prev == nil:
+		return *field(next)
+	case next == nil || !linear:
+		return *field(prev)
+	}
+
+	a := *field(prev)
+	b := *field(next)
+	ratio := float64(at-prev.At) / float64(next.At-prev.At)
+	return a + (b-a)*ratio
+}
+
+func (s *Simulator) StateAt(at time.Duration) SimulatorState {
+	steps := s.Timeline.Steps
+	d := s.Timeline.Device
+
+	state := SimulatorState{Status: "OL"}
+	for _, step := range steps {
+		if step.At > at {
+			break
+		}
+		if len(step.Status) > 0 {
+			state.Status = strings.ToUpper(step.Status)
+		}
+		if step.LowBattery != nil {
+			state.LowBattery = *step.LowBattery
+		}
+	}
+
+	// "LB" is reported by the device as on battery with the low battery flag
+	if state.Status == "LB" {
+		state.Status = "OB"
+		state.LowBattery = true
+	}
+
+	state.InputVoltage = interpolateStep(steps, at, func(s *SimulatorStep) *float64 { return s.InputVoltage }, d.InputVoltageNominal, false)
+	state.InputFrequency = interpolateStep(steps, at, func(s *SimulatorStep) *float64 { return s.InputFrequency }, d.InputFrequencyNominal, false)
+	state.BatteryVoltage = interpolateStep(steps, at, func(s *SimulatorStep) *float64 { return s.BatteryVoltage }, d.BatteryVoltageNominal*13.5/12.0, true)
+	state.Load = interpolateStep(steps, at, func(s *SimulatorStep) *float64 { return s.Load }, 0, true)
+	state.TemperatureC = interpolateStep(steps, at, func(s *SimulatorStep) *float64 { return s.TemperatureC }, 25, true)
+
+	return state
+}
+
+func (s *Simulator) State() SimulatorState {
+	return s.StateAt(s.Elapsed())
+}
+
+func clampByte(val float64, max float64) uint {
+	val = math.Round(val)
+	if val < 0 {
+		return 0
+	}
+	if val > max {
+		return uint(max)
+	}
+	return uint(val)
+}
+
+func (s *Simulator) inputVoltageScaled() float64 {
+	if s.Timeline.Device.InputVoltageNominal == 208 {
+		return 230
+	}
+	return s.Timeline.Device.InputVoltageNominal
+}
+
+// Encodes a voltage the way the 'D' and 'M' replies scale it.
+func (s *Simulator) encodeInputVoltage(v float64) uint {
+	return clampByte(v*120.0/s.inputVoltageScaled(), 0xff)
+}
+
+func (s *Simulator) HandleCommand(cmd []byte) []byte {
+	if len(cmd) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d := s.Timeline.Device
+	state := s.State()
+
+	if state.InputVoltage > 0 {
+		if s.ivMin == 0 || state.InputVoltage < s.ivMin {
+			s.ivMin = state.InputVoltage
+		}
+		if state.InputVoltage > s.ivMax {
+			s.ivMax = state.InputVoltage
+		}
+	}
+
+	switch cmd[0] {
+	case 0:
+		return []byte{0, byte(d.Protocol >> 8), byte(d.Protocol)}
+	case 'D':
+		bv12 := state.BatteryVoltage * 12.0 / d.BatteryVoltageNominal
+		return []byte(fmt.Sprintf("D%02X%02X", s.encodeInputVoltage(state.InputVoltage), clampByte(bv12*10.0, 0xff)))
+	case 'F':
+		return []byte(fmt.Sprintf("F%-6.6s", d.Firmware))
+	case 'L':
+		return []byte(fmt.Sprintf("L%02X", clampByte(state.Load, 0xff)))
+	case 'M':
+		return []byte(fmt.Sprintf("M%02X%02X", s.encodeInputVoltage(s.ivMin), s.encodeInputVoltage(s.ivMax)))
+	case 'P':
+		return []byte(fmt.Sprintf("P%dX", d.Power))
+	case 'S':
+		lb := byte('1')
+		if state.LowBattery {
+			lb = '0'
+		}
+		flags := byte('0')
+		switch state.Status {
+		case "OB":
+			flags = '1'
+		case "OFF":
+			flags = '4'
+		}
+		return []byte{'S', lb, '0', '0', flags}
+	case 'T':
+		nominal := byte('1')
+		if d.InputFrequencyNominal == 50 {
+			nominal = '0'
+		}
+		temp := clampByte((state.TemperatureC+21.0)/0.3636, 0xff)
+		freq := clampByte(state.InputFrequency*10.0, 0xfff)
+		return []byte(fmt.Sprintf("T%02X%03X%c", temp, freq, nominal))
+	case 'U':
+		return []byte{'U', byte(d.UnitId >> 8), byte(d.UnitId)}
+	case 'V':
+		ivn := byte('1')
+		switch d.InputVoltageNominal {
+		case 100:
+			ivn = '0'
+		case 230:
+			ivn = '2'
+		case 208:
+			ivn = '3'
+		}
+		banks := byte('0' + clampByte(float64(d.LoadBanks), 9))
+		return []byte(fmt.Sprintf("V%c%02X%c", ivn, clampByte(d.BatteryVoltageNominal/6.0, 0xff), banks))
+	case 'Z':
+		s.ivMin = 0
+		s.ivMax = 0
+		return []byte{'Z'}
+	case 'A', 'G', 'K', 'N', 'W':
+		// Control commands are acknowledged but do not change the timeline.
+		log.Info().Hex("cmd", cmd).Msg("simulator acknowledged control command")
+		return []byte{cmd[0]}
+	}
+
+	log.Debug().Hex("cmd", cmd).Msg("simulator ignored unknown command")
+	return nil
+}
+
+// Opens a monitor on a simulated device.
+func NewSimulatedMonitor(tl SimulatorTimeline) (*SmartProUPSMonitor, *Simulator, error) {
+	sim := NewSimulator(tl)
+	mon, err := NewSmartProUPSMonitorWithTransport(sim.Transport(), sim.DeviceInfo())
+	if err != nil {
+		return nil, nil, err
+	}
+	mon.SetOpener(func() (Transport, DeviceInfo, error) {
+		return NewMemoryTransport(sim.HandleCommand), sim.DeviceInfo(), nil
+	})
+	return mon, sim, nil
+}
@@ -0,0 +1,115 @@
+package tripplite
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulatorTimelineFile(t *testing.T) {
+	tl, err := LoadSimulatorTimeline("../../config/simulator/outage.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := NewSimulator(*tl)
+
+	tests := []struct {
+		at         time.Duration
+		status     string
+		lowBattery bool
+		voltage    float64
+	}{
+		{0, "OL", false, 13.6},
+		{30 * time.Second, "OB", false, 12.9},
+		{165 * time.Second, "OB", false, 12.25},
+		{6 * time.Minute, "OB", true, 11.0},
+		{8 * time.Minute, "OL", false, 12.2 + (13.5-12.2)*(90.0/210.0)},
+	}
+
+	for _, test := range tests {
+		state := sim.StateAt(test.at)
+		if state.Status != test.status || state.LowBattery != test.lowBattery {
+			t.Errorf("%s: expected %s/%v, got %s/%v", test.at, test.status, test.lowBattery, state.Status, state.LowBattery)
+		}
+		if fmt.Sprintf("%.3f", state.BatteryVoltage) != fmt.Sprintf("%.3f", test.voltage) {
+			t.Errorf("%s: expected battery voltage %f, got %f", test.at, test.voltage, state.BatteryVoltage)
+		}
+	}
+}
+
+func TestSimulatorWatcherEndToEnd(t *testing.T) {
+	tl, err := LoadSimulatorTimeline("../../config/simulator/outage.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	sim := NewSimulator(*tl)
+	sim.Clock = func() time.Time { return now }
+
+	mon, err := NewSmartProUPSMonitorWithTransport(sim.Transport(), sim.DeviceInfo())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	out := filepath.Join(t.TempDir(), "script.log")
+	w := NewWatcher()
+	w.AddScript(Script{
+		Name:           "shutdown",
+		Charge:         50,
+		Status:         "OB",
+		ShutdownScript: fmt.Sprintf("echo shutdown >> %s", out),
+		CancelScript:   fmt.Sprintf("echo cancel >> %s", out),
+	}, false)
+
+	waitFor := func(expected string) {
+		for i := 0; i < 100; i++ {
+			data, _ := os.ReadFile(out)
+			if strings.TrimSpace(string(data)) == expected && !w.Scripts["shutdown"].IsRunning() {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		data, _ := os.ReadFile(out)
+		t.Fatalf("expected script output %q, got %q", expected, string(data))
+	}
+
+	step := func(at time.Duration) *UPSMetrics {
+		now = sim.start.Add(at)
+		m, err := mon.GetStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.OnMetrics(m)
+		return m
+	}
+
+	if m := step(0); m.Status != "OL" || m.BatteryCharge != 100 {
+		t.Errorf("unexpected initial metrics %+v", m)
+	}
+	if m := step(time.Minute); m.Status != "OB" || m.InputVoltage != 0 {
+		t.Errorf("expected mains loss, got %+v", m)
+	}
+	if _, err := os.Stat(out); err == nil {
+		t.Error("shutdown script ran while charge was high")
+	}
+
+	if m := step(5*time.Minute + 30*time.Second); m.BatteryCharge >= 50 {
+		t.Errorf("expected battery to drain below 50%%, got %f", m.BatteryCharge)
+	}
+	waitFor("shutdown")
+
+	if m := step(6 * time.Minute); m.Status != "LB" {
+		t.Errorf("expected low battery, got %s", m.Status)
+	}
+
+	if m := step(7 * time.Minute); m.Status != "OL" {
+		t.Errorf("expected return to line, got %s", m.Status)
+	}
+	waitFor("shutdown\ncancel")
+}
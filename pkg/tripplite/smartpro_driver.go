@@ -5,30 +5,43 @@
 package tripplite
 
 import (
-	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
-	"math"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 
-	"github.com/gotmc/libusb/v2"
 	"github.com/rs/zerolog/log"
+)
 
-	golog "log"
+const (
+	COMM_OK   = "OK"
+	COMM_LOST = "LOST"
+	// Consecutive failed commands before the handle is considered dead.
+	COMM_MAX_FAILURES = 3
 )
 
 var (
 	PROTOCOL_LOOKUP = map[uint]string{
+		0x1001: "OMNIVS",
+		0x2001: "OMNIVS_2001",
 		0x3003: "SMARTPRO",
+		0x3005: "SMART_3005",
 	}
+
+	ErrNoResponse     = errors.New("device did not answer any command")
+	ErrCommandNotSent = errors.New("command was not sent")
+
+	RECONNECT_MIN_DELAY = 1 * time.Second
+	RECONNECT_MAX_DELAY = 60 * time.Second
 )
 
+// Opens a new transport to the same device, used to recover a dead handle.
+type TransportOpener func() (Transport, DeviceInfo, error)
+
 func int_to_hex(val uint16) string {
 	b := make([]byte, 2)
 	binary.BigEndian.PutUint16(b, val)
@@ -51,23 +64,11 @@ func get_protocol_name(protocol uint) string {
 	return ""
 }
 
-func usbGetStringOrDefault(handle *libusb.DeviceHandle, attr uint8, defaultVal string) string {
-	val, err := handle.StringDescriptorASCII(attr)
-	if err != nil || len(val) == 0 {
-		return defaultVal
-	}
-	return val
-}
-
 type SmartProUPSMonitor struct {
-	ctx                   *libusb.Context
-	dev                   *libusb.Device
-	h                     *libusb.DeviceHandle
-	interfaceId           uint16
-	endpointAddress       byte
-	txTimeout             uint16 // milliseconds
+	Name                  string
+	ChargeModel           ChargeModel
+	t                     Transport
 	rxTimeout             uint16 // milliseconds
-	maxPacketSize         uint16
 	Protocol              uint
 	ProtocolName          string
 	VendorId              uint16
@@ -75,71 +76,70 @@ type SmartProUPSMonitor struct {
 	Manufacturer          string
 	Product               string
 	Serial                string
+	Path                  string
+	Communication         string
 	streaming             bool
 	debugUSB              bool
 	resetVoltageResetEver bool
+	open                  TransportOpener
+	lock                  sync.Mutex
+	stateLock             sync.Mutex // streaming and Communication
+	lastMetrics           *UPSMetrics
+	failures              int // consecutive failed commands, under lock
+	bankLock              sync.Mutex
+	loadBanks             int
+	bankStates            map[int]string
 }
 
 func NewSmartProUPSMonitor(vid uint16, pid uint16) (*SmartProUPSMonitor, error) {
+	return NewSmartProUPSMonitorMatching(USBMatch{VendorId: vid, ProductId: pid})
+}
 
-	ctx, err := libusb.NewContext()
-	if err != nil {
-		log.Warn().Err(err).Msg("failed to create context")
-		return nil, err
+// Opens the device selected by match, reconnects select the same device.
+func NewSmartProUPSMonitorMatching(match USBMatch) (*SmartProUPSMonitor, error) {
+	opener := func() (Transport, DeviceInfo, error) {
+		t, err := OpenUSBTransportMatching(match)
+		if err != nil {
+			return nil, DeviceInfo{}, err
+		}
+		return t, t.Info, nil
 	}
 
-	log.Debug().Uint16("vid", vid).Uint16("pid", pid).Msg("opening device")
-	golog.SetOutput(io.Discard)
-	dev, h, err := ctx.OpenDeviceWithVendorProduct(vid, pid)
+	t, info, err := opener()
 	if err != nil {
-		log.Warn().Err(err).Uint16("vid", vid).Uint16("pid", pid).Msg("failed to find device")
-		ctx.Close()
 		return nil, err
 	}
 
-	mon := SmartProUPSMonitor{
-		ctx:             ctx,
-		dev:             dev,
-		h:               h,
-		interfaceId:     0,
-		endpointAddress: 0x81,
-		txTimeout:       5000,
-		rxTimeout:       5000,
-		maxPacketSize:   0,
-		Protocol:        0,
-		ProtocolName:    "",
-		VendorId:        vid,
-		ProductId:       pid,
-		Manufacturer:    "",
-		Product:         "",
-		Serial:          "",
-		streaming:       false,
-		debugUSB:        false,
-	}
-
-	dd, err := dev.DeviceDescriptor()
+	mon, err := NewSmartProUPSMonitorWithTransport(t, info)
 	if err != nil {
-		mon.Close()
 		return nil, err
 	}
+	mon.SetOpener(opener)
+	return mon, nil
+}
 
-	mon.maxPacketSize = uint16(dd.MaxPacketSize0)
-	mon.Manufacturer = strings.TrimSpace(usbGetStringOrDefault(h, dd.ManufacturerIndex, ""))
-	mon.Product = strings.TrimSpace(usbGetStringOrDefault(h, dd.ProductIndex, ""))
-	mon.Serial = strings.TrimSpace(usbGetStringOrDefault(h, dd.SerialNumberIndex, ""))
+// Creates a monitor on top of an already open transport, the transport is
+// closed if the device does not answer the protocol probe.
+func NewSmartProUPSMonitorWithTransport(t Transport, info DeviceInfo) (*SmartProUPSMonitor, error) {
 
-	err = mon.Claim()
+	mon := SmartProUPSMonitor{
+		t:             t,
+		rxTimeout:     1000,
+		Protocol:      0,
+		ProtocolName:  "",
+		VendorId:      info.VendorId,
+		ProductId:     info.ProductId,
+		Manufacturer:  info.Manufacturer,
+		Product:       info.Product,
+		Serial:        info.Serial,
+		Path:          info.Path,
+		Communication: COMM_OK,
+		streaming:     false,
+		debugUSB:      false,
+	}
+
+	err := mon.probe()
 	if err != nil {
-		log.Error().Err(err).Uint16("interface", mon.interfaceId).Msg("unable to claim interface")
-		mon.Close()
-		return nil, err
-	}
-
-	reply, err := mon.SendCommand([]byte{0})
-	if err == nil {
-		mon.Protocol = (uint(reply[1]) << 8) | uint(reply[2])
-		mon.ProtocolName = get_protocol_name(mon.Protocol)
-	} else {
 		mon.Close()
 		return nil, err
 	}
@@ -147,61 +147,77 @@ func NewSmartProUPSMonitor(vid uint16, pid uint16) (*SmartProUPSMonitor, error)
 	return &mon, nil
 }
 
-func (m SmartProUPSMonitor) IsStreaming() bool {
-	return m.streaming
-}
-
-func (m *SmartProUPSMonitor) setReport(reportId uint16, msg []byte) (int, error) {
-
-	bytes_sent, err := m.h.ControlTransfer(
-		0x00+(0x01<<5)+0x01, // requestType
-		0x09,                // request
-		reportId+(0x03<<8),  // value
-		0,                   // HID interface index
-		msg,
-		len(msg),
-		int(m.txTimeout)) // Timeout
-
-	if bytes_sent != len(msg) && err == nil {
-		err = errors.New(fmt.Sprint("failed to send report, sent", bytes_sent, "expected", len(msg)))
+func (m *SmartProUPSMonitor) probe() error {
+	reply, err := m.SendCommand([]byte{0})
+	if err != nil {
+		return err
 	}
+	protocol := (uint(reply[1]) << 8) | uint(reply[2])
+	m.lock.Lock()
+	m.Protocol = protocol
+	m.ProtocolName = get_protocol_name(protocol)
+	m.lock.Unlock()
 
-	return bytes_sent, err
+	// refuse to decode replies of an unknown layout as garbage metrics
+	if _, err := getProtocolDecoder(protocol); err != nil {
+		log.Error().Err(err).Hex("reply", reply).Msg("unknown protocol")
+		return err
+	}
+	return nil
 }
 
-func (m *SmartProUPSMonitor) Claim() error {
+// The identity of the open device, it changes when a reconnect opens another
+// device.
+func (m *SmartProUPSMonitor) DeviceInfo() DeviceInfo {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return DeviceInfo{
+		VendorId:     m.VendorId,
+		ProductId:    m.ProductId,
+		Manufacturer: m.Manufacturer,
+		Product:      m.Product,
+		Serial:       m.Serial,
+		Path:         m.Path,
+	}
+}
 
-	reset := false
-	interfaceId := int(m.interfaceId)
-	h := m.h
+func (m *SmartProUPSMonitor) GetProtocolName() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.ProtocolName
+}
 
-	err := h.ClaimInterface(interfaceId)
-	if err != nil {
-		log.Warn().
-			Err(err).
-			Msg("cannot claim interface, resetting device")
+// Sets how the device is re-opened after communication is lost, monitors
+// without an opener only report the loss.
+func (m *SmartProUPSMonitor) SetOpener(opener TransportOpener) {
+	m.open = opener
+}
 
-		h.ReleaseInterface(interfaceId)
-		h.ResetDevice()
-		reset = true
-		err = nil
-	}
+func (m *SmartProUPSMonitor) IsStreaming() bool {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.streaming
+}
 
-	err = h.SetAutoDetachKernelDriver(true)
-	if err != nil {
-		log.Warn().Msg("failed to set auto detach driver flag")
-	}
+func (m *SmartProUPSMonitor) setStreaming(streaming bool) {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	m.streaming = streaming
+}
 
-	for i := 0; i < 10; i++ {
-		time.Sleep(1 * time.Second)
-		err = h.ClaimInterface(interfaceId)
-		if err == nil {
-			log.Debug().Int("interfaceId", interfaceId).Bool("reset", reset).Msg("claim success")
-			break
-		}
-	}
+func (m *SmartProUPSMonitor) IsConnected() bool {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	return m.Communication == COMM_OK
+}
 
-	return err
+// Sets the communication state, false when it was already set.
+func (m *SmartProUPSMonitor) setCommunication(comm string) bool {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+	changed := m.Communication != comm
+	m.Communication = comm
+	return changed
 }
 
 func (m *SmartProUPSMonitor) SendCode(code byte) ([]byte, error) {
@@ -210,57 +226,53 @@ func (m *SmartProUPSMonitor) SendCode(code byte) ([]byte, error) {
 
 func (m *SmartProUPSMonitor) SendCommand(cmd []byte) ([]byte, error) {
 
-	if m.h == nil {
-		return nil, errors.New("handle is not open")
-	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	if len(cmd) > 5 {
-		return nil, errors.New("message is too large")
+	if m.t == nil {
+		return nil, errors.New("handle is not open")
 	}
 
-	var csum uint8 = 0
 	var done bool = false
 	var recv_retries int = 10
-	var recv_delay int = 1000
+	var recv_delay time.Duration = time.Duration(m.rxTimeout) * time.Millisecond
 	var reply []byte
 	var ret int
 	var err error
 
-	buffer := make([]byte, 8)
-	buffer[0] = ':'
-
-	var i int = 1
-	for _, ch := range cmd {
-		buffer[i] = ch
-		csum += ch
-		i++
+	buffer, err := EncodeCommand(cmd)
+	if err != nil {
+		return nil, err
 	}
-	buffer[i] = 255 - csum
-	buffer[i+1] = '\r'
 
-	_, err = m.setReport(0, buffer)
+	_, err = m.t.SetReport(0, buffer)
 	if err != nil {
-		return nil, err
+		m.failures++
+		return nil, fmt.Errorf("%w: %v", ErrCommandNotSent, err)
 	}
 
 	reply = make([]byte, 9)
 
 	err = nil
 	for i := 0; i < recv_retries && !done; i++ {
-		// TODO: cannot use m.endpointAddress due to type issue
-		ret, err = m.h.InterruptTransfer(0x81, reply, 8, recv_delay)
+		ret, err = m.t.ReadInterrupt(reply[:REPORT_SIZE], recv_delay)
 		if ret == len(buffer) && reply[0] == buffer[1] {
 			done = true
 			err = nil
+		} else if err != nil {
+			// retries only skip stale replies, a timed out read gets nothing
+			break
 		} else {
 			log.Debug().Int("ret", ret).Int("retry", i).Hex("reply", reply).Send()
 		}
 	}
 
 	if err != nil && !done {
+		m.failures++
 		log.Warn().Err(err).Msg("read error")
 		return nil, err
 	}
+	m.failures = 0
 
 	if m.debugUSB {
 		// Too chatty even for debug
@@ -275,74 +287,183 @@ func (m *SmartProUPSMonitor) SendCommand(cmd []byte) ([]byte, error) {
 	return reply, err
 }
 
+// The number of commands in a row the device did not answer.
+func (m *SmartProUPSMonitor) commandFailures() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.failures
+}
+
+func (m *SmartProUPSMonitor) closeTransport() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.t != nil {
+		m.t.Close()
+		m.t = nil
+	}
+}
+
 func (m *SmartProUPSMonitor) Close() {
 	m.CloseStream()
-	if m.h != nil {
-		i := int(m.interfaceId)
-		m.h.ReleaseInterface(i)
-		ok, err := m.h.KernelDriverActive(i)
-		if err == nil && ok {
-			m.h.DetachKernelDriver(i)
-		}
-		m.h.ResetDevice()
-		m.h.Close()
+	m.closeTransport()
+}
+
+// Closes the current transport and opens a new one, the device must answer
+// the protocol probe for the reconnect to succeed.
+func (m *SmartProUPSMonitor) Reconnect() error {
+	if m.open == nil {
+		return errors.New("monitor has no transport opener")
+	}
+
+	m.closeTransport()
+
+	t, info, err := m.open()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.t = t
+	m.Manufacturer = info.Manufacturer
+	m.Product = info.Product
+	m.Serial = info.Serial
+	m.Path = info.Path
+	m.lock.Unlock()
+
+	err = m.probe()
+	if err != nil {
+		m.closeTransport()
+		return err
+	}
+
+	return nil
+}
+
+func (m *SmartProUPSMonitor) sleepWhileStreaming(delay time.Duration) {
+	var delayStep time.Duration = 50 * time.Millisecond
+	for ms := time.Duration(0); m.IsStreaming() && ms < delay; ms += delayStep {
+		time.Sleep(delayStep)
 	}
-	if m.ctx != nil {
-		m.ctx.Close()
+}
+
+// A copy of the last good sample flagged as lost so listeners keep the last
+// known status instead of seeing an empty one.
+func (m *SmartProUPSMonitor) commLostMetrics() *UPSMetrics {
+	now := time.Now()
+	lost := UPSMetrics{
+		Name:         m.Name,
+		Serial:       m.Serial,
+		VendorID:     int_to_hex(m.VendorId),
+		ProductID:    int_to_hex(m.ProductId),
+		Manufacturer: m.Manufacturer,
+	}
+	if m.lastMetrics != nil {
+		lost = *m.lastMetrics
+	}
+	lost.Communication = COMM_LOST
+	lost.Timestamp = now
+	lost.UnixTimestamp = now.Unix()
+	return &lost
+}
+
+// Re-opens the device with exponential backoff until it answers or the
+// stream is closed.
+func (m *SmartProUPSMonitor) reconnectLoop() bool {
+	delay := RECONNECT_MIN_DELAY
+	for attempt := 1; m.IsStreaming(); attempt++ {
+		m.sleepWhileStreaming(delay)
+		if !m.IsStreaming() {
+			break
+		}
+
+		err := m.Reconnect()
+		if err == nil {
+			return true
+		}
+
+		log.Warn().Err(err).Int("attempt", attempt).Dur("delay", delay).Msg("reconnect failed")
+		delay *= 2
+		if delay > RECONNECT_MAX_DELAY {
+			delay = RECONNECT_MAX_DELAY
+		}
 	}
+	return false
 }
 
 type UPSMetrics struct {
-	VendorID              string    `json:"VendorId"`
-	ProductID             string    `json:"ProductId"`
-	Manufacturer          string    `json:"Manufacturer"`
-	Model                 string    `json:"Model"`
-	BatteryCharge         float64   `json:"BatteryCharge"`
-	BatteryVoltage        float64   `json:"BatteryVoltage"`
-	BatteryVoltageNominal float64   `json:"BatteryVoltageNominal"`
-	FirmwareVersion       string    `json:"FirmwareVersion"`
-	InputFrequency        float64   `json:"InputFrequency"`
-	InputFrequencyNominal float64   `json:"InputFrequencyNominal"`
-	InputVoltage          float64   `json:"InputVoltage"`
-	InputVoltageMaximum   float64   `json:"InputVoltageMaximum"`
-	InputVoltageMinimum   float64   `json:"InputVoltageMinimum"`
-	InputVoltageNominal   float64   `json:"InputVoltageNominal"`
-	Load                  uint      `json:"Load"`
-	LoadBanks             int       `json:"LoadBanks"`
-	Power                 uint      `json:"PowerNominal"`
-	PowerUnit             string    `json:"PowerUnit"`
-	Status                string    `json:"Status"`
-	TemperatureC          float64   `json:"TempC"`
-	TemperatureF          float64   `json:"TempF"`
-	UnitId                string    `json:"UnitId"`
-	Timestamp             time.Time `json:"Time"`
-	UnixTimestamp         int64     `json:"UnixTimestamp"`
+	Name                  string     `json:"Name"`
+	Serial                string     `json:"Serial"`
+	VendorID              string     `json:"VendorId"`
+	ProductID             string     `json:"ProductId"`
+	Manufacturer          string     `json:"Manufacturer"`
+	Model                 string     `json:"Model"`
+	BatteryCharge         float64    `json:"BatteryCharge"`
+	BatteryVoltage        float64    `json:"BatteryVoltage"`
+	BatteryVoltageNominal float64    `json:"BatteryVoltageNominal"`
+	FirmwareVersion       string     `json:"FirmwareVersion"`
+	InputFrequency        float64    `json:"InputFrequency"`
+	InputFrequencyNominal float64    `json:"InputFrequencyNominal"`
+	InputVoltage          float64    `json:"InputVoltage"`
+	InputVoltageMaximum   float64    `json:"InputVoltageMaximum"`
+	InputVoltageMinimum   float64    `json:"InputVoltageMinimum"`
+	InputVoltageNominal   float64    `json:"InputVoltageNominal"`
+	Load                  uint       `json:"Load"`
+	LoadBanks             int        `json:"LoadBanks"`
+	LoadBankStates        []LoadBank `json:"LoadBankStates"`
+	RuntimeRemaining      float64    `json:"RuntimeRemaining"`
+	Power                 uint       `json:"PowerNominal"`
+	PowerUnit             string     `json:"PowerUnit"`
+	Status                string     `json:"Status"`
+	TestResult            string     `json:"TestResult"`
+	TemperatureC          float64    `json:"TempC"`
+	TemperatureF          float64    `json:"TempF"`
+	UnitId                string     `json:"UnitId"`
+	Communication         string     `json:"Communication"`
+	Timestamp             time.Time  `json:"Time"`
+	UnixTimestamp         int64      `json:"UnixTimestamp"`
 }
 
 func (m *SmartProUPSMonitor) CloseStream() {
-	m.streaming = false
+	m.setStreaming(false)
 }
 
 func monitorStreamLoop(m *SmartProUPSMonitor, statChan chan *UPSMetrics, errChan chan error, delay time.Duration) {
 	log.Info().Dur("delay", delay).Msg("stream started")
-	var ms time.Duration = 0 * time.Millisecond
 	var delayStep time.Duration = 50 * time.Millisecond
 
 	if delay < time.Duration(delayStep) {
 		delay = delayStep
 	}
 
-	for m.streaming {
+	for m.IsStreaming() {
 		metrics, err := m.GetStats()
 		if err != nil {
 			errChan <- err
 		} else {
+			if m.setCommunication(COMM_OK) {
+				log.Info().Str("protocol", m.GetProtocolName()).Msg("communication restored")
+			}
+			m.lastMetrics = metrics
 			statChan <- metrics
 		}
 
-		for ms = 0; m.streaming && ms < delay; ms += delayStep {
-			time.Sleep(delayStep)
+		failures := m.commandFailures()
+		if failures >= COMM_MAX_FAILURES {
+			if m.setCommunication(COMM_LOST) {
+				log.Error().Int("failures", failures).Msg("communication lost")
+				statChan <- m.commLostMetrics()
+			}
+
+			if m.open != nil && m.reconnectLoop() {
+				continue
+			}
+		} else if err != nil {
+			// retry soon so a dead device is noticed within seconds
+			m.sleepWhileStreaming(delayStep)
+			continue
 		}
+
+		m.sleepWhileStreaming(delay)
 	}
 }
 
@@ -354,8 +475,8 @@ func (m *SmartProUPSMonitor) ResetInputVoltage() error {
 func (m *SmartProUPSMonitor) OpenStream(delay time.Duration) (chan *UPSMetrics, chan error) {
 	metrics := make(chan *UPSMetrics, 1)
 	errors := make(chan error, 1)
+	m.setStreaming(true)
 	go monitorStreamLoop(m, metrics, errors, delay)
-	m.streaming = true
 	return metrics, errors
 }
 
@@ -374,181 +495,42 @@ func (m *SmartProUPSMonitor) tryResetInputVoltageReading() {
 
 func (m *SmartProUPSMonitor) GetStats() (*UPSMetrics, error) {
 
-	battery_voltage_nominal := 12.0
-	input_voltage_nominal := 120.0
-	input_voltage_scaled := 120.0
-	switchable_load_banks := 0
+	decoder, err := getProtocolDecoder(m.Protocol)
+	if err != nil {
+		return nil, err
+	}
 
-	var err error = nil
 	now := time.Now()
-	metrics := UPSMetrics{Timestamp: now, UnixTimestamp: now.Unix()}
+	metrics := UPSMetrics{Timestamp: now, UnixTimestamp: now.Unix(), Communication: COMM_OK}
 	messages := map[byte][]byte{}
-	command_codes := []byte{
-		// 'B',
-		// 'H',
-		// 'X',
-		'D', // ok
-		'F', // ok
-		'L', // ok
-		'M', // ok
-		'P', // ok
-		'S', // ok
-		'T', // ok
-		'U', // ok
-		'V', // ok
-	}
-
-	for _, code := range command_codes {
+
+	for _, code := range decoder.Commands {
 		result, err := m.SendCode(code)
 		if err != nil {
 			log.Error().Err(err).Str("code", string(code)).Msg("command error")
+			// the next commands would only wait out the same timeouts
+			if errors.Is(err, ErrCommandNotSent) || m.commandFailures() >= COMM_MAX_FAILURES {
+				return nil, err
+			}
 			continue
 		}
 		messages[code] = result
 	}
 
+	if len(messages) == 0 {
+		return nil, ErrNoResponse
+	}
+
+	metrics.Name = m.Name
+	metrics.Serial = m.Serial
 	metrics.Manufacturer = m.Manufacturer
 	metrics.Model = strings.Replace(m.Product, strings.ToUpper(m.Manufacturer), "", 1)
 	metrics.Model = strings.TrimSpace(metrics.Model)
 	metrics.VendorID = int_to_hex(m.VendorId)
 	metrics.ProductID = int_to_hex(m.ProductId)
 
-	// firmware
-	if data, ok := messages['F']; ok {
-		tmp := strconv_clean(data[1:7])
-		metrics.FirmwareVersion = tmp
-	}
-
-	// unit
-	if data, ok := messages['U']; ok {
-		tmp := (uint64(data[1]) << 8) | uint64(data[2])
-		metrics.UnitId = strconv.FormatUint(tmp, 10)
-	}
-
-	// load
-	if data, ok := messages['L']; ok {
-		tmp, _ := strconv.ParseInt(string(data[1:3]), 16, 32)
-		metrics.Load = uint(tmp)
-	}
-
-	// temp
-	if data, ok := messages['T']; ok {
-		tmp, _ := strconv.ParseInt(string(data[3:6]), 16, 32)
-		freq := float64(tmp) / 10.0
-		metrics.InputFrequency = freq
-
-		code := data[6]
-		switch code {
-		case '0':
-			metrics.InputFrequencyNominal = 50
-		case '1':
-			metrics.InputFrequencyNominal = 60
-		}
-
-		tmp, _ = strconv.ParseInt(string(data[1:3]), 16, 32)
-		temp := float64(tmp)*0.3636 - 21.0
-		tempc := math.Round(temp*100.0) / 100.0
-		tempf := math.Round(((temp*(9.0/5.0))+32.0)*100.0) / 100.0
-		metrics.TemperatureC = tempc
-		metrics.TemperatureF = tempf
-	}
-
-	// status
-	if data, ok := messages['S']; ok {
-		code := data[4]
-		if code&4 == 4 {
-			metrics.Status = "OFF"
-		} else if code&1 == 1 {
-			metrics.Status = "OB"
-		} else {
-			metrics.Status = "OL"
-		}
-		code = data[1]
-		if code == '0' {
-			metrics.Status = "LB"
-		}
-	}
-
-	// voltage
-	if data, ok := messages['V']; ok {
-		tmp, _ := strconv.ParseInt(string(data[2:4]), 16, 32)
-		battery_voltage_nominal = float64(tmp) * 6.0
-
-		ivn := data[1]
-		lb := data[4]
-
-		switch ivn {
-		case '0':
-			input_voltage_nominal = 100.0
-			input_voltage_scaled = 100.0
-		case '1':
-			input_voltage_nominal = 120.0
-			input_voltage_scaled = 120.0
-		case '2':
-			input_voltage_nominal = 230.0
-			input_voltage_scaled = 230.0
-		case '3':
-			input_voltage_nominal = 208.0
-			input_voltage_scaled = 230.0
-		}
-
-		if lb >= '0' && lb <= '9' {
-			switchable_load_banks = int(lb) - '0'
-		}
-
-	}
-	metrics.LoadBanks = switchable_load_banks
-	metrics.InputVoltageNominal = input_voltage_nominal
-	metrics.BatteryVoltageNominal = battery_voltage_nominal
-
-	// drain (probably)
-	if data, ok := messages['D']; ok {
-		tmp, _ := strconv.ParseInt(string(data[1:3]), 16, 32)
-		iv := float64(tmp) * input_voltage_scaled / 120.0
-
-		tmp, _ = strconv.ParseInt(string(data[3:5]), 16, 32)
-		bv_12v := float64(tmp) / 10.0
-		bv := bv_12v * battery_voltage_nominal / 12.0
-
-		metrics.InputVoltage = math.Round(iv*100.0) / 100.0
-		metrics.BatteryVoltage = math.Round(bv*100.0) / 100.0
-
-		MIN_VOLT := 11.0
-		MAX_VOLT := 13.4
-		if bv_12v >= MAX_VOLT {
-			metrics.BatteryCharge = 100.0
-		} else if bv_12v <= MIN_VOLT {
-			metrics.BatteryCharge = 10.0
-		} else {
-			bc := (100.0 * math.Sqrt((bv_12v-MIN_VOLT)/(MAX_VOLT-MIN_VOLT)))
-			metrics.BatteryCharge = math.Round(bc*100.0) / 100.0
-		}
-		// log.Debug().Float64("bc (12v)", bv_12v).Float64("bc", metrics.BatteryCharge).Send()
-	}
-
-	// min / max
-	if data, ok := messages['M']; ok {
-		tmp, _ := strconv.ParseInt(string(data[1:3]), 16, 32)
-		ivmin := float64(tmp) * input_voltage_scaled / 120.0
-		metrics.InputVoltageMinimum = math.Round(ivmin*100.0) / 100.0
-
-		// TODO - this value appears always 0, it should be 199
-		// log.Info().Float64("ivmin", ivmin).Float64("metrics.InputVoltageMinimum", metrics.InputVoltageMinimum).Float64("tmp", float64(tmp)).Bytes("raw", data[1:3]).Bytes("data", data).Send()
-		if ivmin <= 0 {
-			m.tryResetInputVoltageReading()
-		}
-
-		tmp, _ = strconv.ParseInt(string(data[3:5]), 16, 32)
-		ivmax := float64(tmp) * input_voltage_scaled / 120.0
-		metrics.InputVoltageMaximum = math.Round(ivmax*100.0) / 100.0
-	}
-
-	if data, ok := messages['P']; ok {
-		end := bytes.IndexByte(data, 'X')
-		va, _ := strconv.ParseUint(string(data[1:end]), 10, 32)
-		metrics.Power = uint(va)
-		metrics.PowerUnit = "VA"
-	}
+	decoder.Decode(m, messages, &metrics)
+	metrics.LoadBankStates = m.updateLoadBanks(metrics.LoadBanks)
 
-	return &metrics, err
+	return &metrics, nil
 }
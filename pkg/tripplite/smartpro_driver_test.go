@@ -0,0 +1,272 @@
+package tripplite
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+var smartProReplies = map[byte][]byte{
+	0:   {0, 0x30, 0x03},
+	'D': []byte("D7886"),
+	'F': []byte("F1234AB"),
+	'L': []byte("L1E"),
+	'M': []byte("M6E82"),
+	'P': []byte("P1500X"),
+	'S': []byte("S1000"),
+	'T': []byte("T642581"),
+	'U': {'U', 0x01, 0x02},
+	'V': []byte("V1022"),
+	'Z': []byte("Z"),
+}
+
+func newSmartProTestTransport(replies map[byte][]byte) *MemoryTransport {
+	return NewMemoryTransport(func(cmd []byte) []byte {
+		if len(cmd) == 0 {
+			return nil
+		}
+		return replies[cmd[0]]
+	})
+}
+
+func TestEncodeDecodeCommand(t *testing.T) {
+	for _, cmd := range [][]byte{{0}, {'S'}, []byte("K01"), []byte("N\x05\x00")} {
+		frame, err := EncodeCommand(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame[0] != ':' {
+			t.Errorf("frame does not start with ':' % x", frame)
+		}
+		decoded, err := DecodeCommand(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cmd, decoded) {
+			t.Errorf("expected % x, got % x", cmd, decoded)
+		}
+	}
+
+	frame, _ := EncodeCommand([]byte{'S'})
+	frame[2]++
+	if _, err := DecodeCommand(frame); err == nil {
+		t.Error("expected checksum error")
+	}
+
+	if _, err := EncodeCommand([]byte("TOOLONG")); err == nil {
+		t.Error("expected size error")
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	transport := newSmartProTestTransport(smartProReplies)
+	info := DeviceInfo{VendorId: 0x09ae, ProductId: 0x0001, Manufacturer: "Tripp Lite", Product: "TRIPP LITE SMART1500LCD"}
+
+	mon, err := NewSmartProUPSMonitorWithTransport(transport, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	if mon.ProtocolName != "SMARTPRO" {
+		t.Errorf("expected SMARTPRO protocol, got %q (%x)", mon.ProtocolName, mon.Protocol)
+	}
+
+	m, err := mon.GetStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checks := []struct {
+		name     string
+		expected interface{}
+		actual   interface{}
+	}{
+		{"VendorID", "09ae", m.VendorID},
+		{"Model", "SMART1500LCD", m.Model},
+		{"FirmwareVersion", "1234AB", m.FirmwareVersion},
+		{"UnitId", "258", m.UnitId},
+		{"Load", uint(30), m.Load},
+		{"Status", "OL", m.Status},
+		{"InputFrequency", 60.0, m.InputFrequency},
+		{"InputFrequencyNominal", 60.0, m.InputFrequencyNominal},
+		{"TemperatureC", 15.36, m.TemperatureC},
+		{"InputVoltage", 120.0, m.InputVoltage},
+		{"InputVoltageNominal", 120.0, m.InputVoltageNominal},
+		{"InputVoltageMinimum", 110.0, m.InputVoltageMinimum},
+		{"InputVoltageMaximum", 130.0, m.InputVoltageMaximum},
+		{"BatteryVoltage", 13.4, m.BatteryVoltage},
+		{"BatteryVoltageNominal", 12.0, m.BatteryVoltageNominal},
+		{"BatteryCharge", 100.0, m.BatteryCharge},
+		{"LoadBanks", 2, m.LoadBanks},
+		{"Power", uint(1500), m.Power},
+	}
+
+	for _, check := range checks {
+		if check.expected != check.actual {
+			t.Errorf("%s: expected %v, got %v", check.name, check.expected, check.actual)
+		}
+	}
+}
+
+func TestGetStatsStatus(t *testing.T) {
+	tests := map[string]string{
+		"S1000": "OL",
+		"S1001": "OB",
+		"S0001": "LB",
+		"S1004": "OFF",
+	}
+
+	for reply, expected := range tests {
+		replies := map[byte][]byte{}
+		for k, v := range smartProReplies {
+			replies[k] = v
+		}
+		replies['S'] = []byte(reply)
+
+		mon, err := NewSmartProUPSMonitorWithTransport(newSmartProTestTransport(replies), DeviceInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := mon.GetStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Status != expected {
+			t.Errorf("%s: expected %s, got %s", reply, expected, m.Status)
+		}
+	}
+}
+
+func TestStreamReconnect(t *testing.T) {
+	RECONNECT_MIN_DELAY = 10 * time.Millisecond
+	defer func() { RECONNECT_MIN_DELAY = time.Second }()
+
+	var lock sync.Mutex
+	unplugged := false
+	opens := 0
+
+	transport := newSmartProTestTransport(smartProReplies)
+	mon, err := NewSmartProUPSMonitorWithTransport(transport, DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	mon.SetOpener(func() (Transport, DeviceInfo, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		opens++
+		if unplugged {
+			return nil, DeviceInfo{}, errors.New("device not found")
+		}
+		return newSmartProTestTransport(smartProReplies), DeviceInfo{Serial: "replugged"}, nil
+	})
+
+	metrics, errs := mon.OpenStream(10 * time.Millisecond)
+	next := func() *UPSMetrics {
+		for {
+			select {
+			case m := <-metrics:
+				return m
+			case <-errs:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for metrics")
+			}
+		}
+	}
+
+	if m := next(); m.Communication != COMM_OK {
+		t.Fatalf("expected communication OK, got %s", m.Communication)
+	}
+
+	lock.Lock()
+	unplugged = true
+	lock.Unlock()
+	transport.Close()
+
+	var m *UPSMetrics
+	for m = next(); m.Communication == COMM_OK; m = next() {
+	}
+	if m.Status != "OL" || m.Load != 30 {
+		t.Errorf("expected last known values while communication is lost, got %+v", m)
+	}
+	if mon.IsConnected() {
+		t.Error("expected monitor to report lost communication")
+	}
+
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		if opens >= 2 {
+			unplugged = false
+		}
+		done := !unplugged
+		lock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if m := next(); m.Communication != COMM_OK {
+		t.Errorf("expected communication to be restored, got %s", m.Communication)
+	}
+	if info := mon.DeviceInfo(); info.Serial != "replugged" {
+		t.Errorf("expected the reopened device's info, got %+v", info)
+	}
+}
+
+func TestStreamCommLostWithinPoll(t *testing.T) {
+	var lock sync.Mutex
+	hung := false
+
+	transport := NewMemoryTransport(func(cmd []byte) []byte {
+		lock.Lock()
+		defer lock.Unlock()
+		if hung || len(cmd) == 0 {
+			return nil
+		}
+		return smartProReplies[cmd[0]]
+	})
+	mon, err := NewSmartProUPSMonitorWithTransport(transport, DeviceInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mon.Close()
+
+	sent := func() int {
+		transport.lock.Lock()
+		defer transport.lock.Unlock()
+		return len(transport.Sent)
+	}
+
+	metrics, errs := mon.OpenStream(200 * time.Millisecond)
+	go func() {
+		for range errs {
+		}
+	}()
+	if m := <-metrics; m.Communication != COMM_OK {
+		t.Fatalf("expected communication OK, got %s", m.Communication)
+	}
+
+	lock.Lock()
+	hung = true
+	lock.Unlock()
+	before := sent()
+
+	select {
+	case m := <-metrics:
+		if m.Communication != COMM_LOST {
+			t.Errorf("expected communication to be lost, got %s", m.Communication)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for communication to be lost")
+	}
+
+	// the first poll gave up instead of sending every remaining command
+	if n := sent() - before; n != COMM_MAX_FAILURES {
+		t.Errorf("expected %d commands before giving up, got %d", COMM_MAX_FAILURES, n)
+	}
+}
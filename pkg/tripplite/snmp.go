@@ -0,0 +1,259 @@
+package tripplite
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// OIDs of the RFC 1628 UPS-MIB and the parts of SNMPv2-MIB an agent serves.
+const (
+	SNMP_SYS_DESCR     = ".1.3.6.1.2.1.1.1.0"
+	SNMP_SYS_OBJECT_ID = ".1.3.6.1.2.1.1.2.0"
+	SNMP_SYS_UPTIME    = ".1.3.6.1.2.1.1.3.0"
+	SNMP_SYS_NAME      = ".1.3.6.1.2.1.1.5.0"
+	SNMP_TRAP_OID      = ".1.3.6.1.6.3.1.1.4.1.0"
+
+	UPS_MIB         = ".1.3.6.1.2.1.33"
+	UPS_MIB_OBJECTS = UPS_MIB + ".1"
+
+	UPS_IDENT_MANUFACTURER   = UPS_MIB_OBJECTS + ".1.1.0"
+	UPS_IDENT_MODEL          = UPS_MIB_OBJECTS + ".1.2.0"
+	UPS_IDENT_UPS_SOFTWARE   = UPS_MIB_OBJECTS + ".1.3.0"
+	UPS_IDENT_AGENT_SOFTWARE = UPS_MIB_OBJECTS + ".1.4.0"
+	UPS_IDENT_NAME           = UPS_MIB_OBJECTS + ".1.5.0"
+
+	UPS_BATTERY_STATUS       = UPS_MIB_OBJECTS + ".2.1.0"
+	UPS_SECONDS_ON_BATTERY   = UPS_MIB_OBJECTS + ".2.2.0"
+	UPS_ESTIMATED_MINUTES    = UPS_MIB_OBJECTS + ".2.3.0"
+	UPS_ESTIMATED_CHARGE     = UPS_MIB_OBJECTS + ".2.4.0"
+	UPS_BATTERY_VOLTAGE      = UPS_MIB_OBJECTS + ".2.5.0"
+	UPS_BATTERY_TEMPERATURE  = UPS_MIB_OBJECTS + ".2.7.0"
+	UPS_INPUT_NUM_LINES      = UPS_MIB_OBJECTS + ".3.2.0"
+	UPS_INPUT_FREQUENCY      = UPS_MIB_OBJECTS + ".3.3.1.2.1"
+	UPS_INPUT_VOLTAGE        = UPS_MIB_OBJECTS + ".3.3.1.3.1"
+	UPS_OUTPUT_SOURCE        = UPS_MIB_OBJECTS + ".4.1.0"
+	UPS_OUTPUT_NUM_LINES     = UPS_MIB_OBJECTS + ".4.3.0"
+	UPS_OUTPUT_PERCENT_LOAD  = UPS_MIB_OBJECTS + ".4.4.1.5.1"
+	UPS_ALARMS_PRESENT       = UPS_MIB_OBJECTS + ".6.1.0"
+	UPS_ALARM_ID             = UPS_MIB_OBJECTS + ".6.2.1.1"
+	UPS_ALARM_DESCR          = UPS_MIB_OBJECTS + ".6.2.1.2"
+	UPS_ALARM_TIME           = UPS_MIB_OBJECTS + ".6.2.1.3"
+	UPS_TEST_RESULTS_SUMMARY = UPS_MIB_OBJECTS + ".7.3.0"
+	UPS_TEST_RESULTS_DETAIL  = UPS_MIB_OBJECTS + ".7.4.0"
+	UPS_CONFIG_INPUT_VOLTAGE = UPS_MIB_OBJECTS + ".9.1.0"
+	UPS_CONFIG_INPUT_FREQ    = UPS_MIB_OBJECTS + ".9.2.0"
+	UPS_CONFIG_OUTPUT_VA     = UPS_MIB_OBJECTS + ".9.5.0"
+
+	UPS_TRAP_ON_BATTERY          = UPS_MIB + ".2.0.1"
+	UPS_TRAP_TEST_COMPLETED      = UPS_MIB + ".2.0.2"
+	UPS_TRAP_ALARM_ENTRY_ADDED   = UPS_MIB + ".2.0.3"
+	UPS_TRAP_ALARM_ENTRY_REMOVED = UPS_MIB + ".2.0.4"
+
+	// Well known alarms of upsAlarmDescr.
+	UPS_WELL_KNOWN_ALARMS         = UPS_MIB_OBJECTS + ".6.3"
+	UPS_ALARM_ON_BATTERY          = UPS_WELL_KNOWN_ALARMS + ".2"
+	UPS_ALARM_LOW_BATTERY         = UPS_WELL_KNOWN_ALARMS + ".3"
+	UPS_ALARM_TEMP_BAD            = UPS_WELL_KNOWN_ALARMS + ".5"
+	UPS_ALARM_OUTPUT_OVERLOAD     = UPS_WELL_KNOWN_ALARMS + ".8"
+	UPS_ALARM_COMMUNICATIONS_LOST = UPS_WELL_KNOWN_ALARMS + ".20"
+	UPS_ALARM_TEST_IN_PROGRESS    = UPS_WELL_KNOWN_ALARMS + ".24"
+
+	UPS_AGENT_SOFTWARE = "tripplite-exporter"
+)
+
+// Values of the UPS-MIB enumerations.
+const (
+	UPS_BATTERY_STATUS_UNKNOWN  = 1
+	UPS_BATTERY_STATUS_NORMAL   = 2
+	UPS_BATTERY_STATUS_LOW      = 3
+	UPS_BATTERY_STATUS_DEPLETED = 4
+	UPS_OUTPUT_SOURCE_OTHER     = 1
+	UPS_OUTPUT_SOURCE_NONE      = 2
+	UPS_OUTPUT_SOURCE_NORMAL    = 3
+	UPS_OUTPUT_SOURCE_BATTERY   = 5
+	UPS_TEST_DONE_PASS          = 1
+	UPS_TEST_DONE_ERROR         = 3
+	UPS_TEST_IN_PROGRESS        = 5
+	UPS_TEST_NO_TESTS_INITIATED = 6
+)
+
+// The well known alarm of each event type, back on line has none.
+var upsAlarms = map[string]string{
+	EVENT_ON_BATTERY:       UPS_ALARM_ON_BATTERY,
+	EVENT_LOW_BATTERY:      UPS_ALARM_LOW_BATTERY,
+	EVENT_TEMPERATURE_HIGH: UPS_ALARM_TEMP_BAD,
+	EVENT_OVERLOAD:         UPS_ALARM_OUTPUT_OVERLOAD,
+	EVENT_SELF_TEST:        UPS_ALARM_TEST_IN_PROGRESS,
+	EVENT_COMM_LOST:        UPS_ALARM_COMMUNICATIONS_LOST,
+}
+
+// The upsAlarmDescr and upsAlarmId of an event type. Only one event of a type
+// is active at a time so the id is fixed per type.
+func UPSAlarm(eventType string) (string, int, bool) {
+	descr, ok := upsAlarms[eventType]
+	if !ok {
+		return "", 0, false
+	}
+	for i, kind := range EVENT_TYPES {
+		if kind == eventType {
+			return descr, i + 1, true
+		}
+	}
+	return "", 0, false
+}
+
+// What the UPS-MIB needs besides the sample. sysUpTime counts from Start,
+// Events are the power events of the UPS and the active ones are shown as
+// alarms.
+type UPSMIBState struct {
+	Name   string
+	Descr  string
+	Start  time.Time
+	Now    time.Time
+	Events []PowerEvent
+}
+
+// sysUpTime of a point in time, TimeTicks are hundredths of a second.
+func (s UPSMIBState) Ticks(t time.Time) uint32 {
+	d := t.Sub(s.Start)
+	if d < 0 {
+		return 0
+	}
+	return uint32(d / (10 * time.Millisecond))
+}
+
+func snmpInt(oid string, val int) gosnmp.SnmpPDU {
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Integer, Value: val}
+}
+
+func snmpGauge(oid string, val float64) gosnmp.SnmpPDU {
+	if val < 0 || math.IsNaN(val) {
+		val = 0
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.Gauge32, Value: uint32(math.Round(val))}
+}
+
+func snmpString(oid string, val string) gosnmp.SnmpPDU {
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.OctetString, Value: val}
+}
+
+func upsBatteryStatus(m *UPSMetrics) int {
+	switch {
+	case m.Communication == COMM_LOST:
+		return UPS_BATTERY_STATUS_UNKNOWN
+	case strings.EqualFold(m.Status, "LB"):
+		if m.BatteryCharge <= 0 {
+			return UPS_BATTERY_STATUS_DEPLETED
+		}
+		return UPS_BATTERY_STATUS_LOW
+	}
+	return UPS_BATTERY_STATUS_NORMAL
+}
+
+func upsOutputSource(m *UPSMetrics) int {
+	switch strings.ToUpper(m.Status) {
+	case "OL":
+		return UPS_OUTPUT_SOURCE_NORMAL
+	case "OB", "LB":
+		return UPS_OUTPUT_SOURCE_BATTERY
+	case "OFF":
+		return UPS_OUTPUT_SOURCE_NONE
+	}
+	return UPS_OUTPUT_SOURCE_OTHER
+}
+
+func upsTestSummary(result string) int {
+	switch result {
+	case TEST_RESULT_PASSED:
+		return UPS_TEST_DONE_PASS
+	case TEST_RESULT_BATTERY_FAILED, TEST_RESULT_BAD_INVERTER:
+		return UPS_TEST_DONE_ERROR
+	case TEST_RESULT_IN_PROGRESS:
+		return UPS_TEST_IN_PROGRESS
+	}
+	return UPS_TEST_NO_TESTS_INITIATED
+}
+
+// Seconds since the active on battery event started, 0 while on line.
+func upsSecondsOnBattery(state UPSMIBState) float64 {
+	for _, e := range state.Events {
+		if e.Type == EVENT_ON_BATTERY && e.Active {
+			return state.Now.Sub(time.Unix(e.Start, 0)).Seconds()
+		}
+	}
+	return 0
+}
+
+// The UPS-MIB and system objects of a sample ordered by OID, as walked by
+// GETNEXT.
+func UPSMIBVariables(m *UPSMetrics, state UPSMIBState) []gosnmp.SnmpPDU {
+	vars := []gosnmp.SnmpPDU{
+		snmpString(SNMP_SYS_DESCR, state.Descr),
+		{Name: SNMP_SYS_OBJECT_ID, Type: gosnmp.ObjectIdentifier, Value: UPS_MIB},
+		{Name: SNMP_SYS_UPTIME, Type: gosnmp.TimeTicks, Value: state.Ticks(state.Now)},
+		snmpString(SNMP_SYS_NAME, state.Name),
+		snmpString(UPS_IDENT_MANUFACTURER, m.Manufacturer),
+		snmpString(UPS_IDENT_MODEL, m.Model),
+		snmpString(UPS_IDENT_UPS_SOFTWARE, m.FirmwareVersion),
+		snmpString(UPS_IDENT_AGENT_SOFTWARE, UPS_AGENT_SOFTWARE),
+		snmpString(UPS_IDENT_NAME, state.Name),
+		snmpInt(UPS_BATTERY_STATUS, upsBatteryStatus(m)),
+		snmpGauge(UPS_SECONDS_ON_BATTERY, upsSecondsOnBattery(state)),
+		snmpGauge(UPS_ESTIMATED_MINUTES, m.RuntimeRemaining/60),
+		snmpGauge(UPS_ESTIMATED_CHARGE, m.BatteryCharge),
+		snmpGauge(UPS_BATTERY_VOLTAGE, m.BatteryVoltage*10),
+		snmpInt(UPS_BATTERY_TEMPERATURE, int(math.Round(m.TemperatureC))),
+		snmpInt(UPS_INPUT_NUM_LINES, 1),
+		snmpGauge(UPS_INPUT_FREQUENCY, m.InputFrequency*10),
+		snmpGauge(UPS_INPUT_VOLTAGE, m.InputVoltage),
+		snmpInt(UPS_OUTPUT_SOURCE, upsOutputSource(m)),
+		snmpInt(UPS_OUTPUT_NUM_LINES, 1),
+		snmpGauge(UPS_OUTPUT_PERCENT_LOAD, float64(m.Load)),
+		snmpInt(UPS_TEST_RESULTS_SUMMARY, upsTestSummary(m.TestResult)),
+		snmpString(UPS_TEST_RESULTS_DETAIL, m.TestResult),
+		snmpGauge(UPS_CONFIG_INPUT_VOLTAGE, m.InputVoltageNominal),
+		snmpGauge(UPS_CONFIG_INPUT_FREQ, m.InputFrequencyNominal*10),
+		snmpGauge(UPS_CONFIG_OUTPUT_VA, float64(m.Power)),
+	}
+
+	alarms := 0
+	for _, e := range state.Events {
+		descr, id, ok := UPSAlarm(e.Type)
+		if !ok || !e.Active {
+			continue
+		}
+		alarms++
+		index := "." + strconv.Itoa(id)
+		vars = append(vars,
+			snmpInt(UPS_ALARM_ID+index, id),
+			gosnmp.SnmpPDU{Name: UPS_ALARM_DESCR + index, Type: gosnmp.ObjectIdentifier, Value: descr},
+			gosnmp.SnmpPDU{Name: UPS_ALARM_TIME + index, Type: gosnmp.TimeTicks, Value: state.Ticks(time.Unix(e.Start, 0))},
+		)
+	}
+	vars = append(vars, snmpGauge(UPS_ALARMS_PRESENT, float64(alarms)))
+
+	sort.Slice(vars, func(i, j int) bool { return CompareOID(vars[i].Name, vars[j].Name) < 0 })
+	return vars
+}
+
+// Compares two dotted OIDs arc by arc, a leading dot is optional.
+func CompareOID(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "."), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, _ := strconv.ParseUint(as[i], 10, 32)
+		y, _ := strconv.ParseUint(bs[i], 10, 32)
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
@@ -0,0 +1,82 @@
+package tripplite
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestCompareOID(t *testing.T) {
+	tests := []struct {
+		a, b string
+		cmp  int
+	}{
+		{".1.3.6.1", "1.3.6.1", 0},
+		{".1.3.6.1.2", ".1.3.6.1.10", -1},
+		{".1.3.6.1.2.1", ".1.3.6.1.2", 1},
+		{".1.3.6.2", ".1.3.6.1.9", 1},
+	}
+	for _, test := range tests {
+		cmp := CompareOID(test.a, test.b)
+		if (cmp < 0 && test.cmp >= 0) || (cmp > 0 && test.cmp <= 0) || (cmp == 0 && test.cmp != 0) {
+			t.Errorf("%s <=> %s: expected %d, got %d", test.a, test.b, test.cmp, cmp)
+		}
+	}
+}
+
+func TestUPSMIBVariables(t *testing.T) {
+	start := time.Unix(1000, 0)
+	state := UPSMIBState{
+		Name:  "rack",
+		Start: start,
+		Now:   start.Add(90 * time.Second),
+		Events: []PowerEvent{
+			{UPS: "rack", Type: EVENT_ON_BATTERY, Start: 1030, Active: true},
+			{UPS: "rack", Type: EVENT_OVERLOAD, Start: 1010, End: 1020},
+		},
+	}
+	m := &UPSMetrics{Status: "LB", BatteryCharge: 12, RuntimeRemaining: 300, InputFrequency: 59.94, Load: 40}
+	vars := UPSMIBVariables(m, state)
+
+	values := map[string]gosnmp.SnmpPDU{}
+	for i, v := range vars {
+		values[v.Name] = v
+		if i > 0 && CompareOID(vars[i-1].Name, v.Name) >= 0 {
+			t.Errorf("%s is not ordered after %s", v.Name, vars[i-1].Name)
+		}
+	}
+
+	expect := map[string]interface{}{
+		UPS_BATTERY_STATUS:      UPS_BATTERY_STATUS_LOW,
+		UPS_OUTPUT_SOURCE:       UPS_OUTPUT_SOURCE_BATTERY,
+		UPS_SECONDS_ON_BATTERY:  uint32(60),
+		UPS_ESTIMATED_MINUTES:   uint32(5),
+		UPS_INPUT_FREQUENCY:     uint32(599),
+		UPS_OUTPUT_PERCENT_LOAD: uint32(40),
+		UPS_ALARMS_PRESENT:      uint32(1),
+		SNMP_SYS_UPTIME:         uint32(9000),
+	}
+	for oid, val := range expect {
+		if v, ok := values[oid]; !ok || v.Value != val {
+			t.Errorf("%s: expected %v, got %v", oid, val, v.Value)
+		}
+	}
+
+	_, id, _ := UPSAlarm(EVENT_ON_BATTERY)
+	if v := values[UPS_ALARM_DESCR+"."+strconv.Itoa(id)]; v.Value != UPS_ALARM_ON_BATTERY {
+		t.Errorf("expected the on battery alarm, got %v", v)
+	}
+	if _, id, _ := UPSAlarm(EVENT_OVERLOAD); values[UPS_ALARM_DESCR+"."+strconv.Itoa(id)].Value != nil {
+		t.Errorf("expected the ended overload to be cleared")
+	}
+
+	m.Status = "OL"
+	m.Communication = COMM_LOST
+	for _, v := range UPSMIBVariables(m, UPSMIBState{Now: start, Start: start}) {
+		if v.Name == UPS_BATTERY_STATUS && v.Value != UPS_BATTERY_STATUS_UNKNOWN {
+			t.Errorf("expected an unknown battery status, got %v", v.Value)
+		}
+	}
+}
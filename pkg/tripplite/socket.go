@@ -0,0 +1,50 @@
+package tripplite
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// Message types of the /ws WebSocket API.
+const (
+	// Client to server.
+	SOCKET_SUBSCRIBE   = "subscribe"
+	SOCKET_UNSUBSCRIBE = "unsubscribe"
+	SOCKET_COMMAND     = "command"
+	SOCKET_PING        = "ping"
+	// Server to client, pushed metrics and events use the stream event names.
+	SOCKET_METRICS = STREAM_EVENT_METRICS
+	SOCKET_EVENT   = STREAM_EVENT_POWER
+	SOCKET_RESULT  = "result"
+	SOCKET_PONG    = "pong"
+	SOCKET_ERROR   = "error"
+)
+
+// One WebSocket message in either direction. Id correlates a request with its
+// result or error. UPS and Topics select what a subscription covers, an empty
+// UPS means every UPS and no Topics both metrics and events. Data holds the
+// sample, event, CommandRequest or CommandResponse, HMAC the base64 HMAC of
+// its exact bytes.
+type SocketMessage struct {
+	Type   string          `json:"type"`
+	Id     string          `json:"id,omitempty"`
+	UPS    string          `json:"ups,omitempty"`
+	Topics []string        `json:"topics,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	HMAC   string          `json:"hmac,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Sets Data to the JSON of o, signed when a secret is given.
+func (msg *SocketMessage) SetData(o interface{}, secret []byte) error {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	msg.Data = data
+	msg.HMAC = ""
+	if len(secret) > 0 {
+		msg.HMAC = base64.RawStdEncoding.EncodeToString(ComputeHMAC(secret, data))
+	}
+	return nil
+}
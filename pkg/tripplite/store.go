@@ -0,0 +1,301 @@
+package tripplite
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	SEGMENT_EXT = ".jsonl"
+	// Longest record read back from a segment.
+	SEGMENT_MAX_RECORD = 1 << 20
+)
+
+var (
+	// A new segment is started once the current one reaches either limit.
+	SEGMENT_MAX_SIZE int64 = 4 << 20
+	SEGMENT_MAX_AGE        = 24 * time.Hour
+)
+
+// Whole segments are deleted once every record in them is older than MaxAge,
+// or oldest first while all segments together exceed MaxSize bytes. Zero
+// disables either limit.
+type StoreRetention struct {
+	MaxAge  time.Duration
+	MaxSize int64
+}
+
+// A segment file, named after the unix time of its first record. It holds
+// the records up to the start of the next segment.
+type Segment struct {
+	Path  string
+	Start int64
+	Size  int64
+}
+
+// An append-only store of newline separated records split into segment files.
+type SegmentStore struct {
+	Dir       string
+	Retention StoreRetention
+	lock      sync.Mutex
+	file      *os.File
+	start     int64
+	size      int64
+}
+
+func OpenSegmentStore(dir string, retention StoreRetention) (*SegmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &SegmentStore{Dir: dir, Retention: retention}
+	if err := s.enforceRetention(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Segments sorted oldest first.
+func (s *SegmentStore) Segments() ([]Segment, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []Segment{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, SEGMENT_EXT) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimSuffix(name, SEGMENT_EXT), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		segments = append(segments, Segment{Path: filepath.Join(s.Dir, name), Start: start, Size: info.Size()})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Start < segments[j].Start })
+	return segments, nil
+}
+
+func (s *SegmentStore) enforceRetention(now time.Time) error {
+	segments, err := s.Segments()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, seg := range segments {
+		total += seg.Size
+	}
+
+	// the newest segment is never removed, it may be the one being written
+	for i := 0; i < len(segments)-1; i++ {
+		seg, next := segments[i], segments[i+1]
+		expired := s.Retention.MaxAge > 0 && now.Sub(time.Unix(next.Start, 0)) > s.Retention.MaxAge
+		oversize := s.Retention.MaxSize > 0 && total > s.Retention.MaxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(seg.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Debug().Str("segment", seg.Path).Bool("expired", expired).Msg("removed segment")
+		total -= seg.Size
+	}
+	return nil
+}
+
+func (s *SegmentStore) roll(ts int64) error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	path := filepath.Join(s.Dir, strconv.FormatInt(ts, 10)+SEGMENT_EXT)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.start = ts
+	s.size = info.Size()
+	return s.enforceRetention(time.Unix(ts, 0))
+}
+
+// Appends one record taken at unix time ts, records must not contain newlines.
+func (s *SegmentStore) Append(ts int64, record []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	age := time.Duration(ts-s.start) * time.Second
+	if s.file == nil || s.size >= SEGMENT_MAX_SIZE || age >= SEGMENT_MAX_AGE {
+		if err := s.roll(ts); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(append(record, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// Calls fn with every record of a segment in order until fn returns false.
+// Returns false when fn stopped the scan.
+func (s *SegmentStore) ReadSegment(seg Segment, fn func(record []byte) bool) (bool, error) {
+	file, err := os.Open(seg.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// removed by retention since it was listed
+			return true, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), SEGMENT_MAX_RECORD)
+	for scanner.Scan() {
+		if !fn(scanner.Bytes()) {
+			return false, nil
+		}
+	}
+	return true, scanner.Err()
+}
+
+// Calls fn with every record of the segments which may hold records taken
+// between from and to (unix time, 0 for no bound), oldest first.
+func (s *SegmentStore) Scan(from int64, to int64, fn func(record []byte) bool) error {
+	segments, err := s.Segments()
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if to > 0 && seg.Start > to {
+			break
+		}
+		if from > 0 && i+1 < len(segments) && segments[i+1].Start <= from {
+			continue
+		}
+		more, err := s.ReadSegment(seg, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *SegmentStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Stores UPSMetrics as JSON lines in a SegmentStore.
+type MetricsStore struct {
+	*SegmentStore
+}
+
+func OpenMetricsStore(dir string, retention StoreRetention) (*MetricsStore, error) {
+	s, err := OpenSegmentStore(dir, retention)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsStore{s}, nil
+}
+
+func (s *MetricsStore) Append(m *UPSMetrics) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return s.SegmentStore.Append(m.UnixTimestamp, data)
+}
+
+func decodeMetricsRecord(record []byte) *UPSMetrics {
+	m := UPSMetrics{}
+	if err := json.Unmarshal(record, &m); err != nil {
+		// a torn write from a crash, the next record starts on a new line
+		return nil
+	}
+	return &m
+}
+
+// Samples taken between from and to (unix time, inclusive, 0 for no bound),
+// oldest first.
+func (s *MetricsStore) Read(from int64, to int64) ([]*UPSMetrics, error) {
+	samples := []*UPSMetrics{}
+	err := s.Scan(from, to, func(record []byte) bool {
+		m := decodeMetricsRecord(record)
+		if m == nil || (from > 0 && m.UnixTimestamp < from) {
+			return true
+		}
+		if to > 0 && m.UnixTimestamp > to {
+			return false
+		}
+		samples = append(samples, m)
+		return true
+	})
+	return samples, err
+}
+
+// The newest n samples, oldest first.
+func (s *MetricsStore) Tail(n int) ([]*UPSMetrics, error) {
+	if n <= 0 {
+		return []*UPSMetrics{}, nil
+	}
+
+	segments, err := s.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	samples := []*UPSMetrics{}
+	for i := len(segments) - 1; i >= 0 && len(samples) < n; i-- {
+		chunk := []*UPSMetrics{}
+		_, err := s.ReadSegment(segments[i], func(record []byte) bool {
+			if m := decodeMetricsRecord(record); m != nil {
+				chunk = append(chunk, m)
+			}
+			return true
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", segments[i].Path, err)
+		}
+		samples = append(chunk, samples...)
+	}
+
+	if len(samples) > n {
+		samples = samples[len(samples)-n:]
+	}
+	return samples, nil
+}
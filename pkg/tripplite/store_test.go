@@ -0,0 +1,97 @@
+package tripplite
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMetricsStore(t *testing.T) {
+	defer func(size int64) { SEGMENT_MAX_SIZE = size }(SEGMENT_MAX_SIZE)
+	SEGMENT_MAX_SIZE = 2048
+
+	dir := t.TempDir()
+	store, err := OpenMetricsStore(dir, StoreRetention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 50; i++ {
+		if err := store.Append(&UPSMetrics{Status: "OL", Load: uint(i), UnixTimestamp: int64(1000 + i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	segments, err := store.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("expected several segments, got %d", len(segments))
+	}
+
+	// a torn record from a crash is skipped
+	file, _ := os.OpenFile(segments[len(segments)-1].Path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"Status":"O`)
+	file.Close()
+
+	store, err = OpenMetricsStore(dir, StoreRetention{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.Append(&UPSMetrics{Status: "OB", Load: 51, UnixTimestamp: 1051})
+
+	tail, err := store.Tail(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail) != 5 || tail[0].Load != 47 || tail[4].Load != 51 {
+		t.Errorf("unexpected tail %+v", tail)
+	}
+
+	samples, err := store.Read(1010, 1020)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 11 || samples[0].UnixTimestamp != 1010 || samples[10].UnixTimestamp != 1020 {
+		t.Errorf("unexpected range of %d samples", len(samples))
+	}
+
+	all, _ := store.Read(0, 0)
+	if len(all) != 51 {
+		t.Errorf("expected 51 samples, got %d", len(all))
+	}
+}
+
+func TestStoreRetention(t *testing.T) {
+	defer func(age time.Duration) { SEGMENT_MAX_AGE = age }(SEGMENT_MAX_AGE)
+	SEGMENT_MAX_AGE = time.Hour
+
+	now := time.Now().Unix()
+	hour := int64(3600)
+
+	store, err := OpenMetricsStore(t.TempDir(), StoreRetention{MaxAge: 2 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := int64(5); i >= 0; i-- {
+		store.Append(&UPSMetrics{UnixTimestamp: now - i*hour})
+	}
+
+	segments, _ := store.Segments()
+	// the segment started 3 hours ago holds records up to 2 hours ago
+	if len(segments) != 4 || segments[0].Start != now-3*hour {
+		t.Errorf("expected segments from the last 3 hours, got %+v", segments)
+	}
+
+	store.Retention = StoreRetention{MaxSize: 1}
+	store.Append(&UPSMetrics{UnixTimestamp: now + hour})
+	segments, _ = store.Segments()
+	if len(segments) != 1 || segments[0].Start != now+hour {
+		t.Errorf("expected only the newest segment, got %+v", segments)
+	}
+}
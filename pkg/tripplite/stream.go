@@ -0,0 +1,117 @@
+package tripplite
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	STREAM_CONTENT_TYPE = "text/event-stream"
+	// SSE event names sent by /stream.
+	STREAM_EVENT_METRICS = "metrics"
+	STREAM_EVENT_POWER   = "event"
+)
+
+// One server-sent event. When a secret is configured HMAC holds the base64
+// HMAC of Data, the same value X-Content-Hash carries for a response body.
+// EventSource ignores the extra field so browsers can still consume it.
+type StreamMessage struct {
+	Id    uint64
+	Event string
+	Data  []byte
+	HMAC  string
+}
+
+func NewStreamMessage(id uint64, event string, data []byte, secret []byte) StreamMessage {
+	msg := StreamMessage{Id: id, Event: event, Data: data}
+	if len(secret) > 0 {
+		msg.HMAC = base64.RawStdEncoding.EncodeToString(ComputeHMAC(secret, data))
+	}
+	return msg
+}
+
+// Checks the message signature, always true when app has no secret.
+func (msg StreamMessage) Valid(app App) bool {
+	ok, err := ValidateHMAC(app, msg.Data, msg.HMAC)
+	return ok && err == nil
+}
+
+func (msg StreamMessage) WriteTo(w io.Writer) (int64, error) {
+	b := strings.Builder{}
+	if msg.Id > 0 {
+		fmt.Fprintf(&b, "id: %d\n", msg.Id)
+	}
+	if len(msg.Event) > 0 {
+		fmt.Fprintf(&b, "event: %s\n", msg.Event)
+	}
+	if len(msg.HMAC) > 0 {
+		fmt.Fprintf(&b, "hmac: %s\n", msg.HMAC)
+	}
+	for _, line := range strings.Split(string(msg.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Reads server-sent events, skipping comments and fields it does not know.
+// Retry hints are ignored.
+type StreamReader struct {
+	scanner *bufio.Scanner
+}
+
+func NewStreamReader(r io.Reader) *StreamReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), SEGMENT_MAX_RECORD)
+	return &StreamReader{scanner: scanner}
+}
+
+// Returns the next message, io.EOF once the stream ends.
+func (s *StreamReader) Next() (StreamMessage, error) {
+	msg := StreamMessage{}
+	data := []string{}
+	seen := false
+
+	for s.scanner.Scan() {
+		line := s.scanner.Text()
+		if len(line) == 0 {
+			if !seen {
+				continue
+			}
+			msg.Data = []byte(strings.Join(data, "\n"))
+			return msg, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		switch field {
+		case "id":
+			msg.Id, _ = strconv.ParseUint(value, 10, 64)
+		case "event":
+			msg.Event = value
+		case "hmac":
+			msg.HMAC = value
+		case "data":
+			data = append(data, value)
+		default:
+			// retry and unknown fields
+			continue
+		}
+		seen = true
+	}
+
+	if err := s.scanner.Err(); err != nil {
+		return msg, err
+	}
+	return msg, io.EOF
+}
@@ -0,0 +1,51 @@
+package tripplite
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type testApp struct {
+	secret []byte
+}
+
+func (a testApp) HMACEnabled() bool  { return len(a.secret) > 0 }
+func (a testApp) GetSecret() []byte  { return a.secret }
+func (a testApp) SetChangeId(string) {}
+func (a testApp) IsStale() bool      { return false }
+
+func TestStreamMessages(t *testing.T) {
+	secret := []byte("secret")
+	buf := bytes.Buffer{}
+	buf.WriteString("retry: 5000\n\n: keepalive\n\n")
+	NewStreamMessage(1, STREAM_EVENT_METRICS, []byte(`{"Load":10}`), secret).WriteTo(&buf)
+	NewStreamMessage(2, STREAM_EVENT_POWER, []byte("line 1\nline 2"), secret).WriteTo(&buf)
+
+	r := NewStreamReader(&buf)
+	msg, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 1 || msg.Event != STREAM_EVENT_METRICS || string(msg.Data) != `{"Load":10}` {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if !msg.Valid(testApp{secret}) {
+		t.Errorf("expected a valid signature")
+	}
+	if msg.Valid(testApp{[]byte("other")}) {
+		t.Errorf("expected the signature to fail with another secret")
+	}
+
+	msg, err = r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Id != 2 || string(msg.Data) != "line 1\nline 2" || !msg.Valid(testApp{secret}) {
+		t.Errorf("unexpected multi-line message %+v", msg)
+	}
+
+	if _, err = r.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package tripplite
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Size of a HID report in either direction.
+	REPORT_SIZE = 8
+	// Longest command that fits in a report with ':', checksum and '\r'.
+	MAX_COMMAND_SIZE = 5
+)
+
+var (
+	ErrTransportClosed = errors.New("transport is closed")
+	ErrNoReply         = errors.New("no reply available")
+)
+
+// A Transport moves HID reports between the driver and a device. The framing,
+// checksum and retry logic in SendCommand sits on top of it so the same
+// driver code runs against libusb or an in-memory device.
+type Transport interface {
+	// Sends a HID output report (SET_REPORT) and returns the bytes sent.
+	SetReport(reportId uint16, msg []byte) (int, error)
+	// Reads an interrupt IN reply into the buffer and returns the bytes read.
+	ReadInterrupt(reply []byte, timeout time.Duration) (int, error)
+	Close() error
+}
+
+// Device identity reported by a transport when it is opened.
+type DeviceInfo struct {
+	VendorId     uint16
+	ProductId    uint16
+	Manufacturer string
+	Product      string
+	Serial       string
+	Path         string
+}
+
+// Frames a command as ':' + cmd + checksum + '\r' in a single report.
+func EncodeCommand(cmd []byte) ([]byte, error) {
+	if len(cmd) > MAX_COMMAND_SIZE {
+		return nil, errors.New("message is too large")
+	}
+
+	var csum uint8 = 0
+	buffer := make([]byte, REPORT_SIZE)
+	buffer[0] = ':'
+
+	var i int = 1
+	for _, ch := range cmd {
+		buffer[i] = ch
+		csum += ch
+		i++
+	}
+	buffer[i] = 255 - csum
+	buffer[i+1] = '\r'
+
+	return buffer, nil
+}
+
+// Reverses EncodeCommand, returning the command bytes of a framed report.
+func DecodeCommand(frame []byte) ([]byte, error) {
+	if len(frame) < 3 || frame[0] != ':' {
+		return nil, fmt.Errorf("invalid frame start: % x", frame)
+	}
+
+	var csum uint8 = 0
+	for i := 1; i < len(frame)-1; i++ {
+		if frame[i+1] == '\r' && 255-csum == frame[i] {
+			return frame[1:i], nil
+		}
+		csum += frame[i]
+	}
+
+	return nil, fmt.Errorf("invalid frame checksum or terminator: % x", frame)
+}
+
+// Answers a decoded command, the reply should start with the command code.
+type CommandHandler func(cmd []byte) []byte
+
+// An in-memory Transport which answers every report with a CommandHandler.
+type MemoryTransport struct {
+	Handler  CommandHandler
+	Sent     [][]byte
+	lock     sync.Mutex
+	replies  [][]byte
+	isClosed bool
+}
+
+func NewMemoryTransport(handler CommandHandler) *MemoryTransport {
+	return &MemoryTransport{
+		Handler: handler,
+		Sent:    [][]byte{},
+		replies: [][]byte{},
+	}
+}
+
+func (t *MemoryTransport) SetReport(reportId uint16, msg []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.isClosed {
+		return 0, ErrTransportClosed
+	}
+
+	cmd, err := DecodeCommand(msg)
+	if err != nil {
+		return 0, err
+	}
+	t.Sent = append(t.Sent, cmd)
+
+	if t.Handler != nil {
+		if reply := t.Handler(cmd); reply != nil {
+			padded := make([]byte, REPORT_SIZE)
+			copy(padded, reply)
+			t.replies = append(t.replies, padded)
+		}
+	}
+
+	return len(msg), nil
+}
+
+func (t *MemoryTransport) ReadInterrupt(reply []byte, timeout time.Duration) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.isClosed {
+		return 0, ErrTransportClosed
+	}
+
+	if len(t.replies) == 0 {
+		return 0, ErrNoReply
+	}
+
+	n := copy(reply, t.replies[0])
+	t.replies = t.replies[1:]
+	return n, nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.isClosed = true
+	return nil
+}
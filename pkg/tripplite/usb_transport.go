@@ -0,0 +1,290 @@
+package tripplite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gotmc/libusb/v2"
+	"github.com/rs/zerolog/log"
+
+	golog "log"
+)
+
+func usbGetStringOrDefault(handle *libusb.DeviceHandle, attr uint8, defaultVal string) string {
+	val, err := handle.StringDescriptorASCII(attr)
+	if err != nil || len(val) == 0 {
+		return defaultVal
+	}
+	return val
+}
+
+// The libusb Transport backend.
+type USBTransport struct {
+	ctx             *libusb.Context
+	dev             *libusb.Device
+	h               *libusb.DeviceHandle
+	interfaceId     uint16
+	endpointAddress byte
+	txTimeout       uint16 // milliseconds
+	maxPacketSize   uint16
+	Info            DeviceInfo
+}
+
+// Selects one USB device by VID/PID, an empty Serial or Path matches any
+// device. Path is the port chain "<bus>-<port>[.<port>...]" as named in
+// /sys/bus/usb/devices, e.g. "1-1.4" behind a hub.
+type USBMatch struct {
+	VendorId  uint16
+	ProductId uint16
+	Serial    string
+	Path      string
+}
+
+func (m USBMatch) String() string {
+	str := fmt.Sprintf("%s:%s", int_to_hex(m.VendorId), int_to_hex(m.ProductId))
+	if len(m.Serial) > 0 {
+		str += " serial=" + m.Serial
+	}
+	if len(m.Path) > 0 {
+		str += " path=" + m.Path
+	}
+	return str
+}
+
+// Where the kernel lists USB devices by port chain.
+var USB_SYSFS_DEVICES = "/sys/bus/usb/devices"
+
+func readSysfsInt(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	val, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return val
+}
+
+// Finds the port chain of the device at the bus and address in sysfs,
+// empty when it is not listed.
+func sysfsUSBPath(dir string, bus int, addr int) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		name := e.Name()
+		// skip interfaces (1-1.4:1.0) and root hubs (usb1)
+		if strings.Contains(name, ":") || !strings.Contains(name, "-") {
+			continue
+		}
+		if readSysfsInt(filepath.Join(dir, name, "busnum")) == bus && readSysfsInt(filepath.Join(dir, name, "devnum")) == addr {
+			return name
+		}
+	}
+	return ""
+}
+
+// The full port chain of a device. libusb only tells the last port, so the
+// chain comes from sysfs and falls back to "<bus>-<port>" without it.
+func usbDevicePath(dev *libusb.Device) string {
+	bus, err := dev.BusNumber()
+	if err != nil {
+		return ""
+	}
+	if addr, err := dev.DeviceAddress(); err == nil {
+		if path := sysfsUSBPath(USB_SYSFS_DEVICES, bus, addr); len(path) > 0 {
+			return path
+		}
+	}
+	port, err := dev.PortNumber()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", bus, port)
+}
+
+// Finds and opens the first device matching, the handle of every other
+// candidate is closed again.
+func findUSBDevice(ctx *libusb.Context, match USBMatch) (*libusb.Device, *libusb.DeviceHandle, *libusb.Descriptor, error) {
+	devices, err := ctx.DeviceList()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for _, dev := range devices {
+		dd, err := dev.DeviceDescriptor()
+		if err != nil || dd.VendorID != match.VendorId || dd.ProductID != match.ProductId {
+			continue
+		}
+
+		path := usbDevicePath(dev)
+		if len(match.Path) > 0 && path != match.Path {
+			log.Debug().Str("path", path).Str("match", match.String()).Msg("skipping device on other path")
+			continue
+		}
+
+		h, err := dev.Open()
+		if err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("failed to open device")
+			continue
+		}
+
+		if len(match.Serial) > 0 {
+			serial := strings.TrimSpace(usbGetStringOrDefault(h, dd.SerialNumberIndex, ""))
+			if serial != match.Serial {
+				log.Debug().Str("serial", serial).Str("match", match.String()).Msg("skipping device with other serial")
+				h.Close()
+				continue
+			}
+		}
+
+		return dev, h, dd, nil
+	}
+
+	return nil, nil, nil, fmt.Errorf("no device matching %s", match)
+}
+
+func OpenUSBTransport(vid uint16, pid uint16) (*USBTransport, error) {
+	return OpenUSBTransportMatching(USBMatch{VendorId: vid, ProductId: pid})
+}
+
+func OpenUSBTransportMatching(match USBMatch) (*USBTransport, error) {
+
+	ctx, err := libusb.NewContext()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to create context")
+		return nil, err
+	}
+
+	log.Debug().Str("match", match.String()).Msg("opening device")
+	golog.SetOutput(io.Discard)
+	dev, h, dd, err := findUSBDevice(ctx, match)
+	if err != nil {
+		log.Warn().Err(err).Str("match", match.String()).Msg("failed to find device")
+		ctx.Close()
+		return nil, err
+	}
+
+	t := USBTransport{
+		ctx:             ctx,
+		dev:             dev,
+		h:               h,
+		interfaceId:     0,
+		endpointAddress: 0x81,
+		txTimeout:       5000,
+		maxPacketSize:   0,
+		Info: DeviceInfo{
+			VendorId:  match.VendorId,
+			ProductId: match.ProductId,
+			Path:      usbDevicePath(dev),
+		},
+	}
+
+	t.maxPacketSize = uint16(dd.MaxPacketSize0)
+	t.Info.Manufacturer = strings.TrimSpace(usbGetStringOrDefault(h, dd.ManufacturerIndex, ""))
+	t.Info.Product = strings.TrimSpace(usbGetStringOrDefault(h, dd.ProductIndex, ""))
+	t.Info.Serial = strings.TrimSpace(usbGetStringOrDefault(h, dd.SerialNumberIndex, ""))
+
+	err = t.Claim()
+	if err != nil {
+		log.Error().Err(err).Uint16("interface", t.interfaceId).Msg("unable to claim interface")
+		t.Close()
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (t *USBTransport) Claim() error {
+
+	reset := false
+	interfaceId := int(t.interfaceId)
+	h := t.h
+
+	err := h.ClaimInterface(interfaceId)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("cannot claim interface, resetting device")
+
+		h.ReleaseInterface(interfaceId)
+		h.ResetDevice()
+		reset = true
+		err = nil
+	}
+
+	err = h.SetAutoDetachKernelDriver(true)
+	if err != nil {
+		log.Warn().Msg("failed to set auto detach driver flag")
+	}
+
+	for i := 0; i < 10; i++ {
+		time.Sleep(1 * time.Second)
+		err = h.ClaimInterface(interfaceId)
+		if err == nil {
+			log.Debug().Int("interfaceId", interfaceId).Bool("reset", reset).Msg("claim success")
+			break
+		}
+	}
+
+	return err
+}
+
+func (t *USBTransport) SetReport(reportId uint16, msg []byte) (int, error) {
+
+	if t.h == nil {
+		return 0, errors.New("handle is not open")
+	}
+
+	bytes_sent, err := t.h.ControlTransfer(
+		0x00+(0x01<<5)+0x01, // requestType
+		0x09,                // request
+		reportId+(0x03<<8),  // value
+		0,                   // HID interface index
+		msg,
+		len(msg),
+		int(t.txTimeout)) // Timeout
+
+	if bytes_sent != len(msg) && err == nil {
+		err = errors.New(fmt.Sprint("failed to send report, sent", bytes_sent, "expected", len(msg)))
+	}
+
+	return bytes_sent, err
+}
+
+func (t *USBTransport) ReadInterrupt(reply []byte, timeout time.Duration) (int, error) {
+
+	if t.h == nil {
+		return 0, errors.New("handle is not open")
+	}
+
+	// TODO: cannot use t.endpointAddress due to type issue
+	return t.h.InterruptTransfer(0x81, reply, len(reply), int(timeout.Milliseconds()))
+}
+
+func (t *USBTransport) Close() error {
+	if t.h != nil {
+		i := int(t.interfaceId)
+		t.h.ReleaseInterface(i)
+		ok, err := t.h.KernelDriverActive(i)
+		if err == nil && ok {
+			t.h.DetachKernelDriver(i)
+		}
+		t.h.ResetDevice()
+		t.h.Close()
+		t.h = nil
+	}
+	if t.ctx != nil {
+		t.ctx.Close()
+		t.ctx = nil
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package tripplite
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSysfsUSBPath(t *testing.T) {
+	dir := t.TempDir()
+	devices := map[string][2]int{
+		"usb1":  {1, 1},
+		"1-1":   {1, 2},
+		"1-1.4": {1, 5},
+		"2-3":   {2, 5},
+	}
+	for name, dev := range devices {
+		os.Mkdir(filepath.Join(dir, name), 0755)
+		os.WriteFile(filepath.Join(dir, name, "busnum"), []byte(strconv.Itoa(dev[0])+"\n"), 0644)
+		os.WriteFile(filepath.Join(dir, name, "devnum"), []byte(strconv.Itoa(dev[1])+"\n"), 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "1-1.4:1.0"), 0755)
+
+	if path := sysfsUSBPath(dir, 1, 5); path != "1-1.4" {
+		t.Errorf("expected the port chain behind the hub, got %q", path)
+	}
+	if path := sysfsUSBPath(dir, 2, 5); path != "2-3" {
+		t.Errorf("expected 2-3, got %q", path)
+	}
+	if path := sysfsUSBPath(dir, 1, 1); path != "" {
+		t.Errorf("expected the root hub to be skipped, got %q", path)
+	}
+	if path := sysfsUSBPath(filepath.Join(dir, "missing"), 1, 5); path != "" {
+		t.Errorf("expected no path without sysfs, got %q", path)
+	}
+}
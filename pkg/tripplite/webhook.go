@@ -0,0 +1,135 @@
+package tripplite
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"text/template"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	WEBHOOK_TIMEOUT = 10 * time.Second
+	// Attempts after the first one for webhooks without retries.
+	WEBHOOK_RETRIES = 3
+	// Wait before the first retry, doubled for every further one.
+	WEBHOOK_RETRY_DELAY = 2 * time.Second
+)
+
+// What a webhook is told when its script activates or is cancelled, the
+// default body and the data of body templates. Metrics is the whole sample
+// for templates.
+type WebhookEvent struct {
+	Script    string      `json:"script"`
+	UPS       string      `json:"ups"`
+	Status    string      `json:"status"`
+	Charge    float64     `json:"charge"`
+	Runtime   float64     `json:"runtime"`
+	Active    bool        `json:"active"`
+	Cancel    bool        `json:"cancel"`
+	Timestamp int64       `json:"timestamp"`
+	Metrics   *UPSMetrics `json:"-"`
+}
+
+func NewWebhookEvent(script string, m *UPSMetrics, cancel bool) WebhookEvent {
+	return WebhookEvent{
+		Script:    script,
+		UPS:       m.Name,
+		Status:    m.Status,
+		Charge:    m.BatteryCharge,
+		Runtime:   m.RuntimeRemaining,
+		Active:    !cancel,
+		Cancel:    cancel,
+		Timestamp: time.Now().Unix(),
+		Metrics:   m,
+	}
+}
+
+var webhookFuncs = template.FuncMap{
+	// quotes and escapes a value for JSON, {{ json .Status }}
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func parseWebhookBody(tmpl string) (*template.Template, error) {
+	return template.New("body").Funcs(webhookFuncs).Parse(tmpl)
+}
+
+// Renders a webhook body from a text/template, the event as JSON without one.
+// The result must be valid JSON.
+func WebhookBody(tmpl string, e WebhookEvent) ([]byte, error) {
+	if len(tmpl) == 0 {
+		return json.Marshal(e)
+	}
+	t, err := parseWebhookBody(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.Buffer{}
+	if err := t.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("webhook body is not valid JSON: %s", buf.String())
+	}
+	return buf.Bytes(), nil
+}
+
+// A response which retrying will not change.
+var errWebhookRejected = errors.New("webhook rejected")
+
+func postWebhook(client *http.Client, url string, body []byte, headers map[string]string, secret []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errWebhookRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range headers {
+		req.Header.Set(key, val)
+	}
+	if len(secret) > 0 {
+		req.Header.Set(HTTP_CONTENT_HASH_HEADER, base64.RawStdEncoding.EncodeToString(ComputeHMAC(secret, body)))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	switch {
+	case res.StatusCode < 300:
+		return nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("status %d: %s", res.StatusCode, msg)
+	}
+	return fmt.Errorf("%w with status %d: %s", errWebhookRejected, res.StatusCode, msg)
+}
+
+// POSTs a JSON body, signed with the secret like commands when one is set.
+// Connection errors, server errors and 429 are retried with a doubling
+// delay, other client errors are not.
+func SendWebhook(url string, body []byte, headers map[string]string, secret []byte, retries int) error {
+	client := &http.Client{Timeout: WEBHOOK_TIMEOUT}
+	delay := WEBHOOK_RETRY_DELAY
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = postWebhook(client, url, body, headers, secret); err == nil || errors.Is(err, errWebhookRejected) {
+			return err
+		}
+		log.Warn().Err(err).Str("url", url).Int("attempt", attempt+1).Msg("webhook failed")
+	}
+	return err
+}
@@ -0,0 +1,105 @@
+package tripplite
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type resultRecorder chan ScriptResult
+
+func (r resultRecorder) OnScriptResult(res ScriptResult) {
+	r <- res
+}
+
+func TestWebhookBody(t *testing.T) {
+	e := NewWebhookEvent("page", &UPSMetrics{Name: "rack", Status: "OB", BatteryCharge: 42}, false)
+
+	body, err := WebhookBody("", e)
+	decoded := WebhookEvent{}
+	if err != nil || json.Unmarshal(body, &decoded) != nil || decoded.Script != "page" || decoded.Charge != 42 || !decoded.Active {
+		t.Errorf("unexpected default body %s %v", body, err)
+	}
+
+	tmpl := `{"summary": {{ json (printf "%s on battery at %.0f%%" .UPS .Charge) }}, "severity": "{{ if .Cancel }}info{{ else }}critical{{ end }}", "model": {{ json .Metrics.Model }}}`
+	body, err = WebhookBody(tmpl, e)
+	if err != nil || string(body) != `{"summary": "rack on battery at 42%", "severity": "critical", "model": ""}` {
+		t.Errorf("unexpected templated body %s %v", body, err)
+	}
+
+	if _, err := WebhookBody(`{"status": {{ .Status }}}`, e); err == nil {
+		t.Errorf("expected invalid JSON to be refused")
+	}
+}
+
+func TestWebhookAction(t *testing.T) {
+	WEBHOOK_RETRY_DELAY = time.Millisecond
+	secret := []byte("secret")
+
+	var lock sync.Mutex
+	failures := 2
+	events := make(chan WebhookEvent, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.Header.Get(HTTP_CONTENT_HASH_HEADER) != base64.RawStdEncoding.EncodeToString(ComputeHMAC(secret, body)) {
+			t.Errorf("unexpected signature for %s", body)
+		}
+		e := WebhookEvent{}
+		json.Unmarshal(body, &e)
+		events <- e
+	}))
+	defer srv.Close()
+
+	results := make(resultRecorder, 4)
+	w := NewWatcher()
+	w.SetSecret(secret)
+	w.SetResultListener(results)
+	w.AddScript(Script{Name: "page", Status: "OB", Charge: 50, Action: ACTION_WEBHOOK, URL: srv.URL}, false)
+
+	w.OnMetrics(&UPSMetrics{Name: "rack", Status: "OB", BatteryCharge: 40})
+	select {
+	case e := <-events:
+		if e.UPS != "rack" || e.Status != "OB" || e.Charge != 40 || !e.Active || e.Cancel {
+			t.Errorf("unexpected activation %v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the webhook to be retried until it succeeds")
+	}
+	if res := <-results; res.Script != "page" || res.ExitCode != 0 || len(res.Error) > 0 {
+		t.Errorf("unexpected result %v", res)
+	}
+
+	w.OnMetrics(&UPSMetrics{Name: "rack", Status: "OL", BatteryCharge: 41})
+	select {
+	case e := <-events:
+		if e.Status != "OL" || e.Active || !e.Cancel {
+			t.Errorf("unexpected cancel %v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a cancel webhook")
+	}
+
+	// client errors are not retried
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		failures++
+		lock.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer bad.Close()
+	if err := SendWebhook(bad.URL, []byte("{}"), nil, nil, 3); err == nil || failures != 1 {
+		t.Errorf("expected one rejected attempt, got %d %v", failures, err)
+	}
+}